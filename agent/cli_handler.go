@@ -15,6 +15,7 @@
 package agent
 
 import (
+	"errors"
 	"os"
 
 	"github.com/AdRoll/hologram/log"
@@ -71,17 +72,19 @@ func (h *cliHandler) HandleConnection(c protocol.MessageReadWriteCloser) {
 				log.Debug("Handling AssumeRole request.")
 				assumeRole := dr.GetAssumeRole()
 
-				err := h.client.AssumeRole(assumeRole.GetRole())
+				grant, err := h.client.AssumeRole(assumeRole.GetRole(), RoleOptions{
+					Duration:   assumeRole.GetDuration(),
+					Policy:     assumeRole.GetPolicy(),
+					PolicyARNs: assumeRole.GetPolicyArns(),
+					Preset:     assumeRole.GetPreset(),
+				}, cliPrompter(c))
 
 				var agentResponse protocol.AgentResponse
 				if err == nil {
-					agentResponse.Success = &protocol.Success{}
+					agentResponse.Success = newSuccess(grant)
 				} else {
 					log.Errorf(err.Error())
-					e := err.Error()
-					agentResponse.Failure = &protocol.Failure{
-						ErrorMessage: &e,
-					}
+					agentResponse.Failure = protocol.NewFailure(err)
 				}
 				msg = &protocol.Message{
 					AgentResponse: &agentResponse,
@@ -92,17 +95,50 @@ func (h *cliHandler) HandleConnection(c protocol.MessageReadWriteCloser) {
 				}
 			} else if dr.GetGetUserCredentials() != nil {
 				log.Debug("Handling GetSessionToken request.")
-				err := h.client.GetUserCredentials()
+				grant, err := h.client.GetUserCredentials(cliPrompter(c))
 
 				var agentResponse protocol.AgentResponse
 				if err == nil {
-					agentResponse.Success = &protocol.Success{}
+					agentResponse.Success = newSuccess(grant)
 				} else {
 					log.Errorf(err.Error())
-					e := err.Error()
-					agentResponse.Failure = &protocol.Failure{
-						ErrorMessage: &e,
-					}
+					agentResponse.Failure = protocol.NewFailure(err)
+				}
+				msg = &protocol.Message{
+					AgentResponse: &agentResponse,
+				}
+				err = c.Write(msg)
+				if err != nil {
+					return
+				}
+			} else if dr.GetListRoles() != nil {
+				log.Debug("Handling ListRoles request.")
+				roles, err := h.client.ListRoles(cliPrompter(c))
+
+				var agentResponse protocol.AgentResponse
+				if err == nil {
+					agentResponse.Roles = roles
+				} else {
+					log.Errorf(err.Error())
+					agentResponse.Failure = protocol.NewFailure(err)
+				}
+				msg = &protocol.Message{
+					AgentResponse: &agentResponse,
+				}
+				err = c.Write(msg)
+				if err != nil {
+					return
+				}
+			} else if dr.GetWhoAmI() != nil {
+				log.Debug("Handling WhoAmI request.")
+				identity, err := h.client.WhoAmI(cliPrompter(c))
+
+				var agentResponse protocol.AgentResponse
+				if err == nil {
+					agentResponse.Identity = identity
+				} else {
+					log.Errorf(err.Error())
+					agentResponse.Failure = protocol.NewFailure(err)
 				}
 				msg = &protocol.Message{
 					AgentResponse: &agentResponse,
@@ -123,3 +159,54 @@ func (h *cliHandler) HandleConnection(c protocol.MessageReadWriteCloser) {
 		}
 	}
 }
+
+/*
+newSuccess tells the CLI which role it was given, and whether that is
+not the one it asked for.
+*/
+func newSuccess(grant *Grant) *protocol.Success {
+	success := &protocol.Success{}
+	if grant.RequestedRole != "" {
+		success.RequestedRole = &grant.RequestedRole
+	}
+	if grant.GrantedRole != "" {
+		success.GrantedRole = &grant.GrantedRole
+	}
+	if grant.Duration > 0 {
+		success.Duration = &grant.Duration
+	}
+	if grant.FellBack {
+		success.FellBack = &grant.FellBack
+		success.FallbackReason = &grant.FallbackReason
+	}
+	return success
+}
+
+/*
+cliPrompter relays MFA prompts from the server to the CLI on the other
+end of c, and returns the code it sends back.
+*/
+func cliPrompter(c protocol.MessageReadWriteCloser) MFAPrompter {
+	return func(prompt string) (string, error) {
+		err := c.Write(&protocol.Message{
+			AgentResponse: &protocol.AgentResponse{
+				TokenRequest: &protocol.MFATokenRequest{
+					Prompt: &prompt,
+				},
+			},
+		})
+		if err != nil {
+			return "", err
+		}
+
+		msg, err := c.Read()
+		if err != nil {
+			return "", err
+		}
+		tokenResponse := msg.GetAgentRequest().GetTokenResponse()
+		if tokenResponse == nil {
+			return "", errors.New("expected an MFA code from the CLI")
+		}
+		return tokenResponse.GetTokenValue(), nil
+	}
+}
@@ -15,6 +15,7 @@
 package agent
 
 import (
+	"fmt"
 	"io"
 	"testing"
 
@@ -24,16 +25,40 @@ import (
 
 type dummyClient struct {
 	callCount int
+	mfaCode   string
+	options   RoleOptions
 }
 
-func (c *dummyClient) AssumeRole(role string) error {
+func (c *dummyClient) AssumeRole(role string, options RoleOptions, prompt MFAPrompter) (*Grant, error) {
 	c.callCount++
-	return nil
+	c.options = options
+	if role == "forbidden" {
+		return nil, fmt.Errorf("assuming %s: %w", role, protocol.NewError(protocol.ErrorCode_NOT_AUTHORIZED, "not allowed"))
+	}
+	if role == "sensitive" {
+		code, err := prompt("Enter the MFA code for sensitive: ")
+		c.mfaCode = code
+		return &Grant{RequestedRole: role, GrantedRole: role}, err
+	}
+	if role == "unavailable" {
+		return &Grant{RequestedRole: role, GrantedRole: "default", FellBack: true, FallbackReason: "not allowed"}, nil
+	}
+	return &Grant{RequestedRole: role, GrantedRole: role, Duration: 3600}, nil
 }
 
-func (c *dummyClient) GetUserCredentials() error {
+func (c *dummyClient) GetUserCredentials(prompt MFAPrompter) (*Grant, error) {
 	c.callCount++
-	return nil
+	return &Grant{}, nil
+}
+
+func (c *dummyClient) ListRoles(prompt MFAPrompter) (*protocol.RoleList, error) {
+	c.callCount++
+	alias := "developer"
+	return &protocol.RoleList{Roles: []*protocol.Role{{Alias: &alias}}}, nil
+}
+
+func (c *dummyClient) WhoAmI(prompt MFAPrompter) (*protocol.Identity, error) {
+	return &protocol.Identity{}, nil
 }
 
 func TestCliHandler(t *testing.T) {
@@ -61,6 +86,123 @@ func TestCliHandler(t *testing.T) {
 
 		So(ra.callCount, ShouldEqual, 1)
 	})
+
+	Convey("AssumeRole should pass on the duration asked for and report the one granted", t, func() {
+		ra := &dummyClient{}
+		ch := NewCliHandler("", ra)
+		conn := testConnection(ch.HandleConnection)
+
+		role := "role"
+		duration := int64(28800)
+		conn.Write(&protocol.Message{
+			AgentRequest: &protocol.AgentRequest{
+				AssumeRole: &protocol.AssumeRole{
+					Role:     &role,
+					Duration: &duration,
+				},
+			},
+		})
+
+		response, err := conn.Read()
+		So(err, ShouldBeNil)
+		So(ra.options.Duration, ShouldEqual, 28800)
+		So(response.GetAgentResponse().GetSuccess().GetDuration(), ShouldEqual, 3600)
+	})
+
+	Convey("AssumeRole failures should keep their error code", t, func() {
+		ch := NewCliHandler("", &dummyClient{})
+		conn := testConnection(ch.HandleConnection)
+
+		role := "forbidden"
+		conn.Write(&protocol.Message{
+			AgentRequest: &protocol.AgentRequest{
+				AssumeRole: &protocol.AssumeRole{
+					Role: &role,
+				},
+			},
+		})
+
+		response, err := conn.Read()
+		So(err, ShouldBeNil)
+		failure := response.GetAgentResponse().GetFailure()
+		So(failure.GetErrorCode(), ShouldEqual, protocol.ErrorCode_NOT_AUTHORIZED)
+		So(failure.GetErrorMessage(), ShouldEqual, "assuming forbidden: not allowed")
+	})
+
+	Convey("AssumeRole should say when it fell back to another role", t, func() {
+		ch := NewCliHandler("", &dummyClient{})
+		conn := testConnection(ch.HandleConnection)
+
+		role := "unavailable"
+		conn.Write(&protocol.Message{
+			AgentRequest: &protocol.AgentRequest{
+				AssumeRole: &protocol.AssumeRole{
+					Role: &role,
+				},
+			},
+		})
+
+		response, err := conn.Read()
+		So(err, ShouldBeNil)
+		success := response.GetAgentResponse().GetSuccess()
+		So(success.GetFellBack(), ShouldBeTrue)
+		So(success.GetRequestedRole(), ShouldEqual, "unavailable")
+		So(success.GetGrantedRole(), ShouldEqual, "default")
+		So(success.GetFallbackReason(), ShouldEqual, "not allowed")
+	})
+
+	Convey("ListRoles should pass the roles on to the CLI", t, func() {
+		ch := NewCliHandler("", &dummyClient{})
+		conn := testConnection(ch.HandleConnection)
+
+		conn.Write(&protocol.Message{
+			AgentRequest: &protocol.AgentRequest{
+				ListRoles: &protocol.ListRoles{},
+			},
+		})
+
+		response, err := conn.Read()
+		So(err, ShouldBeNil)
+		roles := response.GetAgentResponse().GetRoles().GetRoles()
+		So(len(roles), ShouldEqual, 1)
+		So(roles[0].GetAlias(), ShouldEqual, "developer")
+	})
+
+	Convey("AssumeRole with an MFA prompt", t, func() {
+		ra := &dummyClient{}
+		ch := NewCliHandler("", ra)
+
+		conn := testConnection(ch.HandleConnection)
+
+		role := "sensitive"
+		conn.Write(&protocol.Message{
+			AgentRequest: &protocol.AgentRequest{
+				AssumeRole: &protocol.AssumeRole{
+					Role: &role,
+				},
+			},
+		})
+
+		Convey("The prompt should be relayed to the CLI and its code to the client", func() {
+			response, err := conn.Read()
+			So(err, ShouldBeNil)
+			So(response.GetAgentResponse().GetTokenRequest().GetPrompt(), ShouldContainSubstring, "sensitive")
+
+			code := "123456"
+			conn.Write(&protocol.Message{
+				AgentRequest: &protocol.AgentRequest{
+					TokenResponse: &protocol.MFATokenResponse{
+						TokenValue: &code,
+					},
+				},
+			})
+
+			response, err = conn.Read()
+			So(err, ShouldBeNil)
+			So(response.GetAgentResponse().GetSuccess(), ShouldNotBeNil)
+			So(ra.mfaCode, ShouldEqual, "123456")
+		})
+	})
 }
 
 func testConnection(handler protocol.ConnectionHandlerFunc) protocol.MessageReadWriteCloser {
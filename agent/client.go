@@ -16,7 +16,6 @@
 package agent
 
 import (
-	"errors"
 	"fmt"
 	"strings"
 	"time"
@@ -29,25 +28,97 @@ import (
 	"github.com/aws/aws-sdk-go/aws/session"
 	"github.com/aws/aws-sdk-go/service/iam"
 	"github.com/aws/aws-sdk-go/service/sts"
+	"golang.org/x/crypto/ssh"
 )
 
+/*
+CredentialsReceiver holds the credentials a Client fetches. Along with
+the credentials it is told the role and options that were asked for, so
+that it can ask for the same again when they expire.
+*/
 type CredentialsReceiver interface {
-	SetCredentials(*sts.Credentials, string)
+	SetCredentials(creds *sts.Credentials, role string, options RoleOptions)
 	SetClient(Client)
 }
 
+/*
+RoleOptions are the optional parts of a request to assume a role.
+*/
+type RoleOptions struct {
+	// Duration is how many seconds the session should last; zero asks
+	// for the longest allowed.
+	Duration int64
+	// Policy is an inline session policy, and PolicyARNs managed
+	// policies, narrowing the session below what the role allows.
+	Policy     string
+	PolicyARNs []string
+	// Preset names a session policy configured on the server.
+	Preset string
+}
+
+/*
+MFAPrompter asks the user for an MFA code, showing them prompt. A nil
+MFAPrompter means nobody is there to ask.
+*/
+type MFAPrompter func(prompt string) (string, error)
+
+/*
+Grant describes the credentials a request was answered with. When the
+server could not give the requested role and fell back to the user's
+default role, FellBack is set and FallbackReason says why.
+*/
+type Grant struct {
+	RequestedRole  string
+	GrantedRole    string
+	FellBack       bool
+	FallbackReason string
+	// Duration is how many seconds the session was granted for, or zero
+	// if the server did not say.
+	Duration int64
+}
+
 type Client interface {
-	AssumeRole(role string) error
-	GetUserCredentials() error
+	AssumeRole(role string, options RoleOptions, prompt MFAPrompter) (*Grant, error)
+	GetUserCredentials(prompt MFAPrompter) (*Grant, error)
+	ListRoles(prompt MFAPrompter) (*protocol.RoleList, error)
+	WhoAmI(prompt MFAPrompter) (*protocol.Identity, error)
+}
+
+/*
+currentCredentials is implemented by credentials receivers that can say
+which role they hold credentials for, and until when.
+*/
+type currentCredentials interface {
+	Current() (*sts.Credentials, string)
+}
+
+/*
+addCurrentRole fills in the role cr holds credentials for, if any.
+*/
+func addCurrentRole(identity *protocol.Identity, cr CredentialsReceiver) *protocol.Identity {
+	current, ok := cr.(currentCredentials)
+	if !ok {
+		return identity
+	}
+	creds, role := current.Current()
+	if creds == nil || creds.Expiration == nil {
+		return identity
+	}
+	expiration := creds.Expiration.Unix()
+	identity.CurrentRole = &role
+	identity.CurrentExpiration = &expiration
+	return identity
 }
 
 type client struct {
 	connectionString string
+	username         string
 	cr               CredentialsReceiver
 }
 
 type accessKeyClient struct {
 	credentialService server.CredentialService
+	authorizer        server.RoleAuthorizer
 	iamUsername       string
 	cr                CredentialsReceiver
 }
@@ -69,6 +140,7 @@ func AccessKeyClient(cr CredentialsReceiver, accountAliases *map[string]string)
 	credentialService := server.NewDirectSessionTokenService(iamAccount, sts, accountAliases)
 	c := &accessKeyClient{
 		credentialService: credentialService,
+		authorizer:        server.NewAllowAllAuthorizer(iamAccount, accountAliases),
 		iamUsername:       *iamUsername,
 		cr:                cr,
 	}
@@ -78,32 +150,64 @@ func AccessKeyClient(cr CredentialsReceiver, accountAliases *map[string]string)
 	return c
 }
 
-func (c *accessKeyClient) AssumeRole(role string) error {
+func (c *accessKeyClient) AssumeRole(role string, options RoleOptions, prompt MFAPrompter) (*Grant, error) {
 	user := server.User{
 		Username: c.iamUsername,
 	}
-	response, err := c.credentialService.AssumeRole(&user, role, false)
+	grant, err := c.authorizer.Authorize(&user, role)
+	if err != nil {
+		return nil, err
+	}
+	if options.Duration > 0 && options.Duration < grant.Duration {
+		grant.Duration = options.Duration
+	}
+	if options.Preset != "" {
+		return nil, protocol.NewError(protocol.ErrorCode_BAD_REQUEST, "policy presets need a Hologram server")
+	}
+	grant.SessionPolicy, err = server.NewSessionPolicy(options.Policy, options.PolicyARNs)
+	if err != nil {
+		return nil, protocol.NewError(protocol.ErrorCode_BAD_REQUEST, "%s", err.Error())
+	}
+	response, err := c.credentialService.AssumeRole(&user, grant)
 
 	if err != nil {
-		return err
+		return nil, err
+	}
+	c.cr.SetCredentials(response, role, options)
+	return &Grant{RequestedRole: role, GrantedRole: grant.ARN, Duration: grant.Duration}, nil
+}
+
+func (c *accessKeyClient) ListRoles(prompt MFAPrompter) (*protocol.RoleList, error) {
+	roles := []server.RoleInfo{}
+	if lister, ok := c.authorizer.(server.RoleLister); ok {
+		roles = lister.ListRoles(&server.User{Username: c.iamUsername})
 	}
-	c.cr.SetCredentials(response, role)
-	return nil
+	return server.NewRoleList(roles), nil
+}
+
+func (c *accessKeyClient) WhoAmI(prompt MFAPrompter) (*protocol.Identity, error) {
+	return addCurrentRole(&protocol.Identity{Username: &c.iamUsername}, c.cr), nil
 }
 
-func (c *accessKeyClient) GetUserCredentials() error {
+func (c *accessKeyClient) GetUserCredentials(prompt MFAPrompter) (*Grant, error) {
 	response, err := c.credentialService.GetSessionToken()
 
 	if err != nil {
-		return err
+		return nil, err
 	}
-	c.cr.SetCredentials(response, "")
-	return nil
+	c.cr.SetCredentials(response, "", RoleOptions{})
+	return &Grant{}, nil
 }
 
-func NewClient(connectionString string, cr CredentialsReceiver) *client {
+/*
+NewClient returns a client that fetches credentials from the Hologram
+server at connectionString. If username is set it is sent along with
+each request, so the server only has to consider that user's keys.
+*/
+func NewClient(connectionString string, username string, cr CredentialsReceiver) *client {
 	c := &client{
 		connectionString: connectionString,
+		username:         username,
 		cr:               cr,
 	}
 	if cr != nil {
@@ -112,28 +216,123 @@ func NewClient(connectionString string, cr CredentialsReceiver) *client {
 	return c
 }
 
-func (c *client) AssumeRole(role string) error {
+func (c *client) AssumeRole(role string, options RoleOptions, prompt MFAPrompter) (*Grant, error) {
 	req := &protocol.ServerRequest{
 		AssumeRole: &protocol.AssumeRole{
-			Role: &role,
+			Role:       &role,
+			User:       c.user(),
+			PolicyArns: options.PolicyARNs,
 		},
 	}
+	if options.Duration > 0 {
+		req.AssumeRole.Duration = &options.Duration
+	}
+	if options.Policy != "" {
+		req.AssumeRole.Policy = &options.Policy
+	}
+	if options.Preset != "" {
+		req.AssumeRole.Preset = &options.Preset
+	}
 
-	return c.requestCredentials(req, role)
+	return c.requestCredentials(req, role, options, prompt)
 }
 
-func (c *client) GetUserCredentials() error {
+func (c *client) GetUserCredentials(prompt MFAPrompter) (*Grant, error) {
 	req := &protocol.ServerRequest{
-		GetUserCredentials: &protocol.GetUserCredentials{},
+		GetUserCredentials: &protocol.GetUserCredentials{
+			User: c.user(),
+		},
+	}
+
+	return c.requestCredentials(req, "", RoleOptions{}, prompt)
+}
+
+func (c *client) user() *string {
+	if c.username == "" {
+		return nil
+	}
+	return &c.username
+}
+
+func (c *client) ListRoles(prompt MFAPrompter) (*protocol.RoleList, error) {
+	response, err := c.request(&protocol.ServerRequest{
+		ListRoles: &protocol.ListRoles{
+			User: c.user(),
+		},
+	}, prompt)
+	if err != nil {
+		return nil, err
+	}
+	if response.GetRoles() == nil {
+		return nil, fmt.Errorf("unexpected response from server: %v", response)
+	}
+	return response.GetRoles(), nil
+}
+
+func (c *client) WhoAmI(prompt MFAPrompter) (*protocol.Identity, error) {
+	response, err := c.request(&protocol.ServerRequest{
+		WhoAmI: &protocol.WhoAmI{
+			User: c.user(),
+		},
+	}, prompt)
+	if err != nil {
+		return nil, err
+	}
+	if response.GetIdentity() == nil {
+		return nil, fmt.Errorf("unexpected response from server: %v", response)
+	}
+	return addCurrentRole(response.GetIdentity(), c.cr), nil
+}
+
+func (c *client) requestCredentials(req *protocol.ServerRequest, role string, options RoleOptions, prompt MFAPrompter) (*Grant, error) {
+	response, err := c.request(req, prompt)
+	if err != nil {
+		return nil, err
+	}
+	credsResponse := response.GetCredentials()
+	if credsResponse == nil {
+		return nil, fmt.Errorf("unexpected response from server: %v", response)
 	}
 
-	return c.requestCredentials(req, "")
+	accessKeyId := credsResponse.GetAccessKeyId()
+	sessionToken := credsResponse.GetAccessToken()
+	secretAccessKey := credsResponse.GetSecretAccessKey()
+	expiration := time.Unix(credsResponse.GetExpiration(), 0)
+
+	creds := &sts.Credentials{
+		AccessKeyId:     &accessKeyId,
+		SessionToken:    &sessionToken,
+		SecretAccessKey: &secretAccessKey,
+		Expiration:      &expiration,
+	}
+	grant := &Grant{
+		RequestedRole:  credsResponse.GetRequestedRole(),
+		GrantedRole:    credsResponse.GetGrantedRole(),
+		FellBack:       credsResponse.GetFellBack(),
+		FallbackReason: credsResponse.GetFallbackReason(),
+		Duration:       credsResponse.GetDuration(),
+	}
+	if grant.FellBack {
+		// Refresh what we were given rather than asking for the
+		// requested role again.
+		log.Warning("Could not assume %s; fell back to %s: %s", role, grant.GrantedRole, grant.FallbackReason)
+		role = grant.GrantedRole
+	}
+	c.cr.SetCredentials(creds, role, options)
+	return grant, nil
 }
 
-func (c *client) requestCredentials(req *protocol.ServerRequest, role string) error {
+/*
+request sends req to the server, answers its SSH challenges and MFA
+prompts, and returns the response that finally answers req.
+*/
+func (c *client) request(req *protocol.ServerRequest, prompt MFAPrompter) (*protocol.ServerResponse, error) {
 	conn, err := remote.NewClient(c.connectionString)
 	if err != nil {
-		return err
+		return nil, &protocol.Error{
+			Code:    protocol.ErrorCode_SERVER_UNAVAILABLE,
+			Message: fmt.Sprintf("Could not reach the Hologram server at %s: %s", c.connectionString, err.Error()),
+		}
 	}
 
 	msg := &protocol.Message{ServerRequest: req}
@@ -141,25 +340,27 @@ func (c *client) requestCredentials(req *protocol.ServerRequest, role string) er
 	err = conn.Write(msg)
 
 	if err != nil {
-		return err
+		return nil, &protocol.Error{Code: protocol.ErrorCode_SERVER_UNAVAILABLE, Message: err.Error()}
 	}
 
+	var key ssh.PublicKey
 	for skip := 0; ; {
 		msg, err = conn.Read()
 		if err != nil {
-			return err
+			return nil, &protocol.Error{Code: protocol.ErrorCode_SERVER_UNAVAILABLE, Message: err.Error()}
 		}
 		if msg.GetServerResponse() != nil {
 			serverResponse := msg.GetServerResponse()
 			if serverResponse.GetChallenge() != nil {
 				challenge := serverResponse.GetChallenge().GetChallenge()
 
-				signature, err := SSHSign([]byte(challenge), skip)
+				var signature *ssh.Signature
+				signature, key, err = SSHSign([]byte(challenge), skip)
 				if err != nil {
-					return err
+					return nil, err
 				}
 				if signature == nil {
-					return errors.New("No keys worked")
+					return nil, protocol.NewError(protocol.ErrorCode_AUTHENTICATION_FAILED, "None of your SSH keys were accepted by the server.")
 				}
 
 				msg = &protocol.Message{
@@ -167,39 +368,49 @@ func (c *client) requestCredentials(req *protocol.ServerRequest, role string) er
 						ChallengeResponse: &protocol.SSHChallengeResponse{
 							Signature: signature.Blob,
 							Format:    &signature.Format,
+							PublicKey: key.Marshal(),
+							Challenge: challenge,
 						},
 					},
 				}
 
 				err = conn.Write(msg)
 				if err != nil {
-					return err
+					return nil, err
+				}
+			} else if serverResponse.GetCredentials() != nil || serverResponse.GetRoles() != nil || serverResponse.GetIdentity() != nil {
+				if key != nil {
+					SSHKeyAccepted(key)
 				}
-			} else if serverResponse.GetCredentials() != nil {
-				credsResponse := serverResponse.GetCredentials()
-				accessKeyId := credsResponse.GetAccessKeyId()
-				sessionToken := credsResponse.GetAccessToken()
-				secretAccessKey := credsResponse.GetSecretAccessKey()
-				expiration := time.Unix(credsResponse.GetExpiration(), 0)
-
-				creds := &sts.Credentials{
-					AccessKeyId:     &accessKeyId,
-					SessionToken:    &sessionToken,
-					SecretAccessKey: &secretAccessKey,
-					Expiration:      &expiration,
+				return serverResponse, nil
+			} else if tokenRequest := serverResponse.GetTokenRequest(); tokenRequest != nil {
+				if prompt == nil {
+					return nil, protocol.NewError(protocol.ErrorCode_MFA_REQUIRED, "An MFA code is required; run hologram again to enter one.")
+				}
+				code, err := prompt(tokenRequest.GetPrompt())
+				if err != nil {
+					return nil, err
+				}
+				err = conn.Write(&protocol.Message{
+					ServerRequest: &protocol.ServerRequest{
+						TokenResponse: &protocol.MFATokenResponse{
+							TokenValue: &code,
+						},
+					},
+				})
+				if err != nil {
+					return nil, err
 				}
-				c.cr.SetCredentials(creds, role)
-				return nil
 			} else if serverResponse.GetVerificationFailure() != nil {
 				// try the next key
 				skip++
 			} else {
-				return fmt.Errorf("unexpected message from server: %v", msg)
+				return nil, fmt.Errorf("unexpected message from server: %v", msg)
 			}
-		} else if msg.GetError() != "" {
-			return errors.New(msg.GetError())
+		} else if err := msg.Err(); err != nil {
+			return nil, err
 		} else {
-			return fmt.Errorf("unexpected message from server: %v", msg)
+			return nil, fmt.Errorf("unexpected message from server: %v", msg)
 		}
 	}
 }
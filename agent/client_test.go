@@ -17,6 +17,7 @@ package agent
 import (
 	"os"
 	"testing"
+	"time"
 
 	"github.com/AdRoll/hologram/protocol"
 	"github.com/AdRoll/hologram/transport/remote"
@@ -32,14 +33,20 @@ func (nl *nullLogger) Write(b []byte) (n int, err error) {
 
 type dummyCredentialsReceiver struct {
 	creds *sts.Credentials
+	role  string
 }
 
-func (r *dummyCredentialsReceiver) SetCredentials(creds *sts.Credentials, role string) {
+func (r *dummyCredentialsReceiver) SetCredentials(creds *sts.Credentials, role string, options RoleOptions) {
 	r.creds = creds
+	r.role = role
 }
 
 func (r *dummyCredentialsReceiver) SetClient(Client) {}
 
+func (r *dummyCredentialsReceiver) Current() (*sts.Credentials, string) {
+	return r.creds, r.role
+}
+
 func TestAssumeRole(t *testing.T) {
 	fixtureSSHKey, _ := Asset("test_ssh_key")
 	SSHSetAgentSock(os.Getenv("SSH_AUTH_SOCK"), fixtureSSHKey)
@@ -53,20 +60,70 @@ func TestAssumeRole(t *testing.T) {
 
 		credentialsReceiver := &dummyCredentialsReceiver{}
 
-		c := NewClient("127.0.0.1:3101", credentialsReceiver)
+		c := NewClient("127.0.0.1:3101", "", credentialsReceiver)
 
 		Reset(func() {
 			server.Close()
 		})
 
-		err = c.AssumeRole("test_role")
+		_, err = c.AssumeRole("test_role", RoleOptions{}, nil)
 
 		So(err, ShouldBeNil)
 		So(credentialsReceiver.creds, ShouldNotBeNil)
+
+		Convey("with an MFA code when the server asks for one", func() {
+			var shown string
+			_, err = c.AssumeRole("mfa_role", RoleOptions{}, func(prompt string) (string, error) {
+				shown = prompt
+				return "123456", nil
+			})
+			So(err, ShouldBeNil)
+			So(shown, ShouldEqual, "MFA code: ")
+		})
+
+		Convey("but fail when nobody can answer the MFA prompt", func() {
+			_, err = c.AssumeRole("mfa_role", RoleOptions{}, nil)
+			So(err, ShouldNotBeNil)
+			So(protocol.AsError(err).Code, ShouldEqual, protocol.ErrorCode_MFA_REQUIRED)
+		})
+
+		Convey("and pass on the server's error code", func() {
+			_, err = c.AssumeRole("throttled_role", RoleOptions{}, nil)
+			So(err, ShouldNotBeNil)
+			So(protocol.AsError(err).Code, ShouldEqual, protocol.ErrorCode_STS_THROTTLED)
+			So(protocol.AsError(err).RetryAfter, ShouldEqual, 5*time.Second)
+		})
+
+		Convey("and list the roles the server allows", func() {
+			roles, err := c.ListRoles(nil)
+			So(err, ShouldBeNil)
+			So(len(roles.GetRoles()), ShouldEqual, 1)
+			So(roles.GetRoles()[0].GetAlias(), ShouldEqual, "developer")
+		})
+
+		Convey("and say who the server thinks we are, and which role we hold", func() {
+			identity, err := c.WhoAmI(nil)
+			So(err, ShouldBeNil)
+			So(identity.GetUsername(), ShouldEqual, "words")
+			So(identity.GetGroups(), ShouldResemble, []string{"cn=devs"})
+			So(identity.GetCurrentRole(), ShouldEqual, "test_role")
+			So(identity.GetCurrentExpiration(), ShouldEqual, 0)
+		})
+
+		Convey("and report when the server fell back to the default role", func() {
+			grant, err := c.AssumeRole("unavailable_role", RoleOptions{}, nil)
+			So(err, ShouldBeNil)
+			So(grant.FellBack, ShouldBeTrue)
+			So(grant.RequestedRole, ShouldEqual, "unavailable_role")
+			So(grant.GrantedRole, ShouldEqual, "arn:aws:iam::123456789012:role/default")
+			So(grant.FallbackReason, ShouldEqual, "not allowed")
+			So(credentialsReceiver.role, ShouldEqual, "arn:aws:iam::123456789012:role/default")
+		})
 	})
 }
 
 func DummyServer(c protocol.MessageReadWriteCloser) {
+	var role string
 	for {
 		msg, err := c.Read()
 		if err != nil {
@@ -81,7 +138,22 @@ func DummyServer(c protocol.MessageReadWriteCloser) {
 			token := "token"
 			exp := int64(0)
 
-			if serverRequest.GetAssumeRole() != nil {
+			creds := &protocol.Message{
+				ServerResponse: &protocol.ServerResponse{
+					Credentials: &protocol.STSCredentials{
+						AccessKeyId:     &accessKey,
+						SecretAccessKey: &secret,
+						AccessToken:     &token,
+						Expiration:      &exp,
+					},
+				},
+			}
+
+			if serverRequest.GetAssumeRole() != nil || serverRequest.GetListRoles() != nil || serverRequest.GetWhoAmI() != nil {
+				role = serverRequest.GetAssumeRole().GetRole()
+				if serverRequest.GetWhoAmI() != nil {
+					role = "whoami"
+				}
 				challenge := &protocol.Message{
 					ServerResponse: &protocol.ServerResponse{
 						Challenge: &protocol.SSHChallenge{
@@ -90,17 +162,52 @@ func DummyServer(c protocol.MessageReadWriteCloser) {
 					},
 				}
 				err = c.Write(challenge)
-			} else if serverRequest.GetChallengeResponse() != nil {
-				creds := &protocol.Message{
+			} else if serverRequest.GetChallengeResponse() != nil && role == "mfa_role" {
+				prompt := "MFA code: "
+				err = c.Write(&protocol.Message{
 					ServerResponse: &protocol.ServerResponse{
-						Credentials: &protocol.STSCredentials{
-							AccessKeyId:     &accessKey,
-							SecretAccessKey: &secret,
-							AccessToken:     &token,
-							Expiration:      &exp,
+						TokenRequest: &protocol.MFATokenRequest{
+							Prompt: &prompt,
 						},
 					},
-				}
+				})
+			} else if serverRequest.GetChallengeResponse() != nil && role == "throttled_role" {
+				err = c.Write(protocol.ErrorMessage(&protocol.Error{
+					Code:       protocol.ErrorCode_STS_THROTTLED,
+					Message:    "Rate exceeded",
+					RetryAfter: 5 * time.Second,
+				}))
+			} else if serverRequest.GetChallengeResponse() != nil && role == "unavailable_role" {
+				granted := "arn:aws:iam::123456789012:role/default"
+				fellBack := true
+				reason := "not allowed"
+				creds.ServerResponse.Credentials.RequestedRole = &role
+				creds.ServerResponse.Credentials.GrantedRole = &granted
+				creds.ServerResponse.Credentials.FellBack = &fellBack
+				creds.ServerResponse.Credentials.FallbackReason = &reason
+				err = c.Write(creds)
+			} else if serverRequest.GetChallengeResponse() != nil && role == "whoami" {
+				username := "words"
+				err = c.Write(&protocol.Message{
+					ServerResponse: &protocol.ServerResponse{
+						Identity: &protocol.Identity{
+							Username: &username,
+							Groups:   []string{"cn=devs"},
+						},
+					},
+				})
+			} else if serverRequest.GetChallengeResponse() != nil && role == "" {
+				alias := "developer"
+				err = c.Write(&protocol.Message{
+					ServerResponse: &protocol.ServerResponse{
+						Roles: &protocol.RoleList{
+							Roles: []*protocol.Role{{Alias: &alias}},
+						},
+					},
+				})
+			} else if serverRequest.GetChallengeResponse() != nil {
+				err = c.Write(creds)
+			} else if serverRequest.GetTokenResponse().GetTokenValue() == "123456" {
 				err = c.Write(creds)
 			}
 		}
@@ -18,23 +18,39 @@ import (
 	"errors"
 	"time"
 
+	"github.com/AdRoll/hologram/protocol"
 	"github.com/aws/aws-sdk-go/service/sts"
 )
 
 type credentialsExpirationManager struct {
-	creds  *sts.Credentials
-	user   string
-	role   string
-	client Client
+	creds   *sts.Credentials
+	user    string
+	role    string
+	options RoleOptions
+	client  Client
+	// mfaRequired holds the error from a refresh that needed an MFA
+	// code, so that the server is not asked again until the user runs
+	// hologram and new credentials are set.
+	mfaRequired error
 }
 
 func NewCredentialsExpirationManager() *credentialsExpirationManager {
 	return &credentialsExpirationManager{}
 }
 
-func (m *credentialsExpirationManager) SetCredentials(newCreds *sts.Credentials, role string) {
+func (m *credentialsExpirationManager) SetCredentials(newCreds *sts.Credentials, role string, options RoleOptions) {
 	m.creds = newCreds
 	m.role = role
+	m.options = options
+	m.mfaRequired = nil
+}
+
+/*
+Current returns the credentials held and the role they are for, without
+refreshing them. An empty role means the user's default role.
+*/
+func (m *credentialsExpirationManager) Current() (*sts.Credentials, string) {
+	return m.creds, m.role
 }
 
 func (m *credentialsExpirationManager) SetClient(client Client) {
@@ -58,13 +74,23 @@ func (m *credentialsExpirationManager) maybeRefreshCredentials() error {
 		return errors.New("No client set for refreshing credentials")
 	}
 	if m.creds.Expiration.Before(time.Now()) {
+		if m.mfaRequired != nil {
+			return m.mfaRequired
+		}
+		var err error
 		if m.role != "" {
 			// and we used AssumeRole to generate the current creds
-			// then use AssumeRole to refresh 'em
-			return m.client.AssumeRole(m.role)
+			// then use AssumeRole to refresh 'em. Nobody is around to
+			// answer an MFA prompt here.
+			_, err = m.client.AssumeRole(m.role, m.options, nil)
+		} else {
+			// go ahead and refresh our creds, just to be safe
+			_, err = m.client.GetUserCredentials(nil)
+		}
+		if err != nil && protocol.AsError(err).Code == protocol.ErrorCode_MFA_REQUIRED {
+			m.mfaRequired = err
 		}
-		// go ahead and refresh our creds, just to be safe
-		return m.client.GetUserCredentials()
+		return err
 	}
 	return nil
 }
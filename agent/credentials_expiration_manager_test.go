@@ -18,6 +18,7 @@ import (
 	"testing"
 	"time"
 
+	"github.com/AdRoll/hologram/protocol"
 	"github.com/aws/aws-sdk-go/service/sts"
 	. "github.com/smartystreets/goconvey/convey"
 )
@@ -25,16 +26,33 @@ import (
 type dummyClient2 struct {
 	assumeRoleCount         int
 	getUserCredentialsCount int
+	options                 RoleOptions
+	err                     error
 }
 
-func (d *dummyClient2) AssumeRole(role string) error {
+func (d *dummyClient2) AssumeRole(role string, options RoleOptions, prompt MFAPrompter) (*Grant, error) {
 	d.assumeRoleCount++
-	return nil
+	d.options = options
+	if d.err != nil {
+		return nil, d.err
+	}
+	return &Grant{RequestedRole: role, GrantedRole: role}, nil
 }
 
-func (d *dummyClient2) GetUserCredentials() error {
+func (d *dummyClient2) GetUserCredentials(prompt MFAPrompter) (*Grant, error) {
 	d.getUserCredentialsCount++
-	return nil
+	if d.err != nil {
+		return nil, d.err
+	}
+	return &Grant{}, nil
+}
+
+func (d *dummyClient2) ListRoles(prompt MFAPrompter) (*protocol.RoleList, error) {
+	return &protocol.RoleList{}, nil
+}
+
+func (d *dummyClient2) WhoAmI(prompt MFAPrompter) (*protocol.Identity, error) {
+	return &protocol.Identity{}, nil
 }
 
 func TestCredentialsExpirationManager(t *testing.T) {
@@ -51,7 +69,7 @@ func TestCredentialsExpirationManager(t *testing.T) {
 				AccessKeyId: &key,
 				Expiration:  &currentExpiration,
 			}
-			credsManager.SetCredentials(&creds, "")
+			credsManager.SetCredentials(&creds, "", RoleOptions{})
 
 			retrievedCreds, err := credsManager.GetCredentials()
 			So(err, ShouldBeNil)
@@ -63,7 +81,7 @@ func TestCredentialsExpirationManager(t *testing.T) {
 				AccessKeyId: &key,
 				Expiration:  &expiredExpiration,
 			}
-			credsManager.SetCredentials(&creds, "")
+			credsManager.SetCredentials(&creds, "", RoleOptions{})
 
 			_, err := credsManager.GetCredentials()
 			So(err, ShouldBeNil)
@@ -75,11 +93,33 @@ func TestCredentialsExpirationManager(t *testing.T) {
 				AccessKeyId: &key,
 				Expiration:  &expiredExpiration,
 			}
-			credsManager.SetCredentials(&creds, "role")
+			credsManager.SetCredentials(&creds, "role", RoleOptions{Duration: 900, Preset: "readonly"})
 
 			_, err := credsManager.GetCredentials()
 			So(err, ShouldBeNil)
 			So(c.assumeRoleCount, ShouldEqual, 1)
+			So(c.options, ShouldResemble, RoleOptions{Duration: 900, Preset: "readonly"})
+		})
+
+		Convey("A refresh that needs an MFA code is not retried until new credentials are set", func() {
+			c.err = protocol.NewError(protocol.ErrorCode_MFA_REQUIRED, "An MFA code is required")
+			creds := sts.Credentials{
+				AccessKeyId: &key,
+				Expiration:  &expiredExpiration,
+			}
+			credsManager.SetCredentials(&creds, "", RoleOptions{})
+
+			_, err := credsManager.GetCredentials()
+			So(protocol.AsError(err).Code, ShouldEqual, protocol.ErrorCode_MFA_REQUIRED)
+			_, err = credsManager.GetCredentials()
+			So(err, ShouldNotBeNil)
+			So(c.getUserCredentialsCount, ShouldEqual, 1)
+
+			c.err = nil
+			credsManager.SetCredentials(&creds, "", RoleOptions{})
+			_, err = credsManager.GetCredentials()
+			So(err, ShouldBeNil)
+			So(c.getUserCredentialsCount, ShouldEqual, 2)
 		})
 	})
 }
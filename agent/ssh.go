@@ -15,9 +15,11 @@
 package agent
 
 import (
+	"bytes"
 	"crypto/rand"
 	"errors"
 	"net"
+	"sync"
 
 	"github.com/AdRoll/hologram/log"
 	"golang.org/x/crypto/ssh"
@@ -27,10 +29,13 @@ import (
 var (
 	// Not sure if this needs a mutex around it. Probably not, because it only gets written once by one thing.
 	socketAddress  string
-	successfulKey  *agent.Key
 	providedSSHKey ssh.Signer
-	errNoKeys      = errors.New("No keys available in ssh-agent")
-	errSSHKey      = errors.New("Could not use the provided SSH key.")
+	// successfulKey is the wire format of the last key the server accepted,
+	// which is tried first next time.
+	successfulKey   []byte
+	successfulKeyMu sync.Mutex
+	errNoKeys       = errors.New("No keys available in ssh-agent")
+	errSSHKey       = errors.New("Could not use the provided SSH key.")
 )
 
 func SSHSetAgentSock(socketAddressFromCli string, sshKeyFromCli []byte) {
@@ -46,51 +51,72 @@ func SSHSetAgentSock(socketAddressFromCli string, sshKeyFromCli []byte) {
 	}
 }
 
-// SSHSign signs the provided challenge using a key from the ssh-agent keyring. The key is chosen by enumerating all
-// keys, then skipping the requested number of keys.
-func SSHSign(challenge []byte, skip int) (*ssh.Signature, error) {
+// SSHSign signs the provided challenge using a key from the ssh-agent keyring, and returns the public half of the key
+// it used so the server can look it up directly. The key is chosen by enumerating all keys, with the key that last
+// worked moved to the front, then skipping the requested number of keys.
+func SSHSign(challenge []byte, skip int) (*ssh.Signature, ssh.PublicKey, error) {
 	var signer ssh.Signer
 
 	if socketAddress == "" {
 		// Do not infinitely loop trying to use our provided SSH key.
 		if skip > 0 {
-			return nil, errSSHKey
+			return nil, nil, errSSHKey
 		}
 
 		log.Debug("Falling back on provided SSH key.")
 		if providedSSHKey == nil {
-			return nil, errSSHKey
+			return nil, nil, errSSHKey
 		}
 		signer = providedSSHKey
 	} else {
 		c, err := net.Dial("unix", socketAddress)
 		if err != nil {
-			return nil, err
+			return nil, nil, err
 		}
+		defer c.Close()
 		agent := agent.NewClient(c)
 
-		keys, err := agent.List()
-		if err != nil {
-			return nil, err
+		signers, getSignersErr := agent.Signers()
+		if getSignersErr != nil {
+			return nil, nil, getSignersErr
 		}
 
-		if len(keys) == 0 {
-			return nil, errNoKeys
+		if len(signers) == 0 {
+			return nil, nil, errNoKeys
 		}
 
-		if skip >= len(keys) {
+		if skip >= len(signers) {
 			// indicate that we've tried everything and exhausted the keyring
-			return nil, nil
-		}
-
-		signers, getSignersErr := agent.Signers()
-		if getSignersErr != nil {
-			return nil, getSignersErr
+			return nil, nil, nil
 		}
 
-		signer = signers[skip]
+		signer = preferSuccessfulKey(signers)[skip]
 	}
 
 	sig, err := signer.Sign(rand.Reader, challenge)
-	return sig, err
+	if err != nil {
+		return nil, nil, err
+	}
+	return sig, signer.PublicKey(), nil
+}
+
+// SSHKeyAccepted records that the server accepted key, so that it is tried first from now on.
+func SSHKeyAccepted(key ssh.PublicKey) {
+	successfulKeyMu.Lock()
+	defer successfulKeyMu.Unlock()
+	successfulKey = key.Marshal()
+}
+
+// preferSuccessfulKey moves the key that last worked to the front of signers, keeping the order of the rest.
+func preferSuccessfulKey(signers []ssh.Signer) []ssh.Signer {
+	successfulKeyMu.Lock()
+	defer successfulKeyMu.Unlock()
+
+	for i, signer := range signers {
+		if successfulKey != nil && bytes.Equal(signer.PublicKey().Marshal(), successfulKey) {
+			ordered := append([]ssh.Signer{signer}, signers[:i]...)
+			return append(ordered, signers[i+1:]...)
+		}
+	}
+	return signers
 }
@@ -40,21 +40,21 @@ func TestSSH(t *testing.T) {
 		SSHSetAgentSock(os.Getenv("SSH_AUTH_SOCK"), nil)
 
 		testBuffer := randomBytes(64)
-		_, err := SSHSign(testBuffer, 0)
+		_, _, err := SSHSign(testBuffer, 0)
 		if err == errNoKeys {
 			t.Skip()
 		}
 
 		Convey("signature should be returned without error", func() {
 			buffer := randomBytes(64)
-			sig, err := SSHSign(buffer, 0)
+			sig, _, err := SSHSign(buffer, 0)
 			So(err, ShouldBeNil)
 			So(sig, ShouldNotBeNil)
 		})
 
 		Convey("crazy index should return no signature", func() {
 			buffer := randomBytes(64)
-			sig, err := SSHSign(buffer, 1000)
+			sig, _, err := SSHSign(buffer, 1000)
 			So(err, ShouldBeNil)
 			So(sig, ShouldBeNil)
 		})
@@ -67,14 +67,18 @@ func TestSSH(t *testing.T) {
 		SSHSetAgentSock("", fixtureSSHKey)
 		Convey("A signature should still be generated without needing the agent.", func() {
 			buffer := randomBytes(64)
-			sig, err := SSHSign(buffer, 0)
+			sig, key, err := SSHSign(buffer, 0)
 			So(err, ShouldBeNil)
 			So(sig, ShouldNotBeNil)
+
+			Convey("and the key that made it should be returned.", func() {
+				So(key.Verify(buffer, sig), ShouldBeNil)
+			})
 		})
 
 		Convey("If the signature verification fails the first time we should not retry infinitely.", func() {
 			buffer := randomBytes(64)
-			sig, err := SSHSign(buffer, 1)
+			sig, _, err := SSHSign(buffer, 1)
 			So(err, ShouldEqual, errSSHKey)
 			So(sig, ShouldBeNil)
 		})
@@ -19,6 +19,7 @@ Config represents the top-level configuration values required by the application
 */
 type Config struct {
 	Host            string            `json:"host"`
+	Username        string            `json:"username"`
 	AccountAliases  map[string]string `json:"accountAliases"`
 	ExtraAllowedIps []string          `json:"extraAllowedIps"`
 }
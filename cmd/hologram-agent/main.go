@@ -115,7 +115,7 @@ func main() {
 	// Create a hologram client that can be used by other services to talk to the server
 	var client (agent.Client)
 	if config.Host != "" {
-		client = agent.NewClient(config.Host, credsManager)
+		client = agent.NewClient(config.Host, config.Username, credsManager)
 	} else {
 		client = agent.AccessKeyClient(credsManager, &config.AccountAliases)
 	}
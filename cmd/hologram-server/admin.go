@@ -0,0 +1,244 @@
+// Copyright 2014 AdRoll, Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"flag"
+	"fmt"
+	"io/ioutil"
+	"net"
+	"net/http"
+	"net/url"
+	"os"
+	"strings"
+	"text/tabwriter"
+	"time"
+
+	"github.com/AdRoll/hologram/server"
+)
+
+const defaultAdminSocket = "/var/run/hologram-server/admin.sock"
+
+const adminUsage = `usage: hologram-server admin [-socket path] [-json] <command> [arguments]
+
+Commands:
+  users [username]   list cached users, or show one
+  groups             list cached groups and their roles
+  keys               list cached SSH keys by fingerprint
+  reload [username]  reload every user from the directory, or just one
+  sync               show when the directory was last synced, and any error
+  connections        list client connections in progress
+  config             show the server's configuration, without secrets
+  deny               show the deny list
+  deny <kind> <value>
+                     refuse a user, key fingerprint or role ARN at once
+  undeny <kind> <value>
+                     take an entry off the deny list
+`
+
+/*
+runAdmin talks to the admin API of a running server, and returns the
+exit code.
+*/
+func runAdmin(args []string) int {
+	flags := flag.NewFlagSet("admin", flag.ContinueOnError)
+	socket := flags.String("socket", defaultAdminSocket, "Path of the server's admin socket.")
+	raw := flags.Bool("json", false, "Print the server's JSON response as it is.")
+	flags.Usage = func() {
+		fmt.Fprint(os.Stderr, adminUsage)
+		flags.PrintDefaults()
+	}
+	if err := flags.Parse(args); err != nil {
+		return 2
+	}
+	if flags.NArg() < 1 || flags.NArg() > 3 {
+		flags.Usage()
+		return 2
+	}
+
+	command, argument := flags.Arg(0), flags.Arg(1)
+	method, path := http.MethodGet, "/"+command
+	if flags.NArg() == 3 && command != "deny" && command != "undeny" {
+		flags.Usage()
+		return 2
+	}
+	switch command {
+	case "users", "reload":
+		if command == "reload" {
+			method = http.MethodPost
+		}
+		if argument != "" {
+			path += "/" + url.PathEscape(argument)
+		}
+	case "deny", "undeny":
+		path = "/deny"
+		if flags.NArg() == 3 {
+			method = http.MethodPost
+			if command == "undeny" {
+				method = http.MethodDelete
+			}
+			path += "?" + url.Values{argument: {flags.Arg(2)}}.Encode()
+		} else if flags.NArg() != 1 || command == "undeny" {
+			flags.Usage()
+			return 2
+		}
+		argument = ""
+	case "groups", "keys", "sync", "connections", "config":
+		if argument != "" {
+			flags.Usage()
+			return 2
+		}
+	default:
+		flags.Usage()
+		return 2
+	}
+
+	body, err := adminRequest(*socket, method, path)
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "%s\n", err.Error())
+		return 1
+	}
+	if *raw || argument != "" || command == "config" {
+		os.Stdout.Write(body)
+		return 0
+	}
+	if err := printAdmin(command, body); err != nil {
+		fmt.Fprintf(os.Stderr, "Could not read the server's response: %s\n", err.Error())
+		return 1
+	}
+	return 0
+}
+
+/*
+adminRequest sends a request to the admin API over its UNIX socket and
+returns the response body.
+*/
+func adminRequest(socket string, method string, path string) ([]byte, error) {
+	client := &http.Client{
+		Timeout: 30 * time.Second,
+		Transport: &http.Transport{
+			DialContext: func(ctx context.Context, _, _ string) (net.Conn, error) {
+				var dialer net.Dialer
+				return dialer.DialContext(ctx, "unix", socket)
+			},
+		},
+	}
+	req, err := http.NewRequest(method, "http://hologram-server"+path, nil)
+	if err != nil {
+		return nil, err
+	}
+	resp, err := client.Do(req)
+	if err != nil {
+		return nil, fmt.Errorf("Could not reach the admin socket at %s: %s", socket, err.Error())
+	}
+	defer resp.Body.Close()
+
+	body, err := ioutil.ReadAll(resp.Body)
+	if err != nil {
+		return nil, err
+	}
+	if resp.StatusCode != http.StatusOK {
+		return nil, fmt.Errorf("%s: %s", resp.Status, strings.TrimSpace(string(body)))
+	}
+	return body, nil
+}
+
+/*
+printAdmin prints a list from the admin API as a table.
+*/
+func printAdmin(command string, body []byte) error {
+	w := tabwriter.NewWriter(os.Stdout, 0, 4, 3, ' ', 0)
+	defer w.Flush()
+
+	switch command {
+	case "users":
+		var users []server.AdminUser
+		if err := json.Unmarshal(body, &users); err != nil {
+			return err
+		}
+		fmt.Fprintln(w, "USERNAME\tDEFAULT ROLE\tKEYS\tGROUPS\tMFA")
+		for _, u := range users {
+			fmt.Fprintf(w, "%s\t%s\t%d\t%d\t%t\n", u.Username, u.DefaultRole, len(u.Keys), len(u.Groups), u.MFA)
+		}
+	case "groups":
+		var groups []server.AdminGroup
+		if err := json.Unmarshal(body, &groups); err != nil {
+			return err
+		}
+		fmt.Fprintln(w, "GROUP\tTIMEOUT\tROLES")
+		for _, g := range groups {
+			fmt.Fprintf(w, "%s\t%s\t%s\n", g.DN, time.Duration(g.Timeout)*time.Second, strings.Join(g.ARNs, ", "))
+		}
+	case "keys":
+		var keys []server.AdminKey
+		if err := json.Unmarshal(body, &keys); err != nil {
+			return err
+		}
+		fmt.Fprintln(w, "FINGERPRINT\tTYPE\tUSERNAME")
+		for _, k := range keys {
+			fmt.Fprintf(w, "%s\t%s\t%s\n", k.Fingerprint, k.Type, k.Username)
+		}
+	case "connections":
+		var connections []server.ConnectionInfo
+		if err := json.Unmarshal(body, &connections); err != nil {
+			return err
+		}
+		fmt.Fprintln(w, "REMOTE ADDRESS\tOPEN FOR\tREQUEST\tUSER")
+		for _, c := range connections {
+			fmt.Fprintf(w, "%s\t%s\t%s\t%s\n", c.RemoteAddr, time.Since(c.Opened).Truncate(time.Second), c.Request, c.User)
+		}
+	case "deny", "undeny":
+		var entries server.DenyEntries
+		if err := json.Unmarshal(body, &entries); err != nil {
+			return err
+		}
+		fmt.Fprintln(w, "KIND\tVALUE")
+		for _, kind := range []struct {
+			name   string
+			values []string
+		}{{server.DenyUser, entries.Users}, {server.DenyKey, entries.Keys}, {server.DenyRole, entries.Roles}} {
+			for _, value := range kind.values {
+				fmt.Fprintf(w, "%s\t%s\n", kind.name, value)
+			}
+		}
+	case "sync", "reload":
+		var status server.SyncStatus
+		if err := json.Unmarshal(body, &status); err != nil {
+			return err
+		}
+		fmt.Fprintf(w, "Last attempt:\t%s\n", formatTime(status.LastAttempt))
+		fmt.Fprintf(w, "Last success:\t%s\n", formatTime(status.LastSuccess))
+		fmt.Fprintf(w, "Last full sync:\t%s\n", formatTime(status.LastFullSync))
+		if status.Incremental {
+			fmt.Fprintf(w, "Last sync was:\tincremental\n")
+		}
+		if status.Duration != "" {
+			fmt.Fprintf(w, "Took:\t%s\n", status.Duration)
+		}
+		if status.LastError != "" {
+			fmt.Fprintf(w, "Last error:\t%s\n", status.LastError)
+		}
+	}
+	return nil
+}
+
+func formatTime(t time.Time) string {
+	if t.IsZero() {
+		return "never"
+	}
+	return fmt.Sprintf("%s (%s ago)", t.Format(time.RFC3339), time.Since(t).Truncate(time.Second))
+}
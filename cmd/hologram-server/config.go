@@ -14,21 +14,103 @@
 
 package main
 
+import (
+	"encoding/json"
+	"net/url"
+	"strings"
+
+	"github.com/AdRoll/hologram/server"
+)
+
+const redacted = "REDACTED"
+
 type LDAP struct {
 	Bind struct {
 		DN       string `json:"dn"`
 		Password string `json:"password"`
 	} `json:"bind"`
-	UserAttr           string `json:"userattr"`
-	BaseDN             string `json:"basedn"`
-	Host               string `json:"host"`
-	InsecureLDAP       bool   `json:"insecureldap"`
-	EnableLDAPRoles    bool   `json:"enableldaproles"`
-	RoleAttribute      string `json:"roleattr"`
-	DefaultRoleAttr    string `json:"defaultroleattr"`
-	GroupClassAttr     string `json:"groupclassattr"`
-	PubKeysAttr        string `json:"pubkeysattr"`
-	RoleTimeoutAttr    string `json:"roletimeoutattr"`
+	UserAttr         string   `json:"userattr"`
+	BaseDN           string   `json:"basedn"`
+	Host             string   `json:"host"`
+	InsecureLDAP     bool     `json:"insecureldap"`
+	EnableLDAPRoles  bool     `json:"enableldaproles"`
+	RoleAttribute    string   `json:"roleattr"`
+	DefaultRoleAttr  string   `json:"defaultroleattr"`
+	GroupClassAttr   string   `json:"groupclassattr"`
+	PubKeysAttr      string   `json:"pubkeysattr"`
+	RoleTimeoutAttr  string   `json:"roletimeoutattr"`
+	MFASecretAttr    string   `json:"mfasecretattr"`
+	IncrementalSync  bool     `json:"incrementalsync"`
+	FullSyncInterval int      `json:"fullsyncinterval"`
+	NestedGroups     bool     `json:"nestedgroups"`
+	MaxGroupDepth    int      `json:"maxgroupdepth"`
+	MemberAttrs      []string `json:"memberattrs"`
+}
+
+type KeyServer struct {
+	URL      string `json:"url"`
+	Merge    string `json:"merge"`
+	CacheTTL int    `json:"cachettl"`
+	Timeout  int    `json:"timeout"`
+}
+
+type Audit struct {
+	File    string `json:"file"`
+	Syslog  bool   `json:"syslog"`
+	HTTP    string `json:"http"`
+	Timeout int    `json:"timeout"`
+}
+
+type Challenge struct {
+	ServerID string `json:"serverid"`
+	Timeout  int    `json:"timeout"`
+}
+
+type Certificates struct {
+	Authorities string `json:"authorities"`
+	Revoked     string `json:"revoked"`
+}
+
+type RateLimit struct {
+	PerIP              float64 `json:"perip"`
+	PerUser            float64 `json:"peruser"`
+	Burst              int     `json:"burst"`
+	MaxChallengeRounds int     `json:"maxchallengerounds"`
+	LockoutFailures    int     `json:"lockoutfailures"`
+	LockoutWindow      int     `json:"lockoutwindow"`
+	LockoutDuration    int     `json:"lockoutduration"`
+	MFAFailures        int     `json:"mfafailures"`
+	MFAWindow          int     `json:"mfawindow"`
+	MFALockout         int     `json:"mfalockout"`
+}
+
+type CredentialCache struct {
+	Enabled     bool `json:"enabled"`
+	MinLifetime int  `json:"minlifetime"`
+}
+
+type Fallback struct {
+	Mode   string   `json:"mode"`
+	Groups []string `json:"groups"`
+}
+
+type PolicyPreset struct {
+	Policy     json.RawMessage `json:"policy"`
+	PolicyARNs []string        `json:"policyarns"`
+}
+
+type Admin struct {
+	Socket string `json:"socket"`
+}
+
+type DenyList struct {
+	File          string `json:"file"`
+	BlockFallback bool   `json:"blockfallback"`
+}
+
+type MFA struct {
+	Mode           string   `json:"mode"`
+	SensitiveRoles []string `json:"sensitiveroles"`
 }
 
 type Config struct {
@@ -37,8 +119,43 @@ type Config struct {
 		Account     string `json:"account"`
 		DefaultRole string `json:"defaultrole"`
 	} `json:"aws"`
-	Stats          string            `json:"stats"`
-	Listen         string            `json:"listen"`
-	CacheTimeout   int               `json:"cachetimeout"`
-	AccountAliases map[string]string `json:"accountAliases"`
+	Stats           string                    `json:"stats"`
+	Listen          string                    `json:"listen"`
+	CacheTimeout    int                       `json:"cachetimeout"`
+	AccountAliases  map[string]string         `json:"accountAliases"`
+	PolicyFile      string                    `json:"policyfile"`
+	UsersFile       string                    `json:"usersfile"`
+	KeyServer       KeyServer                 `json:"keyserver"`
+	Audit           Audit                     `json:"audit"`
+	Challenge       Challenge                 `json:"challenge"`
+	Certificates    Certificates              `json:"certificates"`
+	MFA             MFA                       `json:"mfa"`
+	SessionTags     *server.SessionTagMapping `json:"sessiontags"`
+	RoleChains      map[string][]string       `json:"rolechains"`
+	CredentialCache CredentialCache           `json:"credentialcache"`
+	RateLimit       RateLimit                 `json:"ratelimit"`
+	Fallback        Fallback                  `json:"fallback"`
+	PolicyPresets   map[string]PolicyPreset   `json:"policypresets"`
+	Admin           Admin                     `json:"admin"`
+	DenyList        DenyList                  `json:"denylist"`
+}
+
+/*
+Redacted returns a copy of the config that is safe to show, with the
+LDAP password and any credentials in the audit or key server URLs
+replaced.
+*/
+func (c Config) Redacted() Config {
+	if c.LDAP.Bind.Password != "" {
+		c.LDAP.Bind.Password = redacted
+	}
+	if u, err := url.Parse(c.Audit.HTTP); err == nil && u.User != nil {
+		u.User = url.User(redacted)
+		c.Audit.HTTP = u.String()
+	}
+	if u, err := url.Parse(c.KeyServer.URL); err == nil && u.User != nil {
+		u.User = url.User(redacted)
+		c.KeyServer.URL = strings.Replace(u.String(), "%7Busername%7D", "{username}", -1)
+	}
+	return c
 }
@@ -23,6 +23,7 @@ import (
 	"io/ioutil"
 	"os"
 	"os/signal"
+	"strings"
 	"syscall"
 	"time"
 
@@ -63,6 +64,117 @@ func ConnectLDAP(conf LDAP) (*ldap.Conn, error) {
 	return ldapServer, nil
 }
 
+func makeAuditSink(conf Audit) (server.AuditSink, error) {
+	sinks := []server.AuditSink{}
+
+	if conf.File != "" {
+		fileSink, err := server.NewFileAuditSink(conf.File)
+		if err != nil {
+			return nil, err
+		}
+		log.Debug("Recording audit events to %s", conf.File)
+		sinks = append(sinks, fileSink)
+	}
+
+	if conf.Syslog {
+		syslogSink, err := server.NewSyslogAuditSink()
+		if err != nil {
+			return nil, err
+		}
+		log.Debug("Recording audit events to syslog.")
+		sinks = append(sinks, syslogSink)
+	}
+
+	if conf.HTTP != "" {
+		timeout := conf.Timeout
+		if timeout == 0 {
+			timeout = 5
+		}
+		log.Debug("Recording audit events to %s", conf.HTTP)
+		sinks = append(sinks, server.NewHTTPAuditSink(conf.HTTP, time.Duration(timeout)*time.Second))
+	}
+
+	if len(sinks) == 0 {
+		return server.NoopAuditSink(), nil
+	}
+	return server.NewMultiAuditSink(sinks...), nil
+}
+
+/*
+userDirectory is what the server needs from its source of users, be it
+LDAP or a users file.
+*/
+type userDirectory interface {
+	server.UserDirectory
+	Lookup(username string) *server.User
+	OnEntitlementsChange(onChange func(username string))
+	FullSync() error
+}
+
+// usersFilePollInterval is how often the users file is checked for changes.
+const usersFilePollInterval = 5 * time.Second
+
+/*
+openLDAP connects to LDAP and loads the user cache from it, exiting if
+either fails.
+*/
+func openLDAP(config Config, stats g2s.Statter) (server.LDAPImplementation, userDirectory) {
+	open := func() (server.LDAPImplementation, error) { return ConnectLDAP(config.LDAP) }
+	ldapServer, err := server.NewPersistentLDAP(open)
+	if err != nil {
+		log.Errorf("Fatal error, exiting: %s", err.Error())
+		os.Exit(1)
+	}
+
+	options := []server.LDAPOption{}
+	if len(config.LDAP.MemberAttrs) > 0 {
+		log.Debug("Reading group membership from the %s attributes of groups too.", strings.Join(config.LDAP.MemberAttrs, ", "))
+		options = append(options, server.WithGroupMembership(config.LDAP.MemberAttrs))
+	}
+	if config.KeyServer.URL != "" {
+		cacheTTL, timeout, merge := 300, 5, server.KeyMergeUnion
+		if config.KeyServer.CacheTTL > 0 {
+			cacheTTL = config.KeyServer.CacheTTL
+		}
+		if config.KeyServer.Timeout > 0 {
+			timeout = config.KeyServer.Timeout
+		}
+		if config.KeyServer.Merge != "" {
+			merge = config.KeyServer.Merge
+		}
+		keyServer, err := server.NewKeyServer(config.KeyServer.URL, time.Duration(cacheTTL)*time.Second,
+			time.Duration(timeout)*time.Second, stats)
+		if err != nil {
+			log.Errorf("Top-level error in LDAPUserCache layer: %s", err.Error())
+			os.Exit(1)
+		}
+		log.Debug("Taking SSH keys from the key server too, merged by %s.", merge)
+		options = append(options, server.WithKeyServer(keyServer, merge))
+	}
+
+	ldapCache, err := server.NewLDAPUserCache(ldapServer, stats, config.LDAP.UserAttr, config.LDAP.BaseDN,
+		config.LDAP.EnableLDAPRoles, config.LDAP.RoleAttribute, config.AWS.DefaultRole, config.LDAP.DefaultRoleAttr,
+		config.LDAP.GroupClassAttr, config.LDAP.PubKeysAttr, config.LDAP.RoleTimeoutAttr, config.LDAP.MFASecretAttr,
+		config.SessionTags.Attributes(), options...)
+	if err != nil {
+		log.Errorf("Top-level error in LDAPUserCache layer: %s", err.Error())
+		os.Exit(1)
+	}
+	if config.LDAP.IncrementalSync {
+		fullSyncInterval := 24 * time.Hour
+		if config.LDAP.FullSyncInterval > 0 {
+			fullSyncInterval = time.Duration(config.LDAP.FullSyncInterval) * time.Second
+		}
+		log.Debug("Syncing LDAP incrementally, with a full sync every %s.", fullSyncInterval)
+		ldapCache.SetIncrementalSync(fullSyncInterval)
+	}
+	if config.LDAP.NestedGroups {
+		ldapCache.SetNestedGroups(config.LDAP.MaxGroupDepth)
+	}
+
+	return ldapServer, ldapCache
+}
+
 func main() {
 	// Parse command-line flags for this system.
 	var (
@@ -83,9 +195,17 @@ func main() {
 		debugMode        = flag.Bool("debug", false, "Enable debug mode.")
 		pubKeysAttr      = flag.String("pubkeysattr", "", "Name of the LDAP user attribute containing ssh public key data.")
 		roleTimeoutAttr  = flag.String("roletimeoutattr", "", "Name of the LDAP group attribute containing role timeout in seconds.")
+		policyFile       = flag.String("policyfile", "", "JSON or YAML file of role authorization rules.")
+		usersFile        = flag.String("usersfile", "", "JSON or YAML file of users to serve instead of LDAP.")
+		auditFile        = flag.String("auditfile", "", "File to append structured audit events to.")
+		adminSocket      = flag.String("adminsocket", "", "UNIX socket to serve the admin API on.")
 		config           Config
 	)
 
+	if len(os.Args) > 1 && os.Args[1] == "admin" {
+		os.Exit(runAdmin(os.Args[2:]))
+	}
+
 	flag.Parse()
 
 	// Enable debug log output if the user requested it.
@@ -171,6 +291,22 @@ func main() {
 		config.LDAP.RoleTimeoutAttr = ""
 	}
 
+	if *policyFile != "" {
+		config.PolicyFile = *policyFile
+	}
+
+	if *usersFile != "" {
+		config.UsersFile = *usersFile
+	}
+
+	if *auditFile != "" {
+		config.Audit.File = *auditFile
+	}
+
+	if *adminSocket != "" {
+		config.Admin.Socket = *adminSocket
+	}
+
 	if *cacheTimeout != 3600 {
 		config.CacheTimeout = *cacheTimeout
 	}
@@ -198,25 +334,164 @@ func main() {
 	// Setup the server state machine that responds to requests.
 	stsConnection := sts.New(session.New(&aws.Config{}))
 	credentialsService := server.NewDirectSessionTokenService(config.AWS.Account, stsConnection, &config.AccountAliases)
+	credentialsService.SetSessionTags(config.SessionTags)
+	if err := credentialsService.SetRoleChains(config.RoleChains, nil); err != nil {
+		log.Errorf("Could not set up role chains: %s", err.Error())
+		os.Exit(1)
+	}
 
-	open := func() (server.LDAPImplementation, error) { return ConnectLDAP(config.LDAP) }
-	ldapServer, err := server.NewPersistentLDAP(open)
+	// Users come from a local file when one is given, and from LDAP otherwise.
+	var ldapServer server.LDAPImplementation
+	var directory userDirectory
+	if config.UsersFile != "" {
+		fileCache, err := server.NewFileUserCache(config.UsersFile, config.AWS.DefaultRole, stats)
+		if err != nil {
+			log.Errorf("Could not load users file: %s", err.Error())
+			os.Exit(1)
+		}
+		defer fileCache.Watch(usersFilePollInterval)()
+		log.Info("Serving users from %s; not using LDAP.", config.UsersFile)
+		directory = fileCache
+	} else {
+		ldapServer, directory = openLDAP(config, stats)
+	}
+
+	// Accept OpenSSH user certificates when trusted CAs are configured.
+	var userCache server.UserCache = directory
+	var certAuthenticator interface{ Reload() error }
+	if config.Certificates.Authorities != "" {
+		c, err := server.NewCertAuthenticator(directory, config.Certificates.Authorities, config.Certificates.Revoked, stats)
+		if err != nil {
+			log.Errorf("Could not load certificate authorities: %s", err.Error())
+			os.Exit(1)
+		}
+		userCache = c
+		certAuthenticator = c
+	}
+
+	// Decide who may assume which roles. A policy file takes precedence over
+	// group roles, from LDAP or the users file; with neither, any authenticated
+	// user may assume any role.
+	var authorizer server.RoleAuthorizer
+	var policyAuthorizer interface{ Reload() error }
+	if config.PolicyFile != "" {
+		p, err := server.NewPolicyFileAuthorizer(config.PolicyFile, config.AWS.Account, &config.AccountAliases)
+		if err != nil {
+			log.Errorf("Could not load policy file: %s", err.Error())
+			os.Exit(1)
+		}
+		authorizer = p
+		policyAuthorizer = p
+	} else if config.LDAP.EnableLDAPRoles || config.UsersFile != "" {
+		authorizer = server.NewLDAPGroupAuthorizer(config.AWS.Account, &config.AccountAliases)
+	} else {
+		authorizer = server.NewAllowAllAuthorizer(config.AWS.Account, &config.AccountAliases)
+	}
+	// Reuse credentials that still have enough life left, rather than going to
+	// STS for every request.
+	var credentials server.CredentialService = credentialsService
+	if config.CredentialCache.Enabled {
+		minLifetime := 15 * time.Minute
+		if config.CredentialCache.MinLifetime > 0 {
+			minLifetime = time.Duration(config.CredentialCache.MinLifetime) * time.Second
+		}
+		cache := server.NewCredentialCache(credentialsService, minLifetime, stats)
+		directory.OnEntitlementsChange(cache.Invalidate)
+		credentials = cache
+	}
+
+	serverHandler := server.New(userCache, credentials, authorizer, config.AWS.DefaultRole, stats, ldapServer,
+		config.LDAP.UserAttr, config.LDAP.BaseDN, config.LDAP.EnableLDAPRoles, config.LDAP.DefaultRoleAttr,
+		config.LDAP.PubKeysAttr, config.LDAP.RoleTimeoutAttr)
+
+	auditSink, err := makeAuditSink(config.Audit)
 	if err != nil {
-		log.Errorf("Fatal error, exiting: %s", err.Error())
+		log.Errorf("Could not set up audit trail: %s", err.Error())
 		os.Exit(1)
 	}
+	serverHandler.SetAuditSink(auditSink)
 
-	ldapCache, err := server.NewLDAPUserCache(ldapServer, stats, config.LDAP.UserAttr, config.LDAP.BaseDN,
-		config.LDAP.EnableLDAPRoles, config.LDAP.RoleAttribute, config.AWS.DefaultRole, config.LDAP.DefaultRoleAttr,
-		config.LDAP.GroupClassAttr, config.LDAP.PubKeysAttr, config.LDAP.RoleTimeoutAttr)
+	if config.MFA.Mode != "" {
+		mfa, err := server.NewMFAVerifier(config.MFA.Mode, config.MFA.SensitiveRoles, config.AWS.Account, &config.AccountAliases)
+		if err != nil {
+			log.Errorf("Could not set up MFA: %s", err.Error())
+			os.Exit(1)
+		}
+		if config.MFA.Mode != server.MFAOff && config.LDAP.MFASecretAttr == "" {
+			log.Warning("MFA is enabled but no mfasecretattr is set; every request needing a code will fail.")
+		}
+		serverHandler.SetMFAVerifier(mfa)
+	}
+
+	if config.Fallback.Mode != "" {
+		fallback, err := server.NewFallbackPolicy(config.Fallback.Mode, config.Fallback.Groups)
+		if err != nil {
+			log.Errorf("Could not set up role fallback: %s", err.Error())
+			os.Exit(1)
+		}
+		serverHandler.SetFallbackPolicy(fallback)
+	}
+
+	if len(config.PolicyPresets) > 0 {
+		presets := map[string]*server.SessionPolicy{}
+		for name, preset := range config.PolicyPresets {
+			policy, err := server.NewSessionPolicy(string(preset.Policy), preset.PolicyARNs)
+			if err != nil {
+				log.Errorf("Could not set up policy preset %s: %s", name, err.Error())
+				os.Exit(1)
+			}
+			presets[name] = policy
+		}
+		serverHandler.SetPolicyPresets(presets)
+	}
+
+	if config.Challenge.ServerID != "" || config.Challenge.Timeout != 0 {
+		serverID := config.Challenge.ServerID
+		if serverID == "" {
+			serverID, _ = os.Hostname()
+		}
+		challengeTimeout := 30 * time.Second
+		if config.Challenge.Timeout != 0 {
+			challengeTimeout = time.Duration(config.Challenge.Timeout) * time.Second
+		}
+		serverHandler.SetChallengeOptions(serverID, challengeTimeout)
+	}
+
+	serverHandler.SetRateLimits(server.RateLimits{
+		PerIP:              config.RateLimit.PerIP,
+		PerUser:            config.RateLimit.PerUser,
+		Burst:              config.RateLimit.Burst,
+		MaxChallengeRounds: config.RateLimit.MaxChallengeRounds,
+		LockoutFailures:    config.RateLimit.LockoutFailures,
+		LockoutWindow:      time.Duration(config.RateLimit.LockoutWindow) * time.Second,
+		LockoutDuration:    time.Duration(config.RateLimit.LockoutDuration) * time.Second,
+		MFAFailures:        config.RateLimit.MFAFailures,
+		MFAWindow:          time.Duration(config.RateLimit.MFAWindow) * time.Second,
+		MFALockout:         time.Duration(config.RateLimit.MFALockout) * time.Second,
+	})
+
+	if config.DenyList.File == "" {
+		log.Warning("No deny list file is set; entries added at runtime will be lost on restart.")
+	}
+	denyList, err := server.NewDenyList(config.DenyList.File, config.DenyList.BlockFallback)
 	if err != nil {
-		log.Errorf("Top-level error in LDAPUserCache layer: %s", err.Error())
+		log.Errorf("Could not load the deny list: %s", err.Error())
 		os.Exit(1)
 	}
+	serverHandler.SetDenyList(denyList)
+
+	if config.Admin.Socket != "" {
+		admin := server.NewAdminHandler(directory, serverHandler, denyList, config.Redacted())
+		adminListener, err := server.ListenAdmin(config.Admin.Socket, admin)
+		if err != nil {
+			log.Errorf("Could not start the admin API: %s", err.Error())
+			os.Exit(1)
+		}
+		defer os.Remove(config.Admin.Socket)
+		defer adminListener.Close()
+		log.Info("Serving the admin API on %s", config.Admin.Socket)
+	}
 
-	serverHandler := server.New(ldapCache, credentialsService, config.AWS.DefaultRole, stats, ldapServer,
-		config.LDAP.UserAttr, config.LDAP.BaseDN, config.LDAP.EnableLDAPRoles, config.LDAP.DefaultRoleAttr,
-		config.LDAP.PubKeysAttr, config.LDAP.RoleTimeoutAttr)
 	server, err := remote.NewServer(config.Listen, serverHandler.HandleConnection)
 
 	// Wait for a signal from the OS to shutdown.
@@ -230,7 +505,7 @@ func main() {
 	signal.Notify(debugEnable, syscall.SIGUSR1)
 	signal.Notify(debugDisable, syscall.SIGUSR2)
 
-	// SIGHUP should make Hologram server reload its cache of user information from LDAP.
+	// SIGHUP should make Hologram server reload its cache of user information.
 	reloadCacheSigHup := make(chan os.Signal, 1)
 	signal.Notify(reloadCacheSigHup, syscall.SIGHUP)
 
@@ -258,10 +533,28 @@ func main() {
 				log.DebugMode(false)
 			case <-reloadCacheSigHup:
 				log.Info("Force-reloading user cache.")
-				ldapCache.Update()
+				if err := directory.FullSync(); err != nil {
+					log.Errorf("Could not reload user cache: %s", err.Error())
+				}
+				if policyAuthorizer != nil {
+					log.Info("Reloading policy file.")
+					if err := policyAuthorizer.Reload(); err != nil {
+						log.Errorf("Keeping previous policy: %s", err.Error())
+					}
+				}
+				log.Info("Reloading deny list.")
+				if err := denyList.Reload(); err != nil {
+					log.Errorf("Keeping previous deny list: %s", err.Error())
+				}
+				if certAuthenticator != nil {
+					log.Info("Reloading certificate authorities and revocation list.")
+					if err := certAuthenticator.Reload(); err != nil {
+						log.Errorf("Keeping previous certificate authorities: %s", err.Error())
+					}
+				}
 			case <-cacheTimeoutTicker.C:
 				log.Info("Cache timeout. Reloading user cache.")
-				ldapCache.Update()
+				directory.Update()
 			}
 		}
 	}()
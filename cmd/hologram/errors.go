@@ -0,0 +1,74 @@
+package main
+
+import (
+	"fmt"
+	"os"
+
+	"github.com/AdRoll/hologram/log"
+	"github.com/AdRoll/hologram/protocol"
+)
+
+// exitFellBack means the server gave out credentials for the default role
+// instead of the one asked for.
+const exitFellBack = 3
+
+// Exit codes from 20 up mean the same command may work if run again later.
+var exitCodes = map[protocol.ErrorCode]int{
+	protocol.ErrorCode_UNKNOWN_ERROR:         1,
+	protocol.ErrorCode_BAD_REQUEST:           2,
+	protocol.ErrorCode_AUTHENTICATION_FAILED: 10,
+	protocol.ErrorCode_UNKNOWN_USER:          11,
+	protocol.ErrorCode_NOT_AUTHORIZED:        12,
+	protocol.ErrorCode_MFA_REQUIRED:          13,
+	protocol.ErrorCode_MFA_FAILED:            14,
+	protocol.ErrorCode_STS_ERROR:             15,
+	protocol.ErrorCode_AGENT_UNAVAILABLE:     16,
+	protocol.ErrorCode_ACCESS_REVOKED:        17,
+	protocol.ErrorCode_RATE_LIMITED:          20,
+	protocol.ErrorCode_LOCKED_OUT:            21,
+	protocol.ErrorCode_STS_THROTTLED:         22,
+	protocol.ErrorCode_DIRECTORY_UNAVAILABLE: 23,
+	protocol.ErrorCode_SERVER_UNAVAILABLE:    24,
+}
+
+var hints = map[protocol.ErrorCode]string{
+	protocol.ErrorCode_AUTHENTICATION_FAILED: "Make sure the SSH key registered with Hologram is loaded in ssh-agent (see `ssh-add -l`).",
+	protocol.ErrorCode_UNKNOWN_USER:          "Ask your administrator to give you Hologram access.",
+	protocol.ErrorCode_NOT_AUTHORIZED:        "Check the role name, or ask your administrator for access to the role.",
+	protocol.ErrorCode_MFA_REQUIRED:          "Run the command again from a terminal so that you can enter an MFA code.",
+	protocol.ErrorCode_MFA_FAILED:            "Enter a fresh code from your authenticator app, and check that your clock is right.",
+	protocol.ErrorCode_STS_ERROR:             "AWS refused the request; the role may not trust Hologram, or the timeout may be too long for it.",
+	protocol.ErrorCode_AGENT_UNAVAILABLE:     "Start hologram-agent and try again.",
+	protocol.ErrorCode_ACCESS_REVOKED:        "Your access was revoked by an administrator; contact them if you think this is a mistake.",
+	protocol.ErrorCode_RATE_LIMITED:          "Too many requests were made; wait a little before trying again.",
+	protocol.ErrorCode_LOCKED_OUT:            "Too many failed attempts were made; wait before trying again.",
+	protocol.ErrorCode_STS_THROTTLED:         "AWS is throttling requests; try again shortly.",
+	protocol.ErrorCode_DIRECTORY_UNAVAILABLE: "The Hologram server cannot reach its directory; try again shortly.",
+	protocol.ErrorCode_SERVER_UNAVAILABLE:    "Check your network connection or VPN and try again.",
+}
+
+/*
+exitCode returns the process exit code for an error code.
+*/
+func exitCode(code protocol.ErrorCode) int {
+	if exit, ok := exitCodes[code]; ok {
+		return exit
+	}
+	return 1
+}
+
+/*
+fail reports err along with what the user can do about it, and exits
+with a code that tells scripts what kind of error it was.
+*/
+func fail(err error) {
+	e := protocol.AsError(err)
+	log.Errorf("%s", e.Message)
+	if hint, ok := hints[e.Code]; ok {
+		if e.RetryAfter > 0 {
+			hint = fmt.Sprintf("%s Retry in %d seconds.", hint, int(e.RetryAfter.Seconds()))
+		}
+		log.Info(hint)
+	}
+	os.Exit(exitCode(e.Code))
+}
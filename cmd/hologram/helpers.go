@@ -1,6 +1,7 @@
 package main
 
 import (
+	"bufio"
 	"fmt"
 	"github.com/AdRoll/hologram/log"
 	"github.com/AdRoll/hologram/protocol"
@@ -8,12 +9,33 @@ import (
 	"github.com/mitchellh/go-homedir"
 	"io/ioutil"
 	"os"
+	"strings"
 )
 
 func request(req *protocol.AgentRequest) (*protocol.AgentResponse, error) {
+	return exchange(req, readMFACode)
+}
+
+/*
+quietRequest is request for callers that must never stop to wait on the
+user, such as shell completion: if the server asks for an MFA code, it
+fails instead of prompting.
+*/
+func quietRequest(req *protocol.AgentRequest) (*protocol.AgentResponse, error) {
+	return exchange(req, nil)
+}
+
+/*
+exchange sends req to hologram-agent and returns its answer, asking
+readCode for an MFA code whenever the server wants one.
+*/
+func exchange(req *protocol.AgentRequest, readCode func(prompt string) (string, error)) (*protocol.AgentResponse, error) {
 	client, err := local.NewClient("/var/run/hologram.sock")
 	if err != nil {
-		return nil, fmt.Errorf("Unable to connect to hologram socket.  Is hologram-agent running? Error: %s", err.Error())
+		return nil, &protocol.Error{
+			Code:    protocol.ErrorCode_AGENT_UNAVAILABLE,
+			Message: fmt.Sprintf("Unable to connect to hologram socket.  Is hologram-agent running? Error: %s", err.Error()),
+		}
 	}
 
 	// Try to get to the user's SSH agent, for best compatibility.
@@ -47,11 +69,50 @@ func request(req *protocol.AgentRequest) (*protocol.AgentResponse, error) {
 		return nil, err
 	}
 
-	response, err := client.Read()
+	for {
+		response, err := client.Read()
+		if err != nil {
+			return nil, err
+		}
+
+		if response.GetAgentResponse() == nil {
+			return nil, fmt.Errorf("unexpected response type: %v", response)
+		}
+
+		// The server wants an MFA code before it hands out credentials.
+		if tokenRequest := response.GetAgentResponse().GetTokenRequest(); tokenRequest != nil {
+			if readCode == nil {
+				return nil, protocol.NewError(protocol.ErrorCode_MFA_REQUIRED, "An MFA code is required.")
+			}
+			code, err := readCode(tokenRequest.GetPrompt())
+			if err != nil {
+				return nil, err
+			}
+			err = client.Write(&protocol.Message{
+				AgentRequest: &protocol.AgentRequest{
+					TokenResponse: &protocol.MFATokenResponse{
+						TokenValue: &code,
+					},
+				},
+			})
+			if err != nil {
+				return nil, err
+			}
+			continue
+		}
 
-	if response.GetAgentResponse() == nil {
-		return nil, fmt.Errorf("unexpected response type: %v", response)
+		return response.GetAgentResponse(), nil
 	}
+}
 
-	return response.GetAgentResponse(), nil
+func readMFACode(prompt string) (string, error) {
+	if prompt == "" {
+		prompt = "MFA code: "
+	}
+	fmt.Fprint(os.Stderr, prompt)
+	code, err := bufio.NewReader(os.Stdin).ReadString('\n')
+	if err != nil && code == "" {
+		return "", fmt.Errorf("Could not read MFA code: %s", err.Error())
+	}
+	return strings.TrimSpace(code), nil
 }
@@ -5,7 +5,6 @@ import (
 	"github.com/AdRoll/hologram/log"
 	"github.com/AdRoll/hologram/protocol"
 	"github.com/spf13/cobra"
-	"os"
 )
 
 func init() {
@@ -18,8 +17,7 @@ var meCmd = &cobra.Command{
 	Run: func(cmd *cobra.Command, args []string) {
 		err := me()
 		if err != nil {
-			log.Errorf("%s", err)
-			os.Exit(1)
+			fail(err)
 		}
 	},
 }
@@ -34,7 +32,7 @@ func me() error {
 	}
 
 	if response.GetFailure() != nil {
-		return fmt.Errorf("error from server: %s", response.GetFailure().GetErrorMessage())
+		return response.GetFailure().Err()
 	}
 
 	if response.GetSuccess() != nil {
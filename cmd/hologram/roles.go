@@ -0,0 +1,89 @@
+package main
+
+import (
+	"fmt"
+	"os"
+	"strings"
+	"text/tabwriter"
+	"time"
+
+	"github.com/AdRoll/hologram/protocol"
+	"github.com/spf13/cobra"
+)
+
+func init() {
+	rootCmd.AddCommand(rolesCmd)
+	useCmd.ValidArgsFunction = completeRoles
+}
+
+var rolesCmd = &cobra.Command{
+	Use:   "roles",
+	Short: "Lists the roles you may assume",
+	Run: func(cmd *cobra.Command, args []string) {
+		roles, err := listRoles(request)
+		if err != nil {
+			fail(err)
+		}
+		printRoles(roles)
+	},
+}
+
+/*
+listRoles asks for the roles the server allows, sending the request with
+send.
+*/
+func listRoles(send func(*protocol.AgentRequest) (*protocol.AgentResponse, error)) ([]*protocol.Role, error) {
+	response, err := send(&protocol.AgentRequest{
+		ListRoles: &protocol.ListRoles{},
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	if response.GetFailure() != nil {
+		return nil, response.GetFailure().Err()
+	}
+
+	if response.GetRoles() != nil {
+		return response.GetRoles().GetRoles(), nil
+	}
+
+	return nil, fmt.Errorf("unexpected response type: %v", response)
+}
+
+func printRoles(roles []*protocol.Role) {
+	w := tabwriter.NewWriter(os.Stdout, 0, 4, 2, ' ', 0)
+	fmt.Fprintln(w, "ROLE\tARN\tMAX DURATION\t")
+	for _, role := range roles {
+		alias := role.GetAlias()
+		if role.GetIsDefault() {
+			alias += " (default)"
+		}
+		duration := time.Duration(role.GetMaxDuration()) * time.Second
+		fmt.Fprintf(w, "%s\t%s\t%s\t\n", alias, role.GetArn(), duration)
+	}
+	w.Flush()
+}
+
+/*
+completeRoles offers the roles the server allows as arguments to
+`hologram use`. Wildcard grants are left out, since they are not names
+that can be typed as they are. Completion never prompts for an MFA
+code, so that it cannot hang the shell.
+*/
+func completeRoles(cmd *cobra.Command, args []string, toComplete string) ([]string, cobra.ShellCompDirective) {
+	if len(args) > 0 {
+		return nil, cobra.ShellCompDirectiveNoFileComp
+	}
+	roles, err := listRoles(quietRequest)
+	if err != nil {
+		return nil, cobra.ShellCompDirectiveNoFileComp
+	}
+	names := []string{}
+	for _, role := range roles {
+		if !strings.ContainsAny(role.GetAlias(), "*?") && strings.HasPrefix(role.GetAlias(), toComplete) {
+			names = append(names, role.GetAlias())
+		}
+	}
+	return names, cobra.ShellCompDirectiveNoFileComp
+}
@@ -2,14 +2,28 @@ package main
 
 import (
 	"fmt"
+	"io/ioutil"
+	"os"
+	"time"
+
 	"github.com/AdRoll/hologram/log"
 	"github.com/AdRoll/hologram/protocol"
 	"github.com/spf13/cobra"
-	"os"
+)
+
+var (
+	useDuration   time.Duration
+	usePolicyFile string
+	usePolicyARNs []string
+	usePreset     string
 )
 
 func init() {
 	rootCmd.AddCommand(useCmd)
+	useCmd.Flags().DurationVar(&useDuration, "duration", 0, "how long the session should last, e.g. 15m or 8h; the server may shorten it")
+	useCmd.Flags().StringVar(&usePolicyFile, "policy", "", "file holding a JSON session policy that narrows what the credentials may do")
+	useCmd.Flags().StringArrayVar(&usePolicyARNs, "policy-arn", nil, "ARN of a managed policy that narrows what the credentials may do; may be repeated")
+	useCmd.Flags().StringVar(&usePreset, "preset", "", "name of a session policy configured on the server")
 }
 
 var useCmd = &cobra.Command{
@@ -17,34 +31,68 @@ var useCmd = &cobra.Command{
 	Short: "<role> - Assumes the specified role",
 	Run: func(cmd *cobra.Command, args []string) {
 		var err error
-		if len(args) > 0 {
-			err = use(args[0])
+		if useDuration < 0 {
+			err = protocol.NewError(protocol.ErrorCode_BAD_REQUEST, "--duration must be positive")
+		} else if useDuration > 0 && useDuration < time.Second {
+			// The server takes whole seconds, and zero asks for the longest session.
+			err = protocol.NewError(protocol.ErrorCode_BAD_REQUEST, "--duration must be at least 1s")
+		} else if len(args) > 0 {
+			err = use(args[0], useDuration, usePolicyFile, usePolicyARNs, usePreset)
 		} else {
-			err = fmt.Errorf("usage: hologram use <role>")
+			err = protocol.NewError(protocol.ErrorCode_BAD_REQUEST, "usage: hologram use <role>")
 		}
 		if err != nil {
-			log.Errorf("%s", err)
-			os.Exit(1)
+			fail(err)
 		}
 	},
 }
 
-func use(role string) error {
+func use(role string, duration time.Duration, policyFile string, policyARNs []string, preset string) error {
+	assumeRole := &protocol.AssumeRole{
+		Role:       &role,
+		PolicyArns: policyARNs,
+	}
+	if duration > 0 {
+		seconds := int64(duration / time.Second)
+		assumeRole.Duration = &seconds
+	}
+	if policyFile != "" {
+		policy, err := ioutil.ReadFile(policyFile)
+		if err != nil {
+			return protocol.NewError(protocol.ErrorCode_BAD_REQUEST, "could not read session policy: %s", err)
+		}
+		policyString := string(policy)
+		assumeRole.Policy = &policyString
+	}
+	if preset != "" {
+		assumeRole.Preset = &preset
+	}
 	response, err := request(&protocol.AgentRequest{
-		AssumeRole: &protocol.AssumeRole{
-			Role: &role,
-		},
+		AssumeRole: assumeRole,
 	})
 	if err != nil {
 		return err
 	}
 
 	if response.GetFailure() != nil {
-		return fmt.Errorf(response.GetFailure().GetErrorMessage())
+		return response.GetFailure().Err()
 	}
 
-	if response.GetSuccess() != nil {
+	if success := response.GetSuccess(); success != nil {
+		if success.GetFellBack() {
+			// Neither success nor failure: say plainly which role we have,
+			// and exit with a code of its own so scripts don't carry on.
+			log.Warning("Could not get credentials for role '%s': %s", role, success.GetFallbackReason())
+			log.Warning("Fell back to %s; your commands will run as that role.", success.GetGrantedRole())
+			os.Exit(exitFellBack)
+		}
 		output := fmt.Sprintf("Successfully got credentials for role '%s'", role)
+		if granted := time.Duration(success.GetDuration()) * time.Second; granted > 0 {
+			output = fmt.Sprintf("%s for %s", output, granted)
+			if duration > 0 && granted != duration.Truncate(time.Second) {
+				log.Warning("Asked for %s; the server granted %s.", duration, granted)
+			}
+		}
 		log.Info(output)
 		return nil
 	}
@@ -0,0 +1,84 @@
+package main
+
+import (
+	"fmt"
+	"os"
+	"text/tabwriter"
+	"time"
+
+	"github.com/AdRoll/hologram/protocol"
+	"github.com/spf13/cobra"
+)
+
+func init() {
+	rootCmd.AddCommand(whoamiCmd)
+}
+
+var whoamiCmd = &cobra.Command{
+	Use:   "whoami",
+	Short: "Shows which user your SSH key maps to, and the role you hold",
+	Run: func(cmd *cobra.Command, args []string) {
+		identity, err := whoami()
+		if err != nil {
+			fail(err)
+		}
+		printIdentity(identity, time.Now())
+	},
+}
+
+func whoami() (*protocol.Identity, error) {
+	response, err := request(&protocol.AgentRequest{
+		WhoAmI: &protocol.WhoAmI{},
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	if response.GetFailure() != nil {
+		return nil, response.GetFailure().Err()
+	}
+
+	if response.GetIdentity() != nil {
+		return response.GetIdentity(), nil
+	}
+
+	return nil, fmt.Errorf("unexpected response type: %v", response)
+}
+
+func printIdentity(identity *protocol.Identity, now time.Time) {
+	w := tabwriter.NewWriter(os.Stdout, 0, 4, 2, ' ', 0)
+	fmt.Fprintf(w, "Username:\t%s\n", identity.GetUsername())
+	if identity.GetKeyFingerprint() != "" {
+		fmt.Fprintf(w, "SSH key:\t%s\n", identity.GetKeyFingerprint())
+	}
+	groups := identity.GetGroups()
+	if len(groups) == 0 {
+		fmt.Fprintf(w, "Groups:\t(none)\n")
+	}
+	for i, group := range groups {
+		label := ""
+		if i == 0 {
+			label = "Groups:"
+		}
+		fmt.Fprintf(w, "%s\t%s\n", label, group)
+	}
+	if identity.GetDefaultRole() != "" {
+		fmt.Fprintf(w, "Default role:\t%s\n", identity.GetDefaultRole())
+	}
+
+	current := "(none; run hologram use or hologram me)"
+	if identity.CurrentExpiration != nil {
+		role := identity.GetCurrentRole()
+		if role == "" {
+			role = "default role"
+		}
+		expiration := time.Unix(identity.GetCurrentExpiration(), 0)
+		if expiration.After(now) {
+			current = fmt.Sprintf("%s (expires %s, in %s)", role, expiration.Format(time.RFC3339), expiration.Sub(now).Round(time.Second))
+		} else {
+			current = fmt.Sprintf("%s (expired %s; refreshed when next used)", role, expiration.Format(time.RFC3339))
+		}
+	}
+	fmt.Fprintf(w, "Current role:\t%s\n", current)
+	w.Flush()
+}
@@ -0,0 +1,126 @@
+// Copyright 2014 AdRoll, Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package protocol
+
+import (
+	"errors"
+	"fmt"
+	"time"
+)
+
+/*
+Error is an error with an ErrorCode, which survives the trip from the
+server through the agent to the CLI.
+*/
+type Error struct {
+	Code    ErrorCode
+	Message string
+	// RetryAfter is how long to wait before trying again; zero if unknown.
+	RetryAfter time.Duration
+}
+
+/*
+NewError returns an Error with a formatted message.
+*/
+func NewError(code ErrorCode, format string, args ...interface{}) *Error {
+	return &Error{Code: code, Message: fmt.Sprintf(format, args...)}
+}
+
+func (e *Error) Error() string {
+	return e.Message
+}
+
+/*
+Retryable reports whether the same request may succeed if sent again
+later, as opposed to needing the user or an administrator to act first.
+*/
+func (x ErrorCode) Retryable() bool {
+	switch x {
+	case ErrorCode_RATE_LIMITED, ErrorCode_LOCKED_OUT, ErrorCode_STS_THROTTLED,
+		ErrorCode_DIRECTORY_UNAVAILABLE, ErrorCode_SERVER_UNAVAILABLE:
+		return true
+	}
+	return false
+}
+
+/*
+AsError returns err as an *Error. Wrapped errors keep their full message
+and take the code of the Error inside them; errors without one get
+ErrorCode_UNKNOWN_ERROR.
+*/
+func AsError(err error) *Error {
+	var e *Error
+	if errors.As(err, &e) {
+		return &Error{Code: e.Code, Message: err.Error(), RetryAfter: e.RetryAfter}
+	}
+	return &Error{Code: ErrorCode_UNKNOWN_ERROR, Message: err.Error()}
+}
+
+/*
+ErrorMessage builds the message that reports err to the other end.
+*/
+func ErrorMessage(err error) *Message {
+	e := AsError(err)
+	msg := &Message{
+		Error:     &e.Message,
+		ErrorCode: e.Code.Enum(),
+	}
+	if e.RetryAfter > 0 {
+		retryAfter := int64(e.RetryAfter / time.Second)
+		msg.RetryAfter = &retryAfter
+	}
+	return msg
+}
+
+/*
+NewFailure builds the agent response that reports err to the CLI.
+*/
+func NewFailure(err error) *Failure {
+	e := AsError(err)
+	failure := &Failure{
+		ErrorMessage: &e.Message,
+		ErrorCode:    e.Code.Enum(),
+	}
+	if e.RetryAfter > 0 {
+		retryAfter := int64(e.RetryAfter / time.Second)
+		failure.RetryAfter = &retryAfter
+	}
+	return failure
+}
+
+/*
+Err returns the error carried by a message, or nil if it carries none.
+*/
+func (m *Message) Err() error {
+	if m.GetError() == "" {
+		return nil
+	}
+	return &Error{
+		Code:       m.GetErrorCode(),
+		Message:    m.GetError(),
+		RetryAfter: time.Duration(m.GetRetryAfter()) * time.Second,
+	}
+}
+
+/*
+Err returns the error a failure reports.
+*/
+func (m *Failure) Err() error {
+	return &Error{
+		Code:       m.GetErrorCode(),
+		Message:    m.GetErrorMessage(),
+		RetryAfter: time.Duration(m.GetRetryAfter()) * time.Second,
+	}
+}
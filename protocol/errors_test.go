@@ -0,0 +1,57 @@
+// Copyright 2014 AdRoll, Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package protocol
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"testing"
+	"time"
+
+	. "github.com/smartystreets/goconvey/convey"
+)
+
+func TestErrors(t *testing.T) {
+	Convey("A coded error should survive the wire", t, func() {
+		sent := &Error{Code: ErrorCode_RATE_LIMITED, Message: "slow down", RetryAfter: 30 * time.Second}
+		buffer := new(bytes.Buffer)
+		So(Write(buffer, ErrorMessage(sent)), ShouldBeNil)
+
+		msg, err := Read(buffer)
+		So(err, ShouldBeNil)
+		So(msg.Err(), ShouldResemble, sent)
+		So(AsError(msg.Err()).Code.Retryable(), ShouldBeTrue)
+	})
+
+	Convey("A failure should carry the code of a wrapped error", t, func() {
+		wrapped := fmt.Errorf("assuming role: %w", NewError(ErrorCode_NOT_AUTHORIZED, "no access to %s", "admin"))
+		failure := NewFailure(wrapped)
+		So(failure.GetErrorCode(), ShouldEqual, ErrorCode_NOT_AUTHORIZED)
+		So(failure.GetErrorMessage(), ShouldEqual, "assuming role: no access to admin")
+		So(failure.RetryAfter, ShouldBeNil)
+		So(AsError(failure.Err()).Code.Retryable(), ShouldBeFalse)
+	})
+
+	Convey("Errors without a code should be unknown", t, func() {
+		So(AsError(errors.New("boom")).Code, ShouldEqual, ErrorCode_UNKNOWN_ERROR)
+		So((&Message{}).Err(), ShouldBeNil)
+	})
+
+	Convey("Messages from older servers should read as unknown errors", t, func() {
+		text := "something broke"
+		So(AsError((&Message{Error: &text}).Err()).Code, ShouldEqual, ErrorCode_UNKNOWN_ERROR)
+	})
+}
@@ -16,7 +16,10 @@ package protocol
 
 //go:generate protoc --go_out=. hologram.proto
 
-import "io"
+import (
+	"io"
+	"net"
+)
 
 /*
 MessageReadWriteCloser implementers provide a wrapper around the Hologram
@@ -48,6 +51,17 @@ func (smc *messageConnection) Close() error {
 	return smc.internalConn.Close()
 }
 
+/*
+RemoteAddr returns the address of the peer when the underlying stream
+is a network connection, and nil otherwise.
+*/
+func (smc *messageConnection) RemoteAddr() net.Addr {
+	if c, ok := smc.internalConn.(net.Conn); ok {
+		return c.RemoteAddr()
+	}
+	return nil
+}
+
 /*
 NewmessageConnection is a convenience function to create a
 properly-initialized messageConnection.
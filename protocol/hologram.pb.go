@@ -28,6 +28,8 @@ It has these top-level messages:
 	ServerRequest
 	AssumeRole
 	GetUserCredentials
+	ListRoles
+	WhoAmI
 	AddSSHKey
 	SSHChallengeResponse
 	MFATokenResponse
@@ -36,6 +38,9 @@ It has these top-level messages:
 	SSHVerificationFailure
 	STSCredentials
 	MFATokenRequest
+	RoleList
+	Role
+	Identity
 	AgentRequest
 	AgentResponse
 	Success
@@ -50,6 +55,80 @@ import math "math"
 var _ = proto.Marshal
 var _ = math.Inf
 
+// ErrorCode tells clients what went wrong, so they can decide whether to
+// retry and what to tell the user without parsing error text.
+type ErrorCode int32
+
+const (
+	ErrorCode_UNKNOWN_ERROR         ErrorCode = 0
+	ErrorCode_BAD_REQUEST           ErrorCode = 1
+	ErrorCode_AUTHENTICATION_FAILED ErrorCode = 2
+	ErrorCode_UNKNOWN_USER          ErrorCode = 3
+	ErrorCode_NOT_AUTHORIZED        ErrorCode = 4
+	ErrorCode_MFA_REQUIRED          ErrorCode = 5
+	ErrorCode_MFA_FAILED            ErrorCode = 6
+	ErrorCode_RATE_LIMITED          ErrorCode = 7
+	ErrorCode_LOCKED_OUT            ErrorCode = 8
+	ErrorCode_STS_THROTTLED         ErrorCode = 9
+	ErrorCode_STS_ERROR             ErrorCode = 10
+	ErrorCode_DIRECTORY_UNAVAILABLE ErrorCode = 11
+	ErrorCode_SERVER_UNAVAILABLE    ErrorCode = 12
+	ErrorCode_AGENT_UNAVAILABLE     ErrorCode = 13
+	ErrorCode_ACCESS_REVOKED        ErrorCode = 14
+)
+
+var ErrorCode_name = map[int32]string{
+	0:  "UNKNOWN_ERROR",
+	1:  "BAD_REQUEST",
+	2:  "AUTHENTICATION_FAILED",
+	3:  "UNKNOWN_USER",
+	4:  "NOT_AUTHORIZED",
+	5:  "MFA_REQUIRED",
+	6:  "MFA_FAILED",
+	7:  "RATE_LIMITED",
+	8:  "LOCKED_OUT",
+	9:  "STS_THROTTLED",
+	10: "STS_ERROR",
+	11: "DIRECTORY_UNAVAILABLE",
+	12: "SERVER_UNAVAILABLE",
+	13: "AGENT_UNAVAILABLE",
+	14: "ACCESS_REVOKED",
+}
+var ErrorCode_value = map[string]int32{
+	"UNKNOWN_ERROR":         0,
+	"BAD_REQUEST":           1,
+	"AUTHENTICATION_FAILED": 2,
+	"UNKNOWN_USER":          3,
+	"NOT_AUTHORIZED":        4,
+	"MFA_REQUIRED":          5,
+	"MFA_FAILED":            6,
+	"RATE_LIMITED":          7,
+	"LOCKED_OUT":            8,
+	"STS_THROTTLED":         9,
+	"STS_ERROR":             10,
+	"DIRECTORY_UNAVAILABLE": 11,
+	"SERVER_UNAVAILABLE":    12,
+	"AGENT_UNAVAILABLE":     13,
+	"ACCESS_REVOKED":        14,
+}
+
+func (x ErrorCode) Enum() *ErrorCode {
+	p := new(ErrorCode)
+	*p = x
+	return p
+}
+func (x ErrorCode) String() string {
+	return proto.EnumName(ErrorCode_name, int32(x))
+}
+func (x *ErrorCode) UnmarshalJSON(data []byte) error {
+	value, err := proto.UnmarshalJSONEnum(ErrorCode_value, data, "ErrorCode")
+	if err != nil {
+		return err
+	}
+	*x = ErrorCode(value)
+	return nil
+}
+
 type Message_Source int32
 
 const (
@@ -123,7 +202,11 @@ func (x *Ping_RequestResponse) UnmarshalJSON(data []byte) error {
 }
 
 type Message struct {
-	Error *string `protobuf:"bytes,1,opt,name=error" json:"error,omitempty"`
+	Error     *string    `protobuf:"bytes,1,opt,name=error" json:"error,omitempty"`
+	ErrorCode *ErrorCode `protobuf:"varint,3,opt,name=errorCode,enum=protocol.ErrorCode,def=0" json:"errorCode,omitempty"`
+	// retryAfter is how many seconds the client should wait before trying
+	// again, when that is known.
+	RetryAfter *int64 `protobuf:"varint,4,opt,name=retryAfter" json:"retryAfter,omitempty"`
 	// This is useful for statistics and debugging
 	Source           *Message_Source `protobuf:"varint,2,opt,name=source,enum=protocol.Message_Source,def=0" json:"source,omitempty"`
 	Ping             *Ping           `protobuf:"bytes,5,opt,name=ping" json:"ping,omitempty"`
@@ -140,6 +223,7 @@ func (m *Message) Reset()         { *m = Message{} }
 func (m *Message) String() string { return proto.CompactTextString(m) }
 func (*Message) ProtoMessage()    {}
 
+const Default_Message_ErrorCode ErrorCode = ErrorCode_UNKNOWN_ERROR
 const Default_Message_Source Message_Source = Message_OTHER
 
 func (m *Message) GetError() string {
@@ -149,6 +233,20 @@ func (m *Message) GetError() string {
 	return ""
 }
 
+func (m *Message) GetErrorCode() ErrorCode {
+	if m != nil && m.ErrorCode != nil {
+		return *m.ErrorCode
+	}
+	return Default_Message_ErrorCode
+}
+
+func (m *Message) GetRetryAfter() int64 {
+	if m != nil && m.RetryAfter != nil {
+		return *m.RetryAfter
+	}
+	return 0
+}
+
 func (m *Message) GetSource() Message_Source {
 	if m != nil && m.Source != nil {
 		return *m.Source
@@ -229,6 +327,8 @@ type ServerRequest struct {
 	TokenResponse      *MFATokenResponse     `protobuf:"bytes,6,opt,name=tokenResponse" json:"tokenResponse,omitempty"`
 	GetUserCredentials *GetUserCredentials   `protobuf:"bytes,7,opt,name=getUserCredentials" json:"getUserCredentials,omitempty"`
 	AddSSHkey          *AddSSHKey            `protobuf:"bytes,8,opt,name=addSSHkey" json:"addSSHkey,omitempty"`
+	ListRoles          *ListRoles            `protobuf:"bytes,9,opt,name=listRoles" json:"listRoles,omitempty"`
+	WhoAmI             *WhoAmI               `protobuf:"bytes,10,opt,name=whoAmI" json:"whoAmI,omitempty"`
 	XXX_unrecognized   []byte                `json:"-"`
 }
 
@@ -271,10 +371,28 @@ func (m *ServerRequest) GetAddSSHkey() *AddSSHKey {
 	return nil
 }
 
+func (m *ServerRequest) GetListRoles() *ListRoles {
+	if m != nil {
+		return m.ListRoles
+	}
+	return nil
+}
+
+func (m *ServerRequest) GetWhoAmI() *WhoAmI {
+	if m != nil {
+		return m.WhoAmI
+	}
+	return nil
+}
+
 type AssumeRole struct {
-	User             *string `protobuf:"bytes,1,opt,name=user" json:"user,omitempty"`
-	Role             *string `protobuf:"bytes,2,opt,name=role" json:"role,omitempty"`
-	XXX_unrecognized []byte  `json:"-"`
+	User             *string  `protobuf:"bytes,1,opt,name=user" json:"user,omitempty"`
+	Role             *string  `protobuf:"bytes,2,opt,name=role" json:"role,omitempty"`
+	Duration         *int64   `protobuf:"varint,3,opt,name=duration" json:"duration,omitempty"`
+	Policy           *string  `protobuf:"bytes,4,opt,name=policy" json:"policy,omitempty"`
+	PolicyArns       []string `protobuf:"bytes,5,rep,name=policyArns" json:"policyArns,omitempty"`
+	Preset           *string  `protobuf:"bytes,6,opt,name=preset" json:"preset,omitempty"`
+	XXX_unrecognized []byte   `json:"-"`
 }
 
 func (m *AssumeRole) Reset()         { *m = AssumeRole{} }
@@ -295,14 +413,82 @@ func (m *AssumeRole) GetRole() string {
 	return ""
 }
 
+func (m *AssumeRole) GetDuration() int64 {
+	if m != nil && m.Duration != nil {
+		return *m.Duration
+	}
+	return 0
+}
+
+func (m *AssumeRole) GetPolicy() string {
+	if m != nil && m.Policy != nil {
+		return *m.Policy
+	}
+	return ""
+}
+
+func (m *AssumeRole) GetPolicyArns() []string {
+	if m != nil {
+		return m.PolicyArns
+	}
+	return nil
+}
+
+func (m *AssumeRole) GetPreset() string {
+	if m != nil && m.Preset != nil {
+		return *m.Preset
+	}
+	return ""
+}
+
 type GetUserCredentials struct {
-	XXX_unrecognized []byte `json:"-"`
+	User             *string `protobuf:"bytes,1,opt,name=user" json:"user,omitempty"`
+	XXX_unrecognized []byte  `json:"-"`
 }
 
 func (m *GetUserCredentials) Reset()         { *m = GetUserCredentials{} }
 func (m *GetUserCredentials) String() string { return proto.CompactTextString(m) }
 func (*GetUserCredentials) ProtoMessage()    {}
 
+func (m *GetUserCredentials) GetUser() string {
+	if m != nil && m.User != nil {
+		return *m.User
+	}
+	return ""
+}
+
+type ListRoles struct {
+	User             *string `protobuf:"bytes,1,opt,name=user" json:"user,omitempty"`
+	XXX_unrecognized []byte  `json:"-"`
+}
+
+func (m *ListRoles) Reset()         { *m = ListRoles{} }
+func (m *ListRoles) String() string { return proto.CompactTextString(m) }
+func (*ListRoles) ProtoMessage()    {}
+
+func (m *ListRoles) GetUser() string {
+	if m != nil && m.User != nil {
+		return *m.User
+	}
+	return ""
+}
+
+type WhoAmI struct {
+	User             *string `protobuf:"bytes,1,opt,name=user" json:"user,omitempty"`
+	XXX_unrecognized []byte  `json:"-"`
+}
+
+func (m *WhoAmI) Reset()         { *m = WhoAmI{} }
+func (m *WhoAmI) String() string { return proto.CompactTextString(m) }
+func (*WhoAmI) ProtoMessage()    {}
+
+func (m *WhoAmI) GetUser() string {
+	if m != nil && m.User != nil {
+		return *m.User
+	}
+	return ""
+}
+
 type AddSSHKey struct {
 	Username         *string `protobuf:"bytes,1,req,name=username" json:"username,omitempty"`
 	Passwordhash     *string `protobuf:"bytes,2,req,name=passwordhash" json:"passwordhash,omitempty"`
@@ -336,9 +522,15 @@ func (m *AddSSHKey) GetSshkeybytes() string {
 }
 
 type SSHChallengeResponse struct {
-	Signature        []byte  `protobuf:"bytes,1,req,name=signature" json:"signature,omitempty"`
-	Format           *string `protobuf:"bytes,2,req,name=format" json:"format,omitempty"`
-	XXX_unrecognized []byte  `json:"-"`
+	Signature []byte  `protobuf:"bytes,1,req,name=signature" json:"signature,omitempty"`
+	Format    *string `protobuf:"bytes,2,req,name=format" json:"format,omitempty"`
+	// publicKey is the wire-format key that produced the signature, so
+	// that the server only has to verify against that one key.
+	PublicKey []byte `protobuf:"bytes,3,opt,name=publicKey" json:"publicKey,omitempty"`
+	// challenge echoes the challenge that was signed, so the server can
+	// tell a replayed or stale signature from a bad one.
+	Challenge        []byte `protobuf:"bytes,4,opt,name=challenge" json:"challenge,omitempty"`
+	XXX_unrecognized []byte `json:"-"`
 }
 
 func (m *SSHChallengeResponse) Reset()         { *m = SSHChallengeResponse{} }
@@ -359,6 +551,20 @@ func (m *SSHChallengeResponse) GetFormat() string {
 	return ""
 }
 
+func (m *SSHChallengeResponse) GetPublicKey() []byte {
+	if m != nil {
+		return m.PublicKey
+	}
+	return nil
+}
+
+func (m *SSHChallengeResponse) GetChallenge() []byte {
+	if m != nil {
+		return m.Challenge
+	}
+	return nil
+}
+
 type MFATokenResponse struct {
 	TokenValue       *string `protobuf:"bytes,1,opt,name=tokenValue" json:"tokenValue,omitempty"`
 	XXX_unrecognized []byte  `json:"-"`
@@ -380,6 +586,8 @@ type ServerResponse struct {
 	VerificationFailure *SSHVerificationFailure `protobuf:"bytes,5,opt,name=verificationFailure" json:"verificationFailure,omitempty"`
 	Credentials         *STSCredentials         `protobuf:"bytes,6,opt,name=credentials" json:"credentials,omitempty"`
 	TokenRequest        *MFATokenRequest        `protobuf:"bytes,7,opt,name=tokenRequest" json:"tokenRequest,omitempty"`
+	Roles               *RoleList               `protobuf:"bytes,8,opt,name=roles" json:"roles,omitempty"`
+	Identity            *Identity               `protobuf:"bytes,9,opt,name=identity" json:"identity,omitempty"`
 	XXX_unrecognized    []byte                  `json:"-"`
 }
 
@@ -415,6 +623,20 @@ func (m *ServerResponse) GetTokenRequest() *MFATokenRequest {
 	return nil
 }
 
+func (m *ServerResponse) GetRoles() *RoleList {
+	if m != nil {
+		return m.Roles
+	}
+	return nil
+}
+
+func (m *ServerResponse) GetIdentity() *Identity {
+	if m != nil {
+		return m.Identity
+	}
+	return nil
+}
+
 type SSHChallenge struct {
 	Challenge        []byte `protobuf:"bytes,1,req,name=challenge" json:"challenge,omitempty"`
 	XXX_unrecognized []byte `json:"-"`
@@ -444,6 +666,11 @@ type STSCredentials struct {
 	SecretAccessKey  *string `protobuf:"bytes,2,req,name=secretAccessKey" json:"secretAccessKey,omitempty"`
 	AccessToken      *string `protobuf:"bytes,3,req,name=accessToken" json:"accessToken,omitempty"`
 	Expiration       *int64  `protobuf:"varint,4,req,name=expiration" json:"expiration,omitempty"`
+	RequestedRole    *string `protobuf:"bytes,5,opt,name=requestedRole" json:"requestedRole,omitempty"`
+	GrantedRole      *string `protobuf:"bytes,6,opt,name=grantedRole" json:"grantedRole,omitempty"`
+	FellBack         *bool   `protobuf:"varint,7,opt,name=fellBack" json:"fellBack,omitempty"`
+	FallbackReason   *string `protobuf:"bytes,8,opt,name=fallbackReason" json:"fallbackReason,omitempty"`
+	Duration         *int64  `protobuf:"varint,9,opt,name=duration" json:"duration,omitempty"`
 	XXX_unrecognized []byte  `json:"-"`
 }
 
@@ -479,18 +706,182 @@ func (m *STSCredentials) GetExpiration() int64 {
 	return 0
 }
 
+func (m *STSCredentials) GetRequestedRole() string {
+	if m != nil && m.RequestedRole != nil {
+		return *m.RequestedRole
+	}
+	return ""
+}
+
+func (m *STSCredentials) GetGrantedRole() string {
+	if m != nil && m.GrantedRole != nil {
+		return *m.GrantedRole
+	}
+	return ""
+}
+
+func (m *STSCredentials) GetFellBack() bool {
+	if m != nil && m.FellBack != nil {
+		return *m.FellBack
+	}
+	return false
+}
+
+func (m *STSCredentials) GetFallbackReason() string {
+	if m != nil && m.FallbackReason != nil {
+		return *m.FallbackReason
+	}
+	return ""
+}
+
+func (m *STSCredentials) GetDuration() int64 {
+	if m != nil && m.Duration != nil {
+		return *m.Duration
+	}
+	return 0
+}
+
 type MFATokenRequest struct {
-	XXX_unrecognized []byte `json:"-"`
+	// prompt is shown to the user when asking for the code.
+	Prompt           *string `protobuf:"bytes,1,opt,name=prompt" json:"prompt,omitempty"`
+	XXX_unrecognized []byte  `json:"-"`
 }
 
 func (m *MFATokenRequest) Reset()         { *m = MFATokenRequest{} }
 func (m *MFATokenRequest) String() string { return proto.CompactTextString(m) }
 func (*MFATokenRequest) ProtoMessage()    {}
 
+func (m *MFATokenRequest) GetPrompt() string {
+	if m != nil && m.Prompt != nil {
+		return *m.Prompt
+	}
+	return ""
+}
+
+type RoleList struct {
+	Roles            []*Role `protobuf:"bytes,1,rep,name=roles" json:"roles,omitempty"`
+	XXX_unrecognized []byte  `json:"-"`
+}
+
+func (m *RoleList) Reset()         { *m = RoleList{} }
+func (m *RoleList) String() string { return proto.CompactTextString(m) }
+func (*RoleList) ProtoMessage()    {}
+
+func (m *RoleList) GetRoles() []*Role {
+	if m != nil {
+		return m.Roles
+	}
+	return nil
+}
+
+// Role is a role the user may assume. alias is the shortest name
+// `hologram use` accepts for it, and maxDuration is in seconds.
+type Role struct {
+	Alias            *string `protobuf:"bytes,1,opt,name=alias" json:"alias,omitempty"`
+	Arn              *string `protobuf:"bytes,2,opt,name=arn" json:"arn,omitempty"`
+	MaxDuration      *int64  `protobuf:"varint,3,opt,name=maxDuration" json:"maxDuration,omitempty"`
+	IsDefault        *bool   `protobuf:"varint,4,opt,name=isDefault" json:"isDefault,omitempty"`
+	XXX_unrecognized []byte  `json:"-"`
+}
+
+func (m *Role) Reset()         { *m = Role{} }
+func (m *Role) String() string { return proto.CompactTextString(m) }
+func (*Role) ProtoMessage()    {}
+
+func (m *Role) GetAlias() string {
+	if m != nil && m.Alias != nil {
+		return *m.Alias
+	}
+	return ""
+}
+
+func (m *Role) GetArn() string {
+	if m != nil && m.Arn != nil {
+		return *m.Arn
+	}
+	return ""
+}
+
+func (m *Role) GetMaxDuration() int64 {
+	if m != nil && m.MaxDuration != nil {
+		return *m.MaxDuration
+	}
+	return 0
+}
+
+func (m *Role) GetIsDefault() bool {
+	if m != nil && m.IsDefault != nil {
+		return *m.IsDefault
+	}
+	return false
+}
+
+// Identity is who the server thinks the user is. The agent adds the
+// role it currently holds credentials for, and when they expire; an
+// empty currentRole with a currentExpiration means the default role.
+type Identity struct {
+	Username          *string  `protobuf:"bytes,1,opt,name=username" json:"username,omitempty"`
+	KeyFingerprint    *string  `protobuf:"bytes,2,opt,name=keyFingerprint" json:"keyFingerprint,omitempty"`
+	Groups            []string `protobuf:"bytes,3,rep,name=groups" json:"groups,omitempty"`
+	DefaultRole       *string  `protobuf:"bytes,4,opt,name=defaultRole" json:"defaultRole,omitempty"`
+	CurrentRole       *string  `protobuf:"bytes,5,opt,name=currentRole" json:"currentRole,omitempty"`
+	CurrentExpiration *int64   `protobuf:"varint,6,opt,name=currentExpiration" json:"currentExpiration,omitempty"`
+	XXX_unrecognized  []byte   `json:"-"`
+}
+
+func (m *Identity) Reset()         { *m = Identity{} }
+func (m *Identity) String() string { return proto.CompactTextString(m) }
+func (*Identity) ProtoMessage()    {}
+
+func (m *Identity) GetUsername() string {
+	if m != nil && m.Username != nil {
+		return *m.Username
+	}
+	return ""
+}
+
+func (m *Identity) GetKeyFingerprint() string {
+	if m != nil && m.KeyFingerprint != nil {
+		return *m.KeyFingerprint
+	}
+	return ""
+}
+
+func (m *Identity) GetGroups() []string {
+	if m != nil {
+		return m.Groups
+	}
+	return nil
+}
+
+func (m *Identity) GetDefaultRole() string {
+	if m != nil && m.DefaultRole != nil {
+		return *m.DefaultRole
+	}
+	return ""
+}
+
+func (m *Identity) GetCurrentRole() string {
+	if m != nil && m.CurrentRole != nil {
+		return *m.CurrentRole
+	}
+	return ""
+}
+
+func (m *Identity) GetCurrentExpiration() int64 {
+	if m != nil && m.CurrentExpiration != nil {
+		return *m.CurrentExpiration
+	}
+	return 0
+}
+
 type AgentRequest struct {
 	SshAgentSock       *string             `protobuf:"bytes,2,opt,name=sshAgentSock" json:"sshAgentSock,omitempty"`
 	AssumeRole         *AssumeRole         `protobuf:"bytes,3,opt,name=assumeRole" json:"assumeRole,omitempty"`
 	GetUserCredentials *GetUserCredentials `protobuf:"bytes,4,opt,name=getUserCredentials" json:"getUserCredentials,omitempty"`
+	TokenResponse      *MFATokenResponse   `protobuf:"bytes,6,opt,name=tokenResponse" json:"tokenResponse,omitempty"`
+	ListRoles          *ListRoles          `protobuf:"bytes,7,opt,name=listRoles" json:"listRoles,omitempty"`
+	WhoAmI             *WhoAmI             `protobuf:"bytes,8,opt,name=whoAmI" json:"whoAmI,omitempty"`
 	// sshKeyFile should be sent along if the CLI cannot determine
 	// how to communicate with the user's SSH agent.
 	SshKeyFile       []byte `protobuf:"bytes,5,opt,name=sshKeyFile" json:"sshKeyFile,omitempty"`
@@ -522,6 +913,27 @@ func (m *AgentRequest) GetGetUserCredentials() *GetUserCredentials {
 	return nil
 }
 
+func (m *AgentRequest) GetTokenResponse() *MFATokenResponse {
+	if m != nil {
+		return m.TokenResponse
+	}
+	return nil
+}
+
+func (m *AgentRequest) GetListRoles() *ListRoles {
+	if m != nil {
+		return m.ListRoles
+	}
+	return nil
+}
+
+func (m *AgentRequest) GetWhoAmI() *WhoAmI {
+	if m != nil {
+		return m.WhoAmI
+	}
+	return nil
+}
+
 func (m *AgentRequest) GetSshKeyFile() []byte {
 	if m != nil {
 		return m.SshKeyFile
@@ -530,9 +942,12 @@ func (m *AgentRequest) GetSshKeyFile() []byte {
 }
 
 type AgentResponse struct {
-	Success          *Success `protobuf:"bytes,2,opt,name=success" json:"success,omitempty"`
-	Failure          *Failure `protobuf:"bytes,3,opt,name=failure" json:"failure,omitempty"`
-	XXX_unrecognized []byte   `json:"-"`
+	Success          *Success         `protobuf:"bytes,2,opt,name=success" json:"success,omitempty"`
+	Failure          *Failure         `protobuf:"bytes,3,opt,name=failure" json:"failure,omitempty"`
+	TokenRequest     *MFATokenRequest `protobuf:"bytes,4,opt,name=tokenRequest" json:"tokenRequest,omitempty"`
+	Roles            *RoleList        `protobuf:"bytes,5,opt,name=roles" json:"roles,omitempty"`
+	Identity         *Identity        `protobuf:"bytes,6,opt,name=identity" json:"identity,omitempty"`
+	XXX_unrecognized []byte           `json:"-"`
 }
 
 func (m *AgentResponse) Reset()         { *m = AgentResponse{} }
@@ -553,23 +968,88 @@ func (m *AgentResponse) GetFailure() *Failure {
 	return nil
 }
 
+func (m *AgentResponse) GetTokenRequest() *MFATokenRequest {
+	if m != nil {
+		return m.TokenRequest
+	}
+	return nil
+}
+
+func (m *AgentResponse) GetRoles() *RoleList {
+	if m != nil {
+		return m.Roles
+	}
+	return nil
+}
+
+func (m *AgentResponse) GetIdentity() *Identity {
+	if m != nil {
+		return m.Identity
+	}
+	return nil
+}
+
 type Success struct {
-	XXX_unrecognized []byte `json:"-"`
+	RequestedRole    *string `protobuf:"bytes,1,opt,name=requestedRole" json:"requestedRole,omitempty"`
+	GrantedRole      *string `protobuf:"bytes,2,opt,name=grantedRole" json:"grantedRole,omitempty"`
+	FellBack         *bool   `protobuf:"varint,3,opt,name=fellBack" json:"fellBack,omitempty"`
+	FallbackReason   *string `protobuf:"bytes,4,opt,name=fallbackReason" json:"fallbackReason,omitempty"`
+	Duration         *int64  `protobuf:"varint,5,opt,name=duration" json:"duration,omitempty"`
+	XXX_unrecognized []byte  `json:"-"`
 }
 
 func (m *Success) Reset()         { *m = Success{} }
 func (m *Success) String() string { return proto.CompactTextString(m) }
 func (*Success) ProtoMessage()    {}
 
+func (m *Success) GetRequestedRole() string {
+	if m != nil && m.RequestedRole != nil {
+		return *m.RequestedRole
+	}
+	return ""
+}
+
+func (m *Success) GetGrantedRole() string {
+	if m != nil && m.GrantedRole != nil {
+		return *m.GrantedRole
+	}
+	return ""
+}
+
+func (m *Success) GetFellBack() bool {
+	if m != nil && m.FellBack != nil {
+		return *m.FellBack
+	}
+	return false
+}
+
+func (m *Success) GetFallbackReason() string {
+	if m != nil && m.FallbackReason != nil {
+		return *m.FallbackReason
+	}
+	return ""
+}
+
+func (m *Success) GetDuration() int64 {
+	if m != nil && m.Duration != nil {
+		return *m.Duration
+	}
+	return 0
+}
+
 type Failure struct {
-	ErrorMessage     *string `protobuf:"bytes,1,opt,name=errorMessage" json:"errorMessage,omitempty"`
-	XXX_unrecognized []byte  `json:"-"`
+	ErrorMessage     *string    `protobuf:"bytes,1,opt,name=errorMessage" json:"errorMessage,omitempty"`
+	ErrorCode        *ErrorCode `protobuf:"varint,2,opt,name=errorCode,enum=protocol.ErrorCode,def=0" json:"errorCode,omitempty"`
+	RetryAfter       *int64     `protobuf:"varint,3,opt,name=retryAfter" json:"retryAfter,omitempty"`
+	XXX_unrecognized []byte     `json:"-"`
 }
 
 func (m *Failure) Reset()         { *m = Failure{} }
 func (m *Failure) String() string { return proto.CompactTextString(m) }
 func (*Failure) ProtoMessage()    {}
 
+const Default_Failure_ErrorCode ErrorCode = ErrorCode_UNKNOWN_ERROR
+
 func (m *Failure) GetErrorMessage() string {
 	if m != nil && m.ErrorMessage != nil {
 		return *m.ErrorMessage
@@ -577,7 +1057,22 @@ func (m *Failure) GetErrorMessage() string {
 	return ""
 }
 
+func (m *Failure) GetErrorCode() ErrorCode {
+	if m != nil && m.ErrorCode != nil {
+		return *m.ErrorCode
+	}
+	return Default_Failure_ErrorCode
+}
+
+func (m *Failure) GetRetryAfter() int64 {
+	if m != nil && m.RetryAfter != nil {
+		return *m.RetryAfter
+	}
+	return 0
+}
+
 func init() {
+	proto.RegisterEnum("protocol.ErrorCode", ErrorCode_name, ErrorCode_value)
 	proto.RegisterEnum("protocol.Message_Source", Message_Source_name, Message_Source_value)
 	proto.RegisterEnum("protocol.Ping_RequestResponse", Ping_RequestResponse_name, Ping_RequestResponse_value)
 }
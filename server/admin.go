@@ -0,0 +1,360 @@
+// Copyright 2014 AdRoll, Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package server
+
+import (
+	"encoding/json"
+	"fmt"
+	"net"
+	"net/http"
+	"os"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/AdRoll/hologram/log"
+	"golang.org/x/crypto/ssh"
+)
+
+/*
+UserDirectory is a UserCache whose contents can be listed.
+*/
+type UserDirectory interface {
+	UserCache
+	Users() map[string]*User
+	Groups() map[string]*Group
+}
+
+/*
+ConnectionLister reports the client connections a server has open.
+*/
+type ConnectionLister interface {
+	Connections() []ConnectionInfo
+}
+
+/*
+SyncStatus describes the last refresh of a user cache from its source.
+*/
+type SyncStatus struct {
+	LastAttempt  time.Time `json:"lastAttempt"`
+	LastSuccess  time.Time `json:"lastSuccess"`
+	LastFullSync time.Time `json:"lastFullSync"`
+	Incremental  bool      `json:"incremental"`
+	Duration     string    `json:"duration,omitempty"`
+	LastError    string    `json:"lastError,omitempty"`
+}
+
+// Optional UserDirectory features the admin API uses when available.
+type userUpdater interface {
+	UpdateUser(username string) error
+}
+
+type syncReporter interface {
+	SyncStatus() SyncStatus
+}
+
+type fullSyncer interface {
+	FullSync() error
+}
+
+/*
+AdminUser is a cached user as shown by the admin API.
+*/
+type AdminUser struct {
+	Username    string   `json:"username"`
+	DefaultRole string   `json:"defaultRole,omitempty"`
+	Groups      []string `json:"groups"`
+	Keys        []string `json:"keys"`
+	MFA         bool     `json:"mfa"`
+}
+
+/*
+AdminGroup is a cached group as shown by the admin API.
+*/
+type AdminGroup struct {
+	DN       string   `json:"dn"`
+	ARNs     []string `json:"arns"`
+	Timeout  int64    `json:"timeout"`
+	MemberOf []string `json:"memberOf,omitempty"`
+}
+
+/*
+AdminKey is a cached SSH key as shown by the admin API.
+*/
+type AdminKey struct {
+	Fingerprint string `json:"fingerprint"`
+	Type        string `json:"type"`
+	Username    string `json:"username"`
+}
+
+/*
+adminHandler serves the admin API: a small JSON-over-HTTP interface
+for inspecting and poking a running server, meant to be reached only
+through a local socket.
+*/
+type adminHandler struct {
+	users       UserDirectory
+	connections ConnectionLister
+	deny        *DenyList
+	config      interface{}
+	mux         *http.ServeMux
+}
+
+/*
+NewAdminHandler returns the admin API for users, connections and the
+deny list. config is shown as it is, so secrets must be removed from it
+first.
+*/
+func NewAdminHandler(users UserDirectory, connections ConnectionLister, deny *DenyList, config interface{}) http.Handler {
+	h := &adminHandler{
+		users:       users,
+		connections: connections,
+		deny:        deny,
+		config:      config,
+		mux:         http.NewServeMux(),
+	}
+	h.mux.HandleFunc("/users", h.get(h.listUsers))
+	h.mux.HandleFunc("/users/", h.get(h.getUser))
+	h.mux.HandleFunc("/groups", h.get(h.listGroups))
+	h.mux.HandleFunc("/keys", h.get(h.listKeys))
+	h.mux.HandleFunc("/sync", h.get(h.getSync))
+	h.mux.HandleFunc("/connections", h.get(h.listConnections))
+	h.mux.HandleFunc("/config", h.get(h.getConfig))
+	h.mux.HandleFunc("/reload", h.reload)
+	h.mux.HandleFunc("/reload/", h.reload)
+	h.mux.HandleFunc("/deny", h.editDenyList)
+	return h
+}
+
+func (h *adminHandler) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	h.mux.ServeHTTP(w, r)
+}
+
+/*
+get wraps a handler that returns a value to be sent as JSON, or an HTTP
+status and error.
+*/
+func (h *adminHandler) get(handler func(r *http.Request) (interface{}, int, error)) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		if r.Method != http.MethodGet {
+			http.Error(w, "use GET", http.StatusMethodNotAllowed)
+			return
+		}
+		value, status, err := handler(r)
+		if err != nil {
+			http.Error(w, err.Error(), status)
+			return
+		}
+		writeJSON(w, value)
+	}
+}
+
+func writeJSON(w http.ResponseWriter, value interface{}) {
+	w.Header().Set("Content-Type", "application/json")
+	encoder := json.NewEncoder(w)
+	encoder.SetIndent("", "  ")
+	if err := encoder.Encode(value); err != nil {
+		log.Errorf("Could not write admin response: %s", err.Error())
+	}
+}
+
+func (h *adminHandler) listUsers(r *http.Request) (interface{}, int, error) {
+	users := []AdminUser{}
+	for _, user := range h.users.Users() {
+		users = append(users, adminUser(user))
+	}
+	sort.Slice(users, func(i, j int) bool { return users[i].Username < users[j].Username })
+	return users, http.StatusOK, nil
+}
+
+func (h *adminHandler) getUser(r *http.Request) (interface{}, int, error) {
+	username := strings.TrimPrefix(r.URL.Path, "/users/")
+	user, ok := h.users.Users()[username]
+	if !ok {
+		return nil, http.StatusNotFound, fmt.Errorf("no cached user %q", username)
+	}
+	return adminUser(user), http.StatusOK, nil
+}
+
+func adminUser(user *User) AdminUser {
+	keys := []string{}
+	for _, key := range user.SSHKeys {
+		keys = append(keys, ssh.FingerprintSHA256(key))
+	}
+	groups := append([]string{}, user.MemberOf...)
+	return AdminUser{
+		Username:    user.Username,
+		DefaultRole: user.DefaultRole,
+		Groups:      groups,
+		Keys:        keys,
+		MFA:         user.MFASecret != "",
+	}
+}
+
+func (h *adminHandler) listGroups(r *http.Request) (interface{}, int, error) {
+	groups := []AdminGroup{}
+	for dn, group := range h.users.Groups() {
+		if group == nil {
+			continue
+		}
+		groups = append(groups, AdminGroup{DN: dn, ARNs: group.ARNs, Timeout: group.Timeout, MemberOf: group.MemberOf})
+	}
+	sort.Slice(groups, func(i, j int) bool { return groups[i].DN < groups[j].DN })
+	return groups, http.StatusOK, nil
+}
+
+func (h *adminHandler) listKeys(r *http.Request) (interface{}, int, error) {
+	keys := []AdminKey{}
+	for _, user := range h.users.Users() {
+		for _, key := range user.SSHKeys {
+			keys = append(keys, AdminKey{
+				Fingerprint: ssh.FingerprintSHA256(key),
+				Type:        key.Type(),
+				Username:    user.Username,
+			})
+		}
+	}
+	sort.Slice(keys, func(i, j int) bool {
+		if keys[i].Username != keys[j].Username {
+			return keys[i].Username < keys[j].Username
+		}
+		return keys[i].Fingerprint < keys[j].Fingerprint
+	})
+	return keys, http.StatusOK, nil
+}
+
+func (h *adminHandler) getSync(r *http.Request) (interface{}, int, error) {
+	reporter, ok := h.users.(syncReporter)
+	if !ok {
+		return nil, http.StatusNotImplemented, fmt.Errorf("this user cache does not report its sync status")
+	}
+	return reporter.SyncStatus(), http.StatusOK, nil
+}
+
+func (h *adminHandler) listConnections(r *http.Request) (interface{}, int, error) {
+	return h.connections.Connections(), http.StatusOK, nil
+}
+
+func (h *adminHandler) getConfig(r *http.Request) (interface{}, int, error) {
+	return h.config, http.StatusOK, nil
+}
+
+/*
+reload refreshes every user from the directory, or with a username in
+the path, just that one.
+*/
+func (h *adminHandler) reload(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost {
+		http.Error(w, "use POST", http.StatusMethodNotAllowed)
+		return
+	}
+
+	username := strings.TrimPrefix(strings.TrimPrefix(r.URL.Path, "/reload"), "/")
+	var err error
+	if syncer, ok := h.users.(fullSyncer); ok && username == "" {
+		log.Info("Fully reloading user cache at admin request.")
+		err = syncer.FullSync()
+	} else if username == "" {
+		log.Info("Reloading user cache at admin request.")
+		err = h.users.Update()
+	} else if updater, ok := h.users.(userUpdater); ok {
+		log.Info("Reloading user %s at admin request.", username)
+		err = updater.UpdateUser(username)
+	} else {
+		http.Error(w, "this user cache can only be reloaded as a whole", http.StatusNotImplemented)
+		return
+	}
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadGateway)
+		return
+	}
+
+	if username == "" {
+		var status interface{} = struct{}{}
+		if reporter, ok := h.users.(syncReporter); ok {
+			status = reporter.SyncStatus()
+		}
+		writeJSON(w, status)
+		return
+	}
+	user, ok := h.users.Users()[username]
+	if !ok {
+		http.Error(w, fmt.Sprintf("no user %q after reload", username), http.StatusNotFound)
+		return
+	}
+	writeJSON(w, adminUser(user))
+}
+
+/*
+editDenyList shows the deny list, or with POST or DELETE, adds or
+removes the entries given as user, key and role query parameters.
+*/
+func (h *adminHandler) editDenyList(w http.ResponseWriter, r *http.Request) {
+	var edit func(kind string, value string) error
+	switch r.Method {
+	case http.MethodGet:
+	case http.MethodPost:
+		edit = h.deny.Add
+	case http.MethodDelete:
+		edit = h.deny.Remove
+	default:
+		http.Error(w, "use GET, POST or DELETE", http.StatusMethodNotAllowed)
+		return
+	}
+
+	if edit != nil {
+		query := r.URL.Query()
+		if len(query) == 0 {
+			http.Error(w, "give a user, key or role", http.StatusBadRequest)
+			return
+		}
+		for kind, values := range query {
+			for _, value := range values {
+				if err := edit(kind, value); err != nil {
+					http.Error(w, err.Error(), http.StatusBadRequest)
+					return
+				}
+				log.Warning("Admin request: %s %s %s on the deny list", r.Method, kind, value)
+			}
+		}
+	}
+	writeJSON(w, h.deny.Entries())
+}
+
+/*
+ListenAdmin serves handler on a UNIX socket at path that only the
+server's own user can connect to. A socket left behind by an earlier
+run is removed first.
+*/
+func ListenAdmin(path string, handler http.Handler) (net.Listener, error) {
+	if err := os.Remove(path); err != nil && !os.IsNotExist(err) {
+		return nil, err
+	}
+	listener, err := net.Listen("unix", path)
+	if err != nil {
+		return nil, err
+	}
+	if err := os.Chmod(path, 0600); err != nil {
+		listener.Close()
+		return nil, err
+	}
+
+	go func() {
+		if err := http.Serve(listener, handler); err != nil && !strings.HasSuffix(err.Error(), "use of closed network connection") {
+			log.Errorf("Admin API stopped: %s", err.Error())
+		}
+	}()
+	return listener, nil
+}
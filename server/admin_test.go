@@ -0,0 +1,159 @@
+// Copyright 2014 AdRoll, Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package server_test
+
+import (
+	"encoding/json"
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/AdRoll/hologram/server"
+	. "github.com/smartystreets/goconvey/convey"
+	"golang.org/x/crypto/ssh"
+)
+
+/*
+stubDirectory is a user cache with fixed contents that remembers what
+it was asked to reload.
+*/
+type stubDirectory struct {
+	DummyAuthenticator
+	users     map[string]*server.User
+	groups    map[string]*server.Group
+	reloaded  []string
+	updateErr error
+}
+
+func (d *stubDirectory) Users() map[string]*server.User   { return d.users }
+func (d *stubDirectory) Groups() map[string]*server.Group { return d.groups }
+
+func (d *stubDirectory) Update() error {
+	d.reloaded = append(d.reloaded, "*")
+	return d.updateErr
+}
+
+func (d *stubDirectory) UpdateUser(username string) error {
+	d.reloaded = append(d.reloaded, username)
+	return d.updateErr
+}
+
+func (d *stubDirectory) SyncStatus() server.SyncStatus {
+	status := server.SyncStatus{LastAttempt: time.Unix(1700000000, 0)}
+	if d.updateErr != nil {
+		status.LastError = d.updateErr.Error()
+	}
+	return status
+}
+
+type stubConnections []server.ConnectionInfo
+
+func (c stubConnections) Connections() []server.ConnectionInfo { return c }
+
+func TestAdminAPI(t *testing.T) {
+	Convey("Given the admin API over a user cache", t, func() {
+		signer, err := ssh.ParsePrivateKey(testKeys[0])
+		So(err, ShouldBeNil)
+		directory := &stubDirectory{
+			users: map[string]*server.User{
+				"bob":   {Username: "bob"},
+				"alice": {Username: "alice", DefaultRole: "developer", SSHKeys: []ssh.PublicKey{signer.PublicKey()}, MemberOf: []string{"cn=devs"}, MFASecret: "JBSWY3DP"},
+			},
+			groups: map[string]*server.Group{"cn=devs": {ARNs: []string{"arn:aws:iam::123456:role/developer"}, Timeout: 3600}},
+		}
+		connections := stubConnections{{RemoteAddr: "10.0.0.1:5555", Request: "AssumeRole", User: "alice"}}
+		config := map[string]string{"password": "REDACTED"}
+		deny, err := server.NewDenyList("", false)
+		So(err, ShouldBeNil)
+		admin := server.NewAdminHandler(directory, connections, deny, config)
+
+		// call makes a request and decodes the JSON response into value.
+		call := func(method string, path string, value interface{}) int {
+			w := httptest.NewRecorder()
+			admin.ServeHTTP(w, httptest.NewRequest(method, path, nil))
+			if w.Code == http.StatusOK && value != nil {
+				So(json.Unmarshal(w.Body.Bytes(), value), ShouldBeNil)
+			}
+			return w.Code
+		}
+
+		Convey("Users should be listed in order with their key fingerprints", func() {
+			var users []server.AdminUser
+			So(call("GET", "/users", &users), ShouldEqual, http.StatusOK)
+			So(len(users), ShouldEqual, 2)
+			So(users[0].Username, ShouldEqual, "alice")
+			So(users[0].Keys, ShouldResemble, []string{ssh.FingerprintSHA256(signer.PublicKey())})
+			So(users[0].MFA, ShouldBeTrue)
+			So(users[1].Keys, ShouldBeEmpty)
+		})
+
+		Convey("A single user can be shown, and an unknown one is not found", func() {
+			var user server.AdminUser
+			So(call("GET", "/users/alice", &user), ShouldEqual, http.StatusOK)
+			So(user.Groups, ShouldResemble, []string{"cn=devs"})
+			So(call("GET", "/users/carol", nil), ShouldEqual, http.StatusNotFound)
+		})
+
+		Convey("Groups and keys should be listed", func() {
+			var groups []server.AdminGroup
+			So(call("GET", "/groups", &groups), ShouldEqual, http.StatusOK)
+			So(groups, ShouldResemble, []server.AdminGroup{{DN: "cn=devs", ARNs: []string{"arn:aws:iam::123456:role/developer"}, Timeout: 3600}})
+
+			var keys []server.AdminKey
+			So(call("GET", "/keys", &keys), ShouldEqual, http.StatusOK)
+			So(keys, ShouldResemble, []server.AdminKey{{Fingerprint: ssh.FingerprintSHA256(signer.PublicKey()), Type: "ssh-rsa", Username: "alice"}})
+		})
+
+		Convey("Reloads should go to the cache and need POST", func() {
+			So(call("GET", "/reload", nil), ShouldEqual, http.StatusMethodNotAllowed)
+			So(call("POST", "/reload", nil), ShouldEqual, http.StatusOK)
+			So(call("POST", "/reload/alice", nil), ShouldEqual, http.StatusOK)
+			So(directory.reloaded, ShouldResemble, []string{"*", "alice"})
+		})
+
+		Convey("A failed reload should be reported, as should the sync error", func() {
+			directory.updateErr = errors.New("LDAP Result Code 200")
+			So(call("POST", "/reload", nil), ShouldEqual, http.StatusBadGateway)
+
+			var status server.SyncStatus
+			So(call("GET", "/sync", &status), ShouldEqual, http.StatusOK)
+			So(status.LastError, ShouldEqual, "LDAP Result Code 200")
+		})
+
+		Convey("The deny list should be editable", func() {
+			var entries server.DenyEntries
+			So(call("POST", "/deny?user=alice&role=arn:aws:iam::123456:role/admin", &entries), ShouldEqual, http.StatusOK)
+			So(entries.Users, ShouldResemble, []string{"alice"})
+			So(entries.Roles, ShouldResemble, []string{"arn:aws:iam::123456:role/admin"})
+
+			So(call("DELETE", "/deny?user=alice", &entries), ShouldEqual, http.StatusOK)
+			So(entries.Users, ShouldBeEmpty)
+			So(call("POST", "/deny?key=not-a-fingerprint", nil), ShouldEqual, http.StatusBadRequest)
+			So(call("POST", "/deny", nil), ShouldEqual, http.StatusBadRequest)
+		})
+
+		Convey("Connections and config should be shown as given", func() {
+			var open []server.ConnectionInfo
+			So(call("GET", "/connections", &open), ShouldEqual, http.StatusOK)
+			So(open[0].User, ShouldEqual, "alice")
+
+			var shown map[string]string
+			So(call("GET", "/config", &shown), ShouldEqual, http.StatusOK)
+			So(shown, ShouldResemble, config)
+		})
+	})
+}
@@ -0,0 +1,193 @@
+// Copyright 2014 AdRoll, Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package server
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"log/syslog"
+	"net/http"
+	"os"
+	"sync"
+	"time"
+)
+
+// Outcomes recorded on audit events.
+const (
+	AuditSuccess   = "success"
+	AuditFailure   = "failure"
+	AuditFallback  = "fallback"
+	AuditUnchanged = "unchanged"
+)
+
+/*
+AuditEvent is a single structured record of something a client asked the
+server to do, and what came of it.
+*/
+type AuditEvent struct {
+	Time           time.Time  `json:"time"`
+	Action         string     `json:"action"`
+	Username       string     `json:"username,omitempty"`
+	KeyFingerprint string     `json:"keyFingerprint,omitempty"`
+	RequestedRole  string     `json:"requestedRole,omitempty"`
+	GrantedRole    string     `json:"grantedRole,omitempty"`
+	GrantedBy      []string   `json:"grantedBy,omitempty"`
+	Outcome        string     `json:"outcome"`
+	Error          string     `json:"error,omitempty"`
+	RemoteAddr     string     `json:"remoteAddr,omitempty"`
+	Expiration     *time.Time `json:"expiration,omitempty"`
+	MFA            bool       `json:"mfa,omitempty"`
+	Preset         string     `json:"preset,omitempty"`
+	SessionPolicy  string     `json:"sessionPolicy,omitempty"`
+	PolicyARNs     []string   `json:"policyArns,omitempty"`
+}
+
+/*
+AuditSink implementers persist audit events somewhere durable.
+*/
+type AuditSink interface {
+	Record(event *AuditEvent) error
+}
+
+type noopAuditSink struct{}
+
+func (noopAuditSink) Record(*AuditEvent) error { return nil }
+
+/*
+NoopAuditSink returns a sink that discards every event.
+*/
+func NoopAuditSink() AuditSink {
+	return noopAuditSink{}
+}
+
+/*
+multiAuditSink fans each event out to several sinks.
+*/
+type multiAuditSink []AuditSink
+
+/*
+NewMultiAuditSink returns a sink that records every event to all of the
+given sinks, reporting the first error encountered.
+*/
+func NewMultiAuditSink(sinks ...AuditSink) AuditSink {
+	return multiAuditSink(sinks)
+}
+
+func (ms multiAuditSink) Record(event *AuditEvent) error {
+	var firstErr error
+	for _, sink := range ms {
+		if err := sink.Record(event); err != nil && firstErr == nil {
+			firstErr = err
+		}
+	}
+	return firstErr
+}
+
+/*
+fileAuditSink appends one JSON document per line to a local file.
+*/
+type fileAuditSink struct {
+	sync.Mutex
+	file *os.File
+}
+
+/*
+NewFileAuditSink opens path for appending, creating it if needed.
+*/
+func NewFileAuditSink(path string) (*fileAuditSink, error) {
+	f, err := os.OpenFile(path, os.O_WRONLY|os.O_APPEND|os.O_CREATE, 0600)
+	if err != nil {
+		return nil, err
+	}
+	return &fileAuditSink{file: f}, nil
+}
+
+func (fs *fileAuditSink) Record(event *AuditEvent) error {
+	line, err := json.Marshal(event)
+	if err != nil {
+		return err
+	}
+
+	fs.Lock()
+	defer fs.Unlock()
+	_, err = fs.file.Write(append(line, '\n'))
+	return err
+}
+
+/*
+syslogAuditSink sends events to the local syslog daemon under the auth
+facility, kept apart from Hologram's regular log output.
+*/
+type syslogAuditSink struct {
+	writer *syslog.Writer
+}
+
+/*
+NewSyslogAuditSink connects to the local syslog daemon.
+*/
+func NewSyslogAuditSink() (*syslogAuditSink, error) {
+	w, err := syslog.New(syslog.LOG_AUTH|syslog.LOG_INFO, "hologram-audit")
+	if err != nil {
+		return nil, err
+	}
+	return &syslogAuditSink{writer: w}, nil
+}
+
+func (ss *syslogAuditSink) Record(event *AuditEvent) error {
+	line, err := json.Marshal(event)
+	if err != nil {
+		return err
+	}
+	return ss.writer.Info(string(line))
+}
+
+/*
+httpAuditSink POSTs each event as JSON to a collector, typically one
+listening on localhost.
+*/
+type httpAuditSink struct {
+	url    string
+	client *http.Client
+}
+
+/*
+NewHTTPAuditSink returns a sink that delivers events to url, giving up
+on any one event after timeout.
+*/
+func NewHTTPAuditSink(url string, timeout time.Duration) *httpAuditSink {
+	return &httpAuditSink{
+		url:    url,
+		client: &http.Client{Timeout: timeout},
+	}
+}
+
+func (hs *httpAuditSink) Record(event *AuditEvent) error {
+	body, err := json.Marshal(event)
+	if err != nil {
+		return err
+	}
+
+	resp, err := hs.client.Post(hs.url, "application/json", bytes.NewReader(body))
+	if err != nil {
+		return err
+	}
+	resp.Body.Close()
+
+	if resp.StatusCode < 200 || resp.StatusCode > 299 {
+		return fmt.Errorf("audit collector returned %s", resp.Status)
+	}
+	return nil
+}
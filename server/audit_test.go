@@ -0,0 +1,87 @@
+// Copyright 2014 AdRoll, Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package server_test
+
+import (
+	"encoding/json"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/AdRoll/hologram/server"
+	. "github.com/smartystreets/goconvey/convey"
+)
+
+func TestAuditSinks(t *testing.T) {
+	event := &server.AuditEvent{
+		Time:          time.Now().UTC(),
+		Action:        "AssumeRole",
+		Username:      "alice",
+		RequestedRole: "prod/admin",
+		GrantedRole:   "arn:aws:iam::5432:role/admin",
+		Outcome:       server.AuditSuccess,
+		RemoteAddr:    "10.0.0.1:5555",
+	}
+
+	Convey("A file sink should append one JSON event per line", t, func() {
+		dir, err := ioutil.TempDir("", "hologram-audit")
+		So(err, ShouldBeNil)
+		defer os.RemoveAll(dir)
+		path := filepath.Join(dir, "audit.log")
+
+		sink, err := server.NewFileAuditSink(path)
+		So(err, ShouldBeNil)
+		So(sink.Record(event), ShouldBeNil)
+		So(sink.Record(event), ShouldBeNil)
+
+		contents, err := ioutil.ReadFile(path)
+		So(err, ShouldBeNil)
+		lines := strings.Split(strings.TrimSpace(string(contents)), "\n")
+		So(len(lines), ShouldEqual, 2)
+
+		decoded := &server.AuditEvent{}
+		So(json.Unmarshal([]byte(lines[1]), decoded), ShouldBeNil)
+		So(decoded.Username, ShouldEqual, "alice")
+		So(decoded.GrantedRole, ShouldEqual, "arn:aws:iam::5432:role/admin")
+	})
+
+	Convey("An HTTP sink should post events to the collector", t, func() {
+		received := make(chan *server.AuditEvent, 1)
+		collector := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			decoded := &server.AuditEvent{}
+			json.NewDecoder(r.Body).Decode(decoded)
+			received <- decoded
+		}))
+		defer collector.Close()
+
+		sink := server.NewHTTPAuditSink(collector.URL, time.Second)
+		So(sink.Record(event), ShouldBeNil)
+		So((<-received).RemoteAddr, ShouldEqual, "10.0.0.1:5555")
+
+		Convey("and report collector errors", func() {
+			failing := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+				http.Error(w, "nope", http.StatusInternalServerError)
+			}))
+			defer failing.Close()
+
+			So(server.NewHTTPAuditSink(failing.URL, time.Second).Record(event), ShouldNotBeNil)
+		})
+	})
+}
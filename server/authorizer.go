@@ -0,0 +1,144 @@
+// Copyright 2014 AdRoll, Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package server
+
+import (
+	"fmt"
+
+	"github.com/AdRoll/hologram/log"
+)
+
+// Session length used when nothing more specific has been configured.
+const defaultSessionDuration = int64(3600)
+
+// The shortest and longest sessions STS will issue for a role.
+const (
+	minSessionDuration = int64(900)
+	maxSessionDuration = int64(43200)
+)
+
+/*
+Grant is the outcome of a successful authorization decision: the fully
+expanded role ARN a user may assume and for how long.
+*/
+type Grant struct {
+	ARN      string
+	Duration int64
+	// SessionPolicy, if set, narrows the session below what the role
+	// allows.
+	SessionPolicy *SessionPolicy
+	// GrantedBy is the chain of LDAP group DNs through which the role
+	// was granted, from a group the user belongs to directly to the
+	// group carrying the role.
+	GrantedBy []string
+}
+
+/*
+clampDuration returns how long a session should last when a client asks
+for requested seconds and its grant allows up to max. Zero asks for the
+longest allowed. The result always lies within what STS accepts.
+*/
+func clampDuration(requested int64, max int64) int64 {
+	duration := max
+	if requested > 0 && requested < max {
+		duration = requested
+	}
+	if duration < minSessionDuration {
+		duration = minSessionDuration
+	}
+	if duration > maxSessionDuration {
+		duration = maxSessionDuration
+	}
+	return duration
+}
+
+/*
+RoleAuthorizer implementers decide whether an authenticated user may
+assume a role. The server consults its RoleAuthorizer before any call
+is made to STS.
+*/
+type RoleAuthorizer interface {
+	Authorize(user *User, role string) (*Grant, error)
+}
+
+/*
+allowAllAuthorizer lets any authenticated user assume any role. This is
+how Hologram behaves when neither LDAP roles nor a policy file are used.
+*/
+type allowAllAuthorizer struct {
+	iamAccount     string
+	accountAliases *map[string]string
+}
+
+/*
+NewAllowAllAuthorizer returns an authorizer that grants every request.
+*/
+func NewAllowAllAuthorizer(iamAccount string, accountAliases *map[string]string) *allowAllAuthorizer {
+	return &allowAllAuthorizer{iamAccount: iamAccount, accountAliases: accountAliases}
+}
+
+func (a *allowAllAuthorizer) Authorize(user *User, role string) (*Grant, error) {
+	return &Grant{
+		ARN:      BuildARN(role, a.iamAccount, a.accountAliases),
+		Duration: defaultSessionDuration,
+	}, nil
+}
+
+/*
+ldapGroupAuthorizer grants the roles listed on the LDAP groups a user
+belongs to. Group role values may be glob patterns; when more than one
+matches, the timeout of the group with the most specific pattern is
+used as the session duration.
+*/
+type ldapGroupAuthorizer struct {
+	iamAccount     string
+	accountAliases *map[string]string
+}
+
+/*
+NewLDAPGroupAuthorizer returns an authorizer backed by the role
+attributes of the user's cached LDAP groups.
+*/
+func NewLDAPGroupAuthorizer(iamAccount string, accountAliases *map[string]string) *ldapGroupAuthorizer {
+	return &ldapGroupAuthorizer{iamAccount: iamAccount, accountAliases: accountAliases}
+}
+
+func (a *ldapGroupAuthorizer) Authorize(user *User, role string) (*Grant, error) {
+	var arn = BuildARN(role, a.iamAccount, a.accountAliases)
+
+	log.Debug("Checking ARN %s against groups of user %s", arn, user.Username)
+
+	var grant *Grant
+	var bestPattern string
+	for _, group := range user.Groups {
+		for _, groupRole := range group.ARNs {
+			for _, pattern := range expandRolePattern(groupRole, a.iamAccount, a.accountAliases) {
+				if !globMatch(pattern, arn) {
+					continue
+				}
+				if grant == nil || moreSpecific(pattern, bestPattern) {
+					grant = &Grant{ARN: arn, Duration: group.Timeout, GrantedBy: user.GroupChains[group.DN]}
+					bestPattern = pattern
+				}
+			}
+		}
+	}
+
+	if grant == nil {
+		return nil, fmt.Errorf("User %s is not authorized to assume role %s!", user.Username, arn)
+	}
+	log.Debug("Role %s granted to %s through pattern %s on groups %q", arn, user.Username, bestPattern, grant.GrantedBy)
+	return grant, nil
+}
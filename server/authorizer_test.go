@@ -0,0 +1,232 @@
+// Copyright 2014 AdRoll, Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package server_test
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/AdRoll/hologram/server"
+	. "github.com/smartystreets/goconvey/convey"
+)
+
+const testPolicyYAML = `
+rules:
+  - users: ["alice"]
+    roles: ["prod/readonly-*"]
+    maxduration: 900
+  - groups: ["cn=admins,dc=example,dc=com"]
+    roles: ["arn:aws:iam::*:role/admin"]
+    maxduration: 7200
+  - users: ["*"]
+    roles: ["developer"]
+  - users: ["mallory"]
+    roles: ["*"]
+    effect: deny
+`
+
+const testPolicyJSON = `{
+  "rules": [
+    {"users": ["alice"], "roles": ["developer"], "maxduration": 1800}
+  ]
+}`
+
+func writePolicy(t *testing.T, name string, contents string) string {
+	dir, err := ioutil.TempDir("", "hologram-policy")
+	if err != nil {
+		t.Fatal(err)
+	}
+	path := filepath.Join(dir, name)
+	if err := ioutil.WriteFile(path, []byte(contents), 0600); err != nil {
+		t.Fatal(err)
+	}
+	return path
+}
+
+func TestLDAPGroupAuthorizer(t *testing.T) {
+	aliases := map[string]string{"prod": "arn:aws:iam::5432"}
+	authorizer := server.NewLDAPGroupAuthorizer("99999", &aliases)
+
+	Convey("Given a user in a group granting two roles", t, func() {
+		user := &server.User{
+			Username: "alice",
+			Groups: []*server.Group{
+				{ARNs: []string{"developer", "prod/readonly"}, Timeout: 1200},
+			},
+		}
+
+		Convey("A listed role should be granted with the group timeout", func() {
+			grant, err := authorizer.Authorize(user, "developer")
+			So(err, ShouldBeNil)
+			So(grant.ARN, ShouldEqual, "arn:aws:iam::99999:role/developer")
+			So(grant.Duration, ShouldEqual, 1200)
+		})
+
+		Convey("Aliases should be expanded on both sides", func() {
+			grant, err := authorizer.Authorize(user, "arn:aws:iam::5432:role/readonly")
+			So(err, ShouldBeNil)
+			So(grant.ARN, ShouldEqual, "arn:aws:iam::5432:role/readonly")
+		})
+
+		Convey("An unlisted role should be refused", func() {
+			grant, err := authorizer.Authorize(user, "admin")
+			So(err, ShouldNotBeNil)
+			So(grant, ShouldBeNil)
+		})
+
+		Convey("The granted roles should be listed by alias, marking the default", func() {
+			user.DefaultRole = "developer"
+			roles := authorizer.ListRoles(user)
+			So(roles, ShouldResemble, []server.RoleInfo{
+				{Alias: "developer", ARN: "arn:aws:iam::99999:role/developer", MaxDuration: 1200, Default: true},
+				{Alias: "prod/readonly", ARN: "arn:aws:iam::5432:role/readonly", MaxDuration: 1200},
+			})
+		})
+	})
+
+	Convey("Given groups whose role attributes are patterns", t, func() {
+		aliases := map[string]string{
+			"prod":    "arn:aws:iam::5432",
+			"eu-prod": "arn:aws:iam::6543",
+			"dev":     "arn:aws:iam::7654",
+		}
+		authorizer := server.NewLDAPGroupAuthorizer("99999", &aliases)
+		user := &server.User{
+			Username: "alice",
+			Groups: []*server.Group{
+				{ARNs: []string{"prod/*"}, Timeout: 900},
+				{ARNs: []string{"arn:aws:iam::5432:role/readonly-*"}, Timeout: 1800},
+				{ARNs: []string{"prod/readonly-billing"}, Timeout: 2700},
+				{ARNs: []string{"*prod/auditor"}, Timeout: 600},
+			},
+		}
+
+		Convey("An alias wildcard should match every role in that account", func() {
+			grant, err := authorizer.Authorize(user, "prod/admin")
+			So(err, ShouldBeNil)
+			So(grant.ARN, ShouldEqual, "arn:aws:iam::5432:role/admin")
+			So(grant.Duration, ShouldEqual, 900)
+
+			_, err = authorizer.Authorize(user, "dev/admin")
+			So(err, ShouldNotBeNil)
+		})
+
+		Convey("The most specific pattern should decide the timeout", func() {
+			grant, err := authorizer.Authorize(user, "prod/readonly-logs")
+			So(err, ShouldBeNil)
+			So(grant.Duration, ShouldEqual, 1800)
+		})
+
+		Convey("An exact role should beat any pattern", func() {
+			grant, err := authorizer.Authorize(user, "prod/readonly-billing")
+			So(err, ShouldBeNil)
+			So(grant.Duration, ShouldEqual, 2700)
+		})
+
+		Convey("Wildcards in the alias should match every matching account", func() {
+			grant, err := authorizer.Authorize(user, "eu-prod/auditor")
+			So(err, ShouldBeNil)
+			So(grant.ARN, ShouldEqual, "arn:aws:iam::6543:role/auditor")
+			So(grant.Duration, ShouldEqual, 600)
+
+			_, err = authorizer.Authorize(user, "dev/auditor")
+			So(err, ShouldNotBeNil)
+		})
+	})
+}
+
+func TestPolicyFileAuthorizer(t *testing.T) {
+	aliases := map[string]string{"prod": "arn:aws:iam::5432"}
+
+	Convey("Given a YAML policy file", t, func() {
+		path := writePolicy(t, "policy.yaml", testPolicyYAML)
+		defer os.RemoveAll(filepath.Dir(path))
+
+		authorizer, err := server.NewPolicyFileAuthorizer(path, "99999", &aliases)
+		So(err, ShouldBeNil)
+
+		alice := &server.User{Username: "alice"}
+		admin := &server.User{Username: "bob", MemberOf: []string{"CN=admins,DC=example,DC=com"}}
+		mallory := &server.User{Username: "mallory"}
+
+		Convey("User rules should match role patterns after alias expansion", func() {
+			grant, err := authorizer.Authorize(alice, "prod/readonly-billing")
+			So(err, ShouldBeNil)
+			So(grant.ARN, ShouldEqual, "arn:aws:iam::5432:role/readonly-billing")
+			So(grant.Duration, ShouldEqual, 900)
+		})
+
+		Convey("Group rules should match the user's group DNs", func() {
+			grant, err := authorizer.Authorize(admin, "prod/admin")
+			So(err, ShouldBeNil)
+			So(grant.Duration, ShouldEqual, 7200)
+
+			_, err = authorizer.Authorize(alice, "prod/admin")
+			So(err, ShouldNotBeNil)
+		})
+
+		Convey("Rules without a max duration should use the default", func() {
+			grant, err := authorizer.Authorize(alice, "developer")
+			So(err, ShouldBeNil)
+			So(grant.Duration, ShouldEqual, 3600)
+		})
+
+		Convey("An explicit deny should override any allow", func() {
+			_, err := authorizer.Authorize(mallory, "developer")
+			So(err, ShouldNotBeNil)
+		})
+
+		Convey("Listing roles should show each allowed pattern with its max duration", func() {
+			roles := authorizer.ListRoles(alice)
+			So(roles, ShouldResemble, []server.RoleInfo{
+				{Alias: "developer", ARN: "arn:aws:iam::99999:role/developer", MaxDuration: 3600},
+				{Alias: "prod/readonly-*", ARN: "arn:aws:iam::5432:role/readonly-*", MaxDuration: 900},
+			})
+			So(authorizer.ListRoles(mallory), ShouldBeEmpty)
+		})
+
+		Convey("Reloading should pick up changes to the file", func() {
+			err := ioutil.WriteFile(path, []byte("rules: []\n"), 0600)
+			So(err, ShouldBeNil)
+			So(authorizer.Reload(), ShouldBeNil)
+
+			_, err = authorizer.Authorize(alice, "developer")
+			So(err, ShouldNotBeNil)
+		})
+
+		Convey("A broken file should leave the previous rules in place", func() {
+			err := ioutil.WriteFile(path, []byte("rules: [{effect: maybe, roles: [x]}]\n"), 0600)
+			So(err, ShouldBeNil)
+			So(authorizer.Reload(), ShouldNotBeNil)
+
+			_, err = authorizer.Authorize(alice, "developer")
+			So(err, ShouldBeNil)
+		})
+	})
+
+	Convey("Given a JSON policy file", t, func() {
+		path := writePolicy(t, "policy.json", testPolicyJSON)
+		defer os.RemoveAll(filepath.Dir(path))
+
+		authorizer, err := server.NewPolicyFileAuthorizer(path, "99999", &aliases)
+		So(err, ShouldBeNil)
+
+		grant, err := authorizer.Authorize(&server.User{Username: "alice"}, "developer")
+		So(err, ShouldBeNil)
+		So(grant.Duration, ShouldEqual, 1800)
+	})
+}
@@ -0,0 +1,246 @@
+// Copyright 2014 AdRoll, Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package server
+
+import (
+	"bufio"
+	"bytes"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/AdRoll/hologram/log"
+	"github.com/peterbourgon/g2s"
+	"golang.org/x/crypto/ssh"
+)
+
+/*
+CertUserCache implementers can look a single user up by name, which is
+how certificate principals are mapped to users.
+*/
+type CertUserCache interface {
+	UserCache
+	Lookup(username string) *User
+}
+
+/*
+certAuthenticator accepts OpenSSH user certificates signed by one of a
+set of trusted CAs, and passes everything else on to the user cache.
+*/
+type certAuthenticator struct {
+	CertUserCache
+	sync.RWMutex
+	authoritiesPath string
+	revokedPath     string
+	authorities     [][]byte
+	revoked         *revocationList
+	stats           g2s.Statter
+	now             func() time.Time
+}
+
+/*
+revocationList holds the certificates that must no longer be accepted,
+by serial, key ID or the fingerprint of the certified key.
+*/
+type revocationList struct {
+	serials      map[uint64]bool
+	keyIDs       map[string]bool
+	fingerprints map[string]bool
+}
+
+/*
+NewCertAuthenticator wraps a user cache so that it also accepts user
+certificates. authoritiesPath holds the trusted CA public keys in
+authorized_keys format; revokedPath, which may be empty, lists revoked
+certificates one per line as a serial number, "id:" followed by a key
+ID, or a SHA256 fingerprint of the certified key.
+*/
+func NewCertAuthenticator(cache CertUserCache, authoritiesPath string, revokedPath string, stats g2s.Statter) (*certAuthenticator, error) {
+	ca := &certAuthenticator{
+		CertUserCache:   cache,
+		authoritiesPath: authoritiesPath,
+		revokedPath:     revokedPath,
+		stats:           stats,
+		now:             time.Now,
+	}
+	return ca, ca.Reload()
+}
+
+/*
+Reload re-reads the trusted CAs and the revocation list. The previous
+ones stay in effect if either cannot be read.
+*/
+func (ca *certAuthenticator) Reload() error {
+	contents, err := ioutil.ReadFile(ca.authoritiesPath)
+	if err != nil {
+		return err
+	}
+
+	authorities := [][]byte{}
+	for rest := bytes.TrimSpace(contents); len(rest) > 0; {
+		var key ssh.PublicKey
+		key, _, _, rest, err = ssh.ParseAuthorizedKey(rest)
+		if err != nil {
+			return fmt.Errorf("could not parse CA keys in %s: %s", ca.authoritiesPath, err)
+		}
+		authorities = append(authorities, key.Marshal())
+	}
+	if len(authorities) == 0 {
+		return fmt.Errorf("no CA keys found in %s", ca.authoritiesPath)
+	}
+
+	revoked := newRevocationList()
+	if ca.revokedPath != "" {
+		if revoked, err = readRevocationList(ca.revokedPath); err != nil {
+			return err
+		}
+	}
+
+	ca.Lock()
+	ca.authorities = authorities
+	ca.revoked = revoked
+	ca.Unlock()
+
+	log.Debug("Loaded %d certificate authorities from %s.", len(authorities), ca.authoritiesPath)
+	return nil
+}
+
+func newRevocationList() *revocationList {
+	return &revocationList{
+		serials:      map[uint64]bool{},
+		keyIDs:       map[string]bool{},
+		fingerprints: map[string]bool{},
+	}
+}
+
+func readRevocationList(path string) (*revocationList, error) {
+	contents, err := ioutil.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+
+	revoked := newRevocationList()
+	scanner := bufio.NewScanner(bytes.NewReader(contents))
+	for scanner.Scan() {
+		line := strings.TrimSpace(scanner.Text())
+		switch {
+		case line == "" || strings.HasPrefix(line, "#"):
+		case strings.HasPrefix(line, "id:"):
+			revoked.keyIDs[strings.TrimPrefix(line, "id:")] = true
+		case strings.HasPrefix(line, "SHA256:"):
+			revoked.fingerprints[line] = true
+		default:
+			serial, err := strconv.ParseUint(line, 10, 64)
+			if err != nil {
+				return nil, fmt.Errorf("could not parse revocation entry %q in %s", line, path)
+			}
+			revoked.serials[serial] = true
+		}
+	}
+	return revoked, scanner.Err()
+}
+
+func (r *revocationList) isRevoked(cert *ssh.Certificate) bool {
+	return r.serials[cert.Serial] || r.keyIDs[cert.KeyId] || r.fingerprints[ssh.FingerprintSHA256(cert.Key)]
+}
+
+func (ca *certAuthenticator) isAuthority(key ssh.PublicKey) bool {
+	marshaled := key.Marshal()
+	for _, authority := range ca.authorities {
+		if bytes.Equal(authority, marshaled) {
+			return true
+		}
+	}
+	return false
+}
+
+/*
+Authenticate handles certificates itself and leaves plain keys to the
+wrapped user cache.
+*/
+func (ca *certAuthenticator) Authenticate(username string, key ssh.PublicKey, challenge []byte, sig *ssh.Signature) (
+	*User, ssh.PublicKey, error) {
+	cert, ok := key.(*ssh.Certificate)
+	if !ok {
+		return ca.CertUserCache.Authenticate(username, key, challenge, sig)
+	}
+
+	user, err := ca.checkCertificate(username, cert)
+	if err != nil {
+		log.Warning("Rejecting certificate %q (serial %d): %s", cert.KeyId, cert.Serial, err.Error())
+		ca.stats.Counter(1.0, "errors.certificate", 1)
+		return nil, nil, nil
+	}
+
+	if err := cert.Verify(challenge, sig); err != nil {
+		return nil, nil, &BadSignatureError{Username: user.Username}
+	}
+	return user, cert, nil
+}
+
+/*
+checkCertificate makes sure cert is a user certificate issued by a
+trusted CA, is within its validity window, carries no critical options
+and has not been revoked. It then maps the certificate's principals to a
+user: the claimed username if one was given, otherwise the first
+principal that names a known user.
+*/
+func (ca *certAuthenticator) checkCertificate(username string, cert *ssh.Certificate) (*User, error) {
+	ca.RLock()
+	defer ca.RUnlock()
+
+	if cert.CertType != ssh.UserCert {
+		return nil, errors.New("not a user certificate")
+	}
+	if !ca.isAuthority(cert.SignatureKey) {
+		return nil, errors.New("certificate was not signed by a trusted CA")
+	}
+	// force-command and source-address only make sense for shell access,
+	// and CertChecker leaves source-address to the SSH server, so refuse
+	// restricted certificates rather than ignore their restrictions.
+	for option := range cert.CriticalOptions {
+		return nil, fmt.Errorf("unsupported critical option %q", option)
+	}
+	// OpenSSH treats a certificate without principals as valid for
+	// everyone, which is never what we want here.
+	if len(cert.ValidPrincipals) == 0 {
+		return nil, errors.New("certificate has no principals")
+	}
+
+	checker := &ssh.CertChecker{
+		IsRevoked: ca.revoked.isRevoked,
+		Clock:     ca.now,
+	}
+
+	principals := cert.ValidPrincipals
+	if username != "" {
+		principals = []string{username}
+	}
+	for _, principal := range principals {
+		// CheckCert consults the revocation list and checks the validity
+		// window, the principal and the CA signature.
+		if err := checker.CheckCert(principal, cert); err != nil {
+			return nil, err
+		}
+		if user := ca.Lookup(principal); user != nil {
+			return user, nil
+		}
+	}
+	return nil, fmt.Errorf("no user matches principals %v", principals)
+}
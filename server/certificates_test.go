@@ -0,0 +1,165 @@
+// Copyright 2014 AdRoll, Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package server_test
+
+import (
+	"crypto/ed25519"
+	cryptrand "crypto/rand"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/AdRoll/hologram/server"
+	"github.com/peterbourgon/g2s"
+	. "github.com/smartystreets/goconvey/convey"
+	"golang.org/x/crypto/ssh"
+)
+
+func newSigner(t *testing.T) ssh.Signer {
+	_, private, err := ed25519.GenerateKey(cryptrand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	signer, err := ssh.NewSignerFromKey(private)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return signer
+}
+
+/*
+issueCert signs a user certificate for userKey with ca, after letting
+the caller adjust it.
+*/
+func issueCert(t *testing.T, ca ssh.Signer, userKey ssh.Signer, adjust func(*ssh.Certificate)) ssh.Signer {
+	now := time.Now()
+	cert := &ssh.Certificate{
+		Key:             userKey.PublicKey(),
+		Serial:          42,
+		CertType:        ssh.UserCert,
+		KeyId:           "testuser@laptop",
+		ValidPrincipals: []string{"testuser"},
+		ValidAfter:      uint64(now.Add(-time.Minute).Unix()),
+		ValidBefore:     uint64(now.Add(time.Hour).Unix()),
+	}
+	if adjust != nil {
+		adjust(cert)
+	}
+	if err := cert.SignCert(cryptrand.Reader, ca); err != nil {
+		t.Fatal(err)
+	}
+	signer, err := ssh.NewCertSigner(cert, userKey)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return signer
+}
+
+func TestCertAuthenticator(t *testing.T) {
+	Convey("Given a user cache that trusts a certificate authority", t, func() {
+		dir, err := ioutil.TempDir("", "hologram-certs")
+		So(err, ShouldBeNil)
+		defer os.RemoveAll(dir)
+
+		ca := newSigner(t)
+		caPath := filepath.Join(dir, "user_ca.pub")
+		So(ioutil.WriteFile(caPath, ssh.MarshalAuthorizedKey(ca.PublicKey()), 0644), ShouldBeNil)
+		revokedPath := filepath.Join(dir, "revoked")
+		So(ioutil.WriteFile(revokedPath, []byte("# nothing yet\n"), 0644), ShouldBeNil)
+
+		// The user has no SSH keys in LDAP at all.
+		lc, err := server.NewLDAPUserCache(&StubLDAPServer{}, g2s.Noop(), "cn", "dc=testdn,dc=com", false, "", "", "", "groupOfNames", "sshPublicKey", "", "", nil)
+		So(err, ShouldBeNil)
+		authenticator, err := server.NewCertAuthenticator(lc, caPath, revokedPath, g2s.Noop())
+		So(err, ShouldBeNil)
+
+		userKey := newSigner(t)
+		challenge := randomBytes(64)
+		authenticate := func(username string, signer ssh.Signer) *server.User {
+			sig, err := signer.Sign(cryptrand.Reader, challenge)
+			if err != nil {
+				t.Fatal(err)
+			}
+			user, _, err := authenticator.Authenticate(username, signer.PublicKey(), challenge, sig)
+			So(err, ShouldBeNil)
+			return user
+		}
+
+		Convey("A valid certificate should map its principal to the LDAP user", func() {
+			user := authenticate("", issueCert(t, ca, userKey, nil))
+			So(user, ShouldNotBeNil)
+			So(user.Username, ShouldEqual, "testuser")
+
+			So(authenticate("testuser", issueCert(t, ca, userKey, nil)), ShouldNotBeNil)
+		})
+
+		Convey("A certificate should only work for its own principals", func() {
+			So(authenticate("someoneelse", issueCert(t, ca, userKey, nil)), ShouldBeNil)
+		})
+
+		Convey("A certificate without principals should be rejected", func() {
+			So(authenticate("testuser", issueCert(t, ca, userKey, func(c *ssh.Certificate) {
+				c.ValidPrincipals = nil
+			})), ShouldBeNil)
+		})
+
+		Convey("An expired or not yet valid certificate should be rejected", func() {
+			So(authenticate("", issueCert(t, ca, userKey, func(c *ssh.Certificate) {
+				c.ValidBefore = uint64(time.Now().Add(-time.Second).Unix())
+			})), ShouldBeNil)
+			So(authenticate("", issueCert(t, ca, userKey, func(c *ssh.Certificate) {
+				c.ValidAfter = uint64(time.Now().Add(time.Hour).Unix())
+			})), ShouldBeNil)
+		})
+
+		Convey("A certificate with critical options should be rejected", func() {
+			So(authenticate("", issueCert(t, ca, userKey, func(c *ssh.Certificate) {
+				c.CriticalOptions = map[string]string{"force-command": "/bin/true"}
+			})), ShouldBeNil)
+		})
+
+		Convey("A certificate from an untrusted CA should be rejected", func() {
+			So(authenticate("", issueCert(t, newSigner(t), userKey, nil)), ShouldBeNil)
+		})
+
+		Convey("A host certificate should be rejected", func() {
+			So(authenticate("", issueCert(t, ca, userKey, func(c *ssh.Certificate) {
+				c.CertType = ssh.HostCert
+			})), ShouldBeNil)
+		})
+
+		Convey("A signature by a different key should be rejected", func() {
+			cert := issueCert(t, ca, userKey, nil)
+			sig, err := newSigner(t).Sign(cryptrand.Reader, challenge)
+			So(err, ShouldBeNil)
+			user, _, _ := authenticator.Authenticate("", cert.PublicKey(), challenge, sig)
+			So(user, ShouldBeNil)
+		})
+
+		Convey("Revoked certificates should be rejected after a reload", func() {
+			for _, entry := range []string{"42", "id:testuser@laptop", ssh.FingerprintSHA256(userKey.PublicKey())} {
+				So(ioutil.WriteFile(revokedPath, []byte(entry+"\n"), 0644), ShouldBeNil)
+				So(authenticator.Reload(), ShouldBeNil)
+				So(authenticate("", issueCert(t, ca, userKey, nil)), ShouldBeNil)
+			}
+		})
+
+		Convey("Plain keys should still be checked against LDAP", func() {
+			So(authenticate("", userKey), ShouldBeNil)
+		})
+	})
+}
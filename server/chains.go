@@ -0,0 +1,147 @@
+// Copyright 2014 AdRoll, Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package server
+
+import (
+	"fmt"
+	"regexp"
+	"strings"
+
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/aws/credentials"
+	"github.com/aws/aws-sdk-go/aws/session"
+	"github.com/aws/aws-sdk-go/service/sts"
+)
+
+const (
+	// AWS caps sessions obtained through role chaining at one hour.
+	maxChainedDuration = int64(3600)
+	// Hub sessions are only used to take the next hop, so they get the
+	// shortest duration STS allows.
+	hubSessionDuration = int64(900)
+)
+
+var accountIDPattern = regexp.MustCompile(`^[0-9]{12}$`)
+
+/*
+roleChain lists the hub roles to pass through, in order, before
+assuming any role whose ARN starts with prefix.
+*/
+type roleChain struct {
+	prefix string
+	hubs   []string
+}
+
+/*
+SetRoleChains configures hub roles for accounts whose roles do not trust
+the server's account directly. chains maps an account alias or account
+ID to the roles to assume, in order, before the target role; hub roles
+are named like any other role. newSTS builds the STS client for each hop
+from the previous hop's credentials; nil means the real STS.
+*/
+func (s *directSessionTokenService) SetRoleChains(chains map[string][]string, newSTS func(*sts.Credentials) STSImplementation) error {
+	parsed := []roleChain{}
+	for account, hubs := range chains {
+		var prefix string
+		if s.accountAliases != nil && (*s.accountAliases)[account] != "" {
+			prefix = (*s.accountAliases)[account] + ":role/"
+		} else if accountIDPattern.MatchString(account) {
+			prefix = fmt.Sprintf("arn:aws:iam::%s:role/", account)
+		} else {
+			return fmt.Errorf("role chain for %q: not an account alias or account ID", account)
+		}
+		if len(hubs) == 0 {
+			return fmt.Errorf("role chain for %q has no hub roles", account)
+		}
+
+		chain := roleChain{prefix: prefix}
+		for _, hub := range hubs {
+			chain.hubs = append(chain.hubs, BuildARN(hub, s.iamAccount, s.accountAliases))
+		}
+		parsed = append(parsed, chain)
+	}
+
+	if newSTS == nil {
+		newSTS = chainedSTS
+	}
+	s.chains = parsed
+	s.newSTS = newSTS
+	return nil
+}
+
+/*
+hubsFor returns the hub roles to pass through before assuming arn. A
+hub that is itself the target ends the chain there.
+*/
+func (s *directSessionTokenService) hubsFor(arn string) []string {
+	for _, chain := range s.chains {
+		if !strings.HasPrefix(arn, chain.prefix) {
+			continue
+		}
+		for i, hub := range chain.hubs {
+			if hub == arn {
+				return chain.hubs[:i]
+			}
+		}
+		return chain.hubs
+	}
+	return nil
+}
+
+/*
+MaxDuration returns the longest session STS will issue for arn: an hour
+for roles reached through hub roles, and its usual limit otherwise.
+*/
+func (s *directSessionTokenService) MaxDuration(arn string) int64 {
+	if len(s.hubsFor(arn)) > 0 {
+		return maxChainedDuration
+	}
+	return maxSessionDuration
+}
+
+/*
+tagHop applies the session tags to one hop of a chain. Transitive tags
+and the source identity carry over from the first hop by themselves, and
+STS refuses to have them set again.
+*/
+func (s *directSessionTokenService) tagHop(user *User, options *sts.AssumeRoleInput, first bool) {
+	s.tags.Apply(user, options)
+	if first {
+		return
+	}
+
+	transitive := map[string]bool{}
+	for _, key := range options.TransitiveTagKeys {
+		transitive[*key] = true
+	}
+	tags := []*sts.Tag{}
+	for _, tag := range options.Tags {
+		if !transitive[*tag.Key] {
+			tags = append(tags, tag)
+		}
+	}
+	if len(tags) == 0 {
+		tags = nil
+	}
+	options.Tags = tags
+	options.TransitiveTagKeys = nil
+	options.SourceIdentity = nil
+}
+
+func chainedSTS(creds *sts.Credentials) STSImplementation {
+	return sts.New(session.New(&aws.Config{
+		Credentials: credentials.NewStaticCredentials(*creds.AccessKeyId, *creds.SecretAccessKey, *creds.SessionToken),
+	}))
+}
@@ -0,0 +1,153 @@
+// Copyright 2014 AdRoll, Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package server
+
+import (
+	"bytes"
+	"crypto/rand"
+	"encoding/binary"
+	"errors"
+	"os"
+	"sync"
+	"time"
+)
+
+/*
+challengePrefix separates Hologram challenges from anything else a user's
+SSH key might be asked to sign.
+*/
+const challengePrefix = "hologram-ssh-challenge-v1"
+
+/*
+defaultChallengeTimeout is how long a client has to answer a challenge.
+*/
+const defaultChallengeTimeout = 30 * time.Second
+
+/*
+challengeNonceSize is the number of random bytes in every challenge.
+*/
+const challengeNonceSize = 32
+
+var (
+	errChallengeReplayed = errors.New("challenge was already used or never issued")
+	errChallengeExpired  = errors.New("challenge has expired")
+)
+
+type issuedChallenge struct {
+	conn   string
+	issued time.Time
+}
+
+/*
+challengeStore hands out challenges and makes sure each one is answered
+at most once, on the connection it was issued to, within the timeout.
+*/
+type challengeStore struct {
+	sync.Mutex
+	identity string
+	timeout  time.Duration
+	issued   map[string]issuedChallenge
+	now      func() time.Time
+}
+
+func newChallengeStore(identity string, timeout time.Duration) *challengeStore {
+	return &challengeStore{
+		identity: identity,
+		timeout:  timeout,
+		issued:   map[string]issuedChallenge{},
+		now:      time.Now,
+	}
+}
+
+/*
+issue builds a new challenge for the connection conn. The signed payload
+is the prefix, the server identity, the connection and the time it was
+issued, each length-prefixed, followed by random bytes from crypto/rand.
+*/
+func (cs *challengeStore) issue(conn string) ([]byte, error) {
+	nonce := make([]byte, challengeNonceSize)
+	if _, err := rand.Read(nonce); err != nil {
+		return nil, err
+	}
+
+	cs.Lock()
+	defer cs.Unlock()
+
+	now := cs.now()
+	buf := &bytes.Buffer{}
+	for _, field := range []string{challengePrefix, cs.identity, conn} {
+		binary.Write(buf, binary.BigEndian, uint32(len(field)))
+		buf.WriteString(field)
+	}
+	binary.Write(buf, binary.BigEndian, now.UnixNano())
+	buf.Write(nonce)
+	challenge := buf.Bytes()
+
+	cs.prune(now)
+	cs.issued[string(challenge)] = issuedChallenge{conn: conn, issued: now}
+	return challenge, nil
+}
+
+/*
+redeem uses up a challenge. It fails if the challenge was never issued,
+was already redeemed, belongs to another connection, or is too old.
+*/
+func (cs *challengeStore) redeem(challenge []byte, conn string) error {
+	cs.Lock()
+	defer cs.Unlock()
+
+	issued, ok := cs.issued[string(challenge)]
+	if !ok || issued.conn != conn {
+		return errChallengeReplayed
+	}
+	delete(cs.issued, string(challenge))
+
+	if cs.now().Sub(issued.issued) > cs.timeout {
+		return errChallengeExpired
+	}
+	return nil
+}
+
+/*
+discard forgets a challenge without redeeming it.
+*/
+func (cs *challengeStore) discard(challenge []byte) {
+	cs.Lock()
+	defer cs.Unlock()
+	delete(cs.issued, string(challenge))
+}
+
+/*
+prune drops challenges that can no longer be redeemed. The caller must
+hold the lock.
+*/
+func (cs *challengeStore) prune(now time.Time) {
+	for challenge, issued := range cs.issued {
+		if now.Sub(issued.issued) > cs.timeout {
+			delete(cs.issued, challenge)
+		}
+	}
+}
+
+/*
+hostname is the default server identity bound into challenges.
+*/
+func hostname() string {
+	name, err := os.Hostname()
+	if err != nil {
+		return "hologram-server"
+	}
+	return name
+}
@@ -0,0 +1,117 @@
+// Copyright 2014 AdRoll, Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package server
+
+import (
+	"sort"
+	"sync"
+	"time"
+
+	"github.com/AdRoll/hologram/protocol"
+)
+
+/*
+ConnectionInfo describes a client connection that is still open.
+*/
+type ConnectionInfo struct {
+	RemoteAddr string    `json:"remoteAddr"`
+	Opened     time.Time `json:"opened"`
+	// Request is the kind of the last request on the connection, and
+	// User the user it claimed to be for, or who it authenticated as.
+	Request string `json:"request,omitempty"`
+	User    string `json:"user,omitempty"`
+}
+
+/*
+connectionTracker keeps track of the connections being handled.
+*/
+type connectionTracker struct {
+	sync.Mutex
+	open map[protocol.MessageReadWriteCloser]*ConnectionInfo
+	now  func() time.Time
+}
+
+func newConnectionTracker() *connectionTracker {
+	return &connectionTracker{
+		open: map[protocol.MessageReadWriteCloser]*ConnectionInfo{},
+		now:  time.Now,
+	}
+}
+
+func (ct *connectionTracker) opened(m protocol.MessageReadWriteCloser) {
+	ct.Lock()
+	defer ct.Unlock()
+	ct.open[m] = &ConnectionInfo{RemoteAddr: remoteAddr(m), Opened: ct.now()}
+}
+
+func (ct *connectionTracker) closed(m protocol.MessageReadWriteCloser) {
+	ct.Lock()
+	defer ct.Unlock()
+	delete(ct.open, m)
+}
+
+/*
+update notes what a connection is doing. Empty values leave the
+previous ones in place.
+*/
+func (ct *connectionTracker) update(m protocol.MessageReadWriteCloser, request string, user string) {
+	ct.Lock()
+	defer ct.Unlock()
+	info, ok := ct.open[m]
+	if !ok {
+		return
+	}
+	if request != "" {
+		info.Request = request
+	}
+	if user != "" {
+		info.User = user
+	}
+}
+
+/*
+list returns the open connections, oldest first.
+*/
+func (ct *connectionTracker) list() []ConnectionInfo {
+	ct.Lock()
+	defer ct.Unlock()
+	connections := make([]ConnectionInfo, 0, len(ct.open))
+	for _, info := range ct.open {
+		connections = append(connections, *info)
+	}
+	sort.Slice(connections, func(i, j int) bool {
+		return connections[i].Opened.Before(connections[j].Opened)
+	})
+	return connections
+}
+
+/*
+requestName names the kind of a request, for display.
+*/
+func requestName(r *protocol.ServerRequest) string {
+	switch {
+	case r.GetAssumeRole() != nil:
+		return "AssumeRole"
+	case r.GetGetUserCredentials() != nil:
+		return "GetUserCredentials"
+	case r.GetAddSSHkey() != nil:
+		return "AddSSHKey"
+	case r.GetListRoles() != nil:
+		return "ListRoles"
+	case r.GetWhoAmI() != nil:
+		return "WhoAmI"
+	}
+	return ""
+}
@@ -0,0 +1,159 @@
+// Copyright 2014 AdRoll, Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package server
+
+import (
+	"fmt"
+	"sync"
+	"time"
+
+	"github.com/AdRoll/hologram/log"
+	"github.com/aws/aws-sdk-go/service/sts"
+	"github.com/peterbourgon/g2s"
+)
+
+/*
+credentialCache is a CredentialService that hands out the credentials it
+issued earlier for the same user, role and session parameters for as
+long as they have enough life left, so that busy mornings do not get
+throttled by STS.
+*/
+type credentialCache struct {
+	CredentialService
+	sync.Mutex
+	minLifetime time.Duration
+	stats       g2s.Statter
+	entries     map[credentialKey]*sts.Credentials
+	now         func() time.Time
+}
+
+type credentialKey struct {
+	username     string
+	arn          string
+	duration     int64
+	policy       string
+	entitlements string
+}
+
+/*
+NewCredentialCache wraps a credential service with a cache. Cached
+credentials are only handed out while they have at least minLifetime
+left before they expire.
+*/
+func NewCredentialCache(service CredentialService, minLifetime time.Duration, stats g2s.Statter) *credentialCache {
+	return &credentialCache{
+		CredentialService: service,
+		minLifetime:       minLifetime,
+		stats:             stats,
+		entries:           map[credentialKey]*sts.Credentials{},
+		now:               time.Now,
+	}
+}
+
+/*
+AssumeRole returns cached credentials if there are any with enough life
+left, and otherwise asks the wrapped service for new ones.
+*/
+func (cc *credentialCache) AssumeRole(user *User, grant *Grant) (*sts.Credentials, error) {
+	key := credentialKey{
+		username:     user.Username,
+		arn:          grant.ARN,
+		duration:     grant.Duration,
+		policy:       grant.SessionPolicy.String(),
+		entitlements: entitlements(user),
+	}
+
+	cc.Lock()
+	creds, ok := cc.entries[key]
+	if ok && !cc.fresh(creds) {
+		delete(cc.entries, key)
+		ok = false
+	}
+	cc.Unlock()
+
+	if ok {
+		cc.stats.Counter(1.0, "credentialCacheHit", 1)
+		log.Debug("Reusing cached credentials for %s on %s", user.Username, grant.ARN)
+		return creds, nil
+	}
+	cc.stats.Counter(1.0, "credentialCacheMiss", 1)
+
+	creds, err := cc.CredentialService.AssumeRole(user, grant)
+	if err != nil {
+		return nil, err
+	}
+	if creds != nil && creds.Expiration != nil {
+		cc.Lock()
+		cc.prune()
+		cc.entries[key] = creds
+		cc.Unlock()
+	}
+	return creds, nil
+}
+
+/*
+MaxDuration passes on the wrapped service's session limit, if it has
+one.
+*/
+func (cc *credentialCache) MaxDuration(arn string) int64 {
+	if limiter, ok := cc.CredentialService.(sessionLimiter); ok {
+		return limiter.MaxDuration(arn)
+	}
+	return maxSessionDuration
+}
+
+/*
+Invalidate forgets every cached credential for the user. User caches
+call this when the user's groups, roles or attributes change.
+*/
+func (cc *credentialCache) Invalidate(username string) {
+	cc.Lock()
+	defer cc.Unlock()
+	for key := range cc.entries {
+		if key.username == username {
+			delete(cc.entries, key)
+		}
+	}
+}
+
+func (cc *credentialCache) fresh(creds *sts.Credentials) bool {
+	return creds.Expiration.Sub(cc.now()) >= cc.minLifetime
+}
+
+/*
+prune drops credentials that are too close to expiry to hand out. The
+caller must hold the lock.
+*/
+func (cc *credentialCache) prune() {
+	for key, creds := range cc.entries {
+		if !cc.fresh(creds) {
+			delete(cc.entries, key)
+		}
+	}
+}
+
+/*
+entitlements summarises everything about a user that decides which
+credentials they get, so that a change to any of it is noticed.
+*/
+func entitlements(user *User) string {
+	groups := []Group{}
+	for _, group := range user.Groups {
+		if group != nil {
+			groups = append(groups, *group)
+		}
+	}
+	return fmt.Sprintf("%q %q %v %v", user.DefaultRole, user.MemberOf, groups, user.Attributes)
+}
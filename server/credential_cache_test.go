@@ -0,0 +1,111 @@
+// Copyright 2014 AdRoll, Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package server_test
+
+import (
+	"testing"
+	"time"
+
+	"github.com/AdRoll/hologram/server"
+	"github.com/aws/aws-sdk-go/service/sts"
+	"github.com/peterbourgon/g2s"
+	. "github.com/smartystreets/goconvey/convey"
+)
+
+/*
+countingCredentials issues credentials that expire after lifetime and
+counts how often it was asked.
+*/
+type countingCredentials struct {
+	calls    int
+	lifetime time.Duration
+}
+
+func (c *countingCredentials) AssumeRole(user *server.User, grant *server.Grant) (*sts.Credentials, error) {
+	c.calls++
+	expiration := time.Now().Add(c.lifetime)
+	return &sts.Credentials{Expiration: &expiration}, nil
+}
+
+func (c *countingCredentials) GetSessionToken() (*sts.Credentials, error) {
+	return &sts.Credentials{}, nil
+}
+
+func TestCredentialCache(t *testing.T) {
+	Convey("Given a credential cache", t, func() {
+		backend := &countingCredentials{lifetime: time.Hour}
+		stats := &countingStatter{counters: map[string]int{}}
+		cache := server.NewCredentialCache(backend, 15*time.Minute, stats)
+
+		user := &server.User{Username: "alice", DefaultRole: "engineer"}
+		grant := &server.Grant{ARN: "arn:aws:iam::123456:role/engineer", Duration: 3600}
+
+		Convey("The same request should be answered from the cache", func() {
+			first, err := cache.AssumeRole(user, grant)
+			So(err, ShouldBeNil)
+			second, err := cache.AssumeRole(user, grant)
+			So(err, ShouldBeNil)
+			So(second, ShouldEqual, first)
+			So(backend.calls, ShouldEqual, 1)
+			So(stats.count("credentialCacheMiss"), ShouldEqual, 1)
+			So(stats.count("credentialCacheHit"), ShouldEqual, 1)
+		})
+
+		Convey("Other users, roles, durations and session policies should not share credentials", func() {
+			cache.AssumeRole(user, grant)
+			cache.AssumeRole(&server.User{Username: "bob", DefaultRole: "engineer"}, grant)
+			cache.AssumeRole(user, &server.Grant{ARN: "arn:aws:iam::123456:role/admin", Duration: 3600})
+			cache.AssumeRole(user, &server.Grant{ARN: grant.ARN, Duration: 7200})
+			cache.AssumeRole(user, &server.Grant{ARN: grant.ARN, Duration: 3600, SessionPolicy: &server.SessionPolicy{PolicyARNs: []string{"arn:aws:iam::aws:policy/ReadOnlyAccess"}}})
+			So(backend.calls, ShouldEqual, 5)
+		})
+
+		Convey("Credentials close to expiry should not be handed out", func() {
+			backend.lifetime = 10 * time.Minute
+			cache.AssumeRole(user, grant)
+			cache.AssumeRole(user, grant)
+			So(backend.calls, ShouldEqual, 2)
+		})
+
+		Convey("A change to the user's entitlements should miss the cache", func() {
+			cache.AssumeRole(user, grant)
+			cache.AssumeRole(&server.User{Username: "alice", DefaultRole: "engineer", MemberOf: []string{"cn=admins"}}, grant)
+			So(backend.calls, ShouldEqual, 2)
+		})
+
+		Convey("Invalidating a user should drop their credentials", func() {
+			cache.AssumeRole(user, grant)
+			cache.Invalidate("alice")
+			cache.AssumeRole(user, grant)
+			So(backend.calls, ShouldEqual, 2)
+		})
+	})
+
+	Convey("The LDAP user cache should report changed entitlements", t, func() {
+		s := &StubLDAPServer{OtherKeys: []string{"first"}}
+		lc, err := server.NewLDAPUserCache(s, g2s.Noop(), "cn", "dc=testdn,dc=com", false, "", "", "", "groupOfNames", "sshPublicKey", "", "", []string{"otherKeysAttribute"})
+		So(err, ShouldBeNil)
+
+		changed := []string{}
+		lc.OnEntitlementsChange(func(username string) { changed = append(changed, username) })
+
+		So(lc.Update(), ShouldBeNil)
+		So(changed, ShouldBeEmpty)
+
+		s.OtherKeys = []string{"second"}
+		So(lc.Update(), ShouldBeNil)
+		So(changed, ShouldContain, "testuser")
+	})
+}
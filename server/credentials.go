@@ -18,11 +18,11 @@ package server
 // It was a service before because it held state, which is now gone.
 
 import (
-	"errors"
 	"fmt"
 	"strings"
 
 	"github.com/AdRoll/hologram/log"
+	"github.com/aws/aws-sdk-go/aws"
 	"github.com/aws/aws-sdk-go/service/sts"
 )
 
@@ -30,12 +30,21 @@ import (
 CredentialService implements workflows that return temporary
 credentials to calling processes. No caching is done of these
 results other than that which the CredentialService does itself.
+Callers are expected to have authorized the grant beforehand.
 */
 type CredentialService interface {
-	AssumeRole(user *User, role string, enableLDAPRoles bool) (*sts.Credentials, error)
+	AssumeRole(user *User, grant *Grant) (*sts.Credentials, error)
 	GetSessionToken() (*sts.Credentials, error)
 }
 
+/*
+sessionLimiter is implemented by credential services that cannot issue
+sessions as long as STS normally allows for some roles.
+*/
+type sessionLimiter interface {
+	MaxDuration(arn string) int64
+}
+
 /*
 STSImplementation exists to enable dependency injection of an
 implementation of STS.
@@ -52,18 +61,29 @@ compiled into the application.
 */
 type directSessionTokenService struct {
 	iamAccount     string
-	sts            *sts.STS
+	sts            STSImplementation
 	accountAliases *map[string]string
+	tags           *SessionTagMapping
+	chains         []roleChain
+	newSTS         func(*sts.Credentials) STSImplementation
 }
 
 /*
 NewDirectSessionTokenService returns a credential service that talks
 to Amazon directly.
 */
-func NewDirectSessionTokenService(iamAccount string, sts *sts.STS, accountAliases *map[string]string) *directSessionTokenService {
+func NewDirectSessionTokenService(iamAccount string, sts STSImplementation, accountAliases *map[string]string) *directSessionTokenService {
 	return &directSessionTokenService{iamAccount: iamAccount, sts: sts, accountAliases: accountAliases}
 }
 
+/*
+SetSessionTags sets how users' LDAP identity is passed on to STS. By
+default only the session name is set.
+*/
+func (s *directSessionTokenService) SetSessionTags(tags *SessionTagMapping) {
+	s.tags = tags
+}
+
 func (s *directSessionTokenService) Start() error {
 	return nil
 }
@@ -84,39 +104,37 @@ func BuildARN(role string, defaultAccount string, accountAliases *map[string]str
 	return arn
 }
 
-func (s *directSessionTokenService) AssumeRole(user *User, role string, enableLDAPRoles bool) (*sts.Credentials, error) {
-	var arn = BuildARN(role, s.iamAccount, s.accountAliases)
-
-	log.Debug("Checking ARN %s against user %s (with access %s)", arn, user.Username, enableLDAPRoles)
-
-	timeout := int64(3600)
-	if enableLDAPRoles {
-		found := false
-		for _, group := range user.Groups {
-			for _, a := range group.ARNs {
-				a = BuildARN(a, s.iamAccount, s.accountAliases)
-				if arn == a {
-					found = true
-					timeout = group.Timeout
-					break
-				}
-			}
+func (s *directSessionTokenService) AssumeRole(user *User, grant *Grant) (*sts.Credentials, error) {
+	client := s.sts
+	duration := grant.Duration
+	hubs := s.hubsFor(grant.ARN)
+	for i, hub := range hubs {
+		hub := hub
+		log.Debug("Assuming hub role %s for user %s on the way to %s", hub, user.Username, grant.ARN)
+		options := &sts.AssumeRoleInput{
+			DurationSeconds: aws.Int64(hubSessionDuration),
+			RoleArn:         &hub,
+			RoleSessionName: &user.Username,
 		}
+		s.tagHop(user, options, i == 0)
 
-		log.Debug("Found %s", found)
-
-		if !found {
-			return nil, errors.New(fmt.Sprintf("User %s is not authorized to assume role %s!", user.Username, arn))
+		r, err := client.AssumeRole(options)
+		if err != nil {
+			return nil, fmt.Errorf("could not assume hub role %s: %w", hub, err)
 		}
+		client = s.newSTS(r.Credentials)
 	}
-	log.Debug("User: %s", user.Username)
+
+	log.Debug("Assuming %s for user %s for %d seconds", grant.ARN, user.Username, duration)
 	options := &sts.AssumeRoleInput{
-		DurationSeconds: &timeout,
-		RoleArn:         &arn,
+		DurationSeconds: &duration,
+		RoleArn:         &grant.ARN,
 		RoleSessionName: &user.Username,
 	}
+	s.tagHop(user, options, len(hubs) == 0)
+	grant.SessionPolicy.apply(options)
 
-	r, err := s.sts.AssumeRole(options)
+	r, err := client.AssumeRole(options)
 	if err != nil {
 		log.Debug("Error!! %s", err.Error())
 		return nil, err
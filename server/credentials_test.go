@@ -1,9 +1,12 @@
 package server_test
 
 import (
+	"fmt"
+	"strings"
 	"testing"
 
 	"github.com/AdRoll/hologram/server"
+	"github.com/aws/aws-sdk-go/service/sts"
 	. "github.com/smartystreets/goconvey/convey"
 )
 
@@ -23,3 +26,209 @@ func TestBuildARN(t *testing.T) {
 	})
 
 }
+
+/*
+recordingSTS remembers the last AssumeRole request it was sent.
+*/
+type recordingSTS struct {
+	input *sts.AssumeRoleInput
+}
+
+func (r *recordingSTS) AssumeRole(options *sts.AssumeRoleInput) (*sts.AssumeRoleOutput, error) {
+	r.input = options
+	return &sts.AssumeRoleOutput{Credentials: &sts.Credentials{}}, nil
+}
+
+func (r *recordingSTS) GetSessionToken(options *sts.GetSessionTokenInput) (*sts.GetSessionTokenOutput, error) {
+	return &sts.GetSessionTokenOutput{Credentials: &sts.Credentials{}}, nil
+}
+
+func TestSessionTags(t *testing.T) {
+	Convey("Given a credentials service with session tags", t, func() {
+		stub := &recordingSTS{}
+		service := server.NewDirectSessionTokenService("123456", stub, nil)
+		mapping := &server.SessionTagMapping{
+			Tags:           map[string]string{"team": "departmentNumber", "email": "mail", "cost": "costCenter"},
+			GroupsTag:      "groups",
+			Transitive:     []string{"team", "groups", "cost"},
+			SourceIdentity: "mail",
+		}
+		service.SetSessionTags(mapping)
+		grant := &server.Grant{ARN: "arn:aws:iam::123456:role/engineer", Duration: 3600}
+
+		user := &server.User{
+			Username: "alice",
+			MemberOf: []string{"cn=engineers,ou=groups,dc=example,dc=com", "cn=on call,ou=groups,dc=example,dc=com"},
+			Attributes: map[string][]string{
+				"departmentNumber": {"platform#1"},
+				"mail":             {"alice@example.com"},
+			},
+		}
+
+		tags := func() map[string]string {
+			tags := map[string]string{}
+			for _, tag := range stub.input.Tags {
+				tags[*tag.Key] = *tag.Value
+			}
+			return tags
+		}
+
+		Convey("The mapping should ask for the attributes it needs", func() {
+			So(mapping.Attributes(), ShouldResemble, []string{"costCenter", "departmentNumber", "mail"})
+		})
+
+		Convey("It should tag the session with the user's attributes and groups", func() {
+			_, err := service.AssumeRole(user, grant)
+			So(err, ShouldBeNil)
+			So(*stub.input.RoleSessionName, ShouldEqual, "alice")
+			So(tags(), ShouldResemble, map[string]string{
+				"team":   "platform_1",
+				"email":  "alice@example.com",
+				"groups": "engineers:on call",
+			})
+			So(*stub.input.SourceIdentity, ShouldEqual, "alice@example.com")
+		})
+
+		Convey("Only tags with values should be transitive", func() {
+			_, err := service.AssumeRole(user, grant)
+			So(err, ShouldBeNil)
+			keys := []string{}
+			for _, key := range stub.input.TransitiveTagKeys {
+				keys = append(keys, *key)
+			}
+			So(keys, ShouldResemble, []string{"team", "groups"})
+		})
+
+		Convey("The source identity should fall back to the username", func() {
+			_, err := service.AssumeRole(&server.User{Username: "bob smith"}, grant)
+			So(err, ShouldBeNil)
+			So(*stub.input.SourceIdentity, ShouldEqual, "bob_smith")
+			So(stub.input.Tags, ShouldBeEmpty)
+		})
+
+		Convey("Long values should be truncated", func() {
+			user.Attributes["departmentNumber"] = []string{strings.Repeat("x", 300)}
+			_, err := service.AssumeRole(user, grant)
+			So(err, ShouldBeNil)
+			So(len(tags()["team"]), ShouldEqual, 256)
+		})
+	})
+
+	Convey("Without session tags only the session name should be set", t, func() {
+		stub := &recordingSTS{}
+		service := server.NewDirectSessionTokenService("123456", stub, nil)
+		_, err := service.AssumeRole(&server.User{Username: "alice"}, &server.Grant{ARN: "arn:aws:iam::123456:role/engineer", Duration: 3600})
+		So(err, ShouldBeNil)
+		So(stub.input.Tags, ShouldBeNil)
+		So(stub.input.SourceIdentity, ShouldBeNil)
+	})
+}
+
+/*
+hopRecorder is an STS that records every AssumeRole call along with the
+credentials it was made with, and hands out credentials named after the
+role assumed.
+*/
+type hopRecorder struct {
+	caller string
+	hops   *[]string
+	inputs *[]*sts.AssumeRoleInput
+}
+
+func (h *hopRecorder) AssumeRole(options *sts.AssumeRoleInput) (*sts.AssumeRoleOutput, error) {
+	*h.hops = append(*h.hops, fmt.Sprintf("%s -> %s (%d)", h.caller, *options.RoleArn, *options.DurationSeconds))
+	*h.inputs = append(*h.inputs, options)
+	key := *options.RoleArn
+	return &sts.AssumeRoleOutput{Credentials: &sts.Credentials{AccessKeyId: &key}}, nil
+}
+
+func (h *hopRecorder) GetSessionToken(options *sts.GetSessionTokenInput) (*sts.GetSessionTokenOutput, error) {
+	return &sts.GetSessionTokenOutput{Credentials: &sts.Credentials{}}, nil
+}
+
+func TestRoleChains(t *testing.T) {
+	Convey("Given a credentials service with a hub role for one account", t, func() {
+		hops := []string{}
+		inputs := []*sts.AssumeRoleInput{}
+		aliases := map[string]string{"prod": "arn:aws:iam::222222222222", "dev": "arn:aws:iam::333333333333"}
+		service := server.NewDirectSessionTokenService("111111111111", &hopRecorder{"server", &hops, &inputs}, &aliases)
+		err := service.SetRoleChains(map[string][]string{"prod": {"hologram-hub", "prod/hub"}}, func(creds *sts.Credentials) server.STSImplementation {
+			return &hopRecorder{*creds.AccessKeyId, &hops, &inputs}
+		})
+		So(err, ShouldBeNil)
+
+		Convey("Roles in that account should be reached through the hubs", func() {
+			creds, err := service.AssumeRole(&server.User{Username: "alice"}, &server.Grant{ARN: "arn:aws:iam::222222222222:role/admin", Duration: 3600})
+			So(err, ShouldBeNil)
+			So(*creds.AccessKeyId, ShouldEqual, "arn:aws:iam::222222222222:role/admin")
+			So(hops, ShouldResemble, []string{
+				"server -> arn:aws:iam::111111111111:role/hologram-hub (900)",
+				"arn:aws:iam::111111111111:role/hologram-hub -> arn:aws:iam::222222222222:role/hub (900)",
+				"arn:aws:iam::222222222222:role/hub -> arn:aws:iam::222222222222:role/admin (3600)",
+			})
+		})
+
+		Convey("Chained sessions should be limited to an hour", func() {
+			So(service.MaxDuration("arn:aws:iam::222222222222:role/admin"), ShouldEqual, 3600)
+			So(service.MaxDuration("arn:aws:iam::333333333333:role/admin"), ShouldEqual, 43200)
+		})
+
+		Convey("A hub role should be assumed without going through itself", func() {
+			_, err := service.AssumeRole(&server.User{Username: "alice"}, &server.Grant{ARN: "arn:aws:iam::222222222222:role/hub", Duration: 3600})
+			So(err, ShouldBeNil)
+			So(len(hops), ShouldEqual, 2)
+		})
+
+		Convey("Other accounts should be assumed directly", func() {
+			_, err := service.AssumeRole(&server.User{Username: "alice"}, &server.Grant{ARN: "arn:aws:iam::333333333333:role/admin", Duration: 43200})
+			So(err, ShouldBeNil)
+			So(hops, ShouldResemble, []string{"server -> arn:aws:iam::333333333333:role/admin (43200)"})
+		})
+
+		Convey("Transitive tags and the source identity should only be set on the first hop", func() {
+			service.SetSessionTags(&server.SessionTagMapping{
+				Tags:           map[string]string{"team": "departmentNumber", "email": "mail"},
+				Transitive:     []string{"team"},
+				SourceIdentity: "mail",
+			})
+			user := &server.User{Username: "alice", Attributes: map[string][]string{"departmentNumber": {"platform"}, "mail": {"alice@example.com"}}}
+			_, err := service.AssumeRole(user, &server.Grant{ARN: "arn:aws:iam::222222222222:role/admin", Duration: 3600})
+			So(err, ShouldBeNil)
+			So(len(inputs[0].Tags), ShouldEqual, 2)
+			So(len(inputs[0].TransitiveTagKeys), ShouldEqual, 1)
+			So(*inputs[0].SourceIdentity, ShouldEqual, "alice@example.com")
+			for _, input := range inputs[1:] {
+				So(len(input.Tags), ShouldEqual, 1)
+				So(*input.Tags[0].Key, ShouldEqual, "email")
+				So(input.TransitiveTagKeys, ShouldBeNil)
+				So(input.SourceIdentity, ShouldBeNil)
+			}
+		})
+	})
+
+	Convey("A session policy should only narrow the last hop of a chain", t, func() {
+		hops := []string{}
+		inputs := []*sts.AssumeRoleInput{}
+		aliases := map[string]string{"prod": "arn:aws:iam::222222222222"}
+		service := server.NewDirectSessionTokenService("111111111111", &hopRecorder{"server", &hops, &inputs}, &aliases)
+		So(service.SetRoleChains(map[string][]string{"prod": {"hologram-hub"}}, func(creds *sts.Credentials) server.STSImplementation {
+			return &hopRecorder{*creds.AccessKeyId, &hops, &inputs}
+		}), ShouldBeNil)
+
+		policy := &server.SessionPolicy{Policy: `{"Version":"2012-10-17"}`, PolicyARNs: []string{"arn:aws:iam::aws:policy/ReadOnlyAccess"}}
+		_, err := service.AssumeRole(&server.User{Username: "alice"}, &server.Grant{ARN: "arn:aws:iam::222222222222:role/admin", Duration: 3600, SessionPolicy: policy})
+		So(err, ShouldBeNil)
+		So(len(inputs), ShouldEqual, 2)
+		So(inputs[0].Policy, ShouldBeNil)
+		So(inputs[0].PolicyArns, ShouldBeNil)
+		So(*inputs[1].Policy, ShouldEqual, `{"Version":"2012-10-17"}`)
+		So(*inputs[1].PolicyArns[0].Arn, ShouldEqual, "arn:aws:iam::aws:policy/ReadOnlyAccess")
+	})
+
+	Convey("A role chain for an unknown alias should be refused", t, func() {
+		service := server.NewDirectSessionTokenService("111111111111", &recordingSTS{}, nil)
+		So(service.SetRoleChains(map[string][]string{"nowhere": {"hub"}}, nil), ShouldNotBeNil)
+		So(service.SetRoleChains(map[string][]string{"222222222222": {}}, nil), ShouldNotBeNil)
+		So(service.SetRoleChains(map[string][]string{"222222222222": {"hub"}}, nil), ShouldBeNil)
+	})
+}
@@ -0,0 +1,252 @@
+// Copyright 2014 AdRoll, Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package server
+
+import (
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"sort"
+	"strings"
+	"sync"
+)
+
+// Kinds of deny list entries.
+const (
+	DenyUser = "user"
+	DenyKey  = "key"
+	DenyRole = "role"
+)
+
+/*
+DenyEntries are the usernames, SSH key fingerprints and role ARNs on a
+deny list. Role ARNs may contain '*' and '?' wildcards.
+*/
+type DenyEntries struct {
+	Users []string `json:"users"`
+	Keys  []string `json:"keys"`
+	Roles []string `json:"roles"`
+}
+
+/*
+DenyList is a kill switch: users, keys and roles on it are refused
+before anything else is checked, whatever LDAP or the policy says. It is
+kept in a file so that it survives restarts, and can be changed while
+the server runs.
+*/
+type DenyList struct {
+	sync.RWMutex
+	path          string
+	entries       DenyEntries
+	blockFallback bool
+}
+
+/*
+NewDenyList loads the deny list kept at path, which need not exist yet.
+With an empty path the list is kept in memory only. If blockFallback is
+set, a request refused because its role is denied never falls back to
+the user's default role.
+*/
+func NewDenyList(path string, blockFallback bool) (*DenyList, error) {
+	d := &DenyList{path: path, blockFallback: blockFallback}
+	if err := d.Reload(); err != nil {
+		return nil, err
+	}
+	return d, nil
+}
+
+/*
+Reload re-reads the deny list file, for when it was edited by hand. If
+the file is invalid the current entries are kept.
+*/
+func (d *DenyList) Reload() error {
+	if d.path == "" {
+		return nil
+	}
+	contents, err := ioutil.ReadFile(d.path)
+	if os.IsNotExist(err) {
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+	var entries DenyEntries
+	if err := json.Unmarshal(contents, &entries); err != nil {
+		return fmt.Errorf("could not parse deny list %s: %s", d.path, err)
+	}
+
+	d.Lock()
+	defer d.Unlock()
+	d.entries = entries
+	return nil
+}
+
+/*
+Add puts value on the deny list as the given kind of entry, and saves
+the list.
+*/
+func (d *DenyList) Add(kind string, value string) error {
+	if err := checkDenyEntry(kind, value); err != nil {
+		return err
+	}
+
+	d.Lock()
+	defer d.Unlock()
+	entries := d.copyEntries()
+	list := entries.list(kind)
+	for _, existing := range *list {
+		if existing == value {
+			return nil
+		}
+	}
+	*list = append(*list, value)
+	sort.Strings(*list)
+	return d.save(entries)
+}
+
+/*
+Remove takes value off the deny list, and saves the list.
+*/
+func (d *DenyList) Remove(kind string, value string) error {
+	if err := checkDenyEntry(kind, value); err != nil {
+		return err
+	}
+
+	d.Lock()
+	defer d.Unlock()
+	entries := d.copyEntries()
+	list := entries.list(kind)
+	for i, existing := range *list {
+		if existing == value {
+			*list = append((*list)[:i], (*list)[i+1:]...)
+			return d.save(entries)
+		}
+	}
+	return fmt.Errorf("%s %q is not on the deny list", kind, value)
+}
+
+/*
+Entries returns a copy of what is on the deny list.
+*/
+func (d *DenyList) Entries() DenyEntries {
+	d.RLock()
+	defer d.RUnlock()
+	return d.copyEntries()
+}
+
+/*
+copyEntries returns a copy of the entries that can be changed without
+touching the list. The caller must hold the lock.
+*/
+func (d *DenyList) copyEntries() DenyEntries {
+	return DenyEntries{
+		Users: append([]string{}, d.entries.Users...),
+		Keys:  append([]string{}, d.entries.Keys...),
+		Roles: append([]string{}, d.entries.Roles...),
+	}
+}
+
+func (d *DenyList) deniesUser(username string) bool {
+	d.RLock()
+	defer d.RUnlock()
+	for _, denied := range d.entries.Users {
+		if denied == username {
+			return true
+		}
+	}
+	return false
+}
+
+func (d *DenyList) deniesKey(fingerprint string) bool {
+	d.RLock()
+	defer d.RUnlock()
+	for _, denied := range d.entries.Keys {
+		if denied == fingerprint {
+			return true
+		}
+	}
+	return false
+}
+
+func (d *DenyList) deniesRole(arn string) bool {
+	d.RLock()
+	defer d.RUnlock()
+	for _, denied := range d.entries.Roles {
+		if globMatch(denied, arn) {
+			return true
+		}
+	}
+	return false
+}
+
+/*
+BlocksFallback reports whether a denied role should also stop the
+request from falling back to the default role.
+*/
+func (d *DenyList) BlocksFallback() bool {
+	return d.blockFallback
+}
+
+/*
+list returns the entries of one kind.
+*/
+func (e *DenyEntries) list(kind string) *[]string {
+	switch kind {
+	case DenyUser:
+		return &e.Users
+	case DenyKey:
+		return &e.Keys
+	}
+	return &e.Roles
+}
+
+/*
+save writes entries to a temporary file and moves it into place, so that
+a crash never leaves a half-written list, and only then makes them the
+current entries. If the file cannot be written the list is unchanged.
+The caller must hold the lock.
+*/
+func (d *DenyList) save(entries DenyEntries) error {
+	if d.path != "" {
+		contents, err := json.MarshalIndent(entries, "", "  ")
+		if err != nil {
+			return err
+		}
+		tmp := d.path + ".tmp"
+		if err := ioutil.WriteFile(tmp, contents, 0600); err != nil {
+			return err
+		}
+		if err := os.Rename(tmp, d.path); err != nil {
+			return err
+		}
+	}
+	d.entries = entries
+	return nil
+}
+
+func checkDenyEntry(kind string, value string) error {
+	switch {
+	case kind != DenyUser && kind != DenyKey && kind != DenyRole:
+		return fmt.Errorf("unknown kind of deny list entry %q; use %s, %s or %s", kind, DenyUser, DenyKey, DenyRole)
+	case value == "":
+		return fmt.Errorf("empty %s", kind)
+	case kind == DenyKey && !strings.HasPrefix(value, "SHA256:"):
+		return fmt.Errorf("%q is not a SHA256 key fingerprint", value)
+	case kind == DenyRole && !strings.HasPrefix(value, "arn:"):
+		return fmt.Errorf("%q is not a role ARN", value)
+	}
+	return nil
+}
@@ -0,0 +1,82 @@
+// Copyright 2014 AdRoll, Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package server_test
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/AdRoll/hologram/server"
+	. "github.com/smartystreets/goconvey/convey"
+)
+
+func TestDenyList(t *testing.T) {
+	Convey("Given a deny list kept in a file that does not exist yet", t, func() {
+		dir, err := ioutil.TempDir("", "hologram-deny")
+		So(err, ShouldBeNil)
+		defer os.RemoveAll(dir)
+		path := filepath.Join(dir, "deny.json")
+
+		deny, err := server.NewDenyList(path, false)
+		So(err, ShouldBeNil)
+		So(deny.Entries().Users, ShouldBeEmpty)
+
+		Convey("Entries should be saved and survive a restart", func() {
+			So(deny.Add(server.DenyUser, "mallory"), ShouldBeNil)
+			So(deny.Add(server.DenyKey, "SHA256:abc"), ShouldBeNil)
+			So(deny.Add(server.DenyUser, "mallory"), ShouldBeNil)
+
+			restarted, err := server.NewDenyList(path, false)
+			So(err, ShouldBeNil)
+			So(restarted.Entries().Users, ShouldResemble, []string{"mallory"})
+			So(restarted.Entries().Keys, ShouldResemble, []string{"SHA256:abc"})
+		})
+
+		Convey("Removed entries should be gone from the file too", func() {
+			So(deny.Add(server.DenyRole, "arn:aws:iam::*:role/admin"), ShouldBeNil)
+			So(deny.Remove(server.DenyRole, "arn:aws:iam::*:role/admin"), ShouldBeNil)
+			So(deny.Remove(server.DenyRole, "arn:aws:iam::*:role/admin"), ShouldNotBeNil)
+
+			restarted, err := server.NewDenyList(path, false)
+			So(err, ShouldBeNil)
+			So(restarted.Entries().Roles, ShouldBeEmpty)
+		})
+
+		Convey("A change that cannot be saved should not take effect", func() {
+			So(deny.Add(server.DenyUser, "mallory"), ShouldBeNil)
+			So(os.RemoveAll(dir), ShouldBeNil)
+
+			So(deny.Add(server.DenyUser, "eve"), ShouldNotBeNil)
+			So(deny.Remove(server.DenyUser, "mallory"), ShouldNotBeNil)
+			So(deny.Entries().Users, ShouldResemble, []string{"mallory"})
+		})
+
+		Convey("Malformed entries should be refused", func() {
+			So(deny.Add("laptop", "x"), ShouldNotBeNil)
+			So(deny.Add(server.DenyUser, ""), ShouldNotBeNil)
+			So(deny.Add(server.DenyKey, "aa:bb:cc"), ShouldNotBeNil)
+			So(deny.Add(server.DenyRole, "admin"), ShouldNotBeNil)
+		})
+
+		Convey("A hand edit that breaks the file should keep the current entries", func() {
+			So(deny.Add(server.DenyUser, "mallory"), ShouldBeNil)
+			So(ioutil.WriteFile(path, []byte("{"), 0600), ShouldBeNil)
+			So(deny.Reload(), ShouldNotBeNil)
+			So(deny.Entries().Users, ShouldResemble, []string{"mallory"})
+		})
+	})
+}
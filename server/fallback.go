@@ -0,0 +1,78 @@
+// Copyright 2014 AdRoll, Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package server
+
+import (
+	"fmt"
+	"strings"
+)
+
+// When a user who asked for a role they cannot have gets their default
+// role instead.
+const (
+	FallbackOff    = "off"
+	FallbackOn     = "on"
+	FallbackGroups = "groups"
+)
+
+/*
+FallbackPolicy decides whether a failed AssumeRole may be answered with
+credentials for the user's default role. Falling back is never silent:
+the response names both the requested and the granted role.
+*/
+type FallbackPolicy struct {
+	mode   string
+	groups []string
+}
+
+/*
+NewFallbackPolicy returns a policy for the given mode. In FallbackGroups
+mode only members of one of groups, given either as a DN or as the
+group's name, fall back.
+*/
+func NewFallbackPolicy(mode string, groups []string) (*FallbackPolicy, error) {
+	switch mode {
+	case FallbackOff, FallbackOn:
+	case FallbackGroups:
+		if len(groups) == 0 {
+			return nil, fmt.Errorf("fallback mode %q needs at least one group", mode)
+		}
+	default:
+		return nil, fmt.Errorf("unknown fallback mode %q", mode)
+	}
+	return &FallbackPolicy{mode: mode, groups: groups}, nil
+}
+
+/*
+Allowed reports whether user may fall back to their default role.
+*/
+func (p *FallbackPolicy) Allowed(user *User) bool {
+	if user.DefaultRole == "" {
+		return false
+	}
+	switch p.mode {
+	case FallbackOn:
+		return true
+	case FallbackGroups:
+		for _, dn := range user.MemberOf {
+			for _, group := range p.groups {
+				if strings.EqualFold(dn, group) || strings.EqualFold(groupName(dn), group) {
+					return true
+				}
+			}
+		}
+	}
+	return false
+}
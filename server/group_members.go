@@ -0,0 +1,116 @@
+// Copyright 2014 AdRoll, Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package server
+
+import (
+	"strings"
+
+	"github.com/nmcclain/ldap"
+)
+
+/*
+WithGroupMembership makes the cache also work out group membership from
+the given attributes of group entries, such as member, uniqueMember or
+memberUid, for directories that do not keep memberOf up to date. Values
+that are DNs are matched against the DNs of users and groups, and other
+values against usernames, so both styles can be used in one directory.
+*/
+func WithGroupMembership(memberAttrs []string) LDAPOption {
+	return func(luc *ldapUserCache) error {
+		luc.memberAttrs = memberAttrs
+		return nil
+	}
+}
+
+/*
+groupMembers returns the values of a group entry's membership
+attributes.
+*/
+func (luc *ldapUserCache) groupMembers(entry *ldap.Entry) []string {
+	members := []string{}
+	for _, attribute := range luc.memberAttrs {
+		members = append(members, entry.GetAttributeValues(attribute)...)
+	}
+	return members
+}
+
+/*
+memberIndex maps the members listed on group entries to the DNs of the
+groups listing them.
+*/
+type memberIndex struct {
+	byDN       map[string][]string
+	byUsername map[string][]string
+}
+
+/*
+newMemberIndex indexes the Members of every group.
+*/
+func newMemberIndex(groups map[string]*Group) memberIndex {
+	index := memberIndex{byDN: map[string][]string{}, byUsername: map[string][]string{}}
+	for dn, group := range groups {
+		for _, member := range group.Members {
+			if strings.Contains(member, "=") {
+				key := normalizeDN(member)
+				index.byDN[key] = append(index.byDN[key], dn)
+			} else {
+				key := strings.ToLower(strings.TrimSpace(member))
+				index.byUsername[key] = append(index.byUsername[key], dn)
+			}
+		}
+	}
+	return index
+}
+
+/*
+memberOf returns the DNs of the groups an entry belongs to: those in its
+own memberOf values, followed by any other group that lists its DN or,
+if username is not empty, its username as a member.
+*/
+func (index memberIndex) memberOf(dn string, username string, memberOf []string) []string {
+	fromGroups := index.byDN[normalizeDN(dn)]
+	if username != "" {
+		fromGroups = append(append([]string{}, fromGroups...), index.byUsername[strings.ToLower(username)]...)
+	}
+	if len(fromGroups) == 0 {
+		return memberOf
+	}
+
+	seen := map[string]bool{}
+	all := []string{}
+	for _, group := range append(append([]string{}, memberOf...), fromGroups...) {
+		if key := normalizeDN(group); !seen[key] {
+			seen[key] = true
+			all = append(all, group)
+		}
+	}
+	return all
+}
+
+/*
+normalizeDN puts a DN in a form that can be compared with others: lower
+case, with no spaces around the separators.
+*/
+func normalizeDN(dn string) string {
+	rdns := strings.Split(dn, ",")
+	for i, rdn := range rdns {
+		parts := strings.SplitN(rdn, "=", 2)
+		for j := range parts {
+			parts[j] = strings.TrimSpace(parts[j])
+		}
+		rdns[i] = strings.Join(parts, "=")
+	}
+	return strings.ToLower(strings.Join(rdns, ","))
+}
@@ -0,0 +1,87 @@
+// Copyright 2014 AdRoll, Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package server_test
+
+import (
+	"testing"
+
+	"github.com/AdRoll/hologram/server"
+	"github.com/peterbourgon/g2s"
+	. "github.com/smartystreets/goconvey/convey"
+)
+
+func TestGroupMembership(t *testing.T) {
+	Convey("Given a directory without memberOf, listing members on the groups", t, func() {
+		directory := &directoryStub{}
+		directory.add("cn=developers,ou=groups,dc=example,dc=com", []string{"objectClass", "groupOfNames"}, []string{"roleAttribute", "developer"},
+			[]string{"uniqueMember", "CN=Bob, dc=example, dc=com"}, []string{"modifyTimestamp", "20240101000000Z"})
+		directory.add("cn=ops,ou=groups,dc=example,dc=com", []string{"objectClass", "groupOfNames"}, []string{"roleAttribute", "ops"},
+			[]string{"memberUid", "alice"}, []string{"modifyTimestamp", "20240101000000Z"})
+		directory.add("cn=admins,ou=groups,dc=example,dc=com", []string{"objectClass", "groupOfNames"}, []string{"roleAttribute", "admin"},
+			[]string{"uniqueMember", "cn=ops,ou=groups,dc=example,dc=com"}, []string{"modifyTimestamp", "20240101000000Z"})
+		directory.add("cn=alice,dc=example,dc=com", []string{"cn", "alice"}, []string{"sshPublicKey", authorizedKey(testKeys[0])},
+			[]string{"modifyTimestamp", "20240101000000Z"})
+		directory.add("cn=bob,dc=example,dc=com", []string{"cn", "bob"}, []string{"sshPublicKey", authorizedKey(testKeys[1])},
+			[]string{"modifyTimestamp", "20240101000000Z"})
+
+		authorizer := server.NewLDAPGroupAuthorizer("123456", &map[string]string{})
+		authorized := func(users map[string]*server.User, username string, role string) bool {
+			_, err := authorizer.Authorize(users[username], role)
+			return err == nil
+		}
+
+		Convey("Users should belong to no groups by default", func() {
+			lc, err := server.NewLDAPUserCache(directory, g2s.Noop(), "cn", "dc=example,dc=com", true, "roleAttribute", "default", "", "groupOfNames", "sshPublicKey", "", "", nil)
+			So(err, ShouldBeNil)
+			So(lc.Users()["alice"].Groups, ShouldBeEmpty)
+			So(authorized(lc.Users(), "alice", "ops"), ShouldBeFalse)
+		})
+
+		Convey("With membership attributes configured", func() {
+			lc, err := server.NewLDAPUserCache(directory, g2s.Noop(), "cn", "dc=example,dc=com", true, "roleAttribute", "default", "", "groupOfNames", "sshPublicKey", "", "", nil,
+				server.WithGroupMembership([]string{"uniqueMember", "memberUid"}))
+			So(err, ShouldBeNil)
+
+			Convey("Users listed by DN should belong to the group", func() {
+				So(lc.Users()["bob"].MemberOf, ShouldResemble, []string{"cn=developers,ou=groups,dc=example,dc=com"})
+				So(authorized(lc.Users(), "bob", "developer"), ShouldBeTrue)
+			})
+
+			Convey("Users listed by username should belong to the group", func() {
+				So(lc.Users()["alice"].MemberOf, ShouldResemble, []string{"cn=ops,ou=groups,dc=example,dc=com"})
+				So(authorized(lc.Users(), "alice", "ops"), ShouldBeTrue)
+				So(authorized(lc.Users(), "bob", "ops"), ShouldBeFalse)
+			})
+
+			Convey("Groups listed as members should nest", func() {
+				So(authorized(lc.Users(), "alice", "admin"), ShouldBeFalse)
+				lc.SetNestedGroups(0)
+				grant, err := authorizer.Authorize(lc.Users()["alice"], "admin")
+				So(err, ShouldBeNil)
+				So(grant.GrantedBy, ShouldResemble, []string{"cn=ops,ou=groups,dc=example,dc=com", "cn=admins,ou=groups,dc=example,dc=com"})
+			})
+
+			Convey("A member added by an incremental sync should get the group's roles", func() {
+				lc.SetIncrementalSync(0)
+				directory.add("cn=ops,ou=groups,dc=example,dc=com", []string{"objectClass", "groupOfNames"}, []string{"roleAttribute", "ops"},
+					[]string{"memberUid", "alice", "bob"}, []string{"modifyTimestamp", "20240102000000Z"})
+				So(lc.Update(), ShouldBeNil)
+				So(directory.lastFilter(), ShouldContainSubstring, "modifyTimestamp>=")
+				So(authorized(lc.Users(), "bob", "ops"), ShouldBeTrue)
+				So(authorized(lc.Users(), "bob", "developer"), ShouldBeTrue)
+			})
+		})
+	})
+}
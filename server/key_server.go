@@ -0,0 +1,375 @@
+// Copyright 2014 AdRoll, Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package server
+
+import (
+	"bufio"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/AdRoll/hologram/log"
+	"github.com/peterbourgon/g2s"
+	"golang.org/x/crypto/ssh"
+)
+
+const (
+	// KeyMergeUnion lets users authenticate with their keys from LDAP
+	// and those from the key server alike.
+	KeyMergeUnion = "union"
+	// KeyMergeOverride uses only the keys from the key server for users
+	// it has answered for, ignoring those in LDAP.
+	KeyMergeOverride = "override"
+
+	// keyServerConcurrency is how many requests to the key server may be
+	// in flight at once for one authentication.
+	keyServerConcurrency = 8
+	// maxKeysResponse is the most of a response body that is read.
+	maxKeysResponse = 1 << 20
+)
+
+/*
+keyServer fetches users' public keys, in authorized_keys format, from an
+HTTP service with one URL per user. Answers are cached for a while, and
+then revalidated with the ETag the service gave, if any.
+*/
+type keyServer struct {
+	urlTemplate string
+	ttl         time.Duration
+	client      *http.Client
+	stats       g2s.Statter
+	lock        sync.Mutex
+	cache       map[string]*servedKeys
+}
+
+/*
+servedKeys is what the key server last said about a user. Known is false
+if it has never answered for them.
+*/
+type servedKeys struct {
+	keys    []ssh.PublicKey
+	etag    string
+	checked time.Time
+	known   bool
+}
+
+/*
+NewKeyServer returns a key source that fetches each user's keys from
+urlTemplate, with {username} replaced by their username. Keys are
+refetched at most once every ttl unless revalidation is asked for, and
+each request gives up after timeout.
+*/
+func NewKeyServer(urlTemplate string, ttl time.Duration, timeout time.Duration, stats g2s.Statter) (*keyServer, error) {
+	if !strings.Contains(urlTemplate, "{username}") {
+		return nil, fmt.Errorf("key server URL %s has no {username} in it", urlTemplate)
+	}
+	if _, err := url.Parse(strings.Replace(urlTemplate, "{username}", "user", -1)); err != nil {
+		return nil, err
+	}
+	return &keyServer{
+		urlTemplate: urlTemplate,
+		ttl:         ttl,
+		client:      &http.Client{Timeout: timeout},
+		stats:       stats,
+		cache:       map[string]*servedKeys{},
+	}, nil
+}
+
+/*
+refresh fetches the keys of those users whose cached keys are older
+than the TTL, or of all of them if revalidate is set, a few at a time.
+*/
+func (ks *keyServer) refresh(usernames []string, revalidate bool) {
+	var wg sync.WaitGroup
+	slots := make(chan struct{}, keyServerConcurrency)
+	for _, username := range usernames {
+		cached := ks.cached(username)
+		if cached != nil && !revalidate && time.Since(cached.checked) < ks.ttl {
+			continue
+		}
+
+		wg.Add(1)
+		slots <- struct{}{}
+		go func(username string) {
+			defer wg.Done()
+			defer func() { <-slots }()
+			served := ks.fetch(username, cached)
+			ks.lock.Lock()
+			ks.cache[username] = served
+			ks.lock.Unlock()
+		}(username)
+	}
+	wg.Wait()
+}
+
+/*
+cached returns the key server's last answer about a user, or nil if it
+has not been asked about them yet.
+*/
+func (ks *keyServer) cached(username string) *servedKeys {
+	ks.lock.Lock()
+	defer ks.lock.Unlock()
+	return ks.cache[username]
+}
+
+/*
+fetch asks the key server for a user's keys, sending the ETag of the
+cached answer so that an unchanged list need not be sent again. A user
+the server does not know has no keys there. If the server cannot be
+reached or fails, the cached answer is kept.
+*/
+func (ks *keyServer) fetch(username string, cached *servedKeys) *servedKeys {
+	start := time.Now()
+	defer func() { ks.stats.Timing(1.0, "keyServerRequest", time.Since(start)) }()
+
+	fail := func(err error) *servedKeys {
+		log.Warning("Could not fetch keys for %s from the key server: %s", username, err.Error())
+		ks.stats.Counter(1.0, "keyServerError", 1)
+		if cached == nil {
+			return &servedKeys{checked: start}
+		}
+		return &servedKeys{keys: cached.keys, etag: cached.etag, checked: start, known: cached.known}
+	}
+
+	req, err := http.NewRequest("GET", ks.url(username), nil)
+	if err != nil {
+		return fail(err)
+	}
+	if cached != nil && cached.etag != "" {
+		req.Header.Set("If-None-Match", cached.etag)
+	}
+	resp, err := ks.client.Do(req)
+	if err != nil {
+		return fail(err)
+	}
+	defer resp.Body.Close()
+
+	switch resp.StatusCode {
+	case http.StatusOK:
+		keys, err := parseAuthorizedKeys(username, io.LimitReader(resp.Body, maxKeysResponse))
+		if err != nil {
+			return fail(err)
+		}
+		ks.stats.Counter(1.0, "keyServerFetch", 1)
+		return &servedKeys{keys: keys, etag: resp.Header.Get("ETag"), checked: start, known: true}
+	case http.StatusNotModified:
+		if cached == nil {
+			return fail(fmt.Errorf("key server answered %s to an unconditional request", resp.Status))
+		}
+		ks.stats.Counter(1.0, "keyServerNotModified", 1)
+		return &servedKeys{keys: cached.keys, etag: cached.etag, checked: start, known: true}
+	case http.StatusNotFound:
+		ks.stats.Counter(1.0, "keyServerFetch", 1)
+		return &servedKeys{checked: start, known: true}
+	default:
+		return fail(fmt.Errorf("key server returned %s", resp.Status))
+	}
+}
+
+/*
+url returns the key server URL for a user.
+*/
+func (ks *keyServer) url(username string) string {
+	return strings.Replace(ks.urlTemplate, "{username}", url.PathEscape(username), -1)
+}
+
+/*
+parseAuthorizedKeys reads keys in authorized_keys format, one per line,
+skipping blank lines and comments. Lines that cannot be parsed are
+logged and skipped.
+*/
+func parseAuthorizedKeys(username string, r io.Reader) ([]ssh.PublicKey, error) {
+	keys := []ssh.PublicKey{}
+	scanner := bufio.NewScanner(r)
+	for scanner.Scan() {
+		line := strings.TrimSpace(scanner.Text())
+		if line == "" || strings.HasPrefix(line, "#") {
+			continue
+		}
+		key, _, _, _, err := ssh.ParseAuthorizedKey([]byte(line))
+		if err != nil {
+			log.Warning("SSH key parsing for user %s failed (key was '%s')!", username, line)
+			continue
+		}
+		keys = append(keys, key)
+	}
+	return keys, scanner.Err()
+}
+
+/*
+WithKeyServer makes the cache also take users' keys from a key server,
+merged with their keys in LDAP by merge, either KeyMergeUnion or
+KeyMergeOverride. Users no longer need keys in LDAP to be cached. Keys
+are fetched only for users who authenticate, never for the whole
+directory.
+*/
+func WithKeyServer(ks *keyServer, merge string) LDAPOption {
+	return func(luc *ldapUserCache) error {
+		if merge != KeyMergeUnion && merge != KeyMergeOverride {
+			return fmt.Errorf("unknown key merge policy %q", merge)
+		}
+		luc.keyServer = ks
+		luc.keyMerge = merge
+		return nil
+	}
+}
+
+/*
+userFilter is the LDAP filter for users that can be cached: those with
+keys in LDAP or, with a key server, every user entry.
+*/
+func (luc *ldapUserCache) userFilter() string {
+	if luc.keyServer == nil {
+		return fmt.Sprintf("(%s=*)", luc.pubKeysAttr)
+	}
+	return luc.entryFilter()
+}
+
+/*
+entryFilter is the LDAP filter for every entry with a username that is
+not a group, whether or not it has keys.
+*/
+func (luc *ldapUserCache) entryFilter() string {
+	if luc.groupClassAttr == "" {
+		return fmt.Sprintf("(%s=*)", luc.userAttr)
+	}
+	return fmt.Sprintf("(&(%s=*)(!(objectClass=%s)))", luc.userAttr, luc.groupClassAttr)
+}
+
+/*
+keyHolders returns the users whose keys should be checked with the key
+server before verifying a signature: the claimed user, or else the
+cached holders of the key the client named. With neither there is no
+one to ask about, since the key server is asked about one user at a
+time, and Authenticate asks the client for its username.
+*/
+func (luc *ldapUserCache) keyHolders(username string, key ssh.PublicKey) []string {
+	if luc.keyServer == nil {
+		return nil
+	}
+	if username != "" {
+		return []string{username}
+	}
+	if key == nil {
+		return nil
+	}
+	holders := []string{}
+	for _, user := range luc.current().keys[ssh.FingerprintSHA256(key)] {
+		holders = append(holders, user.Username)
+	}
+	return holders
+}
+
+/*
+serveKeys fetches the key server's keys for those of the named users
+that are cached, as keyServer.refresh does, and swaps in a snapshot with
+their keys merged in if any changed. The key server is only asked about
+users LDAP has, and no lock is held while waiting on it.
+*/
+func (luc *ldapUserCache) serveKeys(usernames []string, revalidate bool) {
+	if luc.keyServer == nil {
+		return
+	}
+	known := []string{}
+	for _, username := range usernames {
+		if _, ok := luc.current().users[username]; ok {
+			known = append(known, username)
+		}
+	}
+	if len(known) == 0 {
+		return
+	}
+	luc.keyServer.refresh(known, revalidate)
+
+	luc.updateLock.Lock()
+	defer luc.updateLock.Unlock()
+	old := luc.current()
+	merged := map[string]*User{}
+	for _, username := range known {
+		if user, ok := old.users[username]; ok {
+			if next := luc.mergeServedKeys(user); next != user {
+				merged[username] = next
+			}
+		}
+	}
+	if len(merged) == 0 {
+		return
+	}
+	users, groups := old.copyMaps()
+	for username, user := range merged {
+		users[username] = user
+	}
+	luc.swap(old, newUserSnapshot(users, groups, old.members))
+}
+
+/*
+mergeServedKeys returns user with the key server's last answer about
+them merged into their LDAP keys, or user itself if that changes
+nothing. The key server is not asked again.
+*/
+func (luc *ldapUserCache) mergeServedKeys(user *User) *User {
+	if luc.keyServer == nil {
+		return user
+	}
+	keys := user.ldapKeys
+	if served := luc.keyServer.cached(user.Username); served != nil {
+		switch {
+		case luc.keyMerge == KeyMergeOverride && served.known:
+			keys = served.keys
+		case luc.keyMerge == KeyMergeUnion:
+			keys = unionKeys(user.ldapKeys, served.keys)
+		}
+	}
+	if sameKeys(keys, user.SSHKeys) {
+		return user
+	}
+	changed := *user
+	changed.SSHKeys = keys
+	return &changed
+}
+
+/*
+unionKeys returns the keys in either list, each only once.
+*/
+func unionKeys(a []ssh.PublicKey, b []ssh.PublicKey) []ssh.PublicKey {
+	seen := map[string]bool{}
+	keys := []ssh.PublicKey{}
+	for _, key := range append(append([]ssh.PublicKey{}, a...), b...) {
+		if fp := ssh.FingerprintSHA256(key); !seen[fp] {
+			seen[fp] = true
+			keys = append(keys, key)
+		}
+	}
+	return keys
+}
+
+/*
+sameKeys reports whether two lists hold the same keys in the same order.
+*/
+func sameKeys(a []ssh.PublicKey, b []ssh.PublicKey) bool {
+	if len(a) != len(b) {
+		return false
+	}
+	for i := range a {
+		if ssh.FingerprintSHA256(a[i]) != ssh.FingerprintSHA256(b[i]) {
+			return false
+		}
+	}
+	return true
+}
@@ -0,0 +1,247 @@
+// Copyright 2014 AdRoll, Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package server_test
+
+import (
+	cryptrand "crypto/rand"
+	"crypto/sha256"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/AdRoll/hologram/server"
+	"github.com/peterbourgon/g2s"
+	. "github.com/smartystreets/goconvey/convey"
+	"golang.org/x/crypto/ssh"
+)
+
+/*
+keyServerStub serves authorized_keys text per user, with ETags, and
+counts the requests it gets. While hold is set, requests say so on it
+and then wait for it to be closed.
+*/
+type keyServerStub struct {
+	sync.Mutex
+	keys        map[string]string
+	down        bool
+	requests    int
+	notModified int
+	hold        chan struct{}
+}
+
+func (ks *keyServerStub) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	ks.Lock()
+	hold := ks.hold
+	ks.Unlock()
+	if hold != nil {
+		hold <- struct{}{}
+		<-hold
+	}
+
+	ks.Lock()
+	defer ks.Unlock()
+	ks.requests++
+	if ks.down {
+		http.Error(w, "down for maintenance", http.StatusServiceUnavailable)
+		return
+	}
+	keys, ok := ks.keys[strings.TrimSuffix(strings.TrimPrefix(r.URL.Path, "/"), ".keys")]
+	if !ok {
+		http.NotFound(w, r)
+		return
+	}
+	etag := fmt.Sprintf(`"%x"`, sha256.Sum256([]byte(keys)))
+	if r.Header.Get("If-None-Match") == etag {
+		ks.notModified++
+		w.WriteHeader(http.StatusNotModified)
+		return
+	}
+	w.Header().Set("ETag", etag)
+	fmt.Fprint(w, keys)
+}
+
+func (ks *keyServerStub) set(username string, keys string) {
+	ks.Lock()
+	defer ks.Unlock()
+	ks.keys[username] = keys
+}
+
+/*
+keyedUserCache is what the tests need of an LDAP user cache.
+*/
+type keyedUserCache interface {
+	server.UserCache
+	Users() map[string]*server.User
+	UpdateUser(username string) error
+}
+
+func signerKey(signer ssh.Signer) string {
+	return strings.TrimSpace(string(ssh.MarshalAuthorizedKey(signer.PublicKey())))
+}
+
+func TestKeyServer(t *testing.T) {
+	Convey("Given LDAP users and a key server", t, func() {
+		ldapKey, servedKey, bobKey, newKey := newSigner(t), newSigner(t), newSigner(t), newSigner(t)
+		directory := &directoryStub{}
+		directory.add("cn=alice,dc=example,dc=com", []string{"cn", "alice"}, []string{"sshPublicKey", signerKey(ldapKey)})
+		directory.add("cn=bob,dc=example,dc=com", []string{"cn", "bob"})
+		stub := &keyServerStub{keys: map[string]string{
+			"alice": "# alice's laptop\n" + signerKey(servedKey) + "\n\nnot a key\n",
+			"bob":   signerKey(bobKey) + " bob@desktop\n",
+		}}
+		keyServer := httptest.NewServer(stub)
+		defer keyServer.Close()
+
+		ks, err := server.NewKeyServer(keyServer.URL+"/{username}.keys", time.Hour, time.Second, g2s.Noop())
+		So(err, ShouldBeNil)
+		var lc keyedUserCache
+		newCache := func(merge string) error {
+			cache, err := server.NewLDAPUserCache(directory, g2s.Noop(), "cn", "dc=example,dc=com", false, "", "default", "", "groupOfNames", "sshPublicKey", "", "", nil,
+				server.WithKeyServer(ks, merge))
+			if err == nil {
+				lc = cache
+			}
+			return err
+		}
+
+		authenticate := func(username string, signer ssh.Signer) *server.User {
+			challenge := randomBytes(64)
+			sig, err := signer.Sign(cryptrand.Reader, challenge)
+			So(err, ShouldBeNil)
+			user, _, err := lc.Authenticate(username, signer.PublicKey(), challenge, sig)
+			So(err, ShouldBeNil)
+			return user
+		}
+
+		Convey("A URL without a username should be refused", func() {
+			_, err := server.NewKeyServer(keyServer.URL+"/keys", time.Hour, time.Second, g2s.Noop())
+			So(err, ShouldNotBeNil)
+			So(newCache("merge"), ShouldNotBeNil)
+		})
+
+		Convey("With the union policy", func() {
+			So(newCache(server.KeyMergeUnion), ShouldBeNil)
+
+			Convey("Keys from both LDAP and the key server should work", func() {
+				So(authenticate("alice", ldapKey).Username, ShouldEqual, "alice")
+				So(authenticate("alice", servedKey).Username, ShouldEqual, "alice")
+				So(lc.Users()["alice"].SSHKeys, ShouldHaveLength, 2)
+			})
+
+			Convey("Users with no keys in LDAP should be cached", func() {
+				So(lc.Users()["bob"], ShouldNotBeNil)
+				So(authenticate("bob", bobKey).Username, ShouldEqual, "bob")
+				So(lc.Users()["bob"].SSHKeys, ShouldHaveLength, 1)
+			})
+
+			Convey("A key only the key server has should need the username the first time", func() {
+				challenge := randomBytes(64)
+				sig, err := bobKey.Sign(cryptrand.Reader, challenge)
+				So(err, ShouldBeNil)
+				_, _, err = lc.Authenticate("", bobKey.PublicKey(), challenge, sig)
+				So(err, ShouldEqual, server.ErrUsernameRequired)
+
+				So(authenticate("bob", bobKey).Username, ShouldEqual, "bob")
+				So(authenticate("", bobKey).Username, ShouldEqual, "bob")
+				So(authenticate("", ldapKey).Username, ShouldEqual, "alice")
+			})
+
+			Convey("Updates should not ask the key server about anyone", func() {
+				So(lc.Update(), ShouldBeNil)
+				So(stub.requests, ShouldEqual, 0)
+			})
+
+			Convey("Only the user authenticating should be fetched", func() {
+				So(authenticate("bob", bobKey).Username, ShouldEqual, "bob")
+				So(stub.requests, ShouldEqual, 1)
+				So(lc.Users()["alice"].SSHKeys, ShouldHaveLength, 1)
+			})
+
+			Convey("Updates should not wait on a fetch", func() {
+				hold := make(chan struct{})
+				stub.Lock()
+				stub.hold = hold
+				stub.Unlock()
+				challenge := randomBytes(64)
+				sig, err := bobKey.Sign(cryptrand.Reader, challenge)
+				So(err, ShouldBeNil)
+				done := make(chan *server.User)
+				go func() {
+					user, _, _ := lc.Authenticate("bob", bobKey.PublicKey(), challenge, sig)
+					done <- user
+				}()
+
+				<-hold
+				So(lc.Update(), ShouldBeNil)
+				stub.Lock()
+				stub.hold = nil
+				stub.Unlock()
+				close(hold)
+				So((<-done).Username, ShouldEqual, "bob")
+			})
+
+			Convey("Keys should be cached until they expire", func() {
+				So(authenticate("bob", bobKey).Username, ShouldEqual, "bob")
+				requests := stub.requests
+				So(authenticate("bob", bobKey).Username, ShouldEqual, "bob")
+				So(stub.requests, ShouldEqual, requests)
+			})
+
+			Convey("An unknown key should revalidate the user's keys", func() {
+				stub.set("bob", signerKey(newKey))
+				So(authenticate("bob", newKey).Username, ShouldEqual, "bob")
+				So(authenticate("bob", bobKey), ShouldBeNil)
+			})
+
+			Convey("Unchanged keys should not be sent again", func() {
+				So(authenticate("bob", newKey), ShouldBeNil)
+				So(stub.notModified, ShouldEqual, 1)
+				So(lc.Users()["bob"].SSHKeys, ShouldHaveLength, 1)
+			})
+
+			Convey("Keys should be kept while the key server is down", func() {
+				So(authenticate("bob", bobKey).Username, ShouldEqual, "bob")
+				stub.down = true
+				So(authenticate("bob", newKey), ShouldBeNil)
+				So(authenticate("bob", bobKey).Username, ShouldEqual, "bob")
+			})
+		})
+
+		Convey("With the override policy", func() {
+			So(newCache(server.KeyMergeOverride), ShouldBeNil)
+
+			Convey("Only the key server's keys should work", func() {
+				So(authenticate("alice", servedKey).Username, ShouldEqual, "alice")
+				So(authenticate("alice", ldapKey), ShouldBeNil)
+			})
+
+			Convey("Users the key server does not know should have no keys", func() {
+				directory.add("cn=carol,dc=example,dc=com", []string{"cn", "carol"}, []string{"sshPublicKey", signerKey(newKey)})
+				So(lc.UpdateUser("carol"), ShouldBeNil)
+				So(lc.Users()["carol"].SSHKeys, ShouldBeEmpty)
+			})
+		})
+
+		Convey("Users' LDAP keys should be used if the key server never answers", func() {
+			stub.down = true
+			So(newCache(server.KeyMergeOverride), ShouldBeNil)
+			So(authenticate("alice", ldapKey).Username, ShouldEqual, "alice")
+		})
+	})
+}
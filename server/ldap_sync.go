@@ -0,0 +1,176 @@
+// Copyright 2014 AdRoll, Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package server
+
+import (
+	"fmt"
+	"strings"
+	"time"
+
+	"github.com/nmcclain/ldap"
+)
+
+// modifyTimestampAttr is the operational attribute LDAP servers keep
+// the time of an entry's last change in.
+const modifyTimestampAttr = "modifyTimestamp"
+
+// generalizedTimeFormat is how filters give LDAP a time.
+const generalizedTimeFormat = "20060102150405Z"
+
+/*
+SetIncrementalSync makes Update() fetch only the groups and users
+modified since the last sync, going by their modifyTimestamp, with a
+full reconcile at least every fullInterval to pick up deletions and
+membership changes that do not touch the user's entry.
+*/
+func (luc *ldapUserCache) SetIncrementalSync(fullInterval time.Duration) {
+	luc.incremental = true
+	luc.fullInterval = fullInterval
+}
+
+/*
+FullSync reloads every group and user from LDAP and forgets those that
+are gone, whether or not incremental sync is on.
+*/
+func (luc *ldapUserCache) FullSync() error {
+	luc.updateLock.Lock()
+	defer luc.updateLock.Unlock()
+	return luc.sync(true)
+}
+
+/*
+SyncStatus reports when the cache was last refreshed from LDAP, and the
+error from the last attempt if it failed.
+*/
+func (luc *ldapUserCache) SyncStatus() SyncStatus {
+	luc.syncLock.Lock()
+	defer luc.syncLock.Unlock()
+	return luc.syncStatus
+}
+
+/*
+sync runs a full or incremental update and records how it went. The
+caller must hold updateLock.
+*/
+func (luc *ldapUserCache) sync(full bool) error {
+	start := time.Now()
+	err := luc.update(full)
+
+	luc.syncLock.Lock()
+	defer luc.syncLock.Unlock()
+	luc.syncStatus.LastAttempt = start
+	luc.syncStatus.Duration = time.Since(start).String()
+	luc.syncStatus.Incremental = !full
+	if err != nil {
+		luc.syncStatus.LastError = err.Error()
+		return err
+	}
+	luc.syncStatus.LastSuccess = start
+	luc.syncStatus.LastError = ""
+	if full {
+		luc.lastFull = start
+		luc.syncStatus.LastFullSync = start
+	}
+	return nil
+}
+
+/*
+incrementalDue reports whether the next Update() can be incremental:
+incremental sync must be on, a full sync must have set a high-water
+mark, and the next full reconcile must not be due yet.
+*/
+func (luc *ldapUserCache) incrementalDue() bool {
+	if !luc.incremental || luc.highWater.IsZero() {
+		return false
+	}
+	return luc.fullInterval <= 0 || time.Since(luc.lastFull) < luc.fullInterval
+}
+
+/*
+latestModified returns the newest modifyTimestamp among entries, or
+since if none is newer. The high-water mark comes from LDAP's own clock,
+so clock skew between the servers does not lose changes.
+*/
+func latestModified(entries []*ldap.Entry, since time.Time) time.Time {
+	for _, entry := range entries {
+		modified, err := parseGeneralizedTime(entry.GetAttributeValue(modifyTimestampAttr))
+		if err == nil && modified.After(since) {
+			since = modified
+		}
+	}
+	return since
+}
+
+/*
+relinkGroups points every user at the current version of their groups,
+after an incremental sync changed some of them. Users are copied rather
+than changed, since older snapshots may still be in use.
+*/
+func (luc *ldapUserCache) relinkGroups(users map[string]*User, groups map[string]*Group, members memberIndex) {
+	for username, user := range users {
+		relinked := *user
+		relinked.MemberOf = members.memberOf(user.DN, username, user.memberOfAttr)
+		relinked.Groups, relinked.GroupChains = luc.resolveGroups(groups, members, relinked.MemberOf)
+		users[username] = &relinked
+	}
+}
+
+/*
+dropKeyless removes the users of entries that have no keys left in LDAP
+from users, unless a key server may have keys for them.
+*/
+func (luc *ldapUserCache) dropKeyless(users map[string]*User, entries []*ldap.Entry) {
+	if luc.keyServer != nil {
+		return
+	}
+	for _, entry := range entries {
+		username := entry.GetAttributeValue(luc.userAttr)
+		if user, ok := users[username]; ok && len(user.ldapKeys) == 0 {
+			delete(users, username)
+		}
+	}
+}
+
+/*
+changedSince narrows an LDAP filter to entries modified at or after
+since. LDAP has no strict greater-than, so entries changed in the same
+second as the last sync are fetched again, which is harmless.
+*/
+func changedSince(filter string, since time.Time) string {
+	return fmt.Sprintf("(&%s(%s>=%s))", filter, modifyTimestampAttr, since.UTC().Format(generalizedTimeFormat))
+}
+
+/*
+parseGeneralizedTime reads an LDAP GeneralizedTime such as
+20240102150405Z or, as Active Directory writes it, 20240102150405.0Z.
+*/
+func parseGeneralizedTime(value string) (time.Time, error) {
+	if value == "" {
+		return time.Time{}, fmt.Errorf("no timestamp")
+	}
+	if i := strings.IndexAny(value, ".,"); i >= 0 {
+		end := strings.IndexAny(value[i:], "Z+-")
+		if end < 0 {
+			return time.Time{}, fmt.Errorf("malformed timestamp %q", value)
+		}
+		value = value[:i] + value[i+end:]
+	}
+	for _, layout := range []string{generalizedTimeFormat, "20060102150405-0700"} {
+		if t, err := time.Parse(layout, value); err == nil {
+			return t.UTC(), nil
+		}
+	}
+	return time.Time{}, fmt.Errorf("malformed timestamp %q", value)
+}
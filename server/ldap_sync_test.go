@@ -0,0 +1,191 @@
+// Copyright 2014 AdRoll, Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package server_test
+
+import (
+	"strings"
+	"testing"
+
+	"github.com/AdRoll/hologram/server"
+	ber "github.com/nmcclain/asn1-ber"
+	"github.com/nmcclain/ldap"
+	"github.com/peterbourgon/g2s"
+	. "github.com/smartystreets/goconvey/convey"
+	"golang.org/x/crypto/ssh"
+)
+
+/*
+directoryStub is an LDAP server holding a fixed set of entries, which
+evaluates search filters against them and records every filter it gets.
+*/
+type directoryStub struct {
+	entries []*ldap.Entry
+	filters []string
+}
+
+func (d *directoryStub) Search(s *ldap.SearchRequest) (*ldap.SearchResult, error) {
+	d.filters = append(d.filters, s.Filter)
+	filter, err := ldap.CompileFilter(s.Filter)
+	if err != nil {
+		return nil, err
+	}
+	result := &ldap.SearchResult{}
+	for _, entry := range d.entries {
+		if applyFilter(filter, entry) {
+			result.Entries = append(result.Entries, entry)
+		}
+	}
+	return result, nil
+}
+
+func (d *directoryStub) Modify(*ldap.ModifyRequest) error { return nil }
+
+/*
+add puts an entry in the directory, replacing any with the same DN.
+Attributes are given as name, value, value... lists.
+*/
+func (d *directoryStub) add(dn string, attributes ...[]string) {
+	entry := &ldap.Entry{DN: dn}
+	for _, attribute := range attributes {
+		entry.Attributes = append(entry.Attributes, &ldap.EntryAttribute{Name: attribute[0], Values: attribute[1:]})
+	}
+	d.remove(dn)
+	d.entries = append(d.entries, entry)
+}
+
+func (d *directoryStub) remove(dn string) {
+	for i, entry := range d.entries {
+		if entry.DN == dn {
+			d.entries = append(d.entries[:i], d.entries[i+1:]...)
+			return
+		}
+	}
+}
+
+func (d *directoryStub) lastFilter() string {
+	return d.filters[len(d.filters)-1]
+}
+
+/*
+applyFilter is ldap.ServerApplyFilter with support for the >= matches
+it lacks; timestamps in the same format compare correctly as strings.
+*/
+func applyFilter(f *ber.Packet, entry *ldap.Entry) bool {
+	switch f.Tag {
+	case ldap.FilterAnd:
+		for _, child := range f.Children {
+			if !applyFilter(child, entry) {
+				return false
+			}
+		}
+		return true
+	case ldap.FilterOr:
+		for _, child := range f.Children {
+			if applyFilter(child, entry) {
+				return true
+			}
+		}
+		return false
+	case ldap.FilterNot:
+		return !applyFilter(f.Children[0], entry)
+	case ldap.FilterGreaterOrEqual:
+		value := entry.GetAttributeValue(f.Children[0].Value.(string))
+		return value != "" && value >= f.Children[1].Value.(string)
+	}
+	ok, _ := ldap.ServerApplyFilter(f, entry)
+	return ok
+}
+
+func authorizedKey(private []byte) string {
+	signer, err := ssh.ParsePrivateKey(private)
+	if err != nil {
+		panic(err)
+	}
+	return strings.TrimSpace(string(ssh.MarshalAuthorizedKey(signer.PublicKey())))
+}
+
+func TestIncrementalSync(t *testing.T) {
+	Convey("Given an LDAP user cache syncing incrementally", t, func() {
+		directory := &directoryStub{}
+		directory.add("cn=devs,dc=example,dc=com", []string{"objectClass", "groupOfNames"}, []string{"roleAttribute", "developer"},
+			[]string{"modifyTimestamp", "20240101000000Z"})
+		directory.add("cn=alice,dc=example,dc=com", []string{"cn", "alice"}, []string{"sshPublicKey", authorizedKey(testKeys[0])},
+			[]string{"memberOf", "cn=devs,dc=example,dc=com"}, []string{"modifyTimestamp", "20240102000000Z"})
+		directory.add("cn=bob,dc=example,dc=com", []string{"cn", "bob"}, []string{"sshPublicKey", authorizedKey(testKeys[1])},
+			[]string{"modifyTimestamp", "20240103000000.0Z"})
+
+		lc, err := server.NewLDAPUserCache(directory, g2s.Noop(), "cn", "dc=example,dc=com", true, "roleAttribute", "default", "", "groupOfNames", "sshPublicKey", "", "", nil)
+		So(err, ShouldBeNil)
+		lc.SetIncrementalSync(0)
+		So(lc.Users(), ShouldContainKey, "bob")
+		status := lc.SyncStatus()
+		So(status.LastSuccess.IsZero(), ShouldBeFalse)
+		So(status.LastFullSync, ShouldEqual, status.LastSuccess)
+		So(status.LastError, ShouldBeEmpty)
+
+		Convey("Updates should only ask for entries changed since the newest one seen", func() {
+			So(lc.Update(), ShouldBeNil)
+			So(directory.lastFilter(), ShouldEqual, "(&(&(cn=*)(!(objectClass=groupOfNames)))(modifyTimestamp>=20240103000000Z))")
+			So(lc.SyncStatus().Incremental, ShouldBeTrue)
+		})
+
+		Convey("A changed user should be picked up by an incremental update", func() {
+			directory.add("cn=carol,dc=example,dc=com", []string{"cn", "carol"}, []string{"sshPublicKey", authorizedKey(testKeys[0])},
+				[]string{"modifyTimestamp", "20240104000000Z"})
+			So(lc.Update(), ShouldBeNil)
+			So(lc.Users(), ShouldContainKey, "carol")
+			So(directory.lastFilter(), ShouldContainSubstring, "20240103000000Z")
+
+			So(lc.Update(), ShouldBeNil)
+			So(directory.lastFilter(), ShouldContainSubstring, "20240104000000Z")
+		})
+
+		Convey("A changed group should reach the users already in it", func() {
+			directory.add("cn=devs,dc=example,dc=com", []string{"objectClass", "groupOfNames"}, []string{"roleAttribute", "developer", "deployer"},
+				[]string{"modifyTimestamp", "20240105000000Z"})
+			So(lc.Update(), ShouldBeNil)
+			So(lc.Users()["alice"].Groups[0].ARNs, ShouldResemble, []string{"developer", "deployer"})
+		})
+
+		Convey("A user whose last key is removed should be dropped by an incremental update", func() {
+			directory.add("cn=bob,dc=example,dc=com", []string{"cn", "bob"}, []string{"modifyTimestamp", "20240104000000Z"})
+			So(lc.Update(), ShouldBeNil)
+			So(lc.SyncStatus().Incremental, ShouldBeTrue)
+			So(lc.Users(), ShouldNotContainKey, "bob")
+			So(lc.Users(), ShouldContainKey, "alice")
+		})
+
+		Convey("Deleted users should only disappear on a full sync", func() {
+			directory.remove("cn=bob,dc=example,dc=com")
+			So(lc.Update(), ShouldBeNil)
+			So(lc.Users(), ShouldContainKey, "bob")
+
+			So(lc.FullSync(), ShouldBeNil)
+			So(lc.Users(), ShouldNotContainKey, "bob")
+			So(directory.lastFilter(), ShouldEqual, "(sshPublicKey=*)")
+		})
+	})
+
+	Convey("Without incremental sync every update should be a full one", t, func() {
+		directory := &directoryStub{}
+		directory.add("cn=alice,dc=example,dc=com", []string{"cn", "alice"}, []string{"sshPublicKey", authorizedKey(testKeys[0])},
+			[]string{"modifyTimestamp", "20240102000000Z"})
+		lc, err := server.NewLDAPUserCache(directory, g2s.Noop(), "cn", "dc=example,dc=com", false, "", "default", "", "groupOfNames", "sshPublicKey", "", "", nil)
+		So(err, ShouldBeNil)
+		So(lc.Update(), ShouldBeNil)
+		So(directory.lastFilter(), ShouldEqual, "(sshPublicKey=*)")
+		So(lc.SyncStatus().Incremental, ShouldBeFalse)
+	})
+}
@@ -0,0 +1,160 @@
+// Copyright 2014 AdRoll, Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package server
+
+import (
+	"crypto/hmac"
+	"crypto/sha1"
+	"crypto/subtle"
+	"encoding/base32"
+	"encoding/binary"
+	"fmt"
+	"strings"
+	"sync"
+	"time"
+)
+
+// When MFA is required.
+const (
+	MFAOff       = "off"
+	MFAAll       = "all"
+	MFASensitive = "sensitive"
+)
+
+const (
+	totpStep   = 30 * time.Second
+	totpDigits = 6
+)
+
+/*
+MFAVerifier decides which requests need a TOTP code on top of the SSH
+challenge, and checks the codes users send back.
+*/
+type MFAVerifier struct {
+	sync.Mutex
+	mode           string
+	sensitiveRoles []string
+	iamAccount     string
+	accountAliases *map[string]string
+	// skew is how many time steps either side of now are accepted, to
+	// allow for clock drift.
+	skew int64
+	// lastStep remembers the last accepted time step per user so that a
+	// code can only be used once.
+	lastStep map[string]int64
+	now      func() time.Time
+}
+
+/*
+NewMFAVerifier returns a verifier for the given mode. In MFASensitive mode
+only roles matching one of sensitiveRoles, which may use account aliases
+and wildcards, require a code.
+*/
+func NewMFAVerifier(mode string, sensitiveRoles []string, iamAccount string, accountAliases *map[string]string) (*MFAVerifier, error) {
+	switch mode {
+	case MFAOff, MFAAll, MFASensitive:
+	default:
+		return nil, fmt.Errorf("unknown MFA mode %q", mode)
+	}
+
+	expanded := []string{}
+	for _, role := range sensitiveRoles {
+		expanded = append(expanded, expandRolePattern(role, iamAccount, accountAliases)...)
+	}
+
+	return &MFAVerifier{
+		mode:           mode,
+		sensitiveRoles: expanded,
+		iamAccount:     iamAccount,
+		accountAliases: accountAliases,
+		skew:           1,
+		lastStep:       map[string]int64{},
+		now:            time.Now,
+	}, nil
+}
+
+/*
+Required reports whether assuming role needs a TOTP code.
+*/
+func (v *MFAVerifier) Required(role string) bool {
+	switch v.mode {
+	case MFAAll:
+		return true
+	case MFASensitive:
+		arn := BuildARN(role, v.iamAccount, v.accountAliases)
+		for _, pattern := range v.sensitiveRoles {
+			if globMatch(pattern, arn) {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+/*
+Verify checks code against the user's TOTP secret. Each code is only
+accepted once.
+*/
+func (v *MFAVerifier) Verify(user *User, code string) error {
+	if user.MFASecret == "" {
+		return fmt.Errorf("%s has not enrolled a TOTP secret", user.Username)
+	}
+	secret, err := decodeTOTPSecret(user.MFASecret)
+	if err != nil {
+		return fmt.Errorf("TOTP secret for %s is invalid: %s", user.Username, err)
+	}
+
+	v.Lock()
+	defer v.Unlock()
+
+	now := v.now().Unix() / int64(totpStep/time.Second)
+	for step := now - v.skew; step <= now+v.skew; step++ {
+		if subtle.ConstantTimeCompare([]byte(totpCode(secret, step)), []byte(strings.TrimSpace(code))) != 1 {
+			continue
+		}
+		if step <= v.lastStep[user.Username] {
+			return fmt.Errorf("TOTP code for %s was already used", user.Username)
+		}
+		v.lastStep[user.Username] = step
+		return nil
+	}
+	return fmt.Errorf("TOTP code for %s is not valid", user.Username)
+}
+
+/*
+decodeTOTPSecret reads a base32 secret as shown by authenticator apps,
+ignoring case, spaces and missing padding.
+*/
+func decodeTOTPSecret(secret string) ([]byte, error) {
+	secret = strings.ToUpper(strings.Replace(secret, " ", "", -1))
+	return base32.StdEncoding.WithPadding(base32.NoPadding).DecodeString(strings.TrimRight(secret, "="))
+}
+
+/*
+totpCode computes the RFC 6238 code for a time step, using HMAC-SHA1 as
+authenticator apps do by default.
+*/
+func totpCode(secret []byte, step int64) string {
+	counter := make([]byte, 8)
+	binary.BigEndian.PutUint64(counter, uint64(step))
+
+	mac := hmac.New(sha1.New, secret)
+	mac.Write(counter)
+	sum := mac.Sum(nil)
+
+	offset := sum[len(sum)-1] & 0x0f
+	value := binary.BigEndian.Uint32(sum[offset:offset+4]) & 0x7fffffff
+	return fmt.Sprintf("%0*d", totpDigits, value%1000000)
+}
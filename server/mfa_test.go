@@ -0,0 +1,92 @@
+// Copyright 2014 AdRoll, Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package server_test
+
+import (
+	"crypto/hmac"
+	"crypto/sha1"
+	"encoding/base32"
+	"encoding/binary"
+	"fmt"
+	"testing"
+	"time"
+
+	"github.com/AdRoll/hologram/server"
+	. "github.com/smartystreets/goconvey/convey"
+)
+
+// The RFC 6238 test secret, "12345678901234567890", in base32.
+const testTOTPSecret = "GEZDGNBVGY3TQOJQGEZDGNBVGY3TQOJQ"
+
+/*
+totp computes a code the way an authenticator app would.
+*/
+func totp(secret string, t time.Time) string {
+	key, _ := base32.StdEncoding.DecodeString(secret)
+	counter := make([]byte, 8)
+	binary.BigEndian.PutUint64(counter, uint64(t.Unix()/30))
+
+	mac := hmac.New(sha1.New, key)
+	mac.Write(counter)
+	sum := mac.Sum(nil)
+	offset := sum[len(sum)-1] & 0x0f
+	return fmt.Sprintf("%06d", (binary.BigEndian.Uint32(sum[offset:])&0x7fffffff)%1000000)
+}
+
+func TestMFAVerifier(t *testing.T) {
+	Convey("The test TOTP generator should match RFC 6238", t, func() {
+		So(totp(testTOTPSecret, time.Unix(59, 0)), ShouldEqual, "287082")
+	})
+
+	Convey("Given an MFA verifier for sensitive roles", t, func() {
+		aliases := map[string]string{"prod": "arn:aws:iam::5432"}
+		mfa, err := server.NewMFAVerifier(server.MFASensitive, []string{"prod/admin-*"}, "123456", &aliases)
+		So(err, ShouldBeNil)
+
+		Convey("Only matching roles should need a code", func() {
+			So(mfa.Required("prod/admin-db"), ShouldBeTrue)
+			So(mfa.Required("arn:aws:iam::5432:role/admin-db"), ShouldBeTrue)
+			So(mfa.Required("prod/readonly"), ShouldBeFalse)
+			So(mfa.Required("admin-db"), ShouldBeFalse)
+		})
+
+		user := &server.User{Username: "alice", MFASecret: testTOTPSecret}
+
+		Convey("A current code should be accepted once", func() {
+			code := totp(testTOTPSecret, time.Now())
+			So(mfa.Verify(user, code), ShouldBeNil)
+			So(mfa.Verify(user, code), ShouldNotBeNil)
+		})
+
+		Convey("A wrong code should be rejected", func() {
+			So(mfa.Verify(user, "000000x"), ShouldNotBeNil)
+		})
+
+		Convey("A user without a secret cannot pass", func() {
+			So(mfa.Verify(&server.User{Username: "bob"}, totp(testTOTPSecret, time.Now())), ShouldNotBeNil)
+		})
+	})
+
+	Convey("An MFA verifier for all requests should always need a code", t, func() {
+		mfa, err := server.NewMFAVerifier(server.MFAAll, nil, "123456", nil)
+		So(err, ShouldBeNil)
+		So(mfa.Required("anything"), ShouldBeTrue)
+	})
+
+	Convey("An unknown MFA mode should be refused", t, func() {
+		_, err := server.NewMFAVerifier("sometimes", nil, "123456", nil)
+		So(err, ShouldNotBeNil)
+	})
+}
@@ -0,0 +1,145 @@
+// Copyright 2014 AdRoll, Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package server
+
+import (
+	"sort"
+	"strings"
+
+	"github.com/AdRoll/hologram/log"
+)
+
+// DefaultMaxGroupDepth is how deeply groups may be nested when no limit
+// is configured.
+const DefaultMaxGroupDepth = 8
+
+/*
+SetNestedGroups makes users members of every group their groups are
+nested in, up to maxDepth levels above the groups they belong to
+directly, so that they get the roles of all of them. A maxDepth of zero
+or less means DefaultMaxGroupDepth. The cached users are relinked at
+once.
+*/
+func (luc *ldapUserCache) SetNestedGroups(maxDepth int) {
+	if maxDepth <= 0 {
+		maxDepth = DefaultMaxGroupDepth
+	}
+
+	luc.updateLock.Lock()
+	defer luc.updateLock.Unlock()
+	luc.maxGroupDepth = maxDepth
+	old := luc.current()
+	users, groups := old.copyMaps()
+	warnGroupCycles(groups, old.members)
+	luc.relinkGroups(users, groups, old.members)
+	luc.swap(old, newUserSnapshot(users, groups, old.members))
+}
+
+/*
+resolveGroups returns the known groups among a user's memberOf values
+and, with nested groups on, every group those are nested in, through
+either side of the membership. It also returns the chain of DNs leading
+to each one. Groups are visited breadth first, so each chain is the
+shortest one, and each group only once, so loops in the nesting end
+there.
+*/
+func (luc *ldapUserCache) resolveGroups(groups map[string]*Group, members memberIndex, memberOf []string) ([]*Group, map[string][]string) {
+	userGroups := []*Group{}
+	chains := map[string][]string{}
+	if !luc.enableLDAPRoles {
+		return userGroups, chains
+	}
+
+	queue := []string{}
+	for _, dn := range memberOf {
+		if _, seen := chains[dn]; seen || groups[dn] == nil {
+			continue
+		}
+		chains[dn] = []string{dn}
+		queue = append(queue, dn)
+	}
+	for len(queue) > 0 {
+		dn := queue[0]
+		queue = queue[1:]
+		group := groups[dn]
+		userGroups = append(userGroups, group)
+
+		chain := chains[dn]
+		if len(chain) > luc.maxGroupDepth {
+			if luc.maxGroupDepth > 0 {
+				log.Debug("Not following the groups %s is nested in: it is %d levels deep already.", dn, len(chain)-1)
+			}
+			continue
+		}
+		for _, parent := range members.memberOf(dn, "", group.MemberOf) {
+			if _, seen := chains[parent]; seen || groups[parent] == nil {
+				continue
+			}
+			chains[parent] = append(append([]string{}, chain...), parent)
+			queue = append(queue, parent)
+		}
+	}
+	return userGroups, chains
+}
+
+/*
+warnGroupCycles logs every group that is, through other groups, nested
+in itself. Such loops are harmless to resolveGroups but are almost
+always a mistake in the directory.
+*/
+func warnGroupCycles(groups map[string]*Group, members memberIndex) {
+	const (
+		unvisited = iota
+		visiting
+		done
+	)
+	state := map[string]int{}
+	path := []string{}
+
+	var visit func(dn string)
+	visit = func(dn string) {
+		state[dn] = visiting
+		path = append(path, dn)
+		for _, parent := range members.memberOf(dn, "", groups[dn].MemberOf) {
+			if groups[parent] == nil {
+				continue
+			}
+			switch state[parent] {
+			case visiting:
+				for i, member := range path {
+					if member == parent {
+						loop := append(append([]string{}, path[i:]...), parent)
+						log.Warning("LDAP groups are nested in a loop: %s", strings.Join(loop, " -> "))
+					}
+				}
+			case unvisited:
+				visit(parent)
+			}
+		}
+		path = path[:len(path)-1]
+		state[dn] = done
+	}
+
+	dns := make([]string, 0, len(groups))
+	for dn := range groups {
+		dns = append(dns, dn)
+	}
+	sort.Strings(dns)
+	for _, dn := range dns {
+		if state[dn] == unvisited {
+			visit(dn)
+		}
+	}
+}
@@ -0,0 +1,94 @@
+// Copyright 2014 AdRoll, Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package server_test
+
+import (
+	"testing"
+
+	"github.com/AdRoll/hologram/server"
+	"github.com/peterbourgon/g2s"
+	. "github.com/smartystreets/goconvey/convey"
+)
+
+func TestNestedGroups(t *testing.T) {
+	Convey("Given users in team groups nested in role groups", t, func() {
+		directory := &directoryStub{}
+		group := func(dn string, role string, memberOf ...string) {
+			attributes := [][]string{{"objectClass", "groupOfNames"}, append([]string{"memberOf"}, memberOf...)}
+			if role != "" {
+				attributes = append(attributes, []string{"roleAttribute", role})
+			}
+			directory.add(dn, attributes...)
+		}
+		group("cn=admins,dc=example,dc=com", "admin")
+		group("cn=developers,dc=example,dc=com", "developer", "cn=admins,dc=example,dc=com")
+		group("cn=team,dc=example,dc=com", "", "cn=developers,dc=example,dc=com")
+		directory.add("cn=alice,dc=example,dc=com", []string{"cn", "alice"}, []string{"sshPublicKey", authorizedKey(testKeys[0])},
+			[]string{"memberOf", "cn=team,dc=example,dc=com", "cn=mailing-list,ou=lists,dc=example,dc=com"})
+
+		lc, err := server.NewLDAPUserCache(directory, g2s.Noop(), "cn", "dc=example,dc=com", true, "roleAttribute", "default", "", "groupOfNames", "sshPublicKey", "", "", nil)
+		So(err, ShouldBeNil)
+		authorizer := server.NewLDAPGroupAuthorizer("123456", &map[string]string{})
+		grantedBy := func(role string) []string {
+			grant, err := authorizer.Authorize(lc.Users()["alice"], role)
+			if err != nil {
+				return nil
+			}
+			return grant.GrantedBy
+		}
+
+		Convey("Only direct groups should count by default, without nil entries for unknown ones", func() {
+			alice := lc.Users()["alice"]
+			So(alice.Groups, ShouldHaveLength, 1)
+			So(alice.Groups[0].DN, ShouldEqual, "cn=team,dc=example,dc=com")
+			So(grantedBy("developer"), ShouldBeNil)
+		})
+
+		Convey("With nested groups on, users should get the roles of every ancestor", func() {
+			lc.SetNestedGroups(0)
+			So(lc.Users()["alice"].Groups, ShouldHaveLength, 3)
+			So(grantedBy("developer"), ShouldResemble, []string{"cn=team,dc=example,dc=com", "cn=developers,dc=example,dc=com"})
+			So(grantedBy("admin"), ShouldResemble, []string{"cn=team,dc=example,dc=com", "cn=developers,dc=example,dc=com", "cn=admins,dc=example,dc=com"})
+		})
+
+		Convey("Nesting should only be followed to the depth limit", func() {
+			lc.SetNestedGroups(1)
+			So(grantedBy("developer"), ShouldNotBeNil)
+			So(grantedBy("admin"), ShouldBeNil)
+		})
+
+		Convey("Groups nested in a loop should be resolved once each", func() {
+			group("cn=admins,dc=example,dc=com", "admin", "cn=team,dc=example,dc=com")
+			So(lc.Update(), ShouldBeNil)
+			lc.SetNestedGroups(0)
+			So(lc.Users()["alice"].Groups, ShouldHaveLength, 3)
+			So(grantedBy("admin"), ShouldHaveLength, 3)
+		})
+
+		Convey("A group moved by an incremental sync should change what users get", func() {
+			lc.SetIncrementalSync(0)
+			lc.SetNestedGroups(0)
+			directory.add("cn=developers,dc=example,dc=com", []string{"objectClass", "groupOfNames"}, []string{"roleAttribute", "developer"},
+				[]string{"modifyTimestamp", "20240101000000Z"})
+			So(lc.FullSync(), ShouldBeNil)
+			So(grantedBy("admin"), ShouldBeNil)
+
+			directory.add("cn=developers,dc=example,dc=com", []string{"objectClass", "groupOfNames"}, []string{"roleAttribute", "developer"},
+				[]string{"memberOf", "cn=admins,dc=example,dc=com"}, []string{"modifyTimestamp", "20240102000000Z"})
+			So(lc.Update(), ShouldBeNil)
+			So(grantedBy("admin"), ShouldHaveLength, 3)
+		})
+	})
+}
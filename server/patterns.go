@@ -0,0 +1,93 @@
+// Copyright 2014 AdRoll, Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package server
+
+import (
+	"strings"
+)
+
+/*
+globMatch reports whether s matches the glob pattern. A '*' matches any
+run of characters, including '/', and a '?' matches exactly one. Unlike
+path.Match this lets "role/*" cover roles with nested IAM paths.
+*/
+func globMatch(pattern string, s string) bool {
+	p, i := 0, 0
+	starP, starI := -1, 0
+	for i < len(s) {
+		if p < len(pattern) && (pattern[p] == '?' || pattern[p] == s[i]) {
+			p++
+			i++
+		} else if p < len(pattern) && pattern[p] == '*' {
+			starP, starI = p, i
+			p++
+		} else if starP != -1 {
+			p = starP + 1
+			starI++
+			i = starI
+		} else {
+			return false
+		}
+	}
+	for p < len(pattern) && pattern[p] == '*' {
+		p++
+	}
+	return p == len(pattern)
+}
+
+/*
+isPattern reports whether s contains any glob metacharacters.
+*/
+func isPattern(s string) bool {
+	return strings.ContainsAny(s, "*?")
+}
+
+/*
+expandRolePattern turns a role pattern from LDAP or a policy file into
+one or more ARN patterns, the same way BuildARN expands a role name.
+When the account alias part itself contains wildcards, as in
+"*-prod/admin", the pattern is expanded once for every matching alias.
+*/
+func expandRolePattern(pattern string, defaultAccount string, accountAliases *map[string]string) []string {
+	split := strings.Split(pattern, "/")
+	if len(split) == 2 && isPattern(split[0]) && !strings.Contains(split[0], ":") {
+		expanded := []string{}
+		if accountAliases != nil {
+			for alias := range *accountAliases {
+				if globMatch(split[0], alias) {
+					expanded = append(expanded, BuildARN(alias+"/"+split[1], defaultAccount, accountAliases))
+				}
+			}
+		}
+		return expanded
+	}
+	return []string{BuildARN(pattern, defaultAccount, accountAliases)}
+}
+
+/*
+moreSpecific reports whether pattern a describes its matches more
+narrowly than pattern b. An exact ARN beats any wildcard, and otherwise
+the pattern with more literal characters wins.
+*/
+func moreSpecific(a string, b string) bool {
+	if isPattern(a) != isPattern(b) {
+		return !isPattern(a)
+	}
+	return literalLength(a) > literalLength(b)
+}
+
+func literalLength(pattern string) int {
+	return len(pattern) - strings.Count(pattern, "*") - strings.Count(pattern, "?")
+}
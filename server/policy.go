@@ -0,0 +1,201 @@
+// Copyright 2014 AdRoll, Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package server
+
+import (
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"path/filepath"
+	"strings"
+	"sync"
+
+	"github.com/AdRoll/hologram/log"
+	"gopkg.in/yaml.v3"
+)
+
+/*
+PolicyRule maps a set of users and groups to the role ARN patterns they
+may (or, with an effect of "deny", may not) assume.
+*/
+type PolicyRule struct {
+	Users       []string `json:"users" yaml:"users"`
+	Groups      []string `json:"groups" yaml:"groups"`
+	Roles       []string `json:"roles" yaml:"roles"`
+	Effect      string   `json:"effect" yaml:"effect"`
+	MaxDuration int64    `json:"maxduration" yaml:"maxduration"`
+}
+
+/*
+Policy is the on-disk format of a policy file, in either JSON or YAML.
+*/
+type Policy struct {
+	Rules []PolicyRule `json:"rules" yaml:"rules"`
+}
+
+/*
+policyFileAuthorizer makes authorization decisions from rules kept in a
+local file so that access can be reviewed and versioned alongside other
+configuration. Deny rules always win over allow rules.
+*/
+type policyFileAuthorizer struct {
+	sync.RWMutex
+	path           string
+	iamAccount     string
+	accountAliases *map[string]string
+	rules          []PolicyRule
+}
+
+/*
+ParsePolicy decodes a policy document. YAML is used when the file name
+ends in .yaml or .yml and JSON otherwise.
+*/
+func ParsePolicy(filename string, contents []byte) (*Policy, error) {
+	policy := &Policy{}
+
+	var err error
+	switch strings.ToLower(filepath.Ext(filename)) {
+	case ".yaml", ".yml":
+		err = yaml.Unmarshal(contents, policy)
+	default:
+		err = json.Unmarshal(contents, policy)
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	for i, rule := range policy.Rules {
+		switch strings.ToLower(rule.Effect) {
+		case "", "allow", "deny":
+		default:
+			return nil, fmt.Errorf("rule %d has unknown effect %q", i, rule.Effect)
+		}
+		if len(rule.Roles) == 0 {
+			return nil, fmt.Errorf("rule %d does not list any roles", i)
+		}
+		if rule.MaxDuration < 0 {
+			return nil, fmt.Errorf("rule %d has a negative maxduration", i)
+		}
+	}
+	return policy, nil
+}
+
+/*
+Reload re-reads the policy file. The previous rules stay in effect if
+the file cannot be read or parsed.
+*/
+func (p *policyFileAuthorizer) Reload() error {
+	contents, err := ioutil.ReadFile(p.path)
+	if err != nil {
+		return err
+	}
+
+	policy, err := ParsePolicy(p.path, contents)
+	if err != nil {
+		return fmt.Errorf("could not parse policy file %s: %s", p.path, err)
+	}
+
+	// Expand account aliases once, up front.
+	for i := range policy.Rules {
+		expanded := []string{}
+		for _, role := range policy.Rules[i].Roles {
+			expanded = append(expanded, expandRolePattern(role, p.iamAccount, p.accountAliases)...)
+		}
+		policy.Rules[i].Roles = expanded
+	}
+
+	p.Lock()
+	p.rules = policy.Rules
+	p.Unlock()
+
+	log.Debug("Loaded %d rules from policy file %s.", len(policy.Rules), p.path)
+	return nil
+}
+
+func (r *PolicyRule) appliesTo(user *User) bool {
+	for _, u := range r.Users {
+		if u == "*" || u == user.Username {
+			return true
+		}
+	}
+	for _, g := range r.Groups {
+		for _, dn := range user.MemberOf {
+			if strings.EqualFold(g, dn) {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+func (r *PolicyRule) matchesRole(arn string) bool {
+	for _, pattern := range r.Roles {
+		if globMatch(pattern, arn) {
+			return true
+		}
+	}
+	return false
+}
+
+func (p *policyFileAuthorizer) Authorize(user *User, role string) (*Grant, error) {
+	arn := BuildARN(role, p.iamAccount, p.accountAliases)
+
+	p.RLock()
+	defer p.RUnlock()
+
+	var grant *Grant
+	for i := range p.rules {
+		rule := &p.rules[i]
+		if !rule.appliesTo(user) || !rule.matchesRole(arn) {
+			continue
+		}
+
+		if strings.EqualFold(rule.Effect, "deny") {
+			log.Debug("Policy rule %d denies %s to user %s", i, arn, user.Username)
+			return nil, fmt.Errorf("User %s is not authorized to assume role %s!", user.Username, arn)
+		}
+
+		duration := rule.MaxDuration
+		if duration == 0 {
+			duration = defaultSessionDuration
+		}
+		// Allow rules are a union, so the most generous matching rule wins.
+		if grant == nil || duration > grant.Duration {
+			grant = &Grant{ARN: arn, Duration: duration}
+		}
+	}
+
+	if grant == nil {
+		return nil, fmt.Errorf("User %s is not authorized to assume role %s!", user.Username, arn)
+	}
+	return grant, nil
+}
+
+/*
+NewPolicyFileAuthorizer returns an authorizer that reads its rules from
+the given JSON or YAML file.
+*/
+func NewPolicyFileAuthorizer(path string, iamAccount string, accountAliases *map[string]string) (*policyFileAuthorizer, error) {
+	p := &policyFileAuthorizer{
+		path:           path,
+		iamAccount:     iamAccount,
+		accountAliases: accountAliases,
+	}
+
+	if err := p.Reload(); err != nil {
+		return nil, err
+	}
+	return p, nil
+}
@@ -0,0 +1,364 @@
+// Copyright 2014 AdRoll, Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package server
+
+import (
+	"errors"
+	"math"
+	"net"
+	"sync"
+	"time"
+)
+
+// Clients try each key in ssh-agent in turn, one round per key.
+const defaultMaxChallengeRounds = 10
+
+// Idle entries are only swept once the limiter tracks this many keys.
+const maxTrackedKeys = 4096
+
+// A user who gets this many MFA codes wrong within the window cannot try
+// another for the lockout, unless configured otherwise.
+const (
+	defaultMFAFailures = 5
+	defaultMFAWindow   = 15 * time.Minute
+	defaultMFALockout  = 15 * time.Minute
+)
+
+var (
+	errRateLimited = errors.New("too many requests")
+	errLockedOut   = errors.New("locked out after repeated failures")
+)
+
+/*
+RateLimits bounds how hard a single client can push the server. Zero
+values turn the corresponding limit off.
+*/
+type RateLimits struct {
+	// PerIP and PerUser are the requests allowed per minute from one
+	// remote IP and for one claimed username.
+	PerIP   float64
+	PerUser float64
+	// Burst is how many requests may arrive at once; it defaults to the
+	// per-minute rate.
+	Burst int
+	// MaxChallengeRounds is how many signatures one request may try
+	// before the connection is closed.
+	MaxChallengeRounds int
+	// After LockoutFailures bad signatures for one user's keys from one
+	// IP within LockoutWindow, that user is refused from that IP for
+	// LockoutDuration.
+	LockoutFailures int
+	LockoutWindow   time.Duration
+	LockoutDuration time.Duration
+	// After MFAFailures wrong MFA codes for one user within MFAWindow,
+	// from any address, that user may not try another code for
+	// MFALockout. Unlike the other limits this one is on by default,
+	// with 5 codes in 15 minutes locking the user out for 15 minutes;
+	// a negative MFAFailures turns it off. Wrong codes also count
+	// towards the lockout above.
+	MFAFailures int
+	MFAWindow   time.Duration
+	MFALockout  time.Duration
+}
+
+/*
+rateLimiter keeps a token bucket per remote IP and per claimed username,
+and a failure record per remote IP and verified username.
+*/
+type rateLimiter struct {
+	sync.Mutex
+	limits   RateLimits
+	buckets  map[string]*bucket
+	failures map[string]*failureRecord
+	now      func() time.Time
+}
+
+type bucket struct {
+	tokens float64
+	last   time.Time
+}
+
+type failureRecord struct {
+	count       int
+	first       time.Time
+	lockedUntil time.Time
+}
+
+func newRateLimiter(limits RateLimits) *rateLimiter {
+	if limits.MaxChallengeRounds <= 0 {
+		limits.MaxChallengeRounds = defaultMaxChallengeRounds
+	}
+	if limits.MFAFailures == 0 {
+		limits.MFAFailures = defaultMFAFailures
+	}
+	if limits.MFAWindow <= 0 {
+		limits.MFAWindow = defaultMFAWindow
+	}
+	if limits.MFALockout <= 0 {
+		limits.MFALockout = defaultMFALockout
+	}
+	return &rateLimiter{
+		limits:   limits,
+		buckets:  map[string]*bucket{},
+		failures: map[string]*failureRecord{},
+		now:      time.Now,
+	}
+}
+
+/*
+allow decides whether a request from conn, claiming to be username,
+may go ahead, and if not, how long the client should wait. Lockouts are
+checked before rates, so that a locked-out client does not use up its
+tokens, and a token is only spent once every bucket has one to give.
+*/
+func (rl *rateLimiter) allow(conn string, username string) (time.Duration, error) {
+	rl.Lock()
+	defer rl.Unlock()
+
+	now := rl.now()
+	if username != "" {
+		if wait := rl.lockedFor(conn, username, now); wait > 0 {
+			return wait, errLockedOut
+		}
+	}
+
+	var buckets []*bucket
+	for _, limit := range rl.bucketLimits(conn, username) {
+		b := rl.refill(limit.key, limit.rate, now)
+		if b.tokens < 1 {
+			return time.Duration((1 - b.tokens) / limit.rate * float64(time.Minute)), errRateLimited
+		}
+		buckets = append(buckets, b)
+	}
+	for _, b := range buckets {
+		b.tokens--
+	}
+	return 0, nil
+}
+
+/*
+bucketLimit is a bucket key and the rate it refills at.
+*/
+type bucketLimit struct {
+	key  string
+	rate float64
+}
+
+/*
+bucketLimits returns the buckets a request has to take a token from. A
+connection with no remote address, which only happens for in-process
+connections, has no IP to be limited by, rather than sharing one bucket
+with every other such connection.
+*/
+func (rl *rateLimiter) bucketLimits(conn string, username string) []bucketLimit {
+	var limits []bucketLimit
+	if ip := remoteIP(conn); ip != "" && rl.limits.PerIP > 0 {
+		limits = append(limits, bucketLimit{key: "ip:" + ip, rate: rl.limits.PerIP})
+	}
+	if username != "" && rl.limits.PerUser > 0 {
+		limits = append(limits, bucketLimit{key: "user:" + username, rate: rl.limits.PerUser})
+	}
+	return limits
+}
+
+/*
+refill returns key's bucket, topped up at rate tokens per minute since it
+was last used. The caller must hold the lock.
+*/
+func (rl *rateLimiter) refill(key string, rate float64, now time.Time) *bucket {
+	burst := float64(rl.limits.Burst)
+	if burst <= 0 {
+		burst = math.Max(1, math.Ceil(rate))
+	}
+
+	b, ok := rl.buckets[key]
+	if !ok {
+		rl.sweep(now)
+		b = &bucket{tokens: burst, last: now}
+		rl.buckets[key] = b
+	}
+	b.tokens = math.Min(burst, b.tokens+now.Sub(b.last).Minutes()*rate)
+	b.last = now
+	return b
+}
+
+/*
+locked returns how much longer username is locked out from conn, or zero
+if they are not.
+*/
+func (rl *rateLimiter) locked(conn string, username string) time.Duration {
+	rl.Lock()
+	defer rl.Unlock()
+	return rl.lockedFor(conn, username, rl.now())
+}
+
+func (rl *rateLimiter) lockedFor(conn string, username string, now time.Time) time.Duration {
+	if record, ok := rl.failures[lockoutKey(conn, username)]; ok && now.Before(record.lockedUntil) {
+		return record.lockedUntil.Sub(now)
+	}
+	return 0
+}
+
+/*
+fail records a bad signature from conn for a key that belongs to
+username, and reports whether it locked them out.
+*/
+func (rl *rateLimiter) fail(conn string, username string) bool {
+	if rl.limits.LockoutFailures <= 0 {
+		return false
+	}
+	rl.Lock()
+	defer rl.Unlock()
+	return rl.record(lockoutKey(conn, username), rl.limits.LockoutFailures, rl.limits.LockoutWindow, rl.limits.LockoutDuration, rl.now())
+}
+
+/*
+failMFA records a wrong MFA code from conn for username, both towards
+the lockout for bad signatures and towards the user's own limit on MFA
+codes. It returns how long the user is now locked out for, or zero.
+*/
+func (rl *rateLimiter) failMFA(conn string, username string) time.Duration {
+	rl.Lock()
+	defer rl.Unlock()
+
+	now := rl.now()
+	if rl.limits.LockoutFailures > 0 {
+		rl.record(lockoutKey(conn, username), rl.limits.LockoutFailures, rl.limits.LockoutWindow, rl.limits.LockoutDuration, now)
+	}
+	if rl.limits.MFAFailures > 0 {
+		rl.record(mfaKey(username), rl.limits.MFAFailures, rl.limits.MFAWindow, rl.limits.MFALockout, now)
+	}
+	return rl.mfaLockedFor(conn, username, now)
+}
+
+/*
+mfaLocked returns how much longer username may not try an MFA code from
+conn, or zero if they may.
+*/
+func (rl *rateLimiter) mfaLocked(conn string, username string) time.Duration {
+	rl.Lock()
+	defer rl.Unlock()
+	return rl.mfaLockedFor(conn, username, rl.now())
+}
+
+func (rl *rateLimiter) mfaLockedFor(conn string, username string, now time.Time) time.Duration {
+	wait := rl.lockedFor(conn, username, now)
+	if record, ok := rl.failures[mfaKey(username)]; ok && record.lockedUntil.Sub(now) > wait {
+		wait = record.lockedUntil.Sub(now)
+	}
+	return wait
+}
+
+/*
+succeedMFA forgets a user's earlier wrong MFA codes once they give a
+right one.
+*/
+func (rl *rateLimiter) succeedMFA(username string) {
+	rl.Lock()
+	defer rl.Unlock()
+	key := mfaKey(username)
+	if record, ok := rl.failures[key]; ok && !rl.now().Before(record.lockedUntil) {
+		delete(rl.failures, key)
+	}
+}
+
+/*
+record counts a failure against key, and reports whether it reached
+failures within window, locking key out for duration. The caller must
+hold the lock.
+*/
+func (rl *rateLimiter) record(key string, failures int, window time.Duration, duration time.Duration, now time.Time) bool {
+	record, ok := rl.failures[key]
+	if !ok || now.Sub(record.first) > window {
+		rl.sweep(now)
+		record = &failureRecord{first: now}
+		rl.failures[key] = record
+	}
+	record.count++
+	if record.count < failures {
+		return false
+	}
+	record.lockedUntil = now.Add(duration)
+	record.count = 0
+	record.first = now
+	return true
+}
+
+/*
+succeed forgets earlier failures once a client proves who it is, so that
+a few mistyped keys do not add up to a lockout over the day.
+*/
+func (rl *rateLimiter) succeed(conn string, username string) {
+	rl.Lock()
+	defer rl.Unlock()
+	key := lockoutKey(conn, username)
+	if record, ok := rl.failures[key]; ok && !rl.now().Before(record.lockedUntil) {
+		delete(rl.failures, key)
+	}
+}
+
+/*
+lockoutKey keys failures by remote IP and verified username together, so
+that nobody can lock a user out from anywhere but their own address.
+Connections with no remote address share the username alone.
+*/
+func lockoutKey(conn string, username string) string {
+	return "lockout:" + remoteIP(conn) + "/" + username
+}
+
+/*
+mfaKey keys wrong MFA codes by username alone: whoever is guessing
+already holds one of the user's keys, so the address they guess from
+does not matter.
+*/
+func mfaKey(username string) string {
+	return "mfa:" + username
+}
+
+/*
+sweep drops buckets that have been idle for an hour and failure records
+that no longer matter, once there are enough of them to be worth the effort.
+The caller must hold the lock.
+*/
+func (rl *rateLimiter) sweep(now time.Time) {
+	if len(rl.buckets) >= maxTrackedKeys {
+		for key, b := range rl.buckets {
+			if now.Sub(b.last) > time.Hour {
+				delete(rl.buckets, key)
+			}
+		}
+	}
+	if len(rl.failures) >= maxTrackedKeys {
+		window := rl.limits.LockoutWindow
+		if rl.limits.MFAWindow > window {
+			window = rl.limits.MFAWindow
+		}
+		for key, record := range rl.failures {
+			if now.After(record.lockedUntil) && now.Sub(record.first) > window {
+				delete(rl.failures, key)
+			}
+		}
+	}
+}
+
+/*
+remoteIP strips the port from a remote address.
+*/
+func remoteIP(conn string) string {
+	if host, _, err := net.SplitHostPort(conn); err == nil {
+		return host
+	}
+	return conn
+}
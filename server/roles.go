@@ -0,0 +1,193 @@
+// Copyright 2014 AdRoll, Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package server
+
+import (
+	"sort"
+	"strings"
+
+	"github.com/AdRoll/hologram/protocol"
+)
+
+/*
+RoleInfo describes a role a user may assume. ARN may be a pattern when
+the user was granted a wildcard.
+*/
+type RoleInfo struct {
+	// Alias is the shortest name `hologram use` accepts for the role.
+	Alias       string
+	ARN         string
+	MaxDuration int64
+	Default     bool
+}
+
+/*
+RoleLister is implemented by authorizers that can say up front which
+roles a user may assume, rather than deciding one request at a time.
+*/
+type RoleLister interface {
+	ListRoles(user *User) []RoleInfo
+}
+
+/*
+ListRoles returns every role user may assume, always including their
+default role. Authorizers that allow any role list only the default.
+*/
+func (a *allowAllAuthorizer) ListRoles(user *User) []RoleInfo {
+	return listRoles(a, user, nil, a.iamAccount, a.accountAliases)
+}
+
+/*
+ListRoles returns the roles on the user's LDAP groups, with the longest
+timeout any of those groups gives each one.
+*/
+func (a *ldapGroupAuthorizer) ListRoles(user *User) []RoleInfo {
+	candidates := []RoleInfo{}
+	for _, group := range user.Groups {
+		if group == nil {
+			continue
+		}
+		for _, groupRole := range group.ARNs {
+			for _, pattern := range expandRolePattern(groupRole, a.iamAccount, a.accountAliases) {
+				candidates = append(candidates, RoleInfo{ARN: pattern, MaxDuration: group.Timeout})
+			}
+		}
+	}
+	return listRoles(a, user, candidates, a.iamAccount, a.accountAliases)
+}
+
+/*
+ListRoles returns the roles the allow rules give user, leaving out any a
+deny rule takes away entirely.
+*/
+func (p *policyFileAuthorizer) ListRoles(user *User) []RoleInfo {
+	p.RLock()
+	candidates := []RoleInfo{}
+	for i := range p.rules {
+		rule := &p.rules[i]
+		if !rule.appliesTo(user) || strings.EqualFold(rule.Effect, "deny") {
+			continue
+		}
+		duration := rule.MaxDuration
+		if duration == 0 {
+			duration = defaultSessionDuration
+		}
+		for _, pattern := range rule.Roles {
+			if !p.denied(user, pattern) {
+				candidates = append(candidates, RoleInfo{ARN: pattern, MaxDuration: duration})
+			}
+		}
+	}
+	p.RUnlock()
+	return listRoles(p, user, candidates, p.iamAccount, p.accountAliases)
+}
+
+/*
+denied reports whether a deny rule for user covers everything pattern
+matches. The caller must hold the read lock.
+*/
+func (p *policyFileAuthorizer) denied(user *User, pattern string) bool {
+	for i := range p.rules {
+		rule := &p.rules[i]
+		if strings.EqualFold(rule.Effect, "deny") && rule.appliesTo(user) && rule.matchesRole(pattern) {
+			return true
+		}
+	}
+	return false
+}
+
+/*
+listRoles merges candidates that name the same ARN, keeping the longest
+duration, adds the user's default role if authorizer grants it, and
+fills in the aliases. Roles come back sorted by alias.
+*/
+func listRoles(authorizer RoleAuthorizer, user *User, candidates []RoleInfo, iamAccount string, accountAliases *map[string]string) []RoleInfo {
+	byARN := map[string]*RoleInfo{}
+	add := func(role RoleInfo) {
+		if existing, ok := byARN[role.ARN]; ok {
+			if role.MaxDuration > existing.MaxDuration {
+				existing.MaxDuration = role.MaxDuration
+			}
+			existing.Default = existing.Default || role.Default
+			return
+		}
+		byARN[role.ARN] = &role
+	}
+
+	for _, role := range candidates {
+		add(role)
+	}
+	if user.DefaultRole != "" {
+		if grant, err := authorizer.Authorize(user, user.DefaultRole); err == nil {
+			add(RoleInfo{ARN: grant.ARN, MaxDuration: grant.Duration, Default: true})
+		}
+	}
+
+	roles := make([]RoleInfo, 0, len(byARN))
+	for _, role := range byARN {
+		role.Alias = roleAlias(role.ARN, iamAccount, accountAliases)
+		roles = append(roles, *role)
+	}
+	sort.Slice(roles, func(i, j int) bool {
+		return roles[i].Alias < roles[j].Alias
+	})
+	return roles
+}
+
+/*
+roleAlias reverses BuildARN: roles in the default account are named by
+their role name, and roles in an aliased account as alias/name. Other
+ARNs are returned as they are.
+*/
+func roleAlias(arn string, iamAccount string, accountAliases *map[string]string) string {
+	if name := strings.TrimPrefix(arn, "arn:aws:iam::"+iamAccount+":role/"); name != arn {
+		return name
+	}
+	if accountAliases == nil {
+		return arn
+	}
+	best := ""
+	for alias, account := range *accountAliases {
+		name := strings.TrimPrefix(arn, account+":role/")
+		// BuildARN only takes alias/name without further slashes.
+		if name == arn || strings.Contains(name, "/") {
+			continue
+		}
+		if best == "" || alias+"/"+name < best {
+			best = alias + "/" + name
+		}
+	}
+	if best == "" {
+		return arn
+	}
+	return best
+}
+
+/*
+NewRoleList converts roles for sending over the wire.
+*/
+func NewRoleList(roles []RoleInfo) *protocol.RoleList {
+	list := &protocol.RoleList{}
+	for i := range roles {
+		role := &roles[i]
+		list.Roles = append(list.Roles, &protocol.Role{
+			Alias:       &role.Alias,
+			Arn:         &role.ARN,
+			MaxDuration: &role.MaxDuration,
+			IsDefault:   &role.Default,
+		})
+	}
+	return list
+}
@@ -16,20 +16,54 @@
 package server
 
 import (
+	"bytes"
 	"errors"
 	"fmt"
-	"math/rand"
+	"net"
+	"time"
 
 	"github.com/AdRoll/hologram/log"
 	"github.com/AdRoll/hologram/protocol"
+	"github.com/aws/aws-sdk-go/aws/awserr"
 	"github.com/aws/aws-sdk-go/service/sts"
 	"github.com/nmcclain/ldap"
 	"github.com/peterbourgon/g2s"
 	"golang.org/x/crypto/ssh"
 )
 
+/*
+Authenticator implementers verify a signature over a challenge. The
+username and key are hints from the client and may be empty or nil, in
+which case every known key has to be tried. A signature that matches no
+known key gives a nil user and no error, unless the named user does not
+exist, which gives ErrUnknownUser, or keys can only be found by username,
+which gives ErrUsernameRequired when none was named; one that fails to
+verify against a known key gives a *BadSignatureError.
+*/
 type Authenticator interface {
-	Authenticate(username string, challenge []byte, sig *ssh.Signature) (user *User, err error)
+	Authenticate(username string, key ssh.PublicKey, challenge []byte, sig *ssh.Signature) (user *User, verifiedKey ssh.PublicKey, err error)
+}
+
+// ErrUnknownUser is returned by an Authenticator when the client named a
+// user that the directory does not have.
+var ErrUnknownUser = errors.New("unknown user")
+
+// ErrUsernameRequired is returned by an Authenticator that could not find
+// the key without a username, as when keys live on a key server.
+var ErrUsernameRequired = errors.New("a username is needed to look up SSH keys")
+
+/*
+BadSignatureError is returned by an Authenticator when the client named
+a key belonging to Username but the signature does not verify with it. Only these
+failures count towards a lockout, as they are the ones that guess at a
+known user's key.
+*/
+type BadSignatureError struct {
+	Username string
+}
+
+func (e *BadSignatureError) Error() string {
+	return fmt.Sprintf("bad signature for a key of user %s", e.Username)
 }
 
 /*
@@ -40,6 +74,15 @@ type server struct {
 	authenticator   Authenticator
 	userCache       UserCache
 	credentials     CredentialService
+	authorizer      RoleAuthorizer
+	audit           AuditSink
+	challenges      *challengeStore
+	mfa             *MFAVerifier
+	limiter         *rateLimiter
+	connections     *connectionTracker
+	fallback        *FallbackPolicy
+	deny            *DenyList
+	policyPresets   map[string]*SessionPolicy
 	stats           g2s.Statter
 	defaultRole     string
 	ldapServer      LDAPImplementation
@@ -58,6 +101,8 @@ each socket that is opened.
 func (sm *server) HandleConnection(m protocol.MessageReadWriteCloser) {
 	// Loop as long as we have this connection alive.
 	log.Debug("Opening new connection handler.")
+	sm.connections.opened(m)
+	defer sm.connections.closed(m)
 	for {
 		recvMsg, err := m.Read()
 		if err != nil {
@@ -74,11 +119,58 @@ func (sm *server) HandleConnection(m protocol.MessageReadWriteCloser) {
 		if pingMsg := recvMsg.GetPing(); pingMsg != nil {
 			sm.HandlePing(m, pingMsg)
 		} else if reqMsg := recvMsg.GetServerRequest(); reqMsg != nil {
+			sm.connections.update(m, requestName(reqMsg), claimedUser(reqMsg))
+			if !sm.allowRequest(m, reqMsg) {
+				break
+			}
 			sm.HandleServerRequest(m, reqMsg)
 		}
 	}
 }
 
+/*
+allowRequest applies the rate limits and lockouts to a request. Rejected
+clients are told why before their connection is closed.
+*/
+func (sm *server) allowRequest(m protocol.MessageReadWriteCloser, r *protocol.ServerRequest) bool {
+	conn := remoteAddr(m)
+	username := claimedUser(r)
+	retryAfter, err := sm.limiter.allow(conn, username)
+	if err == nil {
+		return true
+	}
+
+	code := protocol.ErrorCode_RATE_LIMITED
+	if err == errLockedOut {
+		code = protocol.ErrorCode_LOCKED_OUT
+		sm.stats.Counter(1.0, "errors.lockedOut", 1)
+	} else {
+		sm.stats.Counter(1.0, "errors.rateLimited", 1)
+	}
+	log.Warning("Rejecting request from %s for user %q: %s", conn, username, err.Error())
+	sm.WriteError(m, &protocol.Error{
+		Code:       code,
+		Message:    fmt.Sprintf("Request refused: %s. Try again later.", err.Error()),
+		RetryAfter: retryAfter,
+	})
+	m.Close()
+	return false
+}
+
+/*
+claimedUser returns the username a request claims to be for, if any.
+*/
+func claimedUser(r *protocol.ServerRequest) string {
+	if assumeRoleMsg := r.GetAssumeRole(); assumeRoleMsg != nil {
+		return assumeRoleMsg.GetUser()
+	} else if getUserCredentialsMsg := r.GetGetUserCredentials(); getUserCredentialsMsg != nil {
+		return getUserCredentialsMsg.GetUser()
+	} else if addSSHKeyMsg := r.GetAddSSHkey(); addSSHKeyMsg != nil {
+		return addSSHKeyMsg.GetUsername()
+	}
+	return ""
+}
+
 /*
 PingHandler returns the correct response for a ping.
 */
@@ -95,11 +187,12 @@ func (sm *server) HandlePing(m protocol.MessageReadWriteCloser, p *protocol.Ping
 	m.Write(pingMsg)
 }
 
-func (sm *server) WriteError(m protocol.MessageReadWriteCloser, errStr string) {
-	errMsg := &protocol.Message{
-		Error: &errStr,
-	}
-	m.Write(errMsg)
+/*
+WriteError reports err to the client, along with its error code if it
+is a *protocol.Error.
+*/
+func (sm *server) WriteError(m protocol.MessageReadWriteCloser, err error) {
+	m.Write(protocol.ErrorMessage(err))
 }
 
 /*
@@ -108,132 +201,339 @@ accepts from clients.
 */
 func (sm *server) HandleServerRequest(m protocol.MessageReadWriteCloser, r *protocol.ServerRequest) {
 	if assumeRoleMsg := r.GetAssumeRole(); assumeRoleMsg != nil {
-		sm.stats.Counter(1.0, "messages.assumeRole", 1)
+		sm.handleAssumeRole(m, assumeRoleMsg)
+	} else if getUserCredentialsMsg := r.GetGetUserCredentials(); getUserCredentialsMsg != nil {
+		sm.handleGetUserCredentials(m, getUserCredentialsMsg)
+	} else if addSSHKeyMsg := r.GetAddSSHkey(); addSSHKeyMsg != nil {
+		sm.handleAddSSHKey(m, addSSHKeyMsg)
+	} else if listRolesMsg := r.GetListRoles(); listRolesMsg != nil {
+		sm.handleListRoles(m, listRolesMsg)
+	} else if whoAmIMsg := r.GetWhoAmI(); whoAmIMsg != nil {
+		sm.handleWhoAmI(m, whoAmIMsg)
+	}
+}
 
-		role := assumeRoleMsg.GetRole()
+func (sm *server) handleAssumeRole(m protocol.MessageReadWriteCloser, assumeRoleMsg *protocol.AssumeRole) {
+	sm.stats.Counter(1.0, "messages.assumeRole", 1)
 
-		user, err := sm.SSHChallenge(m)
+	role := assumeRoleMsg.GetRole()
+	duration := assumeRoleMsg.GetDuration()
 
-		if err != nil {
-			m.Close()
+	user, key, err := sm.SSHChallenge(m, assumeRoleMsg.GetUser())
+
+	if err != nil {
+		m.Close()
+		return
+	}
+
+	if user == nil {
+		return
+	}
+
+	event := &AuditEvent{
+		Action:         "AssumeRole",
+		Username:       user.Username,
+		KeyFingerprint: fingerprint(key),
+		RequestedRole:  role,
+		Preset:         assumeRoleMsg.GetPreset(),
+	}
+
+	policy, err := sm.sessionPolicy(assumeRoleMsg)
+	if err != nil {
+		log.Errorf("Bad session policy from %s: %s", user.Username, err.Error())
+		sm.stats.Counter(1.0, "errors.sessionPolicy", 1)
+		event.Outcome = AuditFailure
+		event.Error = err.Error()
+		sm.recordAudit(m, event)
+		sm.WriteError(m, err)
+		return
+	}
+	if policy != nil {
+		event.SessionPolicy = policy.Policy
+		event.PolicyARNs = policy.PolicyARNs
+	}
+
+	if !sm.verifyMFA(m, user, role, event) {
+		m.Close()
+		return
+	}
+
+	creds, grant, err := sm.assumeRole(user, role, duration, policy)
+	if err != nil && !isRevoked(err) && sm.mfaSatisfied(role, event) {
+		// Update user cache and try again
+		sm.userCache.Update()
+		creds, grant, err = sm.assumeRole(user, role, duration, policy)
+	}
+	if err != nil {
+		// error message from the authorizer or Amazon, so forward that on to the client
+		log.Errorf("Error for AssumeRole: %s", err.Error())
+		sm.stats.Counter(1.0, "errors.assumeRole", 1)
+		event.Error = err.Error()
+
+		if response := sm.fallBack(user, role, duration, policy, err, event); response != nil {
+			sm.recordAudit(m, event)
+			m.Write(response)
 			return
 		}
+		event.Outcome = AuditFailure
+		sm.recordAudit(m, event)
+		sm.WriteError(m, err)
+		return
+	}
+	event.Outcome = AuditSuccess
+	event.GrantedRole = grant.ARN
+	event.GrantedBy = grant.GrantedBy
+	event.Expiration = creds.Expiration
+	sm.recordAudit(m, event)
+	m.Write(makeCredsResponse(creds, role, grant))
+}
 
-		if user != nil {
-			creds, err := sm.credentials.AssumeRole(user, role, sm.enableLDAPRoles)
-			if err != nil {
-				// Update user cache and try again
-				sm.userCache.Update()
-				creds, err := sm.credentials.AssumeRole(user, role, sm.enableLDAPRoles)
-
-				if err != nil {
-					// error message from Amazon, so forward that on to the client
-					log.Errorf("Error from AWS for AssumeRole: %s", err.Error())
-					sm.WriteError(m, err.Error())
-					sm.stats.Counter(1.0, "errors.assumeRole", 1)
-
-					// Attempt to use the default role to fall back
-					creds, err = sm.credentials.AssumeRole(user, user.DefaultRole, sm.enableLDAPRoles)
-					if err == nil {
-						m.Write(makeCredsResponse(creds))
-					}
-					return
-				}
-			}
-			m.Write(makeCredsResponse(creds))
-			return
+/*
+fallBack tries to answer a failed request for role with credentials for
+the user's default role, if the fallback policy allows it and doing so
+would not need an MFA code the user hasn't given us. It returns nil if
+the client should get the original error instead.
+*/
+func (sm *server) fallBack(user *User, role string, duration int64, policy *SessionPolicy, reason error, event *AuditEvent) *protocol.Message {
+	if !sm.fallback.Allowed(user) || role == user.DefaultRole {
+		return nil
+	}
+	if isRevoked(reason) && sm.deny.BlocksFallback() {
+		return nil
+	}
+	if sm.mfa.Required(user.DefaultRole) && !event.MFA {
+		return nil
+	}
+	creds, grant, err := sm.assumeRole(user, user.DefaultRole, duration, policy)
+	if err != nil {
+		log.Errorf("Could not fall back to %s for %s: %s", user.DefaultRole, user.Username, err.Error())
+		return nil
+	}
+	log.Warning("%s could not assume %s; falling back to %s", user.Username, role, grant.ARN)
+	sm.stats.Counter(1.0, "messages.fallback", 1)
+	event.Outcome = AuditFallback
+	event.GrantedRole = grant.ARN
+	event.GrantedBy = grant.GrantedBy
+	event.Expiration = creds.Expiration
+
+	response := makeCredsResponse(creds, role, grant)
+	fellBack := true
+	fallbackReason := reason.Error()
+	response.ServerResponse.Credentials.FellBack = &fellBack
+	response.ServerResponse.Credentials.FallbackReason = &fallbackReason
+	return response
+}
+
+func (sm *server) handleGetUserCredentials(m protocol.MessageReadWriteCloser, getUserCredentialsMsg *protocol.GetUserCredentials) {
+	sm.stats.Counter(1.0, "messages.getUserCredentialsMsg", 1)
+	user, key, err := sm.SSHChallenge(m, getUserCredentialsMsg.GetUser())
+	if err != nil {
+		log.Errorf("Error trying to handle GetUserCredentials: %s", err.Error())
+		m.Close()
+		return
+	}
+
+	if user == nil {
+		return
+	}
+
+	event := &AuditEvent{
+		Action:         "GetUserCredentials",
+		Username:       user.Username,
+		KeyFingerprint: fingerprint(key),
+		RequestedRole:  user.DefaultRole,
+	}
+
+	if !sm.verifyMFA(m, user, user.DefaultRole, event) {
+		m.Close()
+		return
+	}
+
+	creds, grant, err := sm.assumeRole(user, user.DefaultRole, 0, nil)
+	if err != nil {
+		log.Errorf("Error trying to handle GetUserCredentials: %s", err.Error())
+		// Update user cache and try again
+		if sm.mfaSatisfied(user.DefaultRole, event) {
+			sm.userCache.Update()
+			creds, grant, err = sm.assumeRole(user, user.DefaultRole, 0, nil)
 		}
-	} else if getUserCredentialsMsg := r.GetGetUserCredentials(); getUserCredentialsMsg != nil {
-		sm.stats.Counter(1.0, "messages.getUserCredentialsMsg", 1)
-		user, err := sm.SSHChallenge(m)
 		if err != nil {
-			log.Errorf("Error trying to handle GetUserCredentials: %s", err.Error())
+			errStr := fmt.Sprintf("Could not get user credentials. %s may not have been given Hologram access yet.", user.Username)
+			sm.WriteError(m, &protocol.Error{
+				Code:       protocol.AsError(err).Code,
+				Message:    errStr,
+				RetryAfter: protocol.AsError(err).RetryAfter,
+			})
+			event.Outcome = AuditFailure
+			event.Error = err.Error()
+			sm.recordAudit(m, event)
 			m.Close()
 			return
 		}
+	}
+	event.Outcome = AuditSuccess
+	event.GrantedRole = grant.ARN
+	event.GrantedBy = grant.GrantedBy
+	event.Expiration = creds.Expiration
+	sm.recordAudit(m, event)
+	m.Write(makeCredsResponse(creds, user.DefaultRole, grant))
+}
 
-		if user != nil {
-			creds, err := sm.credentials.AssumeRole(user, user.DefaultRole, sm.enableLDAPRoles)
-			if err != nil {
-				log.Errorf("Error trying to handle GetUserCredentials: %s", err.Error())
-				// Update user cache and try again
-				sm.userCache.Update()
-				creds, err = sm.credentials.AssumeRole(user, user.DefaultRole, sm.enableLDAPRoles)
-				if err != nil {
-					errStr := fmt.Sprintf("Could not get user credentials. %s may not have been given Hologram access yet.", user.Username)
-					sm.WriteError(m, errStr)
-				}
-				m.Close()
-				return
+func (sm *server) handleListRoles(m protocol.MessageReadWriteCloser, listRolesMsg *protocol.ListRoles) {
+	sm.stats.Counter(1.0, "messages.listRoles", 1)
+	user, _, err := sm.SSHChallenge(m, listRolesMsg.GetUser())
+	if err != nil {
+		log.Errorf("Error trying to handle ListRoles: %s", err.Error())
+		m.Close()
+		return
+	}
+
+	if user == nil {
+		return
+	}
+
+	roles := []RoleInfo{}
+	if lister, ok := sm.authorizer.(RoleLister); ok {
+		for _, role := range lister.ListRoles(user) {
+			if !sm.deny.deniesRole(role.ARN) {
+				role.MaxDuration = clampDuration(0, sm.sessionLimit(role.ARN, role.MaxDuration))
+				roles = append(roles, role)
 			}
-			m.Write(makeCredsResponse(creds))
-			return
 		}
-	} else if addSSHKeyMsg := r.GetAddSSHkey(); addSSHKeyMsg != nil {
-		sm.stats.Counter(1.0, "messages.addSSHKeyMsg", 1)
+	}
+	m.Write(&protocol.Message{
+		ServerResponse: &protocol.ServerResponse{
+			Roles: NewRoleList(roles),
+		},
+	})
+}
 
-		// Search for the user specified in this request.
-		sr := ldap.NewSearchRequest(
-			sm.baseDN,
-			ldap.ScopeWholeSubtree, ldap.NeverDerefAliases, 0, 0, false,
-			fmt.Sprintf("(%s=%s)", sm.userAttr, addSSHKeyMsg.GetUsername()),
-			[]string{sm.pubKeysAttr, sm.userAttr, "userPassword"},
-			nil)
+func (sm *server) handleWhoAmI(m protocol.MessageReadWriteCloser, whoAmIMsg *protocol.WhoAmI) {
+	sm.stats.Counter(1.0, "messages.whoAmI", 1)
+	user, key, err := sm.SSHChallenge(m, whoAmIMsg.GetUser())
+	if err != nil {
+		log.Errorf("Error trying to handle WhoAmI: %s", err.Error())
+		m.Close()
+		return
+	}
 
-		user, err := sm.ldapServer.Search(sr)
-		if err != nil {
-			log.Errorf("Error trying to handle addSSHKeyMsg: %s", err.Error())
-			sm.WriteError(m, "There was an error connecting to the data source.")
-			return
-		}
+	if user == nil {
+		return
+	}
 
-		if len(user.Entries) == 0 {
-			log.Errorf("User %s not found!", addSSHKeyMsg.GetUsername())
-			sm.WriteError(m, "The username or password is incorrect.")
-			return
-		}
+	keyFingerprint := fingerprint(key)
+	m.Write(&protocol.Message{
+		ServerResponse: &protocol.ServerResponse{
+			Identity: &protocol.Identity{
+				Username:       &user.Username,
+				KeyFingerprint: &keyFingerprint,
+				Groups:         user.MemberOf,
+				DefaultRole:    &user.DefaultRole,
+			},
+		},
+	})
+}
 
-		// Check their password.
-		password := user.Entries[0].GetAttributeValue("userPassword")
-		if password != addSSHKeyMsg.GetPasswordhash() {
-			log.Errorf("Provided password for user %s does not match %s!", addSSHKeyMsg.GetUsername(), password)
-			sm.WriteError(m, "The username or password is incorrect.")
-			return
-		}
+func (sm *server) handleAddSSHKey(m protocol.MessageReadWriteCloser, addSSHKeyMsg *protocol.AddSSHKey) {
+	sm.stats.Counter(1.0, "messages.addSSHKeyMsg", 1)
 
-		// Check to see if this SSH key already exists.
-		for _, k := range user.Entries[0].GetAttributeValues(sm.pubKeysAttr) {
-			if k == addSSHKeyMsg.GetSshkeybytes() {
-				log.Warning("User %s already has this SSH key. Doing nothing.", addSSHKeyMsg.GetUsername())
-				successMsg := protocol.Message{Success: &protocol.Success{}}
-				m.Write(&successMsg)
-				return
-			}
-		}
+	event := &AuditEvent{
+		Action:   "AddSSHKey",
+		Username: addSSHKeyMsg.GetUsername(),
+		Outcome:  AuditFailure,
+	}
+	if key, err := ParseSSHKey(addSSHKeyMsg.GetSshkeybytes()); err == nil {
+		event.KeyFingerprint = fingerprint(key)
+	}
+	defer sm.recordAudit(m, event)
 
-		mr := ldap.NewModifyRequest(user.Entries[0].DN)
-		mr.Add(sm.pubKeysAttr, []string{addSSHKeyMsg.GetSshkeybytes()})
-		err = sm.ldapServer.Modify(mr)
-		if err != nil {
-			log.Errorf("Could not modify LDAP user: %s", err.Error())
-			sm.WriteError(m, "Error saving ssh key")
+	if sm.deny.deniesUser(event.Username) || (event.KeyFingerprint != "" && sm.deny.deniesKey(event.KeyFingerprint)) {
+		log.Warning("Refusing to add a key for %s: the user or key is on the deny list", event.Username)
+		sm.stats.Counter(1.0, "errors.revoked", 1)
+		event.Error = "user or key is on the deny list"
+		sm.WriteError(m, protocol.NewError(protocol.ErrorCode_ACCESS_REVOKED, "Your Hologram access has been revoked."))
+		return
+	}
+
+	if sm.ldapServer == nil {
+		log.Warning("Cannot add a key for %s: users do not come from LDAP", event.Username)
+		event.Error = "no LDAP server to add keys to"
+		sm.WriteError(m, protocol.NewError(protocol.ErrorCode_BAD_REQUEST, "This Hologram server cannot add SSH keys; ask an administrator to add yours."))
+		return
+	}
+
+	// Search for the user specified in this request.
+	sr := ldap.NewSearchRequest(
+		sm.baseDN,
+		ldap.ScopeWholeSubtree, ldap.NeverDerefAliases, 0, 0, false,
+		fmt.Sprintf("(%s=%s)", sm.userAttr, escapeFilter(addSSHKeyMsg.GetUsername())),
+		[]string{sm.pubKeysAttr, sm.userAttr, "userPassword"},
+		nil)
+
+	user, err := sm.ldapServer.Search(sr)
+	if err != nil {
+		log.Errorf("Error trying to handle addSSHKeyMsg: %s", err.Error())
+		sm.WriteError(m, protocol.NewError(protocol.ErrorCode_DIRECTORY_UNAVAILABLE, "There was an error connecting to the data source."))
+		event.Error = err.Error()
+		return
+	}
+
+	if len(user.Entries) == 0 {
+		log.Errorf("User %s not found!", addSSHKeyMsg.GetUsername())
+		sm.WriteError(m, protocol.NewError(protocol.ErrorCode_AUTHENTICATION_FAILED, "The username or password is incorrect."))
+		event.Error = "user not found"
+		return
+	}
+
+	// Check their password.
+	password := user.Entries[0].GetAttributeValue("userPassword")
+	if password != addSSHKeyMsg.GetPasswordhash() {
+		log.Errorf("Provided password for user %s does not match %s!", addSSHKeyMsg.GetUsername(), password)
+		sm.WriteError(m, protocol.NewError(protocol.ErrorCode_AUTHENTICATION_FAILED, "The username or password is incorrect."))
+		event.Error = "password mismatch"
+		return
+	}
+
+	// Check to see if this SSH key already exists.
+	for _, k := range user.Entries[0].GetAttributeValues(sm.pubKeysAttr) {
+		if k == addSSHKeyMsg.GetSshkeybytes() {
+			log.Warning("User %s already has this SSH key. Doing nothing.", addSSHKeyMsg.GetUsername())
+			event.Outcome = AuditUnchanged
+			successMsg := protocol.Message{Success: &protocol.Success{}}
+			m.Write(&successMsg)
 			return
 		}
+	}
 
-		successMsg := &protocol.Message{Success: &protocol.Success{}}
-		m.Write(successMsg)
+	mr := ldap.NewModifyRequest(user.Entries[0].DN)
+	mr.Add(sm.pubKeysAttr, []string{addSSHKeyMsg.GetSshkeybytes()})
+	err = sm.ldapServer.Modify(mr)
+	if err != nil {
+		log.Errorf("Could not modify LDAP user: %s", err.Error())
+		sm.WriteError(m, protocol.NewError(protocol.ErrorCode_UNKNOWN_ERROR, "Error saving ssh key"))
+		event.Error = err.Error()
 		return
 	}
+
+	event.Outcome = AuditSuccess
+	successMsg := &protocol.Message{Success: &protocol.Success{}}
+	m.Write(successMsg)
 }
 
 /*
 SSHChallenge performs the challenge-response process to authenticate a connecting client to its SSH keys.
+It returns the user along with the key that produced a valid signature.
+If the client named a user, only that user's keys are considered.
 */
-func (sm *server) SSHChallenge(m protocol.MessageReadWriteCloser) (*User, error) {
-	for {
-		challenge := make([]byte, 64)
-		for i := 0; i < len(challenge); i++ {
-			challenge[i] = byte(rand.Int() % 256)
+func (sm *server) SSHChallenge(m protocol.MessageReadWriteCloser, username string) (*User, ssh.PublicKey, error) {
+	conn := remoteAddr(m)
+	if err := sm.checkRevoked(m, username, nil); err != nil {
+		return nil, nil, err
+	}
+	for round := 1; ; round++ {
+		challenge, err := sm.challenges.issue(conn)
+		if err != nil {
+			return nil, nil, err
 		}
 
 		response := &protocol.Message{
@@ -244,23 +544,46 @@ func (sm *server) SSHChallenge(m protocol.MessageReadWriteCloser) (*User, error)
 			},
 		}
 
-		err := m.Write(response)
+		err = m.Write(response)
 		if err != nil {
-			return nil, err
+			sm.challenges.discard(challenge)
+			return nil, nil, err
 		}
 
 		challengeResponseMessage, err := m.Read()
 		if err != nil {
-			return nil, err
+			sm.challenges.discard(challenge)
+			return nil, nil, err
 		}
 
 		r := challengeResponseMessage.GetServerRequest()
 		if r == nil {
-			return nil, errors.New("not a server request")
+			sm.challenges.discard(challenge)
+			return nil, nil, errors.New("not a server request")
 		}
 		cr := r.GetChallengeResponse()
 		if cr == nil {
-			return nil, errors.New("not a server request")
+			sm.challenges.discard(challenge)
+			sm.WriteError(m, protocol.NewError(protocol.ErrorCode_BAD_REQUEST, "Expected a response to the SSH challenge."))
+			return nil, nil, errors.New("not a challenge response")
+		}
+
+		// Clients that echo the challenge they signed let us tell replayed
+		// and stale signatures apart from ones that simply don't verify.
+		signed := challenge
+		if echoed := cr.GetChallenge(); len(echoed) > 0 && !bytes.Equal(echoed, challenge) {
+			signed = echoed
+			sm.challenges.discard(challenge)
+		}
+		failure := ""
+		if err := sm.challenges.redeem(signed, conn); err != nil {
+			if err == errChallengeExpired {
+				sm.stats.Counter(1.0, "errors.challengeExpired", 1)
+			} else {
+				sm.stats.Counter(1.0, "errors.challengeReplayed", 1)
+			}
+			log.Warning("Rejecting challenge response from %s: %s", conn, err.Error())
+			failure = err.Error()
 		}
 
 		// Compose this into the proper format for Authenticate.
@@ -268,14 +591,84 @@ func (sm *server) SSHChallenge(m protocol.MessageReadWriteCloser) (*User, error)
 			Format: cr.GetFormat(),
 			Blob:   cr.GetSignature(),
 		}
-		verifiedUser, err := sm.authenticator.Authenticate("derp", challenge, sig)
-		if err != nil {
-			return nil, err
+
+		// Newer clients tell us which key they signed with, so we only
+		// have to check that one.
+		var key ssh.PublicKey
+		if keyBytes := cr.GetPublicKey(); failure == "" && len(keyBytes) > 0 {
+			key, err = ssh.ParsePublicKey(keyBytes)
+			if err != nil {
+				log.Warning("Client sent a malformed public key: %s", err.Error())
+				failure = "malformed public key"
+			}
+		}
+
+		if failure == "" && key != nil {
+			if err := sm.checkRevoked(m, username, key); err != nil {
+				return nil, nil, err
+			}
+		}
+
+		// Only a bad signature for a known user's key counts towards a
+		// lockout; keys we have never seen are bounded by the round limit.
+		keyOwner := ""
+		if failure == "" {
+			verifiedUser, verifiedKey, err := sm.authenticator.Authenticate(username, key, signed, sig)
+			if err == ErrUnknownUser {
+				sm.recordAudit(m, &AuditEvent{Action: "SSHChallenge", Username: username, Outcome: AuditFailure, Error: err.Error()})
+				sm.WriteError(m, protocol.NewError(protocol.ErrorCode_UNKNOWN_USER, fmt.Sprintf("User %s is not known to Hologram.", username)))
+				return nil, nil, err
+			}
+			if err == ErrUsernameRequired {
+				sm.recordAudit(m, &AuditEvent{Action: "SSHChallenge", Outcome: AuditFailure, Error: err.Error()})
+				sm.WriteError(m, protocol.NewError(protocol.ErrorCode_BAD_REQUEST, "This server fetches SSH keys from a key server by username; set username in agent.json."))
+				return nil, nil, err
+			}
+			badSignature, isBadSignature := err.(*BadSignatureError)
+			if err != nil && !isBadSignature {
+				sm.recordAudit(m, &AuditEvent{Action: "SSHChallenge", Username: username, Outcome: AuditFailure, Error: err.Error()})
+				sm.WriteError(m, protocol.NewError(protocol.ErrorCode_DIRECTORY_UNAVAILABLE, "Could not look up SSH keys; try again later."))
+				return nil, nil, err
+			}
+			if verifiedUser != nil {
+				if err := sm.checkRevoked(m, verifiedUser.Username, verifiedKey); err != nil {
+					return nil, nil, err
+				}
+				if wait := sm.limiter.locked(conn, verifiedUser.Username); wait > 0 {
+					sm.refuseLockedOut(m, conn, verifiedUser.Username, wait)
+					return nil, nil, errLockedOut
+				}
+				log.Debug("Verification completed for user %s!", verifiedUser.Username)
+				sm.limiter.succeed(conn, verifiedUser.Username)
+				sm.connections.update(m, "", verifiedUser.Username)
+				return verifiedUser, verifiedKey, nil
+			}
+			if isBadSignature {
+				keyOwner = badSignature.Username
+				failure = badSignature.Error()
+			} else {
+				failure = "signature did not match any known key"
+			}
+		}
+		sm.recordAudit(m, &AuditEvent{
+			Action:         "SSHChallenge",
+			Username:       username,
+			KeyFingerprint: fingerprint(key),
+			Outcome:        AuditFailure,
+			Error:          failure,
+		})
+
+		if keyOwner != "" && sm.limiter.fail(conn, keyOwner) {
+			sm.refuseLockedOut(m, conn, keyOwner, sm.limiter.limits.LockoutDuration)
+			return nil, nil, errLockedOut
 		}
-		if verifiedUser != nil {
-			log.Debug("Verification completed for user %s!", verifiedUser.Username)
-			return verifiedUser, nil
+		if round >= sm.limiter.limits.MaxChallengeRounds {
+			sm.stats.Counter(1.0, "errors.challengeRounds", 1)
+			log.Warning("Giving up on %s after %d challenge rounds", conn, round)
+			sm.WriteError(m, protocol.NewError(protocol.ErrorCode_AUTHENTICATION_FAILED, "None of your SSH keys were accepted."))
+			return nil, nil, errors.New("too many challenge rounds")
 		}
+
 		// continue around the loop, letting the client try another key
 		verificationFailure := &protocol.Message{
 			ServerResponse: &protocol.ServerResponse{
@@ -284,13 +677,338 @@ func (sm *server) SSHChallenge(m protocol.MessageReadWriteCloser) (*User, error)
 		}
 		err = m.Write(verificationFailure)
 		if err != nil {
-			return nil, err
+			return nil, nil, err
 		}
 
 	}
 }
 
-func makeCredsResponse(creds *sts.Credentials) *protocol.Message {
+/*
+refuseLockedOut tells a client that username is locked out for a while
+yet.
+*/
+func (sm *server) refuseLockedOut(m protocol.MessageReadWriteCloser, conn string, username string, wait time.Duration) {
+	sm.stats.Counter(1.0, "errors.lockedOut", 1)
+	log.Warning("Refusing user %q from %s after repeated failures", username, conn)
+	sm.WriteError(m, &protocol.Error{
+		Code:       protocol.ErrorCode_LOCKED_OUT,
+		Message:    fmt.Sprintf("Request refused: %s. Try again later.", errLockedOut.Error()),
+		RetryAfter: wait,
+	})
+}
+
+/*
+checkRevoked refuses a user or key on the deny list, telling the client
+why and auditing it. Either may be empty or nil if not known yet. A
+certificate is refused if either it or the key it certifies is denied.
+*/
+func (sm *server) checkRevoked(m protocol.MessageReadWriteCloser, username string, key ssh.PublicKey) error {
+	var revoked error
+	if username != "" && sm.deny.deniesUser(username) {
+		revoked = fmt.Errorf("user %s is on the deny list", username)
+	} else if key != nil && sm.deny.deniesKey(fingerprint(key)) {
+		revoked = fmt.Errorf("key %s is on the deny list", fingerprint(key))
+	} else if cert, ok := key.(*ssh.Certificate); ok && sm.deny.deniesKey(fingerprint(cert.Key)) {
+		revoked = fmt.Errorf("key %s of certificate %q is on the deny list", fingerprint(cert.Key), cert.KeyId)
+	}
+	if revoked == nil {
+		return nil
+	}
+
+	log.Warning("Refusing request from %s: %s", remoteAddr(m), revoked.Error())
+	sm.stats.Counter(1.0, "errors.revoked", 1)
+	sm.recordAudit(m, &AuditEvent{
+		Action:         "SSHChallenge",
+		Username:       username,
+		KeyFingerprint: fingerprint(key),
+		Outcome:        AuditFailure,
+		Error:          revoked.Error(),
+	})
+	sm.WriteError(m, protocol.NewError(protocol.ErrorCode_ACCESS_REVOKED, "Your Hologram access has been revoked."))
+	return revoked
+}
+
+/*
+isRevoked reports whether err is a refusal by the deny list.
+*/
+func isRevoked(err error) bool {
+	return protocol.AsError(err).Code == protocol.ErrorCode_ACCESS_REVOKED
+}
+
+/*
+verifyMFA asks the client for a TOTP code if assuming role requires one.
+No code is asked for a role the user may not assume, since the request
+will be refused anyway. It reports whether the request may go ahead; if
+not, the client has already been told why and the failure audited.
+*/
+func (sm *server) verifyMFA(m protocol.MessageReadWriteCloser, user *User, role string, event *AuditEvent) bool {
+	if !sm.mfa.Required(role) {
+		return true
+	}
+	if _, err := sm.authorize(user, role); err != nil {
+		return true
+	}
+	conn := remoteAddr(m)
+	if wait := sm.limiter.mfaLocked(conn, user.Username); wait > 0 {
+		event.Outcome = AuditFailure
+		event.Error = errLockedOut.Error()
+		sm.recordAudit(m, event)
+		sm.refuseLockedOut(m, conn, user.Username, wait)
+		return false
+	}
+
+	prompt := fmt.Sprintf("Enter the MFA code for %s: ", role)
+	err := m.Write(&protocol.Message{
+		ServerResponse: &protocol.ServerResponse{
+			TokenRequest: &protocol.MFATokenRequest{
+				Prompt: &prompt,
+			},
+		},
+	})
+	if err != nil {
+		return false
+	}
+
+	// Only wrong codes count towards a lockout, as they are the guesses.
+	wrongCode := false
+	msg, err := m.Read()
+	if err == nil {
+		if tokenResponse := msg.GetServerRequest().GetTokenResponse(); tokenResponse != nil {
+			err = sm.mfa.Verify(user, tokenResponse.GetTokenValue())
+			wrongCode = err != nil
+		} else {
+			err = errors.New("expected an MFA token response")
+		}
+	}
+	if err != nil {
+		log.Errorf("MFA failed for %s: %s", user.Username, err.Error())
+		sm.stats.Counter(1.0, "errors.mfa", 1)
+		event.Outcome = AuditFailure
+		event.Error = err.Error()
+		sm.recordAudit(m, event)
+		if wrongCode {
+			if wait := sm.limiter.failMFA(conn, user.Username); wait > 0 {
+				sm.refuseLockedOut(m, conn, user.Username, wait)
+				return false
+			}
+		}
+		sm.WriteError(m, protocol.NewError(protocol.ErrorCode_MFA_FAILED, "The MFA code was not accepted."))
+		return false
+	}
+
+	sm.limiter.succeedMFA(user.Username)
+	event.MFA = true
+	return true
+}
+
+/*
+mfaSatisfied reports whether role needs no MFA code or the client has
+given one. A request that skipped the code because the role was not
+authorized must not be retried, or it could succeed without one.
+*/
+func (sm *server) mfaSatisfied(role string, event *AuditEvent) bool {
+	return event.MFA || !sm.mfa.Required(role)
+}
+
+/*
+authorize asks the authorizer whether the user may assume role, and
+refuses the role if it is on the deny list.
+*/
+func (sm *server) authorize(user *User, role string) (*Grant, error) {
+	grant, err := sm.authorizer.Authorize(user, role)
+	if err != nil {
+		return nil, &protocol.Error{Code: protocol.ErrorCode_NOT_AUTHORIZED, Message: err.Error()}
+	}
+	if sm.deny.deniesRole(grant.ARN) {
+		return nil, protocol.NewError(protocol.ErrorCode_ACCESS_REVOKED, "Access to %s has been revoked.", grant.ARN)
+	}
+	return grant, nil
+}
+
+/*
+sessionLimit returns the longest session granted seconds on arn can
+actually get, once the credential service's own limit is applied.
+*/
+func (sm *server) sessionLimit(arn string, granted int64) int64 {
+	if limiter, ok := sm.credentials.(sessionLimiter); ok && limiter.MaxDuration(arn) < granted {
+		return limiter.MaxDuration(arn)
+	}
+	return granted
+}
+
+/*
+assumeRole asks the authorizer whether the user may assume the role
+and, if so, fetches credentials for it from the credential service. The
+session lasts as close to duration seconds as the grant allows; zero
+asks for the longest allowed. A non-nil policy narrows the session.
+*/
+func (sm *server) assumeRole(user *User, role string, duration int64, policy *SessionPolicy) (*sts.Credentials, *Grant, error) {
+	grant, err := sm.authorize(user, role)
+	if err != nil {
+		if isRevoked(err) {
+			log.Warning("Refusing %s for %s: the role is on the deny list", role, user.Username)
+			sm.stats.Counter(1.0, "errors.revoked", 1)
+		} else {
+			sm.stats.Counter(1.0, "errors.unauthorized", 1)
+		}
+		return nil, nil, err
+	}
+	clamped := clampDuration(duration, sm.sessionLimit(grant.ARN, grant.Duration))
+	if duration != 0 && clamped != duration {
+		log.Debug("Clamping session for %s on %s from %d to %d seconds", user.Username, grant.ARN, duration, clamped)
+	}
+	grant.Duration = clamped
+	grant.SessionPolicy = policy
+	creds, err := sm.credentials.AssumeRole(user, grant)
+	if err != nil {
+		return nil, nil, stsError(err)
+	}
+	return creds, grant, nil
+}
+
+/*
+stsError gives an error from STS an error code, so that clients can tell
+throttling, which is worth retrying, from everything else.
+*/
+func stsError(err error) error {
+	var awsErr awserr.Error
+	if errors.As(err, &awsErr) {
+		switch awsErr.Code() {
+		case "Throttling", "ThrottlingException", "RequestLimitExceeded":
+			return &protocol.Error{Code: protocol.ErrorCode_STS_THROTTLED, Message: err.Error(), RetryAfter: 5 * time.Second}
+		}
+	}
+	return &protocol.Error{Code: protocol.ErrorCode_STS_ERROR, Message: err.Error()}
+}
+
+/*
+recordAudit stamps an event with the time and the client's address and
+hands it to the configured audit sink.
+*/
+func (sm *server) recordAudit(m protocol.MessageReadWriteCloser, event *AuditEvent) {
+	event.Time = time.Now().UTC()
+	event.RemoteAddr = remoteAddr(m)
+	if err := sm.audit.Record(event); err != nil {
+		log.Errorf("Could not record audit event: %s", err.Error())
+		sm.stats.Counter(1.0, "errors.audit", 1)
+	}
+}
+
+/*
+SetAuditSink sets where audit events are recorded. By default they are
+discarded.
+*/
+func (sm *server) SetAuditSink(sink AuditSink) {
+	sm.audit = sink
+}
+
+/*
+fingerprint returns the SHA256 fingerprint of key in the format used
+by OpenSSH, or an empty string if there is no key.
+*/
+func fingerprint(key ssh.PublicKey) string {
+	if key == nil {
+		return ""
+	}
+	return ssh.FingerprintSHA256(key)
+}
+
+/*
+SetMFAVerifier sets which requests need a TOTP code. By default none do.
+*/
+func (sm *server) SetMFAVerifier(mfa *MFAVerifier) {
+	sm.mfa = mfa
+}
+
+/*
+SetChallengeOptions sets the identity this server binds into every SSH
+challenge, and how long clients have to answer one. By default these are
+the host name and 30 seconds.
+*/
+func (sm *server) SetChallengeOptions(identity string, timeout time.Duration) {
+	sm.challenges = newChallengeStore(identity, timeout)
+}
+
+/*
+SetRateLimits sets the request rate limits, challenge round cap and
+lockout policy. By default only the number of challenge rounds and of
+wrong MFA codes is limited.
+*/
+func (sm *server) SetRateLimits(limits RateLimits) {
+	sm.limiter = newRateLimiter(limits)
+}
+
+/*
+sessionPolicy validates the session policy a client sent, and merges it
+with the named preset if there is one.
+*/
+func (sm *server) sessionPolicy(msg *protocol.AssumeRole) (*SessionPolicy, error) {
+	policy, err := NewSessionPolicy(msg.GetPolicy(), msg.GetPolicyArns())
+	if err != nil {
+		return nil, protocol.NewError(protocol.ErrorCode_BAD_REQUEST, "%s", err.Error())
+	}
+	if name := msg.GetPreset(); name != "" {
+		preset, ok := sm.policyPresets[name]
+		if !ok {
+			return nil, protocol.NewError(protocol.ErrorCode_BAD_REQUEST, "unknown policy preset %q", name)
+		}
+		policy, err = mergeSessionPolicies(preset, policy)
+		if err != nil {
+			return nil, protocol.NewError(protocol.ErrorCode_BAD_REQUEST, "%s", err.Error())
+		}
+	}
+	return policy, nil
+}
+
+/*
+SetPolicyPresets sets the named session policies clients may ask for,
+such as a read-only preset. By default there are none.
+*/
+func (sm *server) SetPolicyPresets(presets map[string]*SessionPolicy) {
+	sm.policyPresets = presets
+}
+
+/*
+SetDenyList sets the kill switch checked before every request. By
+default it is empty.
+*/
+func (sm *server) SetDenyList(deny *DenyList) {
+	sm.deny = deny
+}
+
+/*
+SetFallbackPolicy sets who gets their default role when they ask for a
+role they cannot have. By default nobody does, and they get the error.
+*/
+func (sm *server) SetFallbackPolicy(policy *FallbackPolicy) {
+	sm.fallback = policy
+}
+
+/*
+remoteAddr returns the address of the client on the other end of m, if
+the transport knows it.
+*/
+func remoteAddr(m protocol.MessageReadWriteCloser) string {
+	if c, ok := m.(interface {
+		RemoteAddr() net.Addr
+	}); ok && c.RemoteAddr() != nil {
+		return c.RemoteAddr().String()
+	}
+	return ""
+}
+
+/*
+Connections lists the client connections currently open, oldest first.
+*/
+func (sm *server) Connections() []ConnectionInfo {
+	return sm.connections.list()
+}
+
+/*
+makeCredsResponse builds the response carrying creds, which were issued
+under grant in answer to a request for requestedRole.
+*/
+func makeCredsResponse(creds *sts.Credentials, requestedRole string, grant *Grant) *protocol.Message {
 	expiration := creds.Expiration.Unix()
 	credsResponse := &protocol.Message{
 		ServerResponse: &protocol.ServerResponse{
@@ -299,6 +1017,9 @@ func makeCredsResponse(creds *sts.Credentials) *protocol.Message {
 				SecretAccessKey: creds.SecretAccessKey,
 				AccessToken:     creds.SessionToken,
 				Expiration:      &expiration,
+				RequestedRole:   &requestedRole,
+				GrantedRole:     &grant.ARN,
+				Duration:        &grant.Duration,
 			},
 		},
 	}
@@ -311,6 +1032,7 @@ MessageConnection loop.
 */
 func New(userCache UserCache,
 	credentials CredentialService,
+	authorizer RoleAuthorizer,
 	defaultRole string,
 	stats g2s.Statter,
 	ldapServer LDAPImplementation,
@@ -322,6 +1044,14 @@ func New(userCache UserCache,
 	roleTimeoutAttr string) *server {
 	return &server{
 		credentials:     credentials,
+		authorizer:      authorizer,
+		audit:           NoopAuditSink(),
+		challenges:      newChallengeStore(hostname(), defaultChallengeTimeout),
+		mfa:             &MFAVerifier{mode: MFAOff},
+		limiter:         newRateLimiter(RateLimits{}),
+		connections:     newConnectionTracker(),
+		fallback:        &FallbackPolicy{mode: FallbackOff},
+		deny:            &DenyList{},
 		authenticator:   userCache,
 		userCache:       userCache,
 		defaultRole:     defaultRole,
@@ -16,16 +16,22 @@
 package server_test
 
 import (
+	"bytes"
+	"crypto/ed25519"
+	"crypto/rand"
+	"errors"
 	"io"
+	"net"
 	"reflect"
+	"sync"
 	"testing"
 	"time"
 
 	"github.com/AdRoll/hologram/protocol"
 	"github.com/AdRoll/hologram/server"
+	"github.com/aws/aws-sdk-go/aws/awserr"
 	"github.com/aws/aws-sdk-go/service/sts"
 	"github.com/nmcclain/ldap"
-	"github.com/peterbourgon/g2s"
 	. "github.com/smartystreets/goconvey/convey"
 	"golang.org/x/crypto/ssh"
 )
@@ -53,15 +59,69 @@ func ReadWriter(reader io.Reader, writer io.WriteCloser) io.ReadWriteCloser {
 
 type DummyAuthenticator struct {
 	user *server.User
+	err  error
+	// The hints passed to the last Authenticate call.
+	username string
+	key      ssh.PublicKey
 }
 
-func (d *DummyAuthenticator) Authenticate(username string, challenge []byte, sig *ssh.Signature) (user *server.User, err error) {
-	return d.user, nil
+func (d *DummyAuthenticator) Authenticate(username string, key ssh.PublicKey, challenge []byte, sig *ssh.Signature) (user *server.User, verifiedKey ssh.PublicKey, err error) {
+	d.username = username
+	d.key = key
+	return d.user, key, d.err
 }
 
 func (d *DummyAuthenticator) Update() error { return nil }
 
-type dummyCredentials struct{}
+type recordingAuditSink struct {
+	events []*server.AuditEvent
+}
+
+func (r *recordingAuditSink) Record(event *server.AuditEvent) error {
+	r.events = append(r.events, event)
+	return nil
+}
+
+/*
+countingStatter remembers how often each counter was bumped.
+*/
+type countingStatter struct {
+	sync.Mutex
+	counters map[string]int
+}
+
+func (c *countingStatter) Counter(sampleRate float32, bucket string, n ...int) {
+	c.Lock()
+	defer c.Unlock()
+	for _, i := range n {
+		c.counters[bucket] += i
+	}
+}
+
+func (c *countingStatter) Timing(float32, string, ...time.Duration) {}
+func (c *countingStatter) Gauge(float32, string, ...string)         {}
+
+func (c *countingStatter) count(bucket string) int {
+	c.Lock()
+	defer c.Unlock()
+	return c.counters[bucket]
+}
+
+type dummyCredentials struct {
+	// lastDuration and lastPolicy are the session length and policy of
+	// the last AssumeRole call.
+	lastDuration int64
+	lastPolicy   *server.SessionPolicy
+	// maxDuration, if set, is the longest session it can issue.
+	maxDuration int64
+}
+
+func (d *dummyCredentials) MaxDuration(arn string) int64 {
+	if d.maxDuration == 0 {
+		return 43200
+	}
+	return d.maxDuration
+}
 
 func (*dummyCredentials) GetSessionToken() (*sts.Credentials, error) {
 	accessKey := "access_key"
@@ -76,7 +136,12 @@ func (*dummyCredentials) GetSessionToken() (*sts.Credentials, error) {
 	}, nil
 }
 
-func (*dummyCredentials) AssumeRole(user *server.User, role string, enableLDAPRoles bool) (*sts.Credentials, error) {
+func (d *dummyCredentials) AssumeRole(user *server.User, grant *server.Grant) (*sts.Credentials, error) {
+	d.lastDuration = grant.Duration
+	d.lastPolicy = grant.SessionPolicy
+	if grant.ARN == "arn:aws:iam::123456:role/untrusted" {
+		return nil, errors.New("AccessDenied: the role does not trust hologram")
+	}
 	accessKey := "access_key"
 	secretKey := "secret"
 	token := "token"
@@ -132,14 +197,18 @@ func TestServerStateMachine(t *testing.T) {
 	neededModifyRequest.Add("sshPublicKey", []string{"test"})
 
 	Convey("Given a state machine setup with a null logger", t, func() {
-		authenticator := &DummyAuthenticator{&server.User{Username: "words"}}
+		authenticator := &DummyAuthenticator{user: &server.User{Username: "words"}}
 		ldap := &DummyLDAP{
 			username: "ari.adair",
 			password: "098f6bcd4621d373cade4e832627b4f6",
 			sshKeys:  []string{},
 			req:      neededModifyRequest,
 		}
-		testServer := server.New(authenticator, &dummyCredentials{}, "default", g2s.Noop(), ldap, "cn", "dc=testdn,dc=com", false, "", "sshPublicKey", "ref")
+		stats := &countingStatter{counters: map[string]int{}}
+		credentials := &dummyCredentials{}
+		testServer := server.New(authenticator, credentials, server.NewAllowAllAuthorizer("123456", nil), "default", stats, ldap, "cn", "dc=testdn,dc=com", false, "", "sshPublicKey", "ref")
+		audit := &recordingAuditSink{}
+		testServer.SetAuditSink(audit)
 		r, w := io.Pipe()
 
 		testConnection := protocol.NewMessageConnection(ReadWriter(r, w))
@@ -175,7 +244,7 @@ func TestServerStateMachine(t *testing.T) {
 			Convey("it should challenge, then send credentials on success", func() {
 				challenge := msg.GetServerResponse().GetChallenge().GetChallenge()
 
-				So(len(challenge), ShouldEqual, 64)
+				So(bytes.Contains(challenge, []byte("hologram-ssh-challenge-v1")), ShouldBeTrue)
 
 				format := "test"
 				sig := []byte("ssss")
@@ -205,6 +274,19 @@ func TestServerStateMachine(t *testing.T) {
 				So(creds.GetSecretAccessKey(), ShouldEqual, "secret")
 				So(creds.GetAccessToken(), ShouldEqual, "token")
 				So(creds.GetExpiration(), ShouldBeGreaterThanOrEqualTo, time.Now().Unix())
+				So(creds.GetGrantedRole(), ShouldEqual, "arn:aws:iam::123456:role/testrole")
+				So(creds.GetFellBack(), ShouldBeFalse)
+
+				Convey("and record the issuance in the audit trail", func() {
+					So(len(audit.events), ShouldEqual, 1)
+					event := audit.events[0]
+					So(event.Action, ShouldEqual, "AssumeRole")
+					So(event.Username, ShouldEqual, "words")
+					So(event.RequestedRole, ShouldEqual, "testrole")
+					So(event.GrantedRole, ShouldEqual, "arn:aws:iam::123456:role/testrole")
+					So(event.Outcome, ShouldEqual, server.AuditSuccess)
+					So(event.Expiration, ShouldNotBeNil)
+				})
 			})
 
 			Convey("it should then send failure message on failed key verification", func() {
@@ -212,7 +294,7 @@ func TestServerStateMachine(t *testing.T) {
 
 				challenge := msg.GetServerResponse().GetChallenge().GetChallenge()
 
-				So(len(challenge), ShouldEqual, 64)
+				So(bytes.Contains(challenge, []byte("hologram-ssh-challenge-v1")), ShouldBeTrue)
 
 				format := "test"
 				sig := []byte("ssss")
@@ -236,6 +318,882 @@ func TestServerStateMachine(t *testing.T) {
 				So(credsMsg, ShouldNotBeNil)
 				So(credsMsg.GetServerResponse(), ShouldNotBeNil)
 				So(credsMsg.GetServerResponse().GetVerificationFailure(), ShouldNotBeNil)
+
+				So(len(audit.events), ShouldEqual, 1)
+				So(audit.events[0].Action, ShouldEqual, "SSHChallenge")
+				So(audit.events[0].Outcome, ShouldEqual, server.AuditFailure)
+			})
+
+			Convey("it should tell the client when the user is unknown", func() {
+				authenticator.user = nil
+				authenticator.err = server.ErrUnknownUser
+				format := "test"
+				testConnection.Write(&protocol.Message{
+					ServerRequest: &protocol.ServerRequest{
+						ChallengeResponse: &protocol.SSHChallengeResponse{
+							Format:    &format,
+							Signature: []byte("ssss"),
+						},
+					},
+				})
+
+				reply, err := testConnection.Read()
+				if err != nil {
+					t.Fatal(err)
+				}
+				So(reply.GetErrorCode(), ShouldEqual, protocol.ErrorCode_UNKNOWN_USER)
+			})
+		})
+
+		Convey("After an AssumeRequest whose challenge is answered", func() {
+			role := "testrole"
+			format := "test"
+			sig := []byte("ssss")
+
+			testConnection.Write(&protocol.Message{
+				ServerRequest: &protocol.ServerRequest{
+					AssumeRole: &protocol.AssumeRole{
+						Role: &role,
+					},
+				},
+			})
+
+			msg, err := testConnection.Read()
+			if err != nil {
+				t.Fatal(err)
+			}
+			challenge := msg.GetServerResponse().GetChallenge().GetChallenge()
+
+			answer := func(signed []byte) *protocol.Message {
+				testConnection.Write(&protocol.Message{
+					ServerRequest: &protocol.ServerRequest{
+						ChallengeResponse: &protocol.SSHChallengeResponse{
+							Format:    &format,
+							Signature: sig,
+							Challenge: signed,
+						},
+					},
+				})
+				reply, err := testConnection.Read()
+				if err != nil {
+					t.Fatal(err)
+				}
+				return reply
+			}
+
+			Convey("a response echoing the issued challenge should succeed", func() {
+				So(answer(challenge).GetServerResponse().GetCredentials(), ShouldNotBeNil)
+			})
+
+			Convey("a response to a challenge that was never issued should be rejected as a replay", func() {
+				forged := append([]byte{}, challenge...)
+				forged[len(forged)-1] ^= 0xff
+
+				reply := answer(forged)
+				So(reply.GetServerResponse().GetVerificationFailure(), ShouldNotBeNil)
+				So(stats.count("errors.challengeReplayed"), ShouldEqual, 1)
+				So(audit.events[0].Error, ShouldContainSubstring, "already used")
+
+				Convey("and the original challenge should no longer be usable either", func() {
+					next, err := testConnection.Read()
+					if err != nil {
+						t.Fatal(err)
+					}
+					So(next.GetServerResponse().GetChallenge(), ShouldNotBeNil)
+
+					So(answer(challenge).GetServerResponse().GetVerificationFailure(), ShouldNotBeNil)
+					So(stats.count("errors.challengeReplayed"), ShouldEqual, 2)
+				})
+			})
+		})
+
+		Convey("When every request requires MFA", func() {
+			mfa, err := server.NewMFAVerifier(server.MFAAll, nil, "123456", nil)
+			So(err, ShouldBeNil)
+			testServer.SetMFAVerifier(mfa)
+			authenticator.user.MFASecret = testTOTPSecret
+
+			role := "testrole"
+			format := "test"
+			testConnection.Write(&protocol.Message{
+				ServerRequest: &protocol.ServerRequest{
+					AssumeRole: &protocol.AssumeRole{
+						Role: &role,
+					},
+				},
+			})
+			msg, err := testConnection.Read()
+			if err != nil {
+				t.Fatal(err)
+			}
+			testConnection.Write(&protocol.Message{
+				ServerRequest: &protocol.ServerRequest{
+					ChallengeResponse: &protocol.SSHChallengeResponse{
+						Format:    &format,
+						Signature: []byte("ssss"),
+						Challenge: msg.GetServerResponse().GetChallenge().GetChallenge(),
+					},
+				},
+			})
+
+			msg, err = testConnection.Read()
+			if err != nil {
+				t.Fatal(err)
+			}
+			So(msg.GetServerResponse().GetTokenRequest().GetPrompt(), ShouldContainSubstring, "testrole")
+
+			sendCode := func(code string) *protocol.Message {
+				testConnection.Write(&protocol.Message{
+					ServerRequest: &protocol.ServerRequest{
+						TokenResponse: &protocol.MFATokenResponse{
+							TokenValue: &code,
+						},
+					},
+				})
+				reply, err := testConnection.Read()
+				if err != nil {
+					t.Fatal(err)
+				}
+				return reply
+			}
+
+			Convey("a valid code should release the credentials", func() {
+				reply := sendCode(totp(testTOTPSecret, time.Now()))
+				So(reply.GetServerResponse().GetCredentials(), ShouldNotBeNil)
+				So(audit.events[0].MFA, ShouldBeTrue)
+			})
+
+			Convey("a wrong code should be refused", func() {
+				reply := sendCode("not a code")
+				So(reply.GetError(), ShouldContainSubstring, "MFA")
+				So(stats.count("errors.mfa"), ShouldEqual, 1)
+				So(audit.events[0].Outcome, ShouldEqual, server.AuditFailure)
+
+				_, err := testConnection.Read()
+				So(err, ShouldNotBeNil)
+			})
+
+			Convey("a run of wrong codes should lock the user out", func() {
+				testServer.SetRateLimits(server.RateLimits{MFAFailures: 3})
+				// prompt answers the challenge on a new connection and
+				// returns the connection and the server's next message.
+				prompt := func() (protocol.MessageReadWriteCloser, *protocol.Message) {
+					r, w := io.Pipe()
+					conn := protocol.NewMessageConnection(ReadWriter(r, w))
+					go testServer.HandleConnection(conn)
+					conn.Write(&protocol.Message{
+						ServerRequest: &protocol.ServerRequest{
+							AssumeRole: &protocol.AssumeRole{Role: &role},
+						},
+					})
+					msg, err := conn.Read()
+					if err != nil {
+						t.Fatal(err)
+					}
+					conn.Write(&protocol.Message{
+						ServerRequest: &protocol.ServerRequest{
+							ChallengeResponse: &protocol.SSHChallengeResponse{
+								Format:    &format,
+								Signature: []byte("ssss"),
+								Challenge: msg.GetServerResponse().GetChallenge().GetChallenge(),
+							},
+						},
+					})
+					reply, err := conn.Read()
+					if err != nil {
+						t.Fatal(err)
+					}
+					return conn, reply
+				}
+				wrongCode := func(conn protocol.MessageReadWriteCloser) protocol.ErrorCode {
+					code := "not a code"
+					conn.Write(&protocol.Message{
+						ServerRequest: &protocol.ServerRequest{
+							TokenResponse: &protocol.MFATokenResponse{TokenValue: &code},
+						},
+					})
+					reply, err := conn.Read()
+					if err != nil {
+						t.Fatal(err)
+					}
+					return reply.GetErrorCode()
+				}
+
+				So(wrongCode(testConnection), ShouldEqual, protocol.ErrorCode_MFA_FAILED)
+				conn, reply := prompt()
+				So(reply.GetServerResponse().GetTokenRequest(), ShouldNotBeNil)
+				So(wrongCode(conn), ShouldEqual, protocol.ErrorCode_MFA_FAILED)
+				conn, _ = prompt()
+				So(wrongCode(conn), ShouldEqual, protocol.ErrorCode_LOCKED_OUT)
+
+				Convey("and not ask them for another code", func() {
+					_, reply := prompt()
+					So(reply.GetServerResponse().GetTokenRequest(), ShouldBeNil)
+					So(reply.GetErrorCode(), ShouldEqual, protocol.ErrorCode_LOCKED_OUT)
+					So(stats.count("errors.lockedOut"), ShouldEqual, 2)
+				})
+			})
+		})
+
+		Convey("With a challenge timeout that has already passed", func() {
+			testServer.SetChallengeOptions("test-server", time.Nanosecond)
+			role := "testrole"
+			format := "test"
+
+			testConnection.Write(&protocol.Message{
+				ServerRequest: &protocol.ServerRequest{
+					AssumeRole: &protocol.AssumeRole{
+						Role: &role,
+					},
+				},
+			})
+
+			msg, err := testConnection.Read()
+			if err != nil {
+				t.Fatal(err)
+			}
+			challenge := msg.GetServerResponse().GetChallenge().GetChallenge()
+			So(bytes.Contains(challenge, []byte("test-server")), ShouldBeTrue)
+			time.Sleep(time.Millisecond)
+
+			testConnection.Write(&protocol.Message{
+				ServerRequest: &protocol.ServerRequest{
+					ChallengeResponse: &protocol.SSHChallengeResponse{
+						Format:    &format,
+						Signature: []byte("ssss"),
+						Challenge: challenge,
+					},
+				},
+			})
+
+			Convey("a stale signature should be rejected and counted", func() {
+				reply, err := testConnection.Read()
+				if err != nil {
+					t.Fatal(err)
+				}
+				So(reply.GetServerResponse().GetVerificationFailure(), ShouldNotBeNil)
+				So(stats.count("errors.challengeExpired"), ShouldEqual, 1)
+			})
+		})
+
+		Convey("With limits on challenges and requests", func() {
+			role := "testrole"
+			user := "words"
+			format := "test"
+			assumeRole := &protocol.Message{
+				ServerRequest: &protocol.ServerRequest{
+					AssumeRole: &protocol.AssumeRole{
+						Role: &role,
+						User: &user,
+					},
+				},
+			}
+			// answer signs the challenge in msg and returns the server's reply.
+			answer := func(conn protocol.MessageReadWriteCloser, msg *protocol.Message) *protocol.Message {
+				conn.Write(&protocol.Message{
+					ServerRequest: &protocol.ServerRequest{
+						ChallengeResponse: &protocol.SSHChallengeResponse{
+							Format:    &format,
+							Signature: []byte("ssss"),
+							Challenge: msg.GetServerResponse().GetChallenge().GetChallenge(),
+						},
+					},
+				})
+				reply, err := conn.Read()
+				if err != nil {
+					t.Fatal(err)
+				}
+				return reply
+			}
+
+			Convey("a client should only get so many challenge rounds", func() {
+				testServer.SetRateLimits(server.RateLimits{MaxChallengeRounds: 3})
+				authenticator.user = nil
+				testConnection.Write(assumeRole)
+				msg, _ := testConnection.Read()
+				for round := 1; round < 3; round++ {
+					So(answer(testConnection, msg).GetServerResponse().GetVerificationFailure(), ShouldNotBeNil)
+					msg, _ = testConnection.Read()
+				}
+				So(answer(testConnection, msg).GetError(), ShouldNotBeEmpty)
+				So(stats.count("errors.challengeRounds"), ShouldEqual, 1)
+			})
+
+			Convey("repeated bad signatures should lock the user out", func() {
+				testServer.SetRateLimits(server.RateLimits{LockoutFailures: 2, LockoutWindow: time.Minute, LockoutDuration: time.Minute})
+				authenticator.user = nil
+				authenticator.err = &server.BadSignatureError{Username: "words"}
+				testConnection.Write(assumeRole)
+				msg, _ := testConnection.Read()
+				So(answer(testConnection, msg).GetServerResponse().GetVerificationFailure(), ShouldNotBeNil)
+				msg, _ = testConnection.Read()
+				So(answer(testConnection, msg).GetError(), ShouldContainSubstring, "locked out")
+
+				Convey("and refuse their next connection straight away", func() {
+					r, w := io.Pipe()
+					conn := protocol.NewMessageConnection(ReadWriter(r, w))
+					go testServer.HandleConnection(conn)
+					conn.Write(assumeRole)
+					reply, err := conn.Read()
+					So(err, ShouldBeNil)
+					So(reply.GetError(), ShouldContainSubstring, "locked out")
+					So(stats.count("errors.lockedOut"), ShouldEqual, 2)
+				})
+
+				Convey("even when they do not say who they are", func() {
+					authenticator.user = &server.User{Username: "words"}
+					authenticator.err = nil
+					r, w := io.Pipe()
+					conn := protocol.NewMessageConnection(ReadWriter(r, w))
+					go testServer.HandleConnection(conn)
+					conn.Write(&protocol.Message{
+						ServerRequest: &protocol.ServerRequest{
+							AssumeRole: &protocol.AssumeRole{Role: &role},
+						},
+					})
+					msg, err := conn.Read()
+					So(err, ShouldBeNil)
+					So(answer(conn, msg).GetError(), ShouldContainSubstring, "locked out")
+				})
+			})
+
+			Convey("keys nobody owns should not count towards a lockout", func() {
+				testServer.SetRateLimits(server.RateLimits{MaxChallengeRounds: 3, LockoutFailures: 2, LockoutWindow: time.Minute, LockoutDuration: time.Minute})
+				authenticator.user = nil
+				testConnection.Write(assumeRole)
+				msg, _ := testConnection.Read()
+				for round := 1; round < 3; round++ {
+					So(answer(testConnection, msg).GetServerResponse().GetVerificationFailure(), ShouldNotBeNil)
+					msg, _ = testConnection.Read()
+				}
+				So(stats.count("errors.lockedOut"), ShouldEqual, 0)
+			})
+
+			Convey("a request refused for one bucket should not spend another's token", func() {
+				testServer.SetRateLimits(server.RateLimits{PerIP: 2, PerUser: 1})
+				// net.Pipe connections have a remote address, so the
+				// per-IP bucket applies to them.
+				request := func(username string) *protocol.Message {
+					client, serverSide := net.Pipe()
+					defer client.Close()
+					conn := protocol.NewMessageConnection(client)
+					go testServer.HandleConnection(protocol.NewMessageConnection(serverSide))
+					conn.Write(&protocol.Message{
+						ServerRequest: &protocol.ServerRequest{
+							AssumeRole: &protocol.AssumeRole{Role: &role, User: &username},
+						},
+					})
+					reply, err := conn.Read()
+					So(err, ShouldBeNil)
+					return reply
+				}
+				So(request("words").GetServerResponse().GetChallenge(), ShouldNotBeNil)
+				So(request("words").GetError(), ShouldContainSubstring, "too many requests")
+				So(request("other").GetServerResponse().GetChallenge(), ShouldNotBeNil)
+			})
+
+			Convey("requests beyond the per-user rate should be refused", func() {
+				testServer.SetRateLimits(server.RateLimits{PerUser: 1})
+				testConnection.Write(assumeRole)
+				msg, _ := testConnection.Read()
+				So(answer(testConnection, msg).GetServerResponse().GetCredentials(), ShouldNotBeNil)
+
+				testConnection.Write(assumeRole)
+				reply, err := testConnection.Read()
+				So(err, ShouldBeNil)
+				So(reply.GetError(), ShouldContainSubstring, "too many requests")
+				So(stats.count("errors.rateLimited"), ShouldEqual, 1)
+			})
+		})
+
+		Convey("After a ListRoles request whose challenge is answered", func() {
+			authenticator.user = &server.User{Username: "words", DefaultRole: "default"}
+			credentials.maxDuration = 1800
+			testConnection.Write(&protocol.Message{
+				ServerRequest: &protocol.ServerRequest{
+					ListRoles: &protocol.ListRoles{},
+				},
+			})
+			msg, err := testConnection.Read()
+			if err != nil {
+				t.Fatal(err)
+			}
+			format := "test"
+			testConnection.Write(&protocol.Message{
+				ServerRequest: &protocol.ServerRequest{
+					ChallengeResponse: &protocol.SSHChallengeResponse{
+						Format:    &format,
+						Signature: []byte("ssss"),
+						Challenge: msg.GetServerResponse().GetChallenge().GetChallenge(),
+					},
+				},
+			})
+
+			Convey("the server should list the roles the user may assume", func() {
+				reply, err := testConnection.Read()
+				So(err, ShouldBeNil)
+				roles := reply.GetServerResponse().GetRoles().GetRoles()
+				So(len(roles), ShouldEqual, 1)
+				So(roles[0].GetAlias(), ShouldEqual, "default")
+				So(roles[0].GetArn(), ShouldEqual, "arn:aws:iam::123456:role/default")
+				So(roles[0].GetIsDefault(), ShouldBeTrue)
+				So(roles[0].GetMaxDuration(), ShouldEqual, 1800)
+				So(stats.count("messages.listRoles"), ShouldEqual, 1)
+			})
+		})
+
+		Convey("After a WhoAmI request whose challenge is answered", func() {
+			authenticator.user = &server.User{Username: "words", DefaultRole: "default", MemberOf: []string{"cn=devs,dc=testdn,dc=com"}}
+			testConnection.Write(&protocol.Message{
+				ServerRequest: &protocol.ServerRequest{
+					WhoAmI: &protocol.WhoAmI{},
+				},
+			})
+			msg, err := testConnection.Read()
+			if err != nil {
+				t.Fatal(err)
+			}
+			format := "test"
+			testConnection.Write(&protocol.Message{
+				ServerRequest: &protocol.ServerRequest{
+					ChallengeResponse: &protocol.SSHChallengeResponse{
+						Format:    &format,
+						Signature: []byte("ssss"),
+						Challenge: msg.GetServerResponse().GetChallenge().GetChallenge(),
+					},
+				},
+			})
+
+			Convey("the server should say which user the key belongs to", func() {
+				reply, err := testConnection.Read()
+				So(err, ShouldBeNil)
+				identity := reply.GetServerResponse().GetIdentity()
+				So(identity.GetUsername(), ShouldEqual, "words")
+				So(identity.GetGroups(), ShouldResemble, []string{"cn=devs,dc=testdn,dc=com"})
+				So(identity.GetDefaultRole(), ShouldEqual, "default")
+				So(stats.count("messages.whoAmI"), ShouldEqual, 1)
+			})
+
+			Convey("the open connection should be listed with the user it authenticated as", func() {
+				_, err := testConnection.Read()
+				So(err, ShouldBeNil)
+				connections := testServer.Connections()
+				So(len(connections), ShouldEqual, 1)
+				So(connections[0].Request, ShouldEqual, "WhoAmI")
+				So(connections[0].User, ShouldEqual, "words")
+			})
+		})
+
+		Convey("When a client asks for a session length", func() {
+			format := "test"
+			// assume asks for testrole for duration seconds and returns the
+			// credentials the server sends back.
+			assume := func(duration int64) *protocol.STSCredentials {
+				role := "testrole"
+				testConnection.Write(&protocol.Message{
+					ServerRequest: &protocol.ServerRequest{
+						AssumeRole: &protocol.AssumeRole{
+							Role:     &role,
+							Duration: &duration,
+						},
+					},
+				})
+				msg, err := testConnection.Read()
+				if err != nil {
+					t.Fatal(err)
+				}
+				testConnection.Write(&protocol.Message{
+					ServerRequest: &protocol.ServerRequest{
+						ChallengeResponse: &protocol.SSHChallengeResponse{
+							Format:    &format,
+							Signature: []byte("ssss"),
+							Challenge: msg.GetServerResponse().GetChallenge().GetChallenge(),
+						},
+					},
+				})
+				reply, err := testConnection.Read()
+				if err != nil {
+					t.Fatal(err)
+				}
+				return reply.GetServerResponse().GetCredentials()
+			}
+
+			Convey("a shorter session than the role allows should be granted as asked", func() {
+				So(assume(1800).GetDuration(), ShouldEqual, 1800)
+				So(credentials.lastDuration, ShouldEqual, 1800)
+			})
+
+			Convey("a longer session should be cut to the role's maximum", func() {
+				So(assume(8*3600).GetDuration(), ShouldEqual, 3600)
+				So(credentials.lastDuration, ShouldEqual, 3600)
+			})
+
+			Convey("a session should be cut to what the credential service can issue", func() {
+				credentials.maxDuration = 1800
+				So(assume(0).GetDuration(), ShouldEqual, 1800)
+				So(credentials.lastDuration, ShouldEqual, 1800)
+			})
+
+			Convey("a session shorter than STS allows should be raised to its minimum", func() {
+				So(assume(60).GetDuration(), ShouldEqual, 900)
+				So(credentials.lastDuration, ShouldEqual, 900)
+			})
+		})
+
+		Convey("When a client asks for a session policy", func() {
+			format := "test"
+			readOnly := "arn:aws:iam::aws:policy/ReadOnlyAccess"
+			billing := "arn:aws:iam::aws:policy/job-function/Billing"
+			preset, err := server.NewSessionPolicy("", []string{readOnly})
+			So(err, ShouldBeNil)
+			testServer.SetPolicyPresets(map[string]*server.SessionPolicy{"readonly": preset})
+
+			// assume sends msg and answers the challenge, returning the
+			// server's reply.
+			assume := func(msg *protocol.AssumeRole) *protocol.Message {
+				role := "testrole"
+				msg.Role = &role
+				testConnection.Write(&protocol.Message{
+					ServerRequest: &protocol.ServerRequest{AssumeRole: msg},
+				})
+				challenge, err := testConnection.Read()
+				if err != nil {
+					t.Fatal(err)
+				}
+				testConnection.Write(&protocol.Message{
+					ServerRequest: &protocol.ServerRequest{
+						ChallengeResponse: &protocol.SSHChallengeResponse{
+							Format:    &format,
+							Signature: []byte("ssss"),
+							Challenge: challenge.GetServerResponse().GetChallenge().GetChallenge(),
+						},
+					},
+				})
+				reply, err := testConnection.Read()
+				if err != nil {
+					t.Fatal(err)
+				}
+				return reply
+			}
+
+			Convey("a preset should be merged with the policies the client sent", func() {
+				presetName := "readonly"
+				reply := assume(&protocol.AssumeRole{Preset: &presetName, PolicyArns: []string{billing}})
+				So(reply.GetServerResponse().GetCredentials(), ShouldNotBeNil)
+				So(credentials.lastPolicy.PolicyARNs, ShouldResemble, []string{readOnly, billing})
+
+				event := audit.events[len(audit.events)-1]
+				So(event.Preset, ShouldEqual, "readonly")
+				So(event.PolicyARNs, ShouldResemble, []string{readOnly, billing})
+			})
+
+			Convey("an inline policy should reach STS without its whitespace", func() {
+				policy := `{ "Version": "2012-10-17", "Statement": [] }`
+				assume(&protocol.AssumeRole{Policy: &policy})
+				So(credentials.lastPolicy.Policy, ShouldEqual, `{"Version":"2012-10-17","Statement":[]}`)
+			})
+
+			Convey("a malformed policy should be refused as a bad request", func() {
+				policy := "{not json"
+				reply := assume(&protocol.AssumeRole{Policy: &policy})
+				So(reply.GetErrorCode(), ShouldEqual, protocol.ErrorCode_BAD_REQUEST)
+				So(stats.count("errors.sessionPolicy"), ShouldEqual, 1)
+				So(audit.events[len(audit.events)-1].Outcome, ShouldEqual, server.AuditFailure)
+			})
+
+			Convey("an unknown preset should be refused as a bad request", func() {
+				presetName := "superuser"
+				reply := assume(&protocol.AssumeRole{Preset: &presetName})
+				So(reply.GetErrorCode(), ShouldEqual, protocol.ErrorCode_BAD_REQUEST)
+				So(reply.GetError(), ShouldContainSubstring, "superuser")
+			})
+		})
+
+		Convey("When something is on the deny list", func() {
+			authenticator.user = &server.User{Username: "words", DefaultRole: "default"}
+			format := "test"
+			// request asks for role, answering the challenge if there is
+			// one, and returns the server's final answer.
+			request := func(role string, username string) *protocol.Message {
+				testConnection.Write(&protocol.Message{
+					ServerRequest: &protocol.ServerRequest{
+						AssumeRole: &protocol.AssumeRole{Role: &role, User: &username},
+					},
+				})
+				msg, err := testConnection.Read()
+				if err != nil {
+					t.Fatal(err)
+				}
+				if msg.GetServerResponse().GetChallenge() == nil {
+					return msg
+				}
+				testConnection.Write(&protocol.Message{
+					ServerRequest: &protocol.ServerRequest{
+						ChallengeResponse: &protocol.SSHChallengeResponse{
+							Format:    &format,
+							Signature: []byte("ssss"),
+							Challenge: msg.GetServerResponse().GetChallenge().GetChallenge(),
+						},
+					},
+				})
+				reply, err := testConnection.Read()
+				if err != nil {
+					t.Fatal(err)
+				}
+				return reply
+			}
+			setDenyList := func(blockFallback bool, kind string, value string) {
+				deny, err := server.NewDenyList("", blockFallback)
+				So(err, ShouldBeNil)
+				So(deny.Add(kind, value), ShouldBeNil)
+				testServer.SetDenyList(deny)
+			}
+
+			Convey("a user who names themselves should be refused before any challenge", func() {
+				setDenyList(false, server.DenyUser, "words")
+				reply := request("testrole", "words")
+				So(reply.GetErrorCode(), ShouldEqual, protocol.ErrorCode_ACCESS_REVOKED)
+				So(stats.count("errors.revoked"), ShouldEqual, 1)
+				So(audit.events[len(audit.events)-1].Outcome, ShouldEqual, server.AuditFailure)
+			})
+
+			Convey("a user found only by their key should be refused once known", func() {
+				setDenyList(false, server.DenyUser, "words")
+				So(request("testrole", "").GetErrorCode(), ShouldEqual, protocol.ErrorCode_ACCESS_REVOKED)
+			})
+
+			Convey("a denied role should be refused even though the authorizer allows it", func() {
+				setDenyList(false, server.DenyRole, "arn:aws:iam::123456:role/test*")
+				reply := request("testrole", "")
+				So(reply.GetErrorCode(), ShouldEqual, protocol.ErrorCode_ACCESS_REVOKED)
+				So(credentials.lastDuration, ShouldEqual, 0)
+			})
+
+			Convey("a denied role should be refused without asking for an MFA code", func() {
+				mfa, err := server.NewMFAVerifier(server.MFAAll, nil, "123456", nil)
+				So(err, ShouldBeNil)
+				testServer.SetMFAVerifier(mfa)
+				authenticator.user.MFASecret = testTOTPSecret
+
+				setDenyList(false, server.DenyRole, "arn:aws:iam::123456:role/testrole")
+				reply := request("testrole", "")
+				So(reply.GetServerResponse().GetTokenRequest(), ShouldBeNil)
+				So(reply.GetErrorCode(), ShouldEqual, protocol.ErrorCode_ACCESS_REVOKED)
+			})
+
+			Convey("a denied role may fall back unless the deny list blocks it", func() {
+				fallback, err := server.NewFallbackPolicy(server.FallbackOn, nil)
+				So(err, ShouldBeNil)
+				testServer.SetFallbackPolicy(fallback)
+
+				setDenyList(false, server.DenyRole, "arn:aws:iam::123456:role/testrole")
+				So(request("testrole", "").GetServerResponse().GetCredentials().GetFellBack(), ShouldBeTrue)
+
+				setDenyList(true, server.DenyRole, "arn:aws:iam::123456:role/testrole")
+				So(request("testrole", "").GetErrorCode(), ShouldEqual, protocol.ErrorCode_ACCESS_REVOKED)
+			})
+
+			Convey("a certificate for a denied key should be refused", func() {
+				userKey := newSigner(t)
+				cert := issueCert(t, newSigner(t), userKey, nil)
+				setDenyList(false, server.DenyKey, ssh.FingerprintSHA256(userKey.PublicKey()))
+				role := "testrole"
+				testConnection.Write(&protocol.Message{
+					ServerRequest: &protocol.ServerRequest{
+						AssumeRole: &protocol.AssumeRole{Role: &role},
+					},
+				})
+				msg, err := testConnection.Read()
+				if err != nil {
+					t.Fatal(err)
+				}
+				testConnection.Write(&protocol.Message{
+					ServerRequest: &protocol.ServerRequest{
+						ChallengeResponse: &protocol.SSHChallengeResponse{
+							Format:    &format,
+							Signature: []byte("ssss"),
+							Challenge: msg.GetServerResponse().GetChallenge().GetChallenge(),
+							PublicKey: cert.PublicKey().Marshal(),
+						},
+					},
+				})
+				reply, err := testConnection.Read()
+				So(err, ShouldBeNil)
+				So(reply.GetErrorCode(), ShouldEqual, protocol.ErrorCode_ACCESS_REVOKED)
+			})
+
+			Convey("a denied role should not be listed", func() {
+				setDenyList(false, server.DenyRole, "arn:aws:iam::123456:role/default")
+				testConnection.Write(&protocol.Message{
+					ServerRequest: &protocol.ServerRequest{
+						ListRoles: &protocol.ListRoles{},
+					},
+				})
+				msg, err := testConnection.Read()
+				if err != nil {
+					t.Fatal(err)
+				}
+				testConnection.Write(&protocol.Message{
+					ServerRequest: &protocol.ServerRequest{
+						ChallengeResponse: &protocol.SSHChallengeResponse{
+							Format:    &format,
+							Signature: []byte("ssss"),
+							Challenge: msg.GetServerResponse().GetChallenge().GetChallenge(),
+						},
+					},
+				})
+				reply, err := testConnection.Read()
+				So(err, ShouldBeNil)
+				So(reply.GetServerResponse().GetRoles(), ShouldNotBeNil)
+				So(reply.GetServerResponse().GetRoles().GetRoles(), ShouldBeEmpty)
+			})
+		})
+
+		Convey("When the requested role cannot be assumed", func() {
+			authenticator.user = &server.User{Username: "words", DefaultRole: "default", MemberOf: []string{"cn=devs,dc=testdn,dc=com"}}
+			role := "untrusted"
+			format := "test"
+			// request asks for the untrusted role and returns the server's answer.
+			request := func() *protocol.Message {
+				testConnection.Write(&protocol.Message{
+					ServerRequest: &protocol.ServerRequest{
+						AssumeRole: &protocol.AssumeRole{
+							Role: &role,
+						},
+					},
+				})
+				msg, err := testConnection.Read()
+				if err != nil {
+					t.Fatal(err)
+				}
+				testConnection.Write(&protocol.Message{
+					ServerRequest: &protocol.ServerRequest{
+						ChallengeResponse: &protocol.SSHChallengeResponse{
+							Format:    &format,
+							Signature: []byte("ssss"),
+							Challenge: msg.GetServerResponse().GetChallenge().GetChallenge(),
+						},
+					},
+				})
+				reply, err := testConnection.Read()
+				if err != nil {
+					t.Fatal(err)
+				}
+				return reply
+			}
+
+			Convey("by default the client should get only the error", func() {
+				reply := request()
+				So(reply.GetError(), ShouldContainSubstring, "AccessDenied")
+				So(reply.GetErrorCode(), ShouldEqual, protocol.ErrorCode_STS_ERROR)
+
+				testConnection.Write(&protocol.Message{Ping: &protocol.Ping{}})
+				next, err := testConnection.Read()
+				So(err, ShouldBeNil)
+				So(next.GetPing(), ShouldNotBeNil)
+				So(audit.events[len(audit.events)-1].Outcome, ShouldEqual, server.AuditFailure)
+			})
+
+			Convey("with fallback on the client should be told which role it got instead", func() {
+				fallback, err := server.NewFallbackPolicy(server.FallbackOn, nil)
+				So(err, ShouldBeNil)
+				testServer.SetFallbackPolicy(fallback)
+
+				creds := request().GetServerResponse().GetCredentials()
+				So(creds, ShouldNotBeNil)
+				So(creds.GetFellBack(), ShouldBeTrue)
+				So(creds.GetRequestedRole(), ShouldEqual, "untrusted")
+				So(creds.GetGrantedRole(), ShouldEqual, "arn:aws:iam::123456:role/default")
+				So(creds.GetFallbackReason(), ShouldContainSubstring, "AccessDenied")
+
+				event := audit.events[len(audit.events)-1]
+				So(event.Outcome, ShouldEqual, server.AuditFallback)
+				So(event.GrantedRole, ShouldEqual, "arn:aws:iam::123456:role/default")
+				So(stats.count("messages.fallback"), ShouldEqual, 1)
+			})
+
+			Convey("with fallback for some groups only members of them should fall back", func() {
+				fallback, err := server.NewFallbackPolicy(server.FallbackGroups, []string{"devs"})
+				So(err, ShouldBeNil)
+				testServer.SetFallbackPolicy(fallback)
+				So(request().GetServerResponse().GetCredentials().GetFellBack(), ShouldBeTrue)
+
+				authenticator.user.MemberOf = []string{"cn=ops,dc=testdn,dc=com"}
+				So(request().GetError(), ShouldContainSubstring, "AccessDenied")
+			})
+
+			Convey("an unknown fallback mode should be refused", func() {
+				_, err := server.NewFallbackPolicy("sometimes", nil)
+				So(err, ShouldNotBeNil)
+			})
+		})
+
+		Convey("After an AssumeRequest naming the user and key", func() {
+			role := "testrole"
+			username := "words"
+
+			testConnection.Write(&protocol.Message{
+				ServerRequest: &protocol.ServerRequest{
+					AssumeRole: &protocol.AssumeRole{
+						User: &username,
+						Role: &role,
+					},
+				},
+			})
+
+			msg, err := testConnection.Read()
+			if err != nil {
+				t.Fatal(err)
+			}
+			So(msg.GetServerResponse().GetChallenge(), ShouldNotBeNil)
+
+			format := "test"
+			sig := []byte("ssss")
+
+			Convey("it should pass both on to the authenticator", func() {
+				pub, _, err := ed25519.GenerateKey(rand.Reader)
+				So(err, ShouldBeNil)
+				key, err := ssh.NewPublicKey(pub)
+				So(err, ShouldBeNil)
+
+				testConnection.Write(&protocol.Message{
+					ServerRequest: &protocol.ServerRequest{
+						ChallengeResponse: &protocol.SSHChallengeResponse{
+							Format:    &format,
+							Signature: sig,
+							PublicKey: key.Marshal(),
+						},
+					},
+				})
+
+				credsMsg, err := testConnection.Read()
+				if err != nil {
+					t.Fatal(err)
+				}
+				So(credsMsg.GetServerResponse().GetCredentials(), ShouldNotBeNil)
+				So(authenticator.username, ShouldEqual, "words")
+				So(authenticator.key.Marshal(), ShouldResemble, key.Marshal())
+				So(audit.events[0].KeyFingerprint, ShouldEqual, ssh.FingerprintSHA256(key))
+			})
+
+			Convey("it should reject a malformed key without consulting the authenticator", func() {
+				testConnection.Write(&protocol.Message{
+					ServerRequest: &protocol.ServerRequest{
+						ChallengeResponse: &protocol.SSHChallengeResponse{
+							Format:    &format,
+							Signature: sig,
+							PublicKey: []byte("not a key"),
+						},
+					},
+				})
+
+				failureMsg, err := testConnection.Read()
+				if err != nil {
+					t.Fatal(err)
+				}
+				So(failureMsg.GetServerResponse().GetVerificationFailure(), ShouldNotBeNil)
+				So(authenticator.username, ShouldEqual, "")
+				So(audit.events[0].Error, ShouldEqual, "malformed public key")
 			})
 		})
 
@@ -276,3 +1234,53 @@ func TestServerStateMachine(t *testing.T) {
 		})
 	})
 }
+
+/*
+throttledSTS refuses every request the way STS does when its rate limit is
+exceeded.
+*/
+type throttledSTS struct{}
+
+func (throttledSTS) AssumeRole(*sts.AssumeRoleInput) (*sts.AssumeRoleOutput, error) {
+	return nil, awserr.New("Throttling", "Rate exceeded", nil)
+}
+
+func (throttledSTS) GetSessionToken(*sts.GetSessionTokenInput) (*sts.GetSessionTokenOutput, error) {
+	return nil, awserr.New("Throttling", "Rate exceeded", nil)
+}
+
+func TestHubThrottling(t *testing.T) {
+	Convey("Given a server that reaches an account through a throttled hub role", t, func() {
+		aliases := map[string]string{"prod": "arn:aws:iam::222222222222"}
+		credentials := server.NewDirectSessionTokenService("111111111111", throttledSTS{}, &aliases)
+		So(credentials.SetRoleChains(map[string][]string{"prod": {"hologram-hub"}}, func(*sts.Credentials) server.STSImplementation {
+			return throttledSTS{}
+		}), ShouldBeNil)
+		authenticator := &DummyAuthenticator{user: &server.User{Username: "words"}}
+		stats := &countingStatter{counters: map[string]int{}}
+		testServer := server.New(authenticator, credentials, server.NewAllowAllAuthorizer("111111111111", &aliases), "default", stats, &DummyLDAP{}, "cn", "dc=testdn,dc=com", false, "", "sshPublicKey", "ref")
+		r, w := io.Pipe()
+		testConnection := protocol.NewMessageConnection(ReadWriter(r, w))
+		go testServer.HandleConnection(testConnection)
+
+		Convey("Assuming a role behind it should report the throttling", func() {
+			role := "prod/admin"
+			testConnection.Write(&protocol.Message{
+				ServerRequest: &protocol.ServerRequest{AssumeRole: &protocol.AssumeRole{Role: &role}},
+			})
+			_, err := testConnection.Read()
+			So(err, ShouldBeNil)
+
+			format := "test"
+			testConnection.Write(&protocol.Message{
+				ServerRequest: &protocol.ServerRequest{
+					ChallengeResponse: &protocol.SSHChallengeResponse{Format: &format, Signature: []byte("ssss")},
+				},
+			})
+			reply, err := testConnection.Read()
+			So(err, ShouldBeNil)
+			So(reply.GetError(), ShouldNotBeNil)
+			So(reply.GetErrorCode(), ShouldEqual, protocol.ErrorCode_STS_THROTTLED)
+		})
+	})
+}
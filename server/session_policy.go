@@ -0,0 +1,132 @@
+// Copyright 2014 AdRoll, Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package server
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"regexp"
+	"sort"
+	"strings"
+
+	"github.com/aws/aws-sdk-go/service/sts"
+)
+
+// Limits STS puts on session policies.
+const (
+	maxSessionPolicySize = 2048
+	maxPolicyARNs        = 10
+)
+
+var policyARNPattern = regexp.MustCompile(`^arn:aws[a-z-]*:iam::(aws|[0-9]{12}):policy/[A-Za-z0-9+=,.@_/-]+$`)
+
+/*
+SessionPolicy narrows what a session may do to less than its role
+allows. Policy is an inline IAM policy document and PolicyARNs name
+managed policies; the session gets only what both the role and these
+policies allow.
+*/
+type SessionPolicy struct {
+	Policy     string
+	PolicyARNs []string
+}
+
+/*
+NewSessionPolicy checks an inline policy and managed policy ARNs against
+the limits STS enforces, so that a bad policy is refused with a clear
+message rather than an STS error. The inline policy is stored with its
+whitespace removed, since that is how STS counts its size. It returns
+nil if there is no policy at all.
+*/
+func NewSessionPolicy(policy string, policyARNs []string) (*SessionPolicy, error) {
+	if strings.TrimSpace(policy) == "" && len(policyARNs) == 0 {
+		return nil, nil
+	}
+
+	p := &SessionPolicy{}
+	if strings.TrimSpace(policy) != "" {
+		var compact bytes.Buffer
+		if err := json.Compact(&compact, []byte(policy)); err != nil {
+			return nil, fmt.Errorf("session policy is not valid JSON: %s", err)
+		}
+		if compact.Len() > maxSessionPolicySize {
+			return nil, fmt.Errorf("session policy is %d characters without whitespace; STS allows at most %d", compact.Len(), maxSessionPolicySize)
+		}
+		p.Policy = compact.String()
+	}
+
+	seen := map[string]bool{}
+	for _, arn := range policyARNs {
+		if !policyARNPattern.MatchString(arn) {
+			return nil, fmt.Errorf("%q is not a managed policy ARN", arn)
+		}
+		if !seen[arn] {
+			seen[arn] = true
+			p.PolicyARNs = append(p.PolicyARNs, arn)
+		}
+	}
+	if len(p.PolicyARNs) > maxPolicyARNs {
+		return nil, fmt.Errorf("%d managed policies were given; STS allows at most %d", len(p.PolicyARNs), maxPolicyARNs)
+	}
+	sort.Strings(p.PolicyARNs)
+	return p, nil
+}
+
+/*
+mergeSessionPolicies combines a preset with the policy a client sent.
+STS takes a single inline policy, so both may not have one.
+*/
+func mergeSessionPolicies(preset *SessionPolicy, requested *SessionPolicy) (*SessionPolicy, error) {
+	if requested == nil {
+		return preset, nil
+	}
+	if preset == nil {
+		return requested, nil
+	}
+	if preset.Policy != "" && requested.Policy != "" {
+		return nil, fmt.Errorf("the preset already has an inline policy; STS accepts only one")
+	}
+	policy := preset.Policy
+	if policy == "" {
+		policy = requested.Policy
+	}
+	return NewSessionPolicy(policy, append(append([]string{}, preset.PolicyARNs...), requested.PolicyARNs...))
+}
+
+/*
+apply sets the session policy on a request to STS.
+*/
+func (p *SessionPolicy) apply(options *sts.AssumeRoleInput) {
+	if p == nil {
+		return
+	}
+	if p.Policy != "" {
+		options.Policy = stringPtr(p.Policy)
+	}
+	for _, arn := range p.PolicyARNs {
+		options.PolicyArns = append(options.PolicyArns, &sts.PolicyDescriptorType{Arn: stringPtr(arn)})
+	}
+}
+
+/*
+String identifies the policy, for use in cache keys and logs.
+*/
+func (p *SessionPolicy) String() string {
+	if p == nil {
+		return ""
+	}
+	return p.Policy + " " + strings.Join(p.PolicyARNs, ",")
+}
@@ -0,0 +1,63 @@
+// Copyright 2014 AdRoll, Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package server_test
+
+import (
+	"fmt"
+	"strings"
+	"testing"
+
+	"github.com/AdRoll/hologram/server"
+	. "github.com/smartystreets/goconvey/convey"
+)
+
+func TestSessionPolicy(t *testing.T) {
+	Convey("No policy at all should give a nil session policy", t, func() {
+		policy, err := server.NewSessionPolicy("  ", nil)
+		So(err, ShouldBeNil)
+		So(policy, ShouldBeNil)
+	})
+
+	Convey("Managed policy ARNs should be deduplicated and sorted", t, func() {
+		policy, err := server.NewSessionPolicy("", []string{
+			"arn:aws:iam::123456789012:policy/team/deploy",
+			"arn:aws:iam::aws:policy/ReadOnlyAccess",
+			"arn:aws:iam::123456789012:policy/team/deploy",
+		})
+		So(err, ShouldBeNil)
+		So(policy.PolicyARNs, ShouldResemble, []string{
+			"arn:aws:iam::123456789012:policy/team/deploy",
+			"arn:aws:iam::aws:policy/ReadOnlyAccess",
+		})
+	})
+
+	Convey("Policies STS would reject should be refused", t, func() {
+		_, err := server.NewSessionPolicy("{\"Version\":", nil)
+		So(err, ShouldNotBeNil)
+
+		_, err = server.NewSessionPolicy(fmt.Sprintf(`{"Sid":"%s"}`, strings.Repeat("x", 2048)), nil)
+		So(err, ShouldNotBeNil)
+
+		_, err = server.NewSessionPolicy("", []string{"arn:aws:iam::123456789012:role/admin"})
+		So(err, ShouldNotBeNil)
+
+		arns := []string{}
+		for i := 0; i < 11; i++ {
+			arns = append(arns, fmt.Sprintf("arn:aws:iam::123456789012:policy/p%d", i))
+		}
+		_, err = server.NewSessionPolicy("", arns)
+		So(err, ShouldNotBeNil)
+	})
+}
@@ -0,0 +1,252 @@
+// Copyright 2014 AdRoll, Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package server
+
+import (
+	"errors"
+	"sort"
+	"strconv"
+	"strings"
+
+	"github.com/AdRoll/hologram/log"
+	"github.com/peterbourgon/g2s"
+	"golang.org/x/crypto/ssh"
+)
+
+// errNotCached means the key or user was not found, so refreshing the
+// cache might change the outcome.
+var errNotCached = errors.New("key or user not cached")
+
+/*
+userSnapshot is the content of a user cache at one point in time. It is
+never changed once built: an update builds a new snapshot and swaps it
+in, so readers never need a lock and never see half an update.
+*/
+type userSnapshot struct {
+	users   map[string]*User
+	keys    map[string][]*User
+	groups  map[string]*Group
+	members memberIndex
+}
+
+/*
+newUserSnapshot indexes users by key fingerprint. A key may belong to
+more than one user, so each fingerprint maps to all of them, sorted by
+username. The maps given become part of the snapshot and must not be
+changed afterwards.
+*/
+func newUserSnapshot(users map[string]*User, groups map[string]*Group, members memberIndex) *userSnapshot {
+	keys := map[string][]*User{}
+	for _, user := range users {
+		for _, key := range user.SSHKeys {
+			fp := ssh.FingerprintSHA256(key)
+			if keyOwner(keys[fp], user.Username) == nil {
+				keys[fp] = append(keys[fp], user)
+			}
+		}
+	}
+	for _, owners := range keys {
+		sort.Slice(owners, func(i, j int) bool { return owners[i].Username < owners[j].Username })
+	}
+	return &userSnapshot{users: users, keys: keys, groups: groups, members: members}
+}
+
+/*
+copyMaps returns copies of the snapshot's users and groups, for building
+the next snapshot from this one.
+*/
+func (s *userSnapshot) copyMaps() (map[string]*User, map[string]*Group) {
+	users := make(map[string]*User, len(s.users))
+	for username, user := range s.users {
+		users[username] = user
+	}
+	groups := make(map[string]*Group, len(s.groups))
+	for dn, group := range s.groups {
+		groups[dn] = group
+	}
+	return users, groups
+}
+
+/*
+verify checks a signature against the snapshot. When the client told
+us which key it used, only that key is looked up and tried; otherwise
+every key of the named user, or of every user if no name was given, is
+tried in turn. It returns errNotCached if refreshing the cache could
+change the outcome, and a *BadSignatureError for a known key with a bad
+signature.
+*/
+func (s *userSnapshot) verify(username string, key ssh.PublicKey, challenge []byte, sshSig *ssh.Signature) (
+	*User, ssh.PublicKey, error) {
+	if key != nil {
+		owners := s.keys[ssh.FingerprintSHA256(key)]
+		if len(owners) == 0 {
+			return nil, nil, errNotCached
+		}
+		user := owners[0]
+		if username != "" {
+			if user = keyOwner(owners, username); user == nil {
+				return nil, nil, errNotCached
+			}
+		}
+		if key.Verify(challenge, sshSig) != nil {
+			return nil, nil, &BadSignatureError{Username: user.Username}
+		}
+		return user, key, nil
+	}
+
+	candidates := s.users
+	if username != "" {
+		candidates = map[string]*User{}
+		if user, ok := s.users[username]; ok {
+			candidates[username] = user
+		}
+	}
+
+	for _, user := range candidates {
+		for _, key := range user.SSHKeys {
+			verifyErr := key.Verify(challenge, sshSig)
+			if verifyErr == nil {
+				return user, key, nil
+			}
+		}
+	}
+
+	return nil, nil, errNotCached
+}
+
+/*
+unknownUser returns ErrUnknownUser if a user was named and the snapshot
+does not have them.
+*/
+func (s *userSnapshot) unknownUser(username string) error {
+	if _, ok := s.users[username]; username != "" && !ok {
+		return ErrUnknownUser
+	}
+	return nil
+}
+
+/*
+snapshotDiff is what changed between two snapshots.
+*/
+type snapshotDiff struct {
+	added       []string
+	removed     []string
+	rotated     []string
+	changed     []string
+	keysAdded   int
+	keysRemoved int
+}
+
+/*
+diffSnapshots compares two snapshots. A user is rotated if their set of
+keys changed, and changed if their groups, roles or attributes did.
+*/
+func diffSnapshots(old *userSnapshot, next *userSnapshot) snapshotDiff {
+	var diff snapshotDiff
+	for username, user := range next.users {
+		previous, ok := old.users[username]
+		if !ok {
+			diff.added = append(diff.added, username)
+			continue
+		}
+		if entitlements(previous) != entitlements(user) {
+			diff.changed = append(diff.changed, username)
+		}
+	}
+	for username := range old.users {
+		if _, ok := next.users[username]; !ok {
+			diff.removed = append(diff.removed, username)
+		}
+	}
+
+	rotated := map[string]bool{}
+	for fp, owners := range next.keys {
+		if _, ok := old.keys[fp]; !ok {
+			diff.keysAdded++
+		}
+		for _, user := range owners {
+			if keyOwner(old.keys[fp], user.Username) == nil {
+				rotated[user.Username] = true
+			}
+		}
+	}
+	for fp, owners := range old.keys {
+		if _, ok := next.keys[fp]; !ok {
+			diff.keysRemoved++
+		}
+		for _, user := range owners {
+			if keyOwner(next.keys[fp], user.Username) == nil {
+				rotated[user.Username] = true
+			}
+		}
+	}
+	for _, username := range append(diff.added, diff.removed...) {
+		delete(rotated, username)
+	}
+	for username := range rotated {
+		diff.rotated = append(diff.rotated, username)
+	}
+
+	sort.Strings(diff.added)
+	sort.Strings(diff.removed)
+	sort.Strings(diff.rotated)
+	sort.Strings(diff.changed)
+	return diff
+}
+
+/*
+empty reports whether nothing changed.
+*/
+func (d snapshotDiff) empty() bool {
+	return len(d.added) == 0 && len(d.removed) == 0 && len(d.rotated) == 0 &&
+		len(d.changed) == 0 && d.keysAdded == 0 && d.keysRemoved == 0
+}
+
+/*
+report logs the diff and sends it to stats, along with the size of the
+new snapshot. Stat names start with prefix, which names the source of
+the users.
+*/
+func (d snapshotDiff) report(stats g2s.Statter, prefix string, next *userSnapshot) {
+	if !d.empty() {
+		log.Info("User cache changed: %d users added %s, %d removed %s, %d with new keys %s, %d with new entitlements %s; %d keys added and %d removed.",
+			len(d.added), usernameList(d.added), len(d.removed), usernameList(d.removed),
+			len(d.rotated), usernameList(d.rotated), len(d.changed), usernameList(d.changed),
+			d.keysAdded, d.keysRemoved)
+	}
+	stats.Counter(1.0, prefix+"UsersAdded", len(d.added))
+	stats.Counter(1.0, prefix+"UsersRemoved", len(d.removed))
+	stats.Counter(1.0, prefix+"UsersRotated", len(d.rotated))
+	stats.Counter(1.0, prefix+"KeysAdded", d.keysAdded)
+	stats.Counter(1.0, prefix+"KeysRemoved", d.keysRemoved)
+	stats.Gauge(1.0, prefix+"Users", strconv.Itoa(len(next.users)))
+	stats.Gauge(1.0, prefix+"Keys", strconv.Itoa(len(next.keys)))
+}
+
+/*
+keyOwner returns the named user among the owners of a key, or nil.
+*/
+func keyOwner(owners []*User, username string) *User {
+	for _, user := range owners {
+		if user.Username == username {
+			return user
+		}
+	}
+	return nil
+}
+
+func usernameList(usernames []string) string {
+	return "[" + strings.Join(usernames, ", ") + "]"
+}
@@ -0,0 +1,116 @@
+// Copyright 2014 AdRoll, Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package server_test
+
+import (
+	cryptrand "crypto/rand"
+	"sync"
+	"testing"
+
+	"github.com/AdRoll/hologram/server"
+	. "github.com/smartystreets/goconvey/convey"
+	"golang.org/x/crypto/ssh"
+)
+
+func TestUserCacheSnapshots(t *testing.T) {
+	Convey("Given an LDAP user cache", t, func() {
+		directory := &directoryStub{}
+		directory.add("cn=alice,dc=example,dc=com", []string{"cn", "alice"}, []string{"sshPublicKey", authorizedKey(testKeys[0])})
+		directory.add("cn=bob,dc=example,dc=com", []string{"cn", "bob"}, []string{"sshPublicKey", authorizedKey(testKeys[1])})
+
+		stats := &countingStatter{counters: map[string]int{}}
+		lc, err := server.NewLDAPUserCache(directory, stats, "cn", "dc=example,dc=com", false, "", "default", "", "groupOfNames", "sshPublicKey", "", "", nil)
+		So(err, ShouldBeNil)
+		So(stats.count("ldapUsersAdded"), ShouldEqual, 2)
+		So(stats.count("ldapKeysAdded"), ShouldEqual, 2)
+
+		changed := []string{}
+		lc.OnEntitlementsChange(func(username string) {
+			changed = append(changed, username)
+		})
+
+		authenticate := func(private []byte) *server.User {
+			signer, err := ssh.ParsePrivateKey(private)
+			So(err, ShouldBeNil)
+			challenge := randomBytes(64)
+			sig, err := signer.Sign(cryptrand.Reader, challenge)
+			So(err, ShouldBeNil)
+			user, _, _ := lc.Authenticate("", signer.PublicKey(), challenge, sig)
+			return user
+		}
+
+		Convey("A user deleted from LDAP should disappear with their keys", func() {
+			directory.remove("cn=bob,dc=example,dc=com")
+			So(lc.Update(), ShouldBeNil)
+			So(lc.Users(), ShouldNotContainKey, "bob")
+			So(authenticate(testKeys[1]), ShouldBeNil)
+			So(changed, ShouldResemble, []string{"bob"})
+			So(stats.count("ldapUsersRemoved"), ShouldEqual, 1)
+			So(stats.count("ldapKeysRemoved"), ShouldEqual, 1)
+		})
+
+		Convey("A key removed from a user's entry should stop working", func() {
+			directory.add("cn=alice,dc=example,dc=com", []string{"cn", "alice"}, []string{"sshPublicKey", authorizedKey(testKeys[1])})
+			directory.remove("cn=bob,dc=example,dc=com")
+			So(lc.Update(), ShouldBeNil)
+			So(authenticate(testKeys[0]), ShouldBeNil)
+			So(authenticate(testKeys[1]).Username, ShouldEqual, "alice")
+			So(stats.count("ldapUsersRotated"), ShouldEqual, 1)
+		})
+
+		Convey("A user who has no keys left should be dropped when reloaded alone", func() {
+			directory.add("cn=bob,dc=example,dc=com", []string{"cn", "bob"})
+			So(lc.UpdateUser("bob"), ShouldBeNil)
+			So(lc.Users(), ShouldNotContainKey, "bob")
+		})
+
+		Convey("A snapshot already handed out should not change", func() {
+			users := lc.Users()
+			directory.remove("cn=alice,dc=example,dc=com")
+			So(lc.Update(), ShouldBeNil)
+			So(users, ShouldContainKey, "alice")
+			So(lc.Users(), ShouldNotContainKey, "alice")
+		})
+
+		Convey("Updates should be safe while users authenticate", func() {
+			signer, err := ssh.ParsePrivateKey(testKeys[0])
+			So(err, ShouldBeNil)
+			challenge := randomBytes(64)
+			sig, err := signer.Sign(cryptrand.Reader, challenge)
+			So(err, ShouldBeNil)
+
+			var wg sync.WaitGroup
+			failures := make(chan bool, 100)
+			for i := 0; i < 4; i++ {
+				wg.Add(1)
+				go func() {
+					defer wg.Done()
+					for j := 0; j < 25; j++ {
+						user, _, _ := lc.Authenticate("alice", signer.PublicKey(), challenge, sig)
+						failures <- user == nil
+					}
+				}()
+			}
+			for i := 0; i < 10; i++ {
+				lc.Update()
+			}
+			wg.Wait()
+			close(failures)
+			for failed := range failures {
+				So(failed, ShouldBeFalse)
+			}
+		})
+	})
+}
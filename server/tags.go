@@ -0,0 +1,175 @@
+// Copyright 2014 AdRoll, Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package server
+
+import (
+	"sort"
+	"strings"
+
+	"github.com/aws/aws-sdk-go/service/sts"
+)
+
+// Limits STS places on session tags and source identities.
+const (
+	maxSessionTags       = 50
+	maxTagKeyLength      = 128
+	maxTagValueLength    = 256
+	maxSourceIdentityLen = 64
+)
+
+/*
+SessionTagMapping describes how a user's LDAP identity is passed on to
+STS, so that IAM policies can make decisions on it and CloudTrail shows
+who is really behind a session.
+*/
+type SessionTagMapping struct {
+	// Tags maps session tag keys to the LDAP attribute holding their value.
+	Tags map[string]string `json:"tags"`
+	// GroupsTag, if set, is the key of a tag listing the names of the
+	// groups the user belongs to.
+	GroupsTag string `json:"groupstag"`
+	// Transitive lists the tag keys that survive role chaining.
+	Transitive []string `json:"transitive"`
+	// SourceIdentity is the LDAP attribute used as the session's source
+	// identity. The username is used if the user has no such attribute.
+	SourceIdentity string `json:"sourceidentity"`
+}
+
+/*
+Attributes returns the LDAP attributes the mapping needs.
+*/
+func (tm *SessionTagMapping) Attributes() []string {
+	if tm == nil {
+		return nil
+	}
+	seen := map[string]bool{}
+	for _, attribute := range tm.Tags {
+		seen[attribute] = true
+	}
+	if tm.SourceIdentity != "" {
+		seen[tm.SourceIdentity] = true
+	}
+	attributes := []string{}
+	for attribute := range seen {
+		attributes = append(attributes, attribute)
+	}
+	sort.Strings(attributes)
+	return attributes
+}
+
+/*
+Apply adds the user's tags and source identity to an AssumeRole call.
+Tags without a value are left out.
+*/
+func (tm *SessionTagMapping) Apply(user *User, input *sts.AssumeRoleInput) {
+	if tm == nil {
+		return
+	}
+
+	keys := []string{}
+	for key := range tm.Tags {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+
+	values := map[string]string{}
+	for _, key := range keys {
+		if attribute := user.Attributes[tm.Tags[key]]; len(attribute) > 0 {
+			values[key] = attribute[0]
+		}
+	}
+	if tm.GroupsTag != "" {
+		names := []string{}
+		for _, dn := range user.MemberOf {
+			names = append(names, groupName(dn))
+		}
+		if len(names) > 0 {
+			values[tm.GroupsTag] = strings.Join(names, ":")
+			keys = append(keys, tm.GroupsTag)
+		}
+	}
+
+	for _, key := range keys {
+		value, ok := values[key]
+		if !ok || len(input.Tags) >= maxSessionTags {
+			continue
+		}
+		input.Tags = append(input.Tags, &sts.Tag{
+			Key:   stringPtr(truncate(sanitizeTag(key), maxTagKeyLength)),
+			Value: stringPtr(truncate(sanitizeTag(value), maxTagValueLength)),
+		})
+	}
+
+	for _, key := range tm.Transitive {
+		if _, ok := values[key]; ok {
+			input.TransitiveTagKeys = append(input.TransitiveTagKeys, stringPtr(truncate(sanitizeTag(key), maxTagKeyLength)))
+		}
+	}
+
+	if tm.SourceIdentity != "" {
+		identity := user.Username
+		if attribute := user.Attributes[tm.SourceIdentity]; len(attribute) > 0 && attribute[0] != "" {
+			identity = attribute[0]
+		}
+		input.SourceIdentity = stringPtr(truncate(sanitize(identity, "_+=,.@-"), maxSourceIdentityLen))
+	}
+}
+
+/*
+groupName returns the value of the first RDN of a group DN, so that
+"cn=admins,ou=groups,dc=example,dc=com" becomes "admins".
+*/
+func groupName(dn string) string {
+	rdn := strings.SplitN(dn, ",", 2)[0]
+	if i := strings.Index(rdn, "="); i >= 0 {
+		return strings.TrimSpace(rdn[i+1:])
+	}
+	return rdn
+}
+
+/*
+sanitizeTag replaces characters STS does not allow in tag keys and
+values with underscores.
+*/
+func sanitizeTag(s string) string {
+	return sanitize(s, " _.:/=+-@")
+}
+
+/*
+sanitize replaces everything but ASCII letters, digits and the allowed
+punctuation with underscores.
+*/
+func sanitize(s string, allowed string) string {
+	return strings.Map(func(r rune) rune {
+		switch {
+		case r >= 'a' && r <= 'z', r >= 'A' && r <= 'Z', r >= '0' && r <= '9':
+			return r
+		case strings.ContainsRune(allowed, r):
+			return r
+		}
+		return '_'
+	}, s)
+}
+
+func truncate(s string, length int) string {
+	if len(s) > length {
+		return s[:length]
+	}
+	return s
+}
+
+func stringPtr(s string) *string {
+	return &s
+}
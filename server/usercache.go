@@ -19,6 +19,9 @@ import (
 	"fmt"
 	"time"
 	"strconv"
+	"strings"
+	"sync"
+	"sync/atomic"
 
 	"github.com/AdRoll/hologram/log"
 	"github.com/nmcclain/ldap"
@@ -34,11 +37,38 @@ type User struct {
 	SSHKeys     []ssh.PublicKey
 	Groups      []*Group
 	DefaultRole string
+	// MemberOf holds the DNs of every group the user belongs to directly,
+	// whether or not that group carries Hologram roles.
+	MemberOf []string
+	// DN is the user's LDAP entry.
+	DN string
+	// GroupChains maps the DN of each of Groups to the chain of group
+	// DNs through which the user belongs to it, starting with a group
+	// they are a direct member of.
+	GroupChains map[string][]string
+	// MFASecret is the user's base32 TOTP secret, if they have one.
+	MFASecret string
+	// Attributes holds any other LDAP attributes Hologram was asked to
+	// fetch, such as those used for session tags.
+	Attributes map[string][]string
+	// memberOfAttr holds the memberOf values of the user's own entry.
+	memberOfAttr []string
+	// ldapKeys holds the keys from the user's own entry, before any from
+	// a key server are merged in.
+	ldapKeys []ssh.PublicKey
 }
 
+/*
+Group is an LDAP group and the roles it grants.
+*/
 type Group struct {
 	ARNs    []string
 	Timeout int64
+	DN      string
+	// MemberOf holds the DNs of the groups this group is nested in.
+	MemberOf []string
+	// Members holds the values of the group's membership attributes.
+	Members []string
 }
 
 /*
@@ -61,11 +91,13 @@ type LDAPImplementation interface {
 }
 
 /*
-ldapUserCache connects to LDAP and pulls user settings from it.
+ldapUserCache connects to LDAP and pulls user settings from it. Readers
+use the current snapshot without locking; updates build a new snapshot
+under updateLock and swap it in.
 */
 type ldapUserCache struct {
-	users           map[string]*User
-	groups          map[string]*Group
+	snapshot        atomic.Value
+	updateLock      sync.Mutex
 	server          LDAPImplementation
 	stats           g2s.Statter
 	userAttr        string
@@ -77,25 +109,65 @@ type ldapUserCache struct {
 	groupClassAttr  string
 	pubKeysAttr     string
 	roleTimeoutAttr string
+	mfaSecretAttr   string
+	userAttributes  []string
+	maxGroupDepth   int
+	memberAttrs     []string
+	keyServer       *keyServer
+	keyMerge        string
+	onChange        func(username string)
+	syncLock        sync.Mutex
+	syncStatus      SyncStatus
+	incremental     bool
+	fullInterval    time.Duration
+	highWater       time.Time
+	lastFull        time.Time
 }
 
 /*
 Update() searches LDAP for the current user set that supports
-the necessary properties for Hologram.
+the necessary properties for Hologram, and records how it went for
+SyncStatus(). With incremental sync on, only entries changed since the
+last sync are fetched, except when a full reconcile is due.
 
 TODO: call this at some point during verification failure so that keys that have
 been recently added to LDAP work, instead of requiring a server restart.
 */
 func (luc *ldapUserCache) Update() error {
+	luc.updateLock.Lock()
+	defer luc.updateLock.Unlock()
+	return luc.sync(!luc.incrementalDue())
+}
+
+/*
+update searches LDAP for groups and for users with keys, and swaps in a
+new snapshot. A full update builds it from scratch, so users, keys and
+groups that are gone from LDAP disappear; otherwise only entries
+modified since the high-water mark are fetched and applied to a copy of
+the current snapshot. The caller must hold updateLock.
+*/
+func (luc *ldapUserCache) update(full bool) error {
 	start := time.Now()
+	since := luc.highWater
+	highWater := luc.highWater
+	old := luc.current()
+	users, groups := old.copyMaps()
+	members := old.members
+	if full {
+		users, groups, members = map[string]*User{}, map[string]*Group{}, memberIndex{}
+	}
 	if luc.enableLDAPRoles {
 		// Search for groups and their members
+		filter := fmt.Sprintf("(objectClass=%s)", luc.groupClassAttr)
+		if !full {
+			filter = changedSince(filter, since)
+		}
 		groupSearchRequest := ldap.NewSearchRequest(
 			luc.baseDN,
 			ldap.ScopeWholeSubtree, ldap.NeverDerefAliases,
 			0, 0, false,
-			fmt.Sprintf("(objectClass=%s)", luc.groupClassAttr),
-			[]string{luc.roleAttribute, luc.roleTimeoutAttr},
+			filter,
+			append([]string{luc.roleAttribute, luc.roleTimeoutAttr, "memberOf", modifyTimestampAttr}, luc.memberAttrs...),
 			nil,
 		)
 
@@ -104,6 +176,7 @@ func (luc *ldapUserCache) Update() error {
 			return err
 		}
 
+		highWater = latestModified(groupSearchResult.Entries, highWater)
 		for _, entry := range groupSearchResult.Entries {
 			dn := entry.DN
 			ARNs := entry.GetAttributeValues(luc.roleAttribute)
@@ -125,118 +198,325 @@ func (luc *ldapUserCache) Update() error {
 			}
 
 			log.Debug("Adding %s to %s with Timeout %d", ARNs, dn, timeout)
-			luc.groups[dn] = &Group{
-				ARNs:    ARNs,
-				Timeout: timeout,
+			groups[dn] = &Group{
+				ARNs:     ARNs,
+				Timeout:  timeout,
+				DN:       dn,
+				MemberOf: entry.GetAttributeValues("memberOf"),
+				Members:  luc.groupMembers(entry),
 			}
 		}
+		if full || len(groupSearchResult.Entries) > 0 {
+			members = newMemberIndex(groups)
+		}
+		if luc.maxGroupDepth > 0 && len(groupSearchResult.Entries) > 0 {
+			warnGroupCycles(groups, members)
+		}
+		if !full && len(groupSearchResult.Entries) > 0 {
+			luc.relinkGroups(users, groups, members)
+		}
 	}
 
-	filter := fmt.Sprintf("(%s=*)", luc.pubKeysAttr)
+	// A user whose last key was removed no longer matches userFilter, so
+	// incremental updates fetch every changed user entry and drop those
+	// left with no keys.
+	filter := luc.userFilter()
+	if !full {
+		filter = changedSince(luc.entryFilter(), since)
+	}
+	entries, err := luc.searchUsers(filter, users, groups, members)
+	if err != nil {
+		return err
+	}
+	if !full {
+		luc.dropKeyless(users, entries)
+	}
+
+	luc.swap(old, newUserSnapshot(users, groups, members))
+	luc.highWater = latestModified(entries, highWater)
+	if full {
+		log.Debug("LDAP information re-cached.")
+		luc.stats.Timing(1.0, "ldapCacheUpdate", time.Since(start))
+	} else {
+		log.Debug("%d changed LDAP users re-cached.", len(entries))
+		luc.stats.Timing(1.0, "ldapIncrementalUpdate", time.Since(start))
+	}
+	return nil
+}
+
+/*
+UpdateUser refreshes a single user from LDAP, which is much cheaper than
+a full Update() when a client tells us who it claims to be. A user who
+is gone from LDAP, or has no keys left there, is dropped. With a key
+server, the user's keys there are revalidated too.
+*/
+func (luc *ldapUserCache) UpdateUser(username string) error {
+	if err := luc.updateUser(username); err != nil {
+		return err
+	}
+	luc.serveKeys([]string{username}, true)
+	return nil
+}
+
+/*
+updateUser refreshes a single user's entry from LDAP.
+*/
+func (luc *ldapUserCache) updateUser(username string) error {
+	luc.updateLock.Lock()
+	defer luc.updateLock.Unlock()
+	start := time.Now()
+	old := luc.current()
+	users, groups := old.copyMaps()
+	filter := fmt.Sprintf("(&(%s=%s)%s)", luc.userAttr, escapeFilter(username), luc.userFilter())
+	entries, err := luc.searchUsers(filter, users, groups, old.members)
+	if err != nil {
+		return err
+	}
+	if len(entries) == 0 {
+		delete(users, username)
+	}
+	luc.swap(old, newUserSnapshot(users, groups, old.members))
+	luc.stats.Timing(1.0, "ldapUserUpdate", time.Since(start))
+	return nil
+}
+
+/*
+searchUsers puts every user matching the LDAP filter in users, linked to
+their groups and with the keys the key server last gave for them merged
+in, and returns their entries.
+*/
+func (luc *ldapUserCache) searchUsers(filter string, users map[string]*User, groups map[string]*Group, members memberIndex) ([]*ldap.Entry, error) {
+	attributes := []string{luc.pubKeysAttr, luc.userAttr, "memberOf", luc.defaultRoleAttr, modifyTimestampAttr}
+	if luc.mfaSecretAttr != "" {
+		attributes = append(attributes, luc.mfaSecretAttr)
+	}
+	attributes = append(attributes, luc.userAttributes...)
 	searchRequest := ldap.NewSearchRequest(
 		luc.baseDN,
 		ldap.ScopeWholeSubtree, ldap.NeverDerefAliases,
 		0, 0, false,
-		filter, []string{luc.pubKeysAttr, luc.userAttr, "memberOf", luc.defaultRoleAttr},
+		filter, attributes,
 		nil,
 	)
 
 	searchResult, err := luc.server.Search(searchRequest)
 	if err != nil {
-		return err
+		return nil, err
 	}
 	for _, entry := range searchResult.Entries {
 		username := entry.GetAttributeValue(luc.userAttr)
 		userKeys := []ssh.PublicKey{}
 		for _, eachKey := range entry.GetAttributeValues(luc.pubKeysAttr) {
-			sshKeyBytes, _ := base64.StdEncoding.DecodeString(eachKey)
-			userSSHKey, err := ssh.ParsePublicKey(sshKeyBytes)
+			userSSHKey, err := ParseSSHKey(eachKey)
 			if err != nil {
-				userSSHKey, _, _, _, err = ssh.ParseAuthorizedKey([]byte(eachKey))
-				if err != nil {
-					log.Warning("SSH key parsing for user %s failed (key was '%s')!", username, eachKey)
-					continue
-				}
+				log.Warning("SSH key parsing for user %s failed (key was '%s')!", username, eachKey)
+				continue
 			}
 			userKeys = append(userKeys, userSSHKey)
 		}
 
 		userDefaultRole := luc.defaultRole
-		groups := []*Group{}
 		if luc.enableLDAPRoles {
 			userDefaultRole = entry.GetAttributeValue(luc.defaultRoleAttr)
 			if userDefaultRole == "" {
 				userDefaultRole = luc.defaultRole
 			}
-			for _, groupDN := range entry.GetAttributeValues("memberOf") {
-				log.Debug(groupDN)
-				groups = append(groups, luc.groups[groupDN])
-			}
 		}
 
-		luc.users[username] = &User{
-			SSHKeys:     userKeys,
-			Username:    username,
-			Groups:      groups,
-			DefaultRole: userDefaultRole,
-		}
+		memberOfAttr := entry.GetAttributeValues("memberOf")
+		memberOf := members.memberOf(entry.DN, username, memberOfAttr)
+		userGroups, groupChains := luc.resolveGroups(groups, members, memberOf)
+		users[username] = luc.mergeServedKeys(&User{
+			SSHKeys:      userKeys,
+			Username:     username,
+			Groups:       userGroups,
+			GroupChains:  groupChains,
+			DefaultRole:  userDefaultRole,
+			MemberOf:     memberOf,
+			DN:           entry.DN,
+			MFASecret:    luc.mfaSecret(entry),
+			Attributes:   luc.attributes(entry),
+			memberOfAttr: memberOfAttr,
+			ldapKeys:     userKeys,
+		})
 
 		log.Debug("Information on %s (re-)generated.", username)
 	}
+	return searchResult.Entries, nil
+}
 
-	log.Debug("LDAP information re-cached.")
-	luc.stats.Timing(1.0, "ldapCacheUpdate", time.Since(start))
-	return nil
+func (luc *ldapUserCache) mfaSecret(entry *ldap.Entry) string {
+	if luc.mfaSecretAttr == "" {
+		return ""
+	}
+	return entry.GetAttributeValue(luc.mfaSecretAttr)
 }
 
-func (luc *ldapUserCache) Users() map[string]*User {
-	return luc.users
+func (luc *ldapUserCache) attributes(entry *ldap.Entry) map[string][]string {
+	attributes := map[string][]string{}
+	for _, attribute := range luc.userAttributes {
+		if values := entry.GetAttributeValues(attribute); len(values) > 0 {
+			attributes[attribute] = values
+		}
+	}
+	return attributes
 }
 
-func (luc *ldapUserCache) Groups() map[string]*Group {
-	return luc.groups
+/*
+current returns the snapshot to read users, keys and groups from.
+*/
+func (luc *ldapUserCache) current() *userSnapshot {
+	return luc.snapshot.Load().(*userSnapshot)
 }
 
-func (luc *ldapUserCache) _verify(username string, challenge []byte, sshSig *ssh.Signature) (
-	*User, error) {
-	for _, user := range luc.users {
-		for _, key := range user.SSHKeys {
-			verifyErr := key.Verify(challenge, sshSig)
-			if verifyErr == nil {
-				return user, nil
-			}
+/*
+swap makes next the current snapshot, reports what changed since old,
+and tells the OnEntitlementsChange hook about every user whose
+entitlements changed or who is gone. The caller must hold updateLock.
+*/
+func (luc *ldapUserCache) swap(old *userSnapshot, next *userSnapshot) {
+	luc.snapshot.Store(next)
+	diff := diffSnapshots(old, next)
+	diff.report(luc.stats, "ldap", next)
+	if luc.onChange != nil {
+		for _, username := range append(diff.changed, diff.removed...) {
+			luc.onChange(username)
 		}
 	}
+}
 
-	return nil, nil
+/*
+OnEntitlementsChange registers a function to be called with the username
+whenever an update changes a cached user's groups, roles or attributes,
+or drops the user.
+*/
+func (luc *ldapUserCache) OnEntitlementsChange(onChange func(username string)) {
+	luc.onChange = onChange
 }
 
 /*
+ParseSSHKey reads a public key stored either as base64-encoded wire
+format or as a line in authorized_keys format.
+*/
+func ParseSSHKey(encoded string) (ssh.PublicKey, error) {
+	sshKeyBytes, _ := base64.StdEncoding.DecodeString(encoded)
+	key, err := ssh.ParsePublicKey(sshKeyBytes)
+	if err != nil {
+		key, _, _, _, err = ssh.ParseAuthorizedKey([]byte(encoded))
+	}
+	return key, err
+}
+
+/*
+Lookup returns the named user, asking LDAP about them if they are not
+cached yet. Unlike Update() it finds users with no SSH keys in LDAP,
+who can still authenticate with a certificate. It returns nil if there
+is no such user.
+*/
+func (luc *ldapUserCache) Lookup(username string) *User {
+	if user, ok := luc.current().users[username]; ok {
+		return user
+	}
 
- */
-func (luc *ldapUserCache) Authenticate(username string, challenge []byte, sshSig *ssh.Signature) (
-	*User, error) {
-	// Loop through all of the keys and attempt verification.
-	retUser, _ := luc._verify(username, challenge, sshSig)
+	luc.updateLock.Lock()
+	defer luc.updateLock.Unlock()
+	old := luc.current()
+	users, groups := old.copyMaps()
+	filter := fmt.Sprintf("(%s=%s)", luc.userAttr, escapeFilter(username))
+	if _, err := luc.searchUsers(filter, users, groups, old.members); err != nil {
+		log.Errorf("Could not look up %s in LDAP: %s", username, err.Error())
+		return nil
+	}
+	luc.swap(old, newUserSnapshot(users, groups, old.members))
+	return users[username]
+}
 
-	if retUser == nil {
+/*
+Users returns the cached users by username. The map belongs to the
+cache and must not be changed.
+*/
+func (luc *ldapUserCache) Users() map[string]*User {
+	return luc.current().users
+}
+
+/*
+Groups returns the cached groups by DN. The map belongs to the cache and
+must not be changed.
+*/
+func (luc *ldapUserCache) Groups() map[string]*Group {
+	return luc.current().groups
+}
+
+/*
+Authenticate verifies a signature over the challenge, refreshing from
+LDAP once if the key or user is not known yet. Only the claimed user is
+refreshed when the client supplied a username. With a key server, the
+claimed user's keys there, or those of the holders of the named key, are
+fetched first if they are out of date. If the refresh fails and
+the signature still matches no one, the refresh error is returned; a
+claimed user that LDAP does not have gives ErrUnknownUser. With a key
+server and no claimed user, a key no one is known to hold gives
+ErrUsernameRequired, as the key server can only be asked about a user.
+*/
+func (luc *ldapUserCache) Authenticate(username string, key ssh.PublicKey, challenge []byte, sshSig *ssh.Signature) (
+	*User, ssh.PublicKey, error) {
+	luc.serveKeys(luc.keyHolders(username, key), false)
+	retUser, retKey, err := luc.current().verify(username, key, challenge, sshSig)
+
+	if err == errNotCached {
 		log.Debug("Could not find %s in the LDAP cache; updating from the server.", username)
 		luc.stats.Counter(1.0, "ldapCacheMiss", 1)
 
 		// We should update LDAP cache again to retry keys.
-		luc.Update()
-		return luc._verify(username, challenge, sshSig)
+		var updateErr error
+		if username != "" {
+			updateErr = luc.UpdateUser(username)
+		} else {
+			updateErr = luc.Update()
+		}
+		retUser, retKey, err = luc.current().verify(username, key, challenge, sshSig)
+		if err == errNotCached && updateErr != nil {
+			return nil, nil, updateErr
+		}
+	}
+	if err == errNotCached && username == "" && luc.keyServer != nil {
+		return nil, nil, ErrUsernameRequired
 	}
-	return retUser, nil
+	if err == errNotCached {
+		return nil, nil, luc.current().unknownUser(username)
+	}
+	return retUser, retKey, err
+}
+
+/*
+escapeFilter escapes a value for use inside an LDAP search filter, as
+described in RFC 4515.
+*/
+func escapeFilter(value string) string {
+	var buf strings.Builder
+	for i := 0; i < len(value); i++ {
+		switch c := value[i]; c {
+		case '*', '(', ')', '\\', 0:
+			fmt.Fprintf(&buf, "\\%02x", c)
+		default:
+			buf.WriteByte(c)
+		}
+	}
+	return buf.String()
 }
 
+/*
+LDAPOption turns on an optional feature of an LDAP user cache. Options
+are applied before the cache first loads, since they change what is
+fetched from LDAP.
+*/
+type LDAPOption func(luc *ldapUserCache) error
+
 /*
 	NewLDAPUserCache returns a properly-configured LDAP cache.
 */
-func NewLDAPUserCache(server LDAPImplementation, stats g2s.Statter, userAttr string, baseDN string, enableLDAPRoles bool, roleAttribute string, defaultRole string, defaultRoleAttr string, groupClassAttr string, pubKeysAttr string, roleTimeoutAttr string) (*ldapUserCache, error) {
+func NewLDAPUserCache(server LDAPImplementation, stats g2s.Statter, userAttr string, baseDN string, enableLDAPRoles bool, roleAttribute string, defaultRole string, defaultRoleAttr string, groupClassAttr string, pubKeysAttr string, roleTimeoutAttr string, mfaSecretAttr string, userAttributes []string, options ...LDAPOption) (*ldapUserCache, error) {
 	retCache := &ldapUserCache{
-		users:           map[string]*User{},
-		groups:          map[string]*Group{},
 		server:          server,
 		stats:           stats,
 		userAttr:        userAttr,
@@ -248,7 +528,15 @@ func NewLDAPUserCache(server LDAPImplementation, stats g2s.Statter, userAttr str
 		groupClassAttr:  groupClassAttr,
 		pubKeysAttr:     pubKeysAttr,
 		roleTimeoutAttr: roleTimeoutAttr,
+		mfaSecretAttr:   mfaSecretAttr,
+		userAttributes:  userAttributes,
+	}
+	for _, option := range options {
+		if err := option(retCache); err != nil {
+			return nil, err
+		}
 	}
+	retCache.snapshot.Store(newUserSnapshot(map[string]*User{}, map[string]*Group{}, memberIndex{}))
 
 	updateError := retCache.Update()
 
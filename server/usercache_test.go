@@ -16,6 +16,7 @@ package server_test
 
 import (
 	cryptrand "crypto/rand"
+	"errors"
 	"encoding/base64"
 	"math/rand"
 	"net"
@@ -74,9 +75,13 @@ requiring an actual LDAP server.
 type StubLDAPServer struct {
 	Keys      []string
 	OtherKeys []string
+	Err       error
 }
 
 func (sls *StubLDAPServer) Search(s *ldap.SearchRequest) (*ldap.SearchResult, error) {
+	if sls.Err != nil {
+		return nil, sls.Err
+	}
 	return &ldap.SearchResult{
 		Entries: []*ldap.Entry{
 			&ldap.Entry{
@@ -148,6 +153,95 @@ func randomBytes(length int) []byte {
 }
 
 
+func TestKeyDirectedAuthentication(t *testing.T) {
+	Convey("Given an LDAP user cache and a client that names its key", t, func() {
+		privateKey, _ := ssh.ParsePrivateKey(testKeys[0])
+		otherPrivateKey, _ := ssh.ParsePrivateKey(testKeys[1])
+		s := &StubLDAPServer{
+			Keys: []string{string(ssh.MarshalAuthorizedKey(privateKey.PublicKey()))},
+		}
+		lc, err := server.NewLDAPUserCache(s, g2s.Noop(), "cn", "dc=testdn,dc=com", false, "", "", "", "groupOfNames", "sshPublicKey", "", "", nil)
+		So(err, ShouldBeNil)
+
+		challenge := randomBytes(64)
+		sig, err := privateKey.Sign(cryptrand.Reader, challenge)
+		So(err, ShouldBeNil)
+
+		Convey("A signature from that key should be verified", func() {
+			verifiedUser, verifiedKey, err := lc.Authenticate("", privateKey.PublicKey(), challenge, sig)
+			So(err, ShouldBeNil)
+			So(verifiedUser.Username, ShouldEqual, "testuser")
+			So(verifiedKey.Marshal(), ShouldResemble, privateKey.PublicKey().Marshal())
+		})
+
+		Convey("The claimed username should have to own the key", func() {
+			verifiedUser, _, _ := lc.Authenticate("testuser", privateKey.PublicKey(), challenge, sig)
+			So(verifiedUser, ShouldNotBeNil)
+
+			verifiedUser, _, _ = lc.Authenticate("someoneelse", privateKey.PublicKey(), challenge, sig)
+			So(verifiedUser, ShouldBeNil)
+		})
+
+		Convey("A claimed username that LDAP does not have should be reported", func() {
+			_, _, err := lc.Authenticate("someoneelse", privateKey.PublicKey(), challenge, sig)
+			So(err, ShouldEqual, server.ErrUnknownUser)
+		})
+
+		Convey("A refresh that fails should be reported", func() {
+			s.Err = errors.New("LDAP is down")
+			otherSig, err := otherPrivateKey.Sign(cryptrand.Reader, challenge)
+			So(err, ShouldBeNil)
+			verifiedUser, _, err := lc.Authenticate("testuser", otherPrivateKey.PublicKey(), challenge, otherSig)
+			So(verifiedUser, ShouldBeNil)
+			So(err, ShouldEqual, s.Err)
+		})
+
+		Convey("A signature that does not match the named key should be rejected", func() {
+			otherSig, err := otherPrivateKey.Sign(cryptrand.Reader, challenge)
+			So(err, ShouldBeNil)
+			verifiedUser, _, err := lc.Authenticate("", privateKey.PublicKey(), challenge, otherSig)
+			So(verifiedUser, ShouldBeNil)
+			So(err, ShouldResemble, &server.BadSignatureError{Username: "testuser"})
+		})
+
+		Convey("A key added to LDAP after the last update should be found", func() {
+			s.Keys = []string{string(ssh.MarshalAuthorizedKey(otherPrivateKey.PublicKey()))}
+			otherSig, err := otherPrivateKey.Sign(cryptrand.Reader, challenge)
+			So(err, ShouldBeNil)
+
+			verifiedUser, _, _ := lc.Authenticate("testuser", otherPrivateKey.PublicKey(), challenge, otherSig)
+			So(verifiedUser, ShouldNotBeNil)
+
+			Convey("and a key removed from the user should stop working", func() {
+				verifiedUser, _, _ := lc.Authenticate("", privateKey.PublicKey(), challenge, sig)
+				So(verifiedUser, ShouldBeNil)
+			})
+		})
+	})
+
+	Convey("Given two users sharing a key", t, func() {
+		directory := &directoryStub{}
+		directory.add("cn=alice,dc=example,dc=com", []string{"cn", "alice"}, []string{"sshPublicKey", authorizedKey(testKeys[0])})
+		directory.add("cn=bob,dc=example,dc=com", []string{"cn", "bob"}, []string{"sshPublicKey", authorizedKey(testKeys[0])})
+		stats := &countingStatter{counters: map[string]int{}}
+		lc, err := server.NewLDAPUserCache(directory, stats, "cn", "dc=example,dc=com", false, "", "default", "", "groupOfNames", "sshPublicKey", "", "", nil)
+		So(err, ShouldBeNil)
+
+		privateKey, _ := ssh.ParsePrivateKey(testKeys[0])
+		challenge := randomBytes(64)
+		sig, err := privateKey.Sign(cryptrand.Reader, challenge)
+		So(err, ShouldBeNil)
+
+		Convey("Each of them should be found by their username without a refresh", func() {
+			for _, username := range []string{"alice", "bob", "alice"} {
+				verifiedUser, _, _ := lc.Authenticate(username, privateKey.PublicKey(), challenge, sig)
+				So(verifiedUser.Username, ShouldEqual, username)
+			}
+			So(stats.count("ldapCacheMiss"), ShouldEqual, 0)
+		})
+	})
+}
+
 func TestLDAPUserCache(t *testing.T) {
 	Convey("Given an LDAP user cache connected to our server", t, func() {
 		// The SSH agent stuff was moved up here so that we can use it to
@@ -176,7 +270,7 @@ func TestLDAPUserCache(t *testing.T) {
 		s := &StubLDAPServer{
 			Keys: []string{keyValue, testPublicKey},
 		}
-		lc, err := server.NewLDAPUserCache(s, g2s.Noop(), "cn", "dc=testdn,dc=com", false, "", "", "", "groupOfNames", "sshPublicKey", "")
+		lc, err := server.NewLDAPUserCache(s, g2s.Noop(), "cn", "dc=testdn,dc=com", false, "", "", "", "groupOfNames", "sshPublicKey", "", "", nil)
 		So(err, ShouldBeNil)
 		So(lc, ShouldNotBeNil)
 
@@ -193,7 +287,7 @@ func TestLDAPUserCache(t *testing.T) {
 				if err != nil {
 					t.Fatal(err)
 				}
-				verifiedUser, err := lc.Authenticate("ericallen", challenge, sig)
+				verifiedUser, _, err := lc.Authenticate("", nil, challenge, sig)
 				success = success || (verifiedUser != nil)
 			}
 
@@ -217,7 +311,7 @@ func TestLDAPUserCache(t *testing.T) {
 				if err != nil {
 					t.Fatal(err)
 				}
-				verifiedUser, err := lc.Authenticate("ericallen", challenge, sig)
+				verifiedUser, _, err := lc.Authenticate("", nil, challenge, sig)
 				success = success || (verifiedUser != nil)
 			}
 
@@ -236,7 +330,7 @@ func TestLDAPUserCache(t *testing.T) {
 					if err != nil {
 						t.Fatal(err)
 					}
-					verifiedUser, err := lc.Authenticate("ericallen", challenge, sig)
+					verifiedUser, _, err := lc.Authenticate("", nil, challenge, sig)
 					success = success || (verifiedUser != nil)
 				}
 
@@ -250,7 +344,7 @@ func TestLDAPUserCache(t *testing.T) {
 		s = &StubLDAPServer{
 			Keys: []string{testAuthorizedKey},
 		}
-		lc, err = server.NewLDAPUserCache(s, g2s.Noop(), "cn", "dc=testdn,dc=com", false, "", "", "", "groupOfNames", "sshPublicKey", "")
+		lc, err = server.NewLDAPUserCache(s, g2s.Noop(), "cn", "dc=testdn,dc=com", false, "", "", "", "groupOfNames", "sshPublicKey", "", "", nil)
 		So(err, ShouldBeNil)
 		So(lc, ShouldNotBeNil)
 
@@ -260,7 +354,7 @@ func TestLDAPUserCache(t *testing.T) {
 			if err != nil {
 				t.Fatal(err)
 			}
-			verifiedUser, err := lc.Authenticate("ericallen", challenge, sig)
+			verifiedUser, _, err := lc.Authenticate("", nil, challenge, sig)
 			So(verifiedUser, ShouldNotBeNil)
 			So(err, ShouldBeNil)
 		})
@@ -273,7 +367,7 @@ func TestLDAPUserCache(t *testing.T) {
 			Keys:      []string{nonAuthorizedKey},
 			OtherKeys: []string{testAuthorizedKey},
 		}
-		lc, err = server.NewLDAPUserCache(s, g2s.Noop(), "cn", "dc=testdn,dc=com", false, "", "", "", "groupOfNames", "otherKeysAttribute", "")
+		lc, err = server.NewLDAPUserCache(s, g2s.Noop(), "cn", "dc=testdn,dc=com", false, "", "", "", "groupOfNames", "otherKeysAttribute", "", "", nil)
 		So(err, ShouldBeNil)
 		So(lc, ShouldNotBeNil)
 
@@ -284,7 +378,7 @@ func TestLDAPUserCache(t *testing.T) {
 				if err != nil {
 					t.Fatal(err)
 				}
-				verifiedUser, _ := lc.Authenticate("xyzzy", challenge, sig)
+				verifiedUser, _, _ := lc.Authenticate("", nil, challenge, sig)
 				So(verifiedUser, ShouldBeNil)
 			})
 			Convey("A signature using a key in the target attribute should be accepted", func() {
@@ -293,7 +387,7 @@ func TestLDAPUserCache(t *testing.T) {
 				if err != nil {
 					t.Fatal(err)
 				}
-				verifiedUser, err := lc.Authenticate("xyzzy", challenge, sig)
+				verifiedUser, _, err := lc.Authenticate("", nil, challenge, sig)
 				So(err, ShouldBeNil)
 				So(verifiedUser, ShouldNotBeNil)
 			})
@@ -302,7 +396,7 @@ func TestLDAPUserCache(t *testing.T) {
 		s = &StubLDAPServer{
 			Keys: []string{keyValue, testPublicKey},
 		}
-		lc, err = server.NewLDAPUserCache(s, g2s.Noop(), "cn", "dc=testdn,dc=com", false, "roleAttribute", "", "", "groupOfNames", "sshPublicKey", "timeoutAttribute")
+		lc, err = server.NewLDAPUserCache(s, g2s.Noop(), "cn", "dc=testdn,dc=com", false, "roleAttribute", "", "", "groupOfNames", "sshPublicKey", "timeoutAttribute", "", nil)
 		So(err, ShouldBeNil)
 		So(lc, ShouldNotBeNil)
 
@@ -323,7 +417,7 @@ func TestLDAPUserCache(t *testing.T) {
 			})
 		})
 
-		lc, err = server.NewLDAPUserCache(s, g2s.Noop(), "cn", "dc=testdn,dc=com", false, "roleAttribute", "", "", "groupOfNames", "sshPublicKey", "")
+		lc, err = server.NewLDAPUserCache(s, g2s.Noop(), "cn", "dc=testdn,dc=com", false, "roleAttribute", "", "", "groupOfNames", "sshPublicKey", "", "", nil)
 		So(err, ShouldBeNil)
 		So(lc, ShouldNotBeNil)
 
@@ -335,5 +429,14 @@ func TestLDAPUserCache(t *testing.T) {
 			So(groups["testdn_0"].Timeout, ShouldEqual, int64(3600))
 		})
 
+		lc, err = server.NewLDAPUserCache(s, g2s.Noop(), "cn", "dc=testdn,dc=com", false, "", "", "", "groupOfNames", "sshPublicKey", "", "", []string{"roleAttribute", "missingAttribute"})
+		So(err, ShouldBeNil)
+
+		Convey("Extra user attributes should be loaded for session tags", func() {
+			user := lc.Users()["testuser"]
+			So(user, ShouldNotBeNil)
+			So(user.Attributes, ShouldResemble, map[string][]string{"roleAttribute": {"engineer"}})
+		})
+
 	})
 }
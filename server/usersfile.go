@@ -0,0 +1,374 @@
+// Copyright 2014 AdRoll, Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package server
+
+import (
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/AdRoll/hologram/log"
+	"github.com/peterbourgon/g2s"
+	"golang.org/x/crypto/ssh"
+	"gopkg.in/yaml.v3"
+)
+
+/*
+UsersFile is the on-disk format of a users file, in either JSON or YAML.
+*/
+type UsersFile struct {
+	Users  []UsersFileUser           `json:"users" yaml:"users"`
+	Groups map[string]UsersFileGroup `json:"groups" yaml:"groups"`
+}
+
+/*
+UsersFileUser is a user in a users file. Keys are in authorized_keys
+format, and groups are named by their keys in the file's groups.
+*/
+type UsersFileUser struct {
+	Username    string   `json:"username" yaml:"username"`
+	Keys        []string `json:"keys" yaml:"keys"`
+	DefaultRole string   `json:"defaultrole" yaml:"defaultrole"`
+	Groups      []string `json:"groups" yaml:"groups"`
+}
+
+/*
+UsersFileGroup is a group in a users file: the roles its members may
+assume, and the longest session it allows, in seconds.
+*/
+type UsersFileGroup struct {
+	Roles   []string `json:"roles" yaml:"roles"`
+	Timeout int64    `json:"timeout" yaml:"timeout"`
+}
+
+/*
+ParseUsersFile decodes a users file, YAML when the file name ends in
+.yaml or .yml and JSON otherwise, and checks that it makes sense.
+*/
+func ParseUsersFile(filename string, contents []byte) (*UsersFile, error) {
+	file := &UsersFile{}
+
+	var err error
+	switch strings.ToLower(filepath.Ext(filename)) {
+	case ".yaml", ".yml":
+		err = yaml.Unmarshal(contents, file)
+	default:
+		err = json.Unmarshal(contents, file)
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	for name, group := range file.Groups {
+		if group.Timeout < 0 {
+			return nil, fmt.Errorf("group %s has a negative timeout", name)
+		}
+	}
+	usernames := map[string]bool{}
+	for i, user := range file.Users {
+		if user.Username == "" {
+			return nil, fmt.Errorf("user %d has no username", i)
+		}
+		if usernames[user.Username] {
+			return nil, fmt.Errorf("user %s is listed twice", user.Username)
+		}
+		usernames[user.Username] = true
+		for _, name := range user.Groups {
+			if _, ok := file.Groups[name]; !ok {
+				return nil, fmt.Errorf("user %s is in unknown group %s", user.Username, name)
+			}
+		}
+	}
+	return file, nil
+}
+
+/*
+fileUserCache serves users from a local file, for teams with no
+directory service. Like ldapUserCache it keeps an immutable snapshot
+that readers use without locking.
+*/
+type fileUserCache struct {
+	snapshot    atomic.Value
+	updateLock  sync.Mutex
+	path        string
+	defaultRole string
+	stats       g2s.Statter
+	loaded      os.FileInfo
+	onChange    func(username string)
+	syncLock    sync.Mutex
+	syncStatus  SyncStatus
+}
+
+/*
+NewFileUserCache loads the users file at path. Users with no default
+role of their own get defaultRole.
+*/
+func NewFileUserCache(path string, defaultRole string, stats g2s.Statter) (*fileUserCache, error) {
+	fc := &fileUserCache{
+		path:        path,
+		defaultRole: defaultRole,
+		stats:       stats,
+	}
+	fc.snapshot.Store(newUserSnapshot(map[string]*User{}, map[string]*Group{}, memberIndex{}))
+	if err := fc.FullSync(); err != nil {
+		return nil, err
+	}
+	return fc, nil
+}
+
+/*
+Update reloads the users file if it has changed since it was last
+loaded.
+*/
+func (fc *fileUserCache) Update() error {
+	fc.updateLock.Lock()
+	defer fc.updateLock.Unlock()
+	info, err := os.Stat(fc.path)
+	if err != nil {
+		return fc.record(time.Now(), err)
+	}
+	if fc.loaded != nil && info.ModTime().Equal(fc.loaded.ModTime()) && info.Size() == fc.loaded.Size() {
+		return nil
+	}
+	return fc.reload()
+}
+
+/*
+FullSync reloads the users file whether or not it has changed. If it
+cannot be read or parsed, the users already loaded are kept.
+*/
+func (fc *fileUserCache) FullSync() error {
+	fc.updateLock.Lock()
+	defer fc.updateLock.Unlock()
+	return fc.reload()
+}
+
+/*
+Watch checks the users file for changes every interval until stop is
+called.
+*/
+func (fc *fileUserCache) Watch(interval time.Duration) (stop func()) {
+	ticker := time.NewTicker(interval)
+	done := make(chan struct{})
+	go func() {
+		for {
+			select {
+			case <-ticker.C:
+				if err := fc.Update(); err != nil {
+					log.Errorf("Keeping previous users: %s", err.Error())
+				}
+			case <-done:
+				ticker.Stop()
+				return
+			}
+		}
+	}()
+	var once sync.Once
+	return func() { once.Do(func() { close(done) }) }
+}
+
+/*
+reload reads the users file and swaps in a snapshot of it. The caller
+must hold updateLock.
+*/
+func (fc *fileUserCache) reload() error {
+	start := time.Now()
+	info, err := os.Stat(fc.path)
+	if err != nil {
+		return fc.record(start, err)
+	}
+	contents, err := ioutil.ReadFile(fc.path)
+	if err != nil {
+		return fc.record(start, err)
+	}
+	file, err := ParseUsersFile(fc.path, contents)
+	if err != nil {
+		return fc.record(start, fmt.Errorf("could not parse users file %s: %s", fc.path, err))
+	}
+	users, groups, err := fc.build(file)
+	if err != nil {
+		return fc.record(start, fmt.Errorf("could not load users file %s: %s", fc.path, err))
+	}
+
+	old := fc.current()
+	next := newUserSnapshot(users, groups, memberIndex{})
+	fc.snapshot.Store(next)
+	fc.loaded = info
+	diff := diffSnapshots(old, next)
+	diff.report(fc.stats, "usersFile", next)
+	if fc.onChange != nil {
+		for _, username := range append(diff.changed, diff.removed...) {
+			fc.onChange(username)
+		}
+	}
+	log.Debug("Loaded %d users and %d groups from %s.", len(users), len(groups), fc.path)
+	return fc.record(start, nil)
+}
+
+/*
+build turns a parsed users file into users and groups. A key that cannot
+be parsed, or is given to two users, is an error, so that a typo never
+locks anyone out silently.
+*/
+func (fc *fileUserCache) build(file *UsersFile) (map[string]*User, map[string]*Group, error) {
+	groups := map[string]*Group{}
+	for name, group := range file.Groups {
+		timeout := group.Timeout
+		if timeout == 0 {
+			timeout = defaultSessionDuration
+		}
+		groups[name] = &Group{ARNs: group.Roles, Timeout: timeout, DN: name}
+	}
+
+	users := map[string]*User{}
+	owners := map[string]string{}
+	for _, entry := range file.Users {
+		keys := []ssh.PublicKey{}
+		for _, line := range entry.Keys {
+			key, err := ParseSSHKey(line)
+			if err != nil {
+				return nil, nil, fmt.Errorf("user %s has an invalid key %q: %s", entry.Username, line, err)
+			}
+			fp := ssh.FingerprintSHA256(key)
+			if owner, ok := owners[fp]; ok && owner != entry.Username {
+				return nil, nil, fmt.Errorf("key %s is given to both %s and %s", fp, owner, entry.Username)
+			}
+			owners[fp] = entry.Username
+			keys = append(keys, key)
+		}
+
+		userGroups := []*Group{}
+		chains := map[string][]string{}
+		for _, name := range entry.Groups {
+			if _, ok := chains[name]; ok {
+				continue
+			}
+			userGroups = append(userGroups, groups[name])
+			chains[name] = []string{name}
+		}
+
+		defaultRole := entry.DefaultRole
+		if defaultRole == "" {
+			defaultRole = fc.defaultRole
+		}
+		users[entry.Username] = &User{
+			Username:    entry.Username,
+			SSHKeys:     keys,
+			Groups:      userGroups,
+			GroupChains: chains,
+			DefaultRole: defaultRole,
+			MemberOf:    append([]string{}, entry.Groups...),
+			Attributes:  map[string][]string{},
+		}
+	}
+	return users, groups, nil
+}
+
+/*
+record notes how a reload went for SyncStatus(), and returns err.
+*/
+func (fc *fileUserCache) record(start time.Time, err error) error {
+	fc.syncLock.Lock()
+	defer fc.syncLock.Unlock()
+	fc.syncStatus.LastAttempt = start
+	fc.syncStatus.Duration = time.Since(start).String()
+	if err != nil {
+		fc.syncStatus.LastError = err.Error()
+		return err
+	}
+	fc.syncStatus.LastSuccess = start
+	fc.syncStatus.LastFullSync = start
+	fc.syncStatus.LastError = ""
+	return nil
+}
+
+/*
+SyncStatus reports when the users file was last loaded, and the error
+from the last attempt if it failed.
+*/
+func (fc *fileUserCache) SyncStatus() SyncStatus {
+	fc.syncLock.Lock()
+	defer fc.syncLock.Unlock()
+	return fc.syncStatus
+}
+
+func (fc *fileUserCache) current() *userSnapshot {
+	return fc.snapshot.Load().(*userSnapshot)
+}
+
+/*
+Authenticate verifies a signature over the challenge against the keys in
+the users file, reloading it once if the key or user is not known yet
+and the file has changed. If the reload fails and the signature still
+matches no one, the reload error is returned; a claimed user that the
+file does not have gives ErrUnknownUser.
+*/
+func (fc *fileUserCache) Authenticate(username string, key ssh.PublicKey, challenge []byte, sshSig *ssh.Signature) (
+	*User, ssh.PublicKey, error) {
+	user, verifiedKey, err := fc.current().verify(username, key, challenge, sshSig)
+	if err == errNotCached {
+		fc.stats.Counter(1.0, "usersFileMiss", 1)
+		updateErr := fc.Update()
+		if updateErr != nil {
+			log.Errorf("Could not reload users file: %s", updateErr.Error())
+		}
+		user, verifiedKey, err = fc.current().verify(username, key, challenge, sshSig)
+		if err == errNotCached && updateErr != nil {
+			return nil, nil, updateErr
+		}
+	}
+	if err == errNotCached {
+		return nil, nil, fc.current().unknownUser(username)
+	}
+	return user, verifiedKey, err
+}
+
+/*
+Lookup returns the named user, or nil if there is no such user.
+*/
+func (fc *fileUserCache) Lookup(username string) *User {
+	return fc.current().users[username]
+}
+
+/*
+Users returns the users by username. The map belongs to the cache and
+must not be changed.
+*/
+func (fc *fileUserCache) Users() map[string]*User {
+	return fc.current().users
+}
+
+/*
+Groups returns the groups by name. The map belongs to the cache and must
+not be changed.
+*/
+func (fc *fileUserCache) Groups() map[string]*Group {
+	return fc.current().groups
+}
+
+/*
+OnEntitlementsChange registers a function to be called with the username
+whenever a reload changes a user's groups or default role, or drops the
+user.
+*/
+func (fc *fileUserCache) OnEntitlementsChange(onChange func(username string)) {
+	fc.onChange = onChange
+}
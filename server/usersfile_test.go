@@ -0,0 +1,175 @@
+// Copyright 2014 AdRoll, Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package server_test
+
+import (
+	cryptrand "crypto/rand"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/AdRoll/hologram/server"
+	"github.com/peterbourgon/g2s"
+	. "github.com/smartystreets/goconvey/convey"
+	"golang.org/x/crypto/ssh"
+)
+
+func TestFileUserCache(t *testing.T) {
+	Convey("Given a users file", t, func() {
+		dir, err := ioutil.TempDir("", "hologram-users")
+		So(err, ShouldBeNil)
+		defer os.RemoveAll(dir)
+		path := filepath.Join(dir, "users.yaml")
+
+		// Each write moves the modification time on, so that changes are
+		// seen even within the file system's timestamp resolution.
+		modified := time.Now()
+		write := func(contents string) {
+			So(ioutil.WriteFile(path, []byte(contents), 0600), ShouldBeNil)
+			modified = modified.Add(time.Second)
+			So(os.Chtimes(path, modified, modified), ShouldBeNil)
+		}
+		write(fmt.Sprintf(`
+groups:
+  developers:
+    roles: [developer, "prod/readonly-*"]
+  admins:
+    roles: [admin]
+    timeout: 7200
+users:
+  - username: alice
+    keys: ["%s alice@laptop"]
+    groups: [developers, admins]
+  - username: bob
+    keys: ["%s"]
+    defaultrole: developer
+`, authorizedKey(testKeys[0]), authorizedKey(testKeys[1])))
+
+		lc, err := server.NewFileUserCache(path, "default", g2s.Noop())
+		So(err, ShouldBeNil)
+
+		authenticate := func(private []byte) *server.User {
+			signer, err := ssh.ParsePrivateKey(private)
+			So(err, ShouldBeNil)
+			challenge := randomBytes(64)
+			sig, err := signer.Sign(cryptrand.Reader, challenge)
+			So(err, ShouldBeNil)
+			user, _, err := lc.Authenticate("", signer.PublicKey(), challenge, sig)
+			So(err, ShouldBeNil)
+			return user
+		}
+
+		Convey("It should authenticate users by their keys", func() {
+			So(authenticate(testKeys[0]).Username, ShouldEqual, "alice")
+			So(authenticate(testKeys[1]).Username, ShouldEqual, "bob")
+		})
+
+		Convey("It should give users the roles of their groups", func() {
+			authorizer := server.NewLDAPGroupAuthorizer("123456", &map[string]string{"prod": "654321"})
+			grant, err := authorizer.Authorize(lc.Lookup("alice"), "admin")
+			So(err, ShouldBeNil)
+			So(grant.Duration, ShouldEqual, 7200)
+			So(grant.GrantedBy, ShouldResemble, []string{"admins"})
+
+			grant, err = authorizer.Authorize(lc.Lookup("alice"), "prod/readonly-billing")
+			So(err, ShouldBeNil)
+			So(grant.Duration, ShouldEqual, 3600)
+
+			_, err = authorizer.Authorize(lc.Lookup("bob"), "developer")
+			So(err, ShouldNotBeNil)
+		})
+
+		Convey("Users without a default role should get the server's", func() {
+			So(lc.Lookup("alice").DefaultRole, ShouldEqual, "default")
+			So(lc.Lookup("bob").DefaultRole, ShouldEqual, "developer")
+		})
+
+		Convey("Changes to the file should be picked up", func() {
+			changed := []string{}
+			lc.OnEntitlementsChange(func(username string) {
+				changed = append(changed, username)
+			})
+			write(fmt.Sprintf(`
+users:
+  - username: alice
+    keys: ["%s"]
+    defaultrole: developer
+`, authorizedKey(testKeys[1])))
+			So(lc.Update(), ShouldBeNil)
+			So(lc.Users(), ShouldNotContainKey, "bob")
+			So(authenticate(testKeys[0]), ShouldBeNil)
+			So(authenticate(testKeys[1]).Username, ShouldEqual, "alice")
+			So(changed, ShouldResemble, []string{"alice", "bob"})
+		})
+
+		Convey("An unknown key should make it look at the file again", func() {
+			write(fmt.Sprintf(`
+users:
+  - username: alice
+    keys: ["%s"]
+`, authorizedKey(testKeys[0])))
+			So(lc.Update(), ShouldBeNil)
+			write(fmt.Sprintf(`
+users:
+  - username: carol
+    keys: ["%s"]
+`, authorizedKey(testKeys[1])))
+			So(authenticate(testKeys[1]).Username, ShouldEqual, "carol")
+		})
+
+		Convey("A broken file should leave the users as they were", func() {
+			write(`
+users:
+  - username: alice
+    keys: ["not a key"]
+`)
+			So(lc.Update(), ShouldNotBeNil)
+			So(lc.SyncStatus().LastError, ShouldContainSubstring, "invalid key")
+			So(authenticate(testKeys[0]).Username, ShouldEqual, "alice")
+
+			write(`
+users:
+  - username: alice
+    groups: [nobody]
+`)
+			So(lc.FullSync(), ShouldNotBeNil)
+			So(lc.SyncStatus().LastError, ShouldContainSubstring, "unknown group")
+			So(lc.Users(), ShouldContainKey, "bob")
+		})
+
+		Convey("Watching the file should reload it when it changes", func() {
+			stop := lc.Watch(10 * time.Millisecond)
+			defer stop()
+			write(`{"users": [{"username": "dave"}]}`)
+			deadline := time.Now().Add(2 * time.Second)
+			for lc.Lookup("dave") == nil && time.Now().Before(deadline) {
+				time.Sleep(10 * time.Millisecond)
+			}
+			So(lc.Lookup("dave"), ShouldNotBeNil)
+		})
+	})
+
+	Convey("Users files should be checked", t, func() {
+		_, err := server.ParseUsersFile("users.json", []byte(`{"users": [{"username": "alice"}, {"username": "alice"}]}`))
+		So(err, ShouldNotBeNil)
+		_, err = server.ParseUsersFile("users.json", []byte(`{"users": [{"keys": []}]}`))
+		So(err, ShouldNotBeNil)
+		_, err = server.ParseUsersFile("users.json", []byte(`{"groups": {"ops": {"timeout": -1}}}`))
+		So(err, ShouldNotBeNil)
+	})
+}